@@ -45,15 +45,19 @@ func (p *Program) String() string {
 }
 
 type LetStatement struct {
-	Token token.Token // = token.LET
-	Name  *Identifier
-	Value Expression
+	Token    token.Token // = token.LET
+	Name     *Identifier
+	Value    Expression
+	Exported bool // Declared by `export let`, which makes the binding visible to the importers of the module.
 }
 
 func (ls *LetStatement) statementNode()       {}
 func (ls *LetStatement) TokenLiteral() string { return ls.Token.Literal }
 func (ls *LetStatement) String() string {
 	var out bytes.Buffer
+	if ls.Exported {
+		out.WriteString("export ")
+	}
 	out.WriteString(ls.TokenLiteral() + " ")
 	out.WriteString(ls.Name.String())
 	out.WriteString(" = ")
@@ -66,6 +70,79 @@ func (ls *LetStatement) String() string {
 	return out.String()
 }
 
+// `import "path";` binds the exports of the module at the path.
+type ImportStatement struct {
+	Token token.Token // = token.IMPORT
+	Path  *StringLiteral
+}
+
+func (is *ImportStatement) statementNode()       {}
+func (is *ImportStatement) TokenLiteral() string { return is.Token.Literal }
+func (is *ImportStatement) String() string {
+	return is.TokenLiteral() + " \"" + is.Path.Value + "\";"
+}
+
+// `throw value;` raises the value as an exception, which unwinds to the innermost enclosing try.
+type ThrowStatement struct {
+	Token token.Token // = token.THROW
+	Value Expression
+}
+
+func (ts *ThrowStatement) statementNode()       {}
+func (ts *ThrowStatement) TokenLiteral() string { return ts.Token.Literal }
+func (ts *ThrowStatement) String() string {
+	var out bytes.Buffer
+	out.WriteString(ts.TokenLiteral() + " ")
+
+	if ts.Value != nil {
+		out.WriteString(ts.Value.String())
+	}
+
+	out.WriteString(";")
+	return out.String()
+}
+
+// `yield value;` suspends the generator running the enclosing function, and gives the value to its caller.
+type YieldStatement struct {
+	Token token.Token // = token.YIELD
+	Value Expression
+}
+
+func (ys *YieldStatement) statementNode()       {}
+func (ys *YieldStatement) TokenLiteral() string { return ys.Token.Literal }
+func (ys *YieldStatement) String() string {
+	var out bytes.Buffer
+	out.WriteString(ys.TokenLiteral() + " ")
+
+	if ys.Value != nil {
+		out.WriteString(ys.Value.String())
+	}
+
+	out.WriteString(";")
+	return out.String()
+}
+
+// `for (x in iterable) { ... }` runs the body for each element of an array or each value yielded by a generator.
+type ForStatement struct {
+	Token    token.Token // = token.FOR
+	Variable *Identifier
+	Iterable Expression
+	Body     *BlockStatement
+}
+
+func (fs *ForStatement) statementNode()       {}
+func (fs *ForStatement) TokenLiteral() string { return fs.Token.Literal }
+func (fs *ForStatement) String() string {
+	var out bytes.Buffer
+	out.WriteString("for(")
+	out.WriteString(fs.Variable.String())
+	out.WriteString(" in ")
+	out.WriteString(fs.Iterable.String())
+	out.WriteString(") ")
+	out.WriteString(fs.Body.String())
+	return out.String()
+}
+
 type ReturnStatement struct {
 	Token       token.Token // = token.RETURN
 	ReturnValue Expression
@@ -199,9 +276,56 @@ func (ie *IfExpression) String() string {
 	return out.String()
 }
 
+/*
+`try { ... } catch (e) { ... } finally { ... }` evaluates to the value of the try block,
+or to that of the catch block when the try block throws. Either Catch or Finally may be nil, but not both.
+*/
+type TryExpression struct {
+	Token          token.Token // = token.TRY
+	Body           *BlockStatement
+	CatchParameter *Identifier // Bound to the thrown value.
+	Catch          *BlockStatement
+	Finally        *BlockStatement
+}
+
+func (te *TryExpression) expressionNode()      {}
+func (te *TryExpression) TokenLiteral() string { return te.Token.Literal }
+func (te *TryExpression) String() string {
+	var out bytes.Buffer
+
+	out.WriteString("try ")
+	out.WriteString(te.Body.String())
+
+	if te.Catch != nil {
+		out.WriteString("catch(" + te.CatchParameter.String() + ") ")
+		out.WriteString(te.Catch.String())
+	}
+	if te.Finally != nil {
+		out.WriteString("finally ")
+		out.WriteString(te.Finally.String())
+	}
+	return out.String()
+}
+
+/*
+`spawn f(x)` calls the function in a new task, with the function and the arguments evaluated by the spawning task.
+Any other operand must evaluate to a function without parameters. The expression evaluates to the task.
+*/
+type SpawnExpression struct {
+	Token    token.Token // = token.SPAWN
+	Function Expression
+}
+
+func (se *SpawnExpression) expressionNode()      {}
+func (se *SpawnExpression) TokenLiteral() string { return se.Token.Literal }
+func (se *SpawnExpression) String() string {
+	return "spawn " + se.Function.String()
+}
+
 type BlockStatement struct {
-	Token      token.Token
+	Token      token.Token // = {
 	Statements []Statement
+	EndToken   token.Token // = }, or EOF when the block is not closed
 }
 
 func (bs *BlockStatement) statementNode()       {}
@@ -220,6 +344,7 @@ type FunctionLiteral struct {
 	Parameters []*Identifier
 	Body       *BlockStatement
 	Name       string
+	Generator  bool // Whether the body yields, which makes a call return a generator instead of running it.
 }
 
 func (fl *FunctionLiteral) expressionNode()      {}
@@ -242,10 +367,34 @@ func (fl *FunctionLiteral) String() string {
 	return out.String()
 }
 
+type MacroLiteral struct {
+	Token      token.Token //= 'macro'
+	Parameters []*Identifier
+	Body       *BlockStatement
+}
+
+func (ml *MacroLiteral) expressionNode()      {}
+func (ml *MacroLiteral) TokenLiteral() string { return ml.Token.Literal }
+func (ml *MacroLiteral) String() string {
+	var out bytes.Buffer
+
+	params := []string{}
+	for _, p := range ml.Parameters {
+		params = append(params, p.String())
+	}
+	out.WriteString(ml.TokenLiteral())
+	out.WriteString("(")
+	out.WriteString(strings.Join(params, ", "))
+	out.WriteString(") ")
+	out.WriteString(ml.Body.String())
+	return out.String()
+}
+
 type CallExpression struct {
 	Token     token.Token // (
 	Function  Expression  // Identifier or FunctionLiteral
 	Arguments []Expression
+	EndToken  token.Token // )
 }
 
 func (ce *CallExpression) expressionNode()      {}
@@ -266,6 +415,7 @@ func (ce *CallExpression) String() string {
 type ArrayLiteral struct {
 	Token    token.Token // [ token
 	Elements []Expression
+	EndToken token.Token // ]
 }
 
 func (al *ArrayLiteral) expressionNode()      {}
@@ -285,8 +435,9 @@ func (al *ArrayLiteral) String() string {
 }
 
 type HashLiteral struct {
-	Token token.Token
-	Pairs map[Expression]Expression
+	Token    token.Token
+	Pairs    map[Expression]Expression
+	EndToken token.Token // }
 }
 
 func (hl *HashLiteral) expressionNode()      {}
@@ -294,8 +445,8 @@ func (hl *HashLiteral) TokenLiteral() string { return hl.Token.Literal }
 func (hl *HashLiteral) String() string {
 	var out bytes.Buffer
 	pairs := []string{}
-	for key, value := range hl.Pairs {
-		pairs = append(pairs, key.String()+":"+value.String())
+	for _, key := range hl.SortedKeys() {
+		pairs = append(pairs, key.String()+":"+hl.Pairs[key].String())
 	}
 
 	out.WriteString("{")
@@ -306,9 +457,10 @@ func (hl *HashLiteral) String() string {
 }
 
 type IndexExpression struct {
-	Token token.Token
-	Left  Expression
-	Index Expression
+	Token    token.Token // [
+	Left     Expression
+	Index    Expression
+	EndToken token.Token // ]
 }
 
 func (ie *IndexExpression) expressionNode()      {}
@@ -0,0 +1,166 @@
+package ast
+
+import "fmt"
+
+/*
+Return a deep copy of the node, which can be modified without changing the original.
+Tokens are copied as they are, so the copy keeps the source positions of the original.
+*/
+func Copy(node Node) Node {
+	if isNil(node) {
+		return node
+	}
+
+	switch n := node.(type) {
+	case *Program:
+		return &Program{Statements: copyStatements(n.Statements)}
+	case *BlockStatement:
+		return copyBlock(n)
+	case *LetStatement:
+		return &LetStatement{Token: n.Token, Name: copyIdentifier(n.Name), Value: copyExpression(n.Value), Exported: n.Exported}
+	case *ReturnStatement:
+		return &ReturnStatement{Token: n.Token, ReturnValue: copyExpression(n.ReturnValue)}
+	case *ThrowStatement:
+		return &ThrowStatement{Token: n.Token, Value: copyExpression(n.Value)}
+	case *YieldStatement:
+		return &YieldStatement{Token: n.Token, Value: copyExpression(n.Value)}
+	case *ForStatement:
+		return &ForStatement{
+			Token:    n.Token,
+			Variable: copyIdentifier(n.Variable),
+			Iterable: copyExpression(n.Iterable),
+			Body:     copyBlock(n.Body),
+		}
+	case *ImportStatement:
+		c := &ImportStatement{Token: n.Token}
+		if n.Path != nil {
+			path := *n.Path
+			c.Path = &path
+		}
+		return c
+	case *ExpressionStatement:
+		return &ExpressionStatement{Token: n.Token, Expression: copyExpression(n.Expression)}
+	case *Identifier:
+		return copyIdentifier(n)
+	case *IntegerLiteral:
+		c := *n
+		return &c
+	case *StringLiteral:
+		c := *n
+		return &c
+	case *Boolean:
+		c := *n
+		return &c
+	case *PrefixExpression:
+		return &PrefixExpression{Token: n.Token, Operator: n.Operator, Right: copyExpression(n.Right)}
+	case *InfixExpression:
+		return &InfixExpression{
+			Token:    n.Token,
+			Left:     copyExpression(n.Left),
+			Operator: n.Operator,
+			Right:    copyExpression(n.Right),
+		}
+	case *IfExpression:
+		return &IfExpression{
+			Token:       n.Token,
+			Condition:   copyExpression(n.Condition),
+			Consequence: copyBlock(n.Consequence),
+			Alternative: copyBlock(n.Alternative),
+		}
+	case *TryExpression:
+		return &TryExpression{
+			Token:          n.Token,
+			Body:           copyBlock(n.Body),
+			CatchParameter: copyIdentifier(n.CatchParameter),
+			Catch:          copyBlock(n.Catch),
+			Finally:        copyBlock(n.Finally),
+		}
+	case *SpawnExpression:
+		return &SpawnExpression{Token: n.Token, Function: copyExpression(n.Function)}
+	case *FunctionLiteral:
+		return &FunctionLiteral{
+			Token:      n.Token,
+			Parameters: copyIdentifiers(n.Parameters),
+			Body:       copyBlock(n.Body),
+			Name:       n.Name,
+			Generator:  n.Generator,
+		}
+	case *MacroLiteral:
+		return &MacroLiteral{Token: n.Token, Parameters: copyIdentifiers(n.Parameters), Body: copyBlock(n.Body)}
+	case *CallExpression:
+		return &CallExpression{
+			Token:     n.Token,
+			Function:  copyExpression(n.Function),
+			Arguments: copyExpressions(n.Arguments),
+			EndToken:  n.EndToken,
+		}
+	case *ArrayLiteral:
+		return &ArrayLiteral{Token: n.Token, Elements: copyExpressions(n.Elements), EndToken: n.EndToken}
+	case *IndexExpression:
+		return &IndexExpression{Token: n.Token, Left: copyExpression(n.Left), Index: copyExpression(n.Index), EndToken: n.EndToken}
+	case *HashLiteral:
+		pairs := make(map[Expression]Expression, len(n.Pairs))
+		for key, value := range n.Pairs {
+			pairs[copyExpression(key)] = copyExpression(value)
+		}
+		return &HashLiteral{Token: n.Token, Pairs: pairs, EndToken: n.EndToken}
+	}
+	panic(fmt.Sprintf("ast.Copy: unexpected node type %T", node))
+}
+
+func copyStatements(list []Statement) []Statement {
+	if list == nil {
+		return nil
+	}
+	result := make([]Statement, len(list))
+	for i, s := range list {
+		if !isNil(s) {
+			result[i] = Copy(s).(Statement)
+		}
+	}
+	return result
+}
+
+func copyExpressions(list []Expression) []Expression {
+	if list == nil {
+		return nil
+	}
+	result := make([]Expression, len(list))
+	for i, e := range list {
+		result[i] = copyExpression(e)
+	}
+	return result
+}
+
+func copyExpression(e Expression) Expression {
+	if isNil(e) {
+		return e
+	}
+	return Copy(e).(Expression)
+}
+
+func copyIdentifiers(list []*Identifier) []*Identifier {
+	if list == nil {
+		return nil
+	}
+	result := make([]*Identifier, len(list))
+	for i, ident := range list {
+		result[i] = copyIdentifier(ident)
+	}
+	return result
+}
+
+func copyIdentifier(ident *Identifier) *Identifier {
+	if ident == nil {
+		return nil
+	}
+	c := *ident
+	return &c
+}
+
+func copyBlock(block *BlockStatement) *BlockStatement {
+	if block == nil {
+		return nil
+	}
+	return &BlockStatement{Token: block.Token, Statements: copyStatements(block.Statements), EndToken: block.EndToken}
+}
@@ -0,0 +1,566 @@
+package ast
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"monkey/token"
+	"strings"
+)
+
+/*
+The JSON form of a syntax tree, for tools which are not written in Go. Each node is an object with:
+  - "type": the name of the node type, e.g. "InfixExpression",
+  - "span": the "start" and the "end" positions of the node, where the end is just after its last character,
+  - "token": the token the node was parsed from, as in EncodeTokens,
+  - its fields, named as in Go in lower camel case, e.g. "returnValue". Missing nodes are null.
+
+The pairs of a hash literal are an array of objects with a "key" and a "value", in the order of the source code.
+Blocks, calls, arrays, hashes and index expressions also have the "endToken" which closes them.
+*/
+func EncodeJSON(node Node) ([]byte, error) {
+	return json.MarshalIndent(encodeNode(node), "", "  ")
+}
+
+// Encode the tokens as a JSON array of objects with their "type", "literal", "line" and "column".
+func EncodeTokens(tokens []token.Token) ([]byte, error) {
+	list := make([]jsonObject, len(tokens))
+	for i, tok := range tokens {
+		list[i] = encodeToken(tok)
+	}
+	return json.MarshalIndent(list, "", "  ")
+}
+
+// A position in the source code. Both the line and the column are 1-based.
+type Position struct {
+	Line   int `json:"line"`
+	Column int `json:"column"`
+}
+
+// Returns the position just after the last character of the node. Nodes built without positions end at line 0.
+func EndPosition(node Node) Position {
+	switch n := node.(type) {
+	case *Program:
+		if len(n.Statements) > 0 {
+			return EndPosition(n.Statements[len(n.Statements)-1])
+		}
+		return Position{}
+	case *LetStatement:
+		if !isNil(n.Value) {
+			return EndPosition(n.Value)
+		}
+		if n.Name != nil {
+			return EndPosition(n.Name)
+		}
+	case *ReturnStatement:
+		if !isNil(n.ReturnValue) {
+			return EndPosition(n.ReturnValue)
+		}
+	case *ThrowStatement:
+		if !isNil(n.Value) {
+			return EndPosition(n.Value)
+		}
+	case *YieldStatement:
+		if !isNil(n.Value) {
+			return EndPosition(n.Value)
+		}
+	case *ForStatement:
+		if n.Body != nil {
+			return EndPosition(n.Body)
+		}
+	case *ImportStatement:
+		if n.Path != nil {
+			return EndPosition(n.Path)
+		}
+	case *ExpressionStatement:
+		if !isNil(n.Expression) {
+			return EndPosition(n.Expression)
+		}
+	case *BlockStatement:
+		return tokenEnd(n.EndToken)
+	case *PrefixExpression:
+		if !isNil(n.Right) {
+			return EndPosition(n.Right)
+		}
+	case *InfixExpression:
+		if !isNil(n.Right) {
+			return EndPosition(n.Right)
+		}
+	case *IfExpression:
+		if n.Alternative != nil {
+			return EndPosition(n.Alternative)
+		}
+		if n.Consequence != nil {
+			return EndPosition(n.Consequence)
+		}
+	case *TryExpression:
+		for _, block := range []*BlockStatement{n.Finally, n.Catch, n.Body} {
+			if block != nil {
+				return EndPosition(block)
+			}
+		}
+	case *SpawnExpression:
+		if !isNil(n.Function) {
+			return EndPosition(n.Function)
+		}
+	case *FunctionLiteral:
+		if n.Body != nil {
+			return EndPosition(n.Body)
+		}
+	case *MacroLiteral:
+		if n.Body != nil {
+			return EndPosition(n.Body)
+		}
+	case *CallExpression:
+		return tokenEnd(n.EndToken)
+	case *ArrayLiteral:
+		return tokenEnd(n.EndToken)
+	case *IndexExpression:
+		return tokenEnd(n.EndToken)
+	case *HashLiteral:
+		return tokenEnd(n.EndToken)
+	}
+	return tokenEnd(StartToken(node))
+}
+
+// Returns the position just after the token. The lexer removes the quotes of strings, which may span lines.
+func tokenEnd(tok token.Token) Position {
+	if tok.Line == 0 {
+		return Position{}
+	}
+	if tok.Type != token.STRING {
+		return Position{Line: tok.Line, Column: tok.Column + len(tok.Literal)}
+	}
+	lines := strings.Split(tok.Literal, "\n")
+	if len(lines) == 1 {
+		return Position{Line: tok.Line, Column: tok.Column + len(tok.Literal) + 2}
+	}
+	return Position{Line: tok.Line + len(lines) - 1, Column: len(lines[len(lines)-1]) + 2}
+}
+
+// A JSON object whose fields are written in order, unlike those of a map.
+type jsonObject []jsonField
+
+type jsonField struct {
+	name  string
+	value interface{}
+}
+
+func (o jsonObject) MarshalJSON() ([]byte, error) {
+	var out bytes.Buffer
+	out.WriteString("{")
+	for i, f := range o {
+		if i > 0 {
+			out.WriteString(",")
+		}
+		name, _ := json.Marshal(f.name)
+		out.Write(name)
+		out.WriteString(":")
+		value, err := json.Marshal(f.value)
+		if err != nil {
+			return nil, err
+		}
+		out.Write(value)
+	}
+	out.WriteString("}")
+	return out.Bytes(), nil
+}
+
+func encodeToken(tok token.Token) jsonObject {
+	return jsonObject{
+		{"type", string(tok.Type)},
+		{"literal", tok.Literal},
+		{"line", tok.Line},
+		{"column", tok.Column},
+	}
+}
+
+func encodeNode(node Node) interface{} {
+	if isNil(node) {
+		return nil
+	}
+
+	start := StartToken(node)
+	o := jsonObject{
+		{"type", strings.TrimPrefix(fmt.Sprintf("%T", node), "*ast.")},
+		{"span", jsonObject{
+			{"start", Position{Line: start.Line, Column: start.Column}},
+			{"end", EndPosition(node)},
+		}},
+	}
+	if _, ok := node.(*Program); !ok {
+		o = append(o, jsonField{"token", encodeToken(nodeToken(node))})
+	}
+
+	switch n := node.(type) {
+	case *Program:
+		o = append(o, jsonField{"statements", encodeStatements(n.Statements)})
+	case *LetStatement:
+		o = append(o, jsonField{"name", encodeNode(n.Name)}, jsonField{"value", encodeNode(n.Value)}, jsonField{"exported", n.Exported})
+	case *ReturnStatement:
+		o = append(o, jsonField{"returnValue", encodeNode(n.ReturnValue)})
+	case *ThrowStatement:
+		o = append(o, jsonField{"value", encodeNode(n.Value)})
+	case *YieldStatement:
+		o = append(o, jsonField{"value", encodeNode(n.Value)})
+	case *ForStatement:
+		o = append(o,
+			jsonField{"variable", encodeNode(n.Variable)},
+			jsonField{"iterable", encodeNode(n.Iterable)},
+			jsonField{"body", encodeNode(n.Body)},
+		)
+	case *ImportStatement:
+		o = append(o, jsonField{"path", encodeNode(n.Path)})
+	case *ExpressionStatement:
+		o = append(o, jsonField{"expression", encodeNode(n.Expression)})
+	case *BlockStatement:
+		o = append(o, jsonField{"statements", encodeStatements(n.Statements)}, jsonField{"endToken", encodeToken(n.EndToken)})
+	case *Identifier:
+		o = append(o, jsonField{"value", n.Value})
+	case *IntegerLiteral:
+		o = append(o, jsonField{"value", n.Value})
+	case *StringLiteral:
+		o = append(o, jsonField{"value", n.Value})
+	case *Boolean:
+		o = append(o, jsonField{"value", n.Value})
+	case *PrefixExpression:
+		o = append(o, jsonField{"operator", n.Operator}, jsonField{"right", encodeNode(n.Right)})
+	case *InfixExpression:
+		o = append(o,
+			jsonField{"left", encodeNode(n.Left)},
+			jsonField{"operator", n.Operator},
+			jsonField{"right", encodeNode(n.Right)},
+		)
+	case *IfExpression:
+		o = append(o,
+			jsonField{"condition", encodeNode(n.Condition)},
+			jsonField{"consequence", encodeNode(n.Consequence)},
+			jsonField{"alternative", encodeNode(n.Alternative)},
+		)
+	case *TryExpression:
+		o = append(o,
+			jsonField{"body", encodeNode(n.Body)},
+			jsonField{"catchParameter", encodeNode(n.CatchParameter)},
+			jsonField{"catch", encodeNode(n.Catch)},
+			jsonField{"finally", encodeNode(n.Finally)},
+		)
+	case *SpawnExpression:
+		o = append(o, jsonField{"function", encodeNode(n.Function)})
+	case *FunctionLiteral:
+		o = append(o,
+			jsonField{"parameters", encodeIdentifiers(n.Parameters)},
+			jsonField{"body", encodeNode(n.Body)},
+			jsonField{"name", n.Name},
+			jsonField{"generator", n.Generator},
+		)
+	case *MacroLiteral:
+		o = append(o, jsonField{"parameters", encodeIdentifiers(n.Parameters)}, jsonField{"body", encodeNode(n.Body)})
+	case *CallExpression:
+		o = append(o,
+			jsonField{"function", encodeNode(n.Function)},
+			jsonField{"arguments", encodeExpressions(n.Arguments)},
+			jsonField{"endToken", encodeToken(n.EndToken)},
+		)
+	case *ArrayLiteral:
+		o = append(o, jsonField{"elements", encodeExpressions(n.Elements)}, jsonField{"endToken", encodeToken(n.EndToken)})
+	case *IndexExpression:
+		o = append(o,
+			jsonField{"left", encodeNode(n.Left)},
+			jsonField{"index", encodeNode(n.Index)},
+			jsonField{"endToken", encodeToken(n.EndToken)},
+		)
+	case *HashLiteral:
+		pairs := []jsonObject{}
+		for _, key := range n.SortedKeys() {
+			pairs = append(pairs, jsonObject{{"key", encodeNode(key)}, {"value", encodeNode(n.Pairs[key])}})
+		}
+		o = append(o, jsonField{"pairs", pairs}, jsonField{"endToken", encodeToken(n.EndToken)})
+	default:
+		panic(fmt.Sprintf("ast.EncodeJSON: unexpected node type %T", node))
+	}
+	return o
+}
+
+func encodeStatements(list []Statement) []interface{} {
+	result := make([]interface{}, len(list))
+	for i, s := range list {
+		result[i] = encodeNode(s)
+	}
+	return result
+}
+
+func encodeExpressions(list []Expression) []interface{} {
+	result := make([]interface{}, len(list))
+	for i, e := range list {
+		result[i] = encodeNode(e)
+	}
+	return result
+}
+
+func encodeIdentifiers(list []*Identifier) []interface{} {
+	result := make([]interface{}, len(list))
+	for i, ident := range list {
+		result[i] = encodeNode(ident)
+	}
+	return result
+}
+
+// Returns the Token field of the node, which is not always its first token, e.g. the operator of an infix expression.
+func nodeToken(node Node) token.Token {
+	switch n := node.(type) {
+	case *InfixExpression:
+		return n.Token
+	case *CallExpression:
+		return n.Token
+	case *IndexExpression:
+		return n.Token
+	}
+	return StartToken(node)
+}
+
+// Decode a syntax tree from its JSON form written by EncodeJSON. The spans are ignored.
+func DecodeJSON(data []byte) (Node, error) {
+	var d decoder
+	node := d.node(json.RawMessage(data))
+	if d.err != nil {
+		return nil, d.err
+	}
+	return node, nil
+}
+
+// Keeps the first error, so that the decoding functions can return nil and go on.
+type decoder struct {
+	err error
+}
+
+func (d *decoder) fail(format string, args ...interface{}) {
+	if d.err == nil {
+		d.err = fmt.Errorf("ast: "+format, args...)
+	}
+}
+
+func (d *decoder) unmarshal(data json.RawMessage, v interface{}) {
+	if d.err != nil || len(data) == 0 {
+		return
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		d.fail("%s", err)
+	}
+}
+
+func (d *decoder) token(data json.RawMessage) token.Token {
+	var t struct {
+		Type    string `json:"type"`
+		Literal string `json:"literal"`
+		Line    int    `json:"line"`
+		Column  int    `json:"column"`
+	}
+	d.unmarshal(data, &t)
+	return token.Token{Type: token.TokenType(t.Type), Literal: t.Literal, Line: t.Line, Column: t.Column}
+}
+
+func (d *decoder) node(data json.RawMessage) Node {
+	if d.err != nil || len(data) == 0 || string(data) == "null" {
+		return nil
+	}
+	var fields map[string]json.RawMessage
+	d.unmarshal(data, &fields)
+	if d.err != nil {
+		return nil
+	}
+	var nodeType string
+	d.unmarshal(fields["type"], &nodeType)
+	tok := d.token(fields["token"])
+
+	switch nodeType {
+	case "Program":
+		return &Program{Statements: d.statements(fields["statements"])}
+	case "LetStatement":
+		n := &LetStatement{Token: tok, Name: d.identifier(fields["name"]), Value: d.expression(fields["value"])}
+		d.unmarshal(fields["exported"], &n.Exported)
+		return n
+	case "ReturnStatement":
+		return &ReturnStatement{Token: tok, ReturnValue: d.expression(fields["returnValue"])}
+	case "ThrowStatement":
+		return &ThrowStatement{Token: tok, Value: d.expression(fields["value"])}
+	case "YieldStatement":
+		return &YieldStatement{Token: tok, Value: d.expression(fields["value"])}
+	case "ForStatement":
+		return &ForStatement{
+			Token:    tok,
+			Variable: d.identifier(fields["variable"]),
+			Iterable: d.expression(fields["iterable"]),
+			Body:     d.block(fields["body"]),
+		}
+	case "ImportStatement":
+		n := &ImportStatement{Token: tok}
+		if path, ok := d.node(fields["path"]).(*StringLiteral); ok {
+			n.Path = path
+		} else {
+			d.fail("the path of an ImportStatement must be a StringLiteral")
+		}
+		return n
+	case "ExpressionStatement":
+		return &ExpressionStatement{Token: tok, Expression: d.expression(fields["expression"])}
+	case "BlockStatement":
+		return &BlockStatement{Token: tok, Statements: d.statements(fields["statements"]), EndToken: d.token(fields["endToken"])}
+	case "Identifier":
+		n := &Identifier{Token: tok}
+		d.unmarshal(fields["value"], &n.Value)
+		return n
+	case "IntegerLiteral":
+		n := &IntegerLiteral{Token: tok}
+		d.unmarshal(fields["value"], &n.Value)
+		return n
+	case "StringLiteral":
+		n := &StringLiteral{Token: tok}
+		d.unmarshal(fields["value"], &n.Value)
+		return n
+	case "Boolean":
+		n := &Boolean{Token: tok}
+		d.unmarshal(fields["value"], &n.Value)
+		return n
+	case "PrefixExpression":
+		n := &PrefixExpression{Token: tok, Right: d.expression(fields["right"])}
+		d.unmarshal(fields["operator"], &n.Operator)
+		return n
+	case "InfixExpression":
+		n := &InfixExpression{Token: tok, Left: d.expression(fields["left"]), Right: d.expression(fields["right"])}
+		d.unmarshal(fields["operator"], &n.Operator)
+		return n
+	case "IfExpression":
+		return &IfExpression{
+			Token:       tok,
+			Condition:   d.expression(fields["condition"]),
+			Consequence: d.block(fields["consequence"]),
+			Alternative: d.block(fields["alternative"]),
+		}
+	case "TryExpression":
+		return &TryExpression{
+			Token:          tok,
+			Body:           d.block(fields["body"]),
+			CatchParameter: d.identifier(fields["catchParameter"]),
+			Catch:          d.block(fields["catch"]),
+			Finally:        d.block(fields["finally"]),
+		}
+	case "SpawnExpression":
+		return &SpawnExpression{Token: tok, Function: d.expression(fields["function"])}
+	case "FunctionLiteral":
+		n := &FunctionLiteral{Token: tok, Parameters: d.identifiers(fields["parameters"]), Body: d.block(fields["body"])}
+		d.unmarshal(fields["name"], &n.Name)
+		d.unmarshal(fields["generator"], &n.Generator)
+		return n
+	case "MacroLiteral":
+		return &MacroLiteral{Token: tok, Parameters: d.identifiers(fields["parameters"]), Body: d.block(fields["body"])}
+	case "CallExpression":
+		return &CallExpression{
+			Token:     tok,
+			Function:  d.expression(fields["function"]),
+			Arguments: d.expressions(fields["arguments"]),
+			EndToken:  d.token(fields["endToken"]),
+		}
+	case "ArrayLiteral":
+		return &ArrayLiteral{Token: tok, Elements: d.expressions(fields["elements"]), EndToken: d.token(fields["endToken"])}
+	case "IndexExpression":
+		return &IndexExpression{
+			Token:    tok,
+			Left:     d.expression(fields["left"]),
+			Index:    d.expression(fields["index"]),
+			EndToken: d.token(fields["endToken"]),
+		}
+	case "HashLiteral":
+		var pairs []struct {
+			Key   json.RawMessage `json:"key"`
+			Value json.RawMessage `json:"value"`
+		}
+		d.unmarshal(fields["pairs"], &pairs)
+		n := &HashLiteral{Token: tok, Pairs: make(map[Expression]Expression, len(pairs)), EndToken: d.token(fields["endToken"])}
+		for _, pair := range pairs {
+			key := d.expression(pair.Key)
+			if key == nil {
+				d.fail("a key of a HashLiteral is null")
+				continue
+			}
+			n.Pairs[key] = d.expression(pair.Value)
+		}
+		return n
+	}
+	d.fail("unknown node type %q", nodeType)
+	return nil
+}
+
+func (d *decoder) list(data json.RawMessage) []json.RawMessage {
+	var list []json.RawMessage
+	d.unmarshal(data, &list)
+	return list
+}
+
+func (d *decoder) statements(data json.RawMessage) []Statement {
+	result := []Statement{}
+	for _, item := range d.list(data) {
+		node := d.node(item)
+		s, ok := node.(Statement)
+		if !ok {
+			d.fail("%T is not a statement", node)
+			continue
+		}
+		result = append(result, s)
+	}
+	return result
+}
+
+func (d *decoder) expressions(data json.RawMessage) []Expression {
+	result := []Expression{}
+	for _, item := range d.list(data) {
+		result = append(result, d.expression(item))
+	}
+	return result
+}
+
+// A null expression is decoded as nil.
+func (d *decoder) expression(data json.RawMessage) Expression {
+	node := d.node(data)
+	if node == nil {
+		return nil
+	}
+	e, ok := node.(Expression)
+	if !ok {
+		d.fail("%T is not an expression", node)
+		return nil
+	}
+	return e
+}
+
+func (d *decoder) identifiers(data json.RawMessage) []*Identifier {
+	result := []*Identifier{}
+	for _, item := range d.list(data) {
+		result = append(result, d.identifier(item))
+	}
+	return result
+}
+
+func (d *decoder) identifier(data json.RawMessage) *Identifier {
+	node := d.node(data)
+	if node == nil {
+		return nil
+	}
+	ident, ok := node.(*Identifier)
+	if !ok {
+		d.fail("%T is not an Identifier", node)
+		return nil
+	}
+	return ident
+}
+
+func (d *decoder) block(data json.RawMessage) *BlockStatement {
+	node := d.node(data)
+	if node == nil {
+		return nil
+	}
+	block, ok := node.(*BlockStatement)
+	if !ok {
+		d.fail("%T is not a BlockStatement", node)
+		return nil
+	}
+	return block
+}
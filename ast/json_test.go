@@ -0,0 +1,56 @@
+package ast
+
+import (
+	"monkey/token"
+	"strings"
+	"testing"
+)
+
+func TestEncodeJSON(t *testing.T) {
+	// x + 1
+	program := &Program{Statements: []Statement{
+		&ExpressionStatement{
+			Token: token.Token{Type: token.IDENT, Literal: "x", Line: 1, Column: 1},
+			Expression: &InfixExpression{
+				Token:    token.Token{Type: token.PLUS, Literal: "+", Line: 1, Column: 3},
+				Left:     &Identifier{Token: token.Token{Type: token.IDENT, Literal: "x", Line: 1, Column: 1}, Value: "x"},
+				Operator: "+",
+				Right:    &IntegerLiteral{Token: token.Token{Type: token.INT, Literal: "1", Line: 1, Column: 5}, Value: 1},
+			},
+		},
+	}}
+
+	data, err := EncodeJSON(program)
+	if err != nil {
+		t.Fatalf("EncodeJSON failed: %s", err)
+	}
+	compact := strings.Join(strings.Fields(string(data)), "")
+	expected := `"expression":{"type":"InfixExpression",` +
+		`"span":{"start":{"line":1,"column":1},"end":{"line":1,"column":6}},` +
+		`"token":{"type":"+","literal":"+","line":1,"column":3},` +
+		`"left":{"type":"Identifier"`
+	if !strings.Contains(compact, expected) {
+		t.Errorf("the JSON does not contain %s:\n%s", expected, data)
+	}
+}
+
+func TestDecodeJSONErrors(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`{"type": "Unknown"}`, `unknown node type "Unknown"`},
+		{`{"type": "Program", "statements": [{"type": "Identifier", "value": "x"}]}`, "*ast.Identifier is not a statement"},
+		{`{"type": "LetStatement", "name": {"type": "IntegerLiteral", "value": 1}}`, "*ast.IntegerLiteral is not an Identifier"},
+		{`{"type": "IntegerLiteral", "value": "1"}`, "cannot unmarshal string"},
+		{`{"type": "HashLiteral", "pairs": [{"key": null, "value": null}]}`, "a key of a HashLiteral is null"},
+		{`[`, "unexpected end of JSON input"},
+	}
+
+	for _, tt := range tests {
+		_, err := DecodeJSON([]byte(tt.input))
+		if err == nil || !strings.Contains(err.Error(), tt.expected) {
+			t.Errorf("wrong error for %s. want=%q, got=%v", tt.input, tt.expected, err)
+		}
+	}
+}
@@ -0,0 +1,353 @@
+package ast
+
+import (
+	"fmt"
+	"monkey/token"
+	"reflect"
+	"sort"
+)
+
+/*
+Visit is called for each node found by Walk().
+If the returned visitor w is not nil, the children of the node are walked with w, followed by a call of w.Visit(nil).
+*/
+type Visitor interface {
+	Visit(node Node) (w Visitor)
+}
+
+/*
+Walk the tree of the node in depth-first order, in the same order as the source code.
+Pairs of a HashLiteral are visited in the order of the positions of their keys.
+*/
+func Walk(v Visitor, node Node) {
+	if isNil(node) {
+		return
+	}
+	if v = v.Visit(node); v == nil {
+		return
+	}
+
+	switch n := node.(type) {
+	case *Program:
+		walkStatements(v, n.Statements)
+	case *BlockStatement:
+		walkStatements(v, n.Statements)
+	case *LetStatement:
+		Walk(v, n.Name)
+		Walk(v, n.Value)
+	case *ReturnStatement:
+		Walk(v, n.ReturnValue)
+	case *ThrowStatement:
+		Walk(v, n.Value)
+	case *YieldStatement:
+		Walk(v, n.Value)
+	case *ForStatement:
+		Walk(v, n.Variable)
+		Walk(v, n.Iterable)
+		Walk(v, n.Body)
+	case *ImportStatement:
+		Walk(v, n.Path)
+	case *ExpressionStatement:
+		Walk(v, n.Expression)
+	case *PrefixExpression:
+		Walk(v, n.Right)
+	case *InfixExpression:
+		Walk(v, n.Left)
+		Walk(v, n.Right)
+	case *IfExpression:
+		Walk(v, n.Condition)
+		Walk(v, n.Consequence)
+		Walk(v, n.Alternative)
+	case *TryExpression:
+		Walk(v, n.Body)
+		Walk(v, n.CatchParameter)
+		Walk(v, n.Catch)
+		Walk(v, n.Finally)
+	case *SpawnExpression:
+		Walk(v, n.Function)
+	case *FunctionLiteral:
+		for _, p := range n.Parameters {
+			Walk(v, p)
+		}
+		Walk(v, n.Body)
+	case *MacroLiteral:
+		for _, p := range n.Parameters {
+			Walk(v, p)
+		}
+		Walk(v, n.Body)
+	case *CallExpression:
+		Walk(v, n.Function)
+		walkExpressions(v, n.Arguments)
+	case *ArrayLiteral:
+		walkExpressions(v, n.Elements)
+	case *IndexExpression:
+		Walk(v, n.Left)
+		Walk(v, n.Index)
+	case *HashLiteral:
+		for _, key := range n.SortedKeys() {
+			Walk(v, key)
+			Walk(v, n.Pairs[key])
+		}
+	case *Identifier, *IntegerLiteral, *StringLiteral, *Boolean:
+		// Leaves.
+	default:
+		panic(fmt.Sprintf("ast.Walk: unexpected node type %T", n))
+	}
+
+	v.Visit(nil)
+}
+
+func walkStatements(v Visitor, list []Statement) {
+	for _, s := range list {
+		Walk(v, s)
+	}
+}
+
+func walkExpressions(v Visitor, list []Expression) {
+	for _, e := range list {
+		Walk(v, e)
+	}
+}
+
+type inspector func(Node) bool
+
+func (f inspector) Visit(node Node) Visitor {
+	if f(node) {
+		return f
+	}
+	return nil
+}
+
+/*
+Walk the tree of the node, calling f for each node and then f(nil) after its children.
+The children of a node are skipped when f returns false for it.
+*/
+func Inspect(node Node, f func(Node) bool) {
+	Walk(inspector(f), node)
+}
+
+// Returns the replacement of the node. It may return the node itself.
+type ModifierFunc func(Node) Node
+
+/*
+Replace each node in the tree by the result of the modifier, from the leaves up to the node itself.
+Children are replaced in place, and the replacement of the node is returned.
+The modifier has to return a node which can take the place of the original: an Expression for an Expression,
+a Statement for a Statement, an *Identifier for a parameter or a name of a let statement,
+and a *BlockStatement for a block.
+*/
+func Modify(node Node, modifier ModifierFunc) Node {
+	if isNil(node) {
+		return node
+	}
+
+	switch n := node.(type) {
+	case *Program:
+		modifyStatements(n.Statements, modifier)
+	case *BlockStatement:
+		modifyStatements(n.Statements, modifier)
+	case *LetStatement:
+		n.Name = modifyIdentifier(n.Name, modifier)
+		n.Value = modifyExpression(n.Value, modifier)
+	case *ReturnStatement:
+		n.ReturnValue = modifyExpression(n.ReturnValue, modifier)
+	case *ThrowStatement:
+		n.Value = modifyExpression(n.Value, modifier)
+	case *YieldStatement:
+		n.Value = modifyExpression(n.Value, modifier)
+	case *ForStatement:
+		n.Variable = modifyIdentifier(n.Variable, modifier)
+		n.Iterable = modifyExpression(n.Iterable, modifier)
+		n.Body = modifyBlock(n.Body, modifier)
+	case *ImportStatement:
+		if n.Path != nil {
+			modified := Modify(n.Path, modifier)
+			path, ok := modified.(*StringLiteral)
+			if !ok {
+				panic(fmt.Sprintf("ast.Modify: the path of an import was replaced by %T", modified))
+			}
+			n.Path = path
+		}
+	case *ExpressionStatement:
+		n.Expression = modifyExpression(n.Expression, modifier)
+	case *PrefixExpression:
+		n.Right = modifyExpression(n.Right, modifier)
+	case *InfixExpression:
+		n.Left = modifyExpression(n.Left, modifier)
+		n.Right = modifyExpression(n.Right, modifier)
+	case *IfExpression:
+		n.Condition = modifyExpression(n.Condition, modifier)
+		n.Consequence = modifyBlock(n.Consequence, modifier)
+		n.Alternative = modifyBlock(n.Alternative, modifier)
+	case *TryExpression:
+		n.Body = modifyBlock(n.Body, modifier)
+		n.CatchParameter = modifyIdentifier(n.CatchParameter, modifier)
+		n.Catch = modifyBlock(n.Catch, modifier)
+		n.Finally = modifyBlock(n.Finally, modifier)
+	case *SpawnExpression:
+		n.Function = modifyExpression(n.Function, modifier)
+	case *FunctionLiteral:
+		for i, p := range n.Parameters {
+			n.Parameters[i] = modifyIdentifier(p, modifier)
+		}
+		n.Body = modifyBlock(n.Body, modifier)
+	case *MacroLiteral:
+		for i, p := range n.Parameters {
+			n.Parameters[i] = modifyIdentifier(p, modifier)
+		}
+		n.Body = modifyBlock(n.Body, modifier)
+	case *CallExpression:
+		n.Function = modifyExpression(n.Function, modifier)
+		modifyExpressions(n.Arguments, modifier)
+	case *ArrayLiteral:
+		modifyExpressions(n.Elements, modifier)
+	case *IndexExpression:
+		n.Left = modifyExpression(n.Left, modifier)
+		n.Index = modifyExpression(n.Index, modifier)
+	case *HashLiteral:
+		pairs := make(map[Expression]Expression, len(n.Pairs))
+		for _, key := range n.SortedKeys() {
+			value := n.Pairs[key]
+			pairs[modifyExpression(key, modifier)] = modifyExpression(value, modifier)
+		}
+		n.Pairs = pairs
+	}
+
+	return modifier(node)
+}
+
+func modifyStatements(list []Statement, modifier ModifierFunc) {
+	for i, s := range list {
+		if isNil(s) {
+			continue
+		}
+		modified, ok := Modify(s, modifier).(Statement)
+		if !ok {
+			panic(fmt.Sprintf("ast.Modify: a statement was replaced by %T", modified))
+		}
+		list[i] = modified
+	}
+}
+
+func modifyExpressions(list []Expression, modifier ModifierFunc) {
+	for i, e := range list {
+		list[i] = modifyExpression(e, modifier)
+	}
+}
+
+func modifyExpression(e Expression, modifier ModifierFunc) Expression {
+	if isNil(e) {
+		return e
+	}
+	modified := Modify(e, modifier)
+	result, ok := modified.(Expression)
+	if !ok {
+		panic(fmt.Sprintf("ast.Modify: an expression was replaced by %T", modified))
+	}
+	return result
+}
+
+func modifyIdentifier(ident *Identifier, modifier ModifierFunc) *Identifier {
+	if ident == nil {
+		return nil
+	}
+	modified := Modify(ident, modifier)
+	result, ok := modified.(*Identifier)
+	if !ok {
+		panic(fmt.Sprintf("ast.Modify: an identifier was replaced by %T", modified))
+	}
+	return result
+}
+
+func modifyBlock(block *BlockStatement, modifier ModifierFunc) *BlockStatement {
+	if block == nil {
+		return nil
+	}
+	modified := Modify(block, modifier)
+	result, ok := modified.(*BlockStatement)
+	if !ok {
+		panic(fmt.Sprintf("ast.Modify: a block was replaced by %T", modified))
+	}
+	return result
+}
+
+// Returns the keys of the pairs in the order of their positions in the source code.
+func (hl *HashLiteral) SortedKeys() []Expression {
+	keys := make([]Expression, 0, len(hl.Pairs))
+	for key := range hl.Pairs {
+		keys = append(keys, key)
+	}
+	sort.SliceStable(keys, func(i, j int) bool {
+		a, b := StartToken(keys[i]), StartToken(keys[j])
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		if a.Column != b.Column {
+			return a.Column < b.Column
+		}
+		return keys[i].String() < keys[j].String() // Nodes built without positions.
+	})
+	return keys
+}
+
+// Returns the first token of the node in the source code.
+func StartToken(node Node) token.Token {
+	switch n := node.(type) {
+	case *Program:
+		if len(n.Statements) > 0 {
+			return StartToken(n.Statements[0])
+		}
+	case *InfixExpression:
+		return StartToken(n.Left)
+	case *CallExpression:
+		return StartToken(n.Function)
+	case *IndexExpression:
+		return StartToken(n.Left)
+	case *LetStatement:
+		return n.Token
+	case *ReturnStatement:
+		return n.Token
+	case *ThrowStatement:
+		return n.Token
+	case *YieldStatement:
+		return n.Token
+	case *ForStatement:
+		return n.Token
+	case *ImportStatement:
+		return n.Token
+	case *ExpressionStatement:
+		return n.Token
+	case *BlockStatement:
+		return n.Token
+	case *Identifier:
+		return n.Token
+	case *IntegerLiteral:
+		return n.Token
+	case *StringLiteral:
+		return n.Token
+	case *Boolean:
+		return n.Token
+	case *PrefixExpression:
+		return n.Token
+	case *IfExpression:
+		return n.Token
+	case *TryExpression:
+		return n.Token
+	case *SpawnExpression:
+		return n.Token
+	case *FunctionLiteral:
+		return n.Token
+	case *MacroLiteral:
+		return n.Token
+	case *ArrayLiteral:
+		return n.Token
+	case *HashLiteral:
+		return n.Token
+	}
+	return token.Token{}
+}
+
+// Nodes which failed to parse may be nil pointers wrapped in interfaces.
+func isNil(node Node) bool {
+	return node == nil || reflect.ValueOf(node).IsNil()
+}
@@ -0,0 +1,254 @@
+package ast
+
+import (
+	"fmt"
+	"monkey/token"
+	"reflect"
+	"testing"
+)
+
+func TestWalk(t *testing.T) {
+	ident := func(name string, line, column int) *Identifier {
+		return &Identifier{Token: token.Token{Type: token.IDENT, Literal: name, Line: line, Column: column}, Value: name}
+	}
+	// let f = fn(x) { if (x) { [x] } else { {b: 1, a: 2}[a] } }; f(-x + 1)
+	program := &Program{Statements: []Statement{
+		&LetStatement{Name: ident("f", 1, 5), Value: &FunctionLiteral{
+			Parameters: []*Identifier{ident("x", 1, 12)},
+			Body: &BlockStatement{Statements: []Statement{
+				&ExpressionStatement{Expression: &IfExpression{
+					Condition:   ident("x", 1, 21),
+					Consequence: &BlockStatement{Statements: []Statement{&ExpressionStatement{Expression: &ArrayLiteral{Elements: []Expression{ident("x", 1, 27)}}}}},
+					Alternative: &BlockStatement{Statements: []Statement{&ReturnStatement{ReturnValue: &IndexExpression{
+						Left: &HashLiteral{Pairs: map[Expression]Expression{
+							ident("b", 1, 41): &IntegerLiteral{Value: 1},
+							ident("a", 1, 47): &IntegerLiteral{Value: 2},
+						}},
+						Index: ident("a", 1, 53),
+					}}}},
+				}},
+			}},
+		}},
+		&ExpressionStatement{Expression: &CallExpression{
+			Function:  ident("f", 2, 1),
+			Arguments: []Expression{&InfixExpression{Left: &PrefixExpression{Right: ident("x", 2, 4)}, Right: &Boolean{Value: true}}},
+		}},
+	}}
+
+	visited := []string{}
+	Inspect(program, func(node Node) bool {
+		if node == nil {
+			visited = append(visited, "end")
+			return false
+		}
+		name := reflect.TypeOf(node).Elem().Name()
+		if ident, ok := node.(*Identifier); ok {
+			name = ident.Value
+		}
+		visited = append(visited, name)
+		return true
+	})
+
+	expected := []string{
+		"Program",
+		"LetStatement", "f", "end", "FunctionLiteral", "x", "end", "BlockStatement",
+		"ExpressionStatement", "IfExpression", "x", "end",
+		"BlockStatement", "ExpressionStatement", "ArrayLiteral", "x", "end", "end", "end", "end",
+		"BlockStatement", "ReturnStatement", "IndexExpression", "HashLiteral",
+		"b", "end", "IntegerLiteral", "end", "a", "end", "IntegerLiteral", "end", "end",
+		"a", "end", "end", "end", "end",
+		"end", "end", "end", "end", "end",
+		"ExpressionStatement", "CallExpression", "f", "end",
+		"InfixExpression", "PrefixExpression", "x", "end", "end", "Boolean", "end", "end",
+		"end", "end",
+		"end",
+	}
+	if !reflect.DeepEqual(visited, expected) {
+		t.Errorf("wrong order of nodes.\nwant=%v\ngot= %v", expected, visited)
+	}
+}
+
+func TestInspectSkipsChildren(t *testing.T) {
+	program := &Program{Statements: []Statement{
+		&ExpressionStatement{Expression: &FunctionLiteral{
+			Parameters: []*Identifier{{Value: "x"}},
+			Body:       &BlockStatement{Statements: []Statement{&ExpressionStatement{Expression: &Identifier{Value: "x"}}}},
+		}},
+		&ExpressionStatement{Expression: &Identifier{Value: "y"}},
+	}}
+
+	identifiers := []string{}
+	Inspect(program, func(node Node) bool {
+		if ident, ok := node.(*Identifier); ok {
+			identifiers = append(identifiers, ident.Value)
+		}
+		_, isFunction := node.(*FunctionLiteral)
+		return !isFunction
+	})
+	if !reflect.DeepEqual(identifiers, []string{"y"}) {
+		t.Errorf("expected only y outside of the function, got=%v", identifiers)
+	}
+}
+
+func TestModify(t *testing.T) {
+	one := func() Expression { return &IntegerLiteral{Value: 1} }
+	two := func() Expression { return &IntegerLiteral{Value: 2} }
+
+	turnOneIntoTwo := func(node Node) Node {
+		integer, ok := node.(*IntegerLiteral)
+		if !ok || integer.Value != 1 {
+			return node
+		}
+		integer.Value = 2
+		return integer
+	}
+
+	tests := []struct {
+		input    Node
+		expected Node
+	}{
+		{one(), two()},
+		{
+			&Program{Statements: []Statement{&ExpressionStatement{Expression: one()}}},
+			&Program{Statements: []Statement{&ExpressionStatement{Expression: two()}}},
+		},
+		{&InfixExpression{Left: one(), Operator: "+", Right: two()}, &InfixExpression{Left: two(), Operator: "+", Right: two()}},
+		{&InfixExpression{Left: two(), Operator: "+", Right: one()}, &InfixExpression{Left: two(), Operator: "+", Right: two()}},
+		{&PrefixExpression{Operator: "-", Right: one()}, &PrefixExpression{Operator: "-", Right: two()}},
+		{&IndexExpression{Left: one(), Index: one()}, &IndexExpression{Left: two(), Index: two()}},
+		{
+			&IfExpression{
+				Condition:   one(),
+				Consequence: &BlockStatement{Statements: []Statement{&ExpressionStatement{Expression: one()}}},
+				Alternative: &BlockStatement{Statements: []Statement{&ExpressionStatement{Expression: one()}}},
+			},
+			&IfExpression{
+				Condition:   two(),
+				Consequence: &BlockStatement{Statements: []Statement{&ExpressionStatement{Expression: two()}}},
+				Alternative: &BlockStatement{Statements: []Statement{&ExpressionStatement{Expression: two()}}},
+			},
+		},
+		{&IfExpression{Condition: one(), Consequence: &BlockStatement{}}, &IfExpression{Condition: two(), Consequence: &BlockStatement{}}},
+		{&ReturnStatement{ReturnValue: one()}, &ReturnStatement{ReturnValue: two()}},
+		{&LetStatement{Name: &Identifier{Value: "x"}, Value: one()}, &LetStatement{Name: &Identifier{Value: "x"}, Value: two()}},
+		{
+			&FunctionLiteral{Parameters: []*Identifier{}, Body: &BlockStatement{Statements: []Statement{&ExpressionStatement{Expression: one()}}}},
+			&FunctionLiteral{Parameters: []*Identifier{}, Body: &BlockStatement{Statements: []Statement{&ExpressionStatement{Expression: two()}}}},
+		},
+		{&CallExpression{Function: one(), Arguments: []Expression{one(), two()}}, &CallExpression{Function: two(), Arguments: []Expression{two(), two()}}},
+		{&ArrayLiteral{Elements: []Expression{one(), one()}}, &ArrayLiteral{Elements: []Expression{two(), two()}}},
+		{
+			&MacroLiteral{Parameters: []*Identifier{}, Body: &BlockStatement{Statements: []Statement{&ExpressionStatement{Expression: one()}}}},
+			&MacroLiteral{Parameters: []*Identifier{}, Body: &BlockStatement{Statements: []Statement{&ExpressionStatement{Expression: two()}}}},
+		},
+	}
+
+	for _, tt := range tests {
+		modified := Modify(tt.input, turnOneIntoTwo)
+		if !reflect.DeepEqual(modified, tt.expected) {
+			t.Errorf("not equal.\nwant=%#v\ngot= %#v", tt.expected, modified)
+		}
+	}
+
+	hash := &HashLiteral{Pairs: map[Expression]Expression{one(): one(), one(): one()}}
+	Modify(hash, turnOneIntoTwo)
+	for key, value := range hash.Pairs {
+		if key.(*IntegerLiteral).Value != 2 || value.(*IntegerLiteral).Value != 2 {
+			t.Errorf("value is not modified: %s: %s", key, value)
+		}
+	}
+}
+
+func TestModifyParametersAndNames(t *testing.T) {
+	rename := func(node Node) Node {
+		if ident, ok := node.(*Identifier); ok {
+			return &Identifier{Value: ident.Value + "_"}
+		}
+		return node
+	}
+
+	let := &LetStatement{
+		Name: &Identifier{Value: "f"},
+		Value: &FunctionLiteral{
+			Parameters: []*Identifier{{Value: "a"}, {Value: "b"}},
+			Body:       &BlockStatement{Statements: []Statement{&ExpressionStatement{Expression: &Identifier{Value: "a"}}}},
+		},
+	}
+	Modify(let, rename)
+	fn := let.Value.(*FunctionLiteral)
+	body := fn.Body.Statements[0].(*ExpressionStatement).Expression.(*Identifier)
+	if let.Name.Value != "f_" || fn.Parameters[0].Value != "a_" || fn.Parameters[1].Value != "b_" || body.Value != "a_" {
+		t.Errorf("identifiers are not renamed: %s %s %s %s", let.Name, fn.Parameters[0], fn.Parameters[1], body)
+	}
+}
+
+func TestModifyRejectsWrongReplacements(t *testing.T) {
+	defer func() {
+		if r := recover(); r == nil || fmt.Sprint(r) != "ast.Modify: an identifier was replaced by *ast.IntegerLiteral" {
+			t.Errorf("expected a panic about the identifier, got=%v", r)
+		}
+	}()
+
+	Modify(&LetStatement{Name: &Identifier{Value: "x"}, Value: &IntegerLiteral{Value: 1}}, func(node Node) Node {
+		if _, ok := node.(*Identifier); ok {
+			return &IntegerLiteral{Value: 1}
+		}
+		return node
+	})
+}
+
+func TestCopy(t *testing.T) {
+	original := &Program{Statements: []Statement{
+		&LetStatement{Name: &Identifier{Value: "m"}, Value: &MacroLiteral{
+			Parameters: []*Identifier{{Value: "a"}},
+			Body: &BlockStatement{Statements: []Statement{&ReturnStatement{ReturnValue: &IfExpression{
+				Condition:   &InfixExpression{Left: &Identifier{Value: "a"}, Operator: "<", Right: &IntegerLiteral{Value: 1}},
+				Consequence: &BlockStatement{Statements: []Statement{&ExpressionStatement{Expression: &StringLiteral{Value: "x"}}}},
+			}}}},
+		}},
+		&ExpressionStatement{Expression: &SpawnExpression{Function: &CallExpression{
+			Function: &FunctionLiteral{Parameters: []*Identifier{}, Body: &BlockStatement{Statements: []Statement{&ForStatement{
+				Variable: &Identifier{Value: "x"},
+				Iterable: &Identifier{Value: "xs"},
+				Body:     &BlockStatement{Statements: []Statement{&YieldStatement{Value: &Identifier{Value: "x"}}}},
+			}}}, Name: "f", Generator: true},
+			Arguments: []Expression{
+				&ArrayLiteral{Elements: []Expression{&Boolean{Value: true}, &PrefixExpression{Operator: "-", Right: &IntegerLiteral{Value: 2}}}},
+				&IndexExpression{Left: &Identifier{Value: "h"}, Index: &IntegerLiteral{Value: 3}},
+			},
+		}}},
+	}}
+
+	copied := Copy(original)
+	if !reflect.DeepEqual(copied, original) {
+		t.Fatalf("the copy is not equal to the original.\nwant=%#v\ngot= %#v", original, copied)
+	}
+
+	// Changing every node of the copy leaves the original as it was.
+	want := original.String()
+	Modify(copied, func(node Node) Node {
+		switch node := node.(type) {
+		case *Identifier:
+			node.Value = "changed"
+		case *IntegerLiteral:
+			node.Value = 100
+		case *StringLiteral:
+			node.Value = "changed"
+		}
+		return node
+	})
+	if got := original.String(); got != want {
+		t.Errorf("the original is changed.\nwant=%s\ngot= %s", want, got)
+	}
+	if copied.String() == want {
+		t.Errorf("the copy is not changed: %s", copied)
+	}
+
+	key, value := &StringLiteral{Value: "k"}, &StringLiteral{Value: "v"}
+	hash := Copy(&HashLiteral{Pairs: map[Expression]Expression{key: value}}).(*HashLiteral)
+	for k, v := range hash.Pairs {
+		if k == key || v == value || k.(*StringLiteral).Value != "k" || v.(*StringLiteral).Value != "v" {
+			t.Errorf("wrong copy of the pair: %#v: %#v", k, v)
+		}
+	}
+}
@@ -46,7 +46,7 @@ func main() {
 			return
 		}
 
-		machine := vm.New(comp.ByteCode())
+		machine := vm.New(comp.ByteCode(), vm.DefaultConfig())
 		start := time.Now()
 		err = machine.Run()
 		if err != nil {
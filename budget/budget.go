@@ -0,0 +1,114 @@
+// Package budget limits how much work a Monkey program may do.
+// It is shared by the virtual machine and the evaluator so that both engines stop for the same reasons
+// and report the same error types.
+package budget
+
+import (
+	"context"
+	"fmt"
+)
+
+/*
+The budgets of an execution, which each engine counts in its own units:
+steps are instructions in the VM and evaluated AST nodes in the evaluator, and the depth counts frames or nested calls.
+Zero means unlimited, except for MaxDepth, for which it means the default of the engine.
+*/
+type Limits struct {
+	MaxSteps  int64
+	MaxMemory int64
+	MaxDepth  int
+}
+
+// Returned when the context of the execution is canceled or its deadline passes.
+type CanceledError struct {
+	Err error // context.Canceled or context.DeadlineExceeded
+}
+
+func (e *CanceledError) Error() string { return "execution canceled: " + e.Err.Error() }
+func (e *CanceledError) Unwrap() error { return e.Err }
+
+// Returned when the execution runs more steps than allowed.
+// A step is an instruction in the VM, and an evaluation of one AST node in the evaluator.
+type StepLimitError struct {
+	Limit int64
+}
+
+func (e *StepLimitError) Error() string {
+	return fmt.Sprintf("step limit exceeded: max %d steps", e.Limit)
+}
+
+// Returned when the execution allocates more memory than allowed.
+type MemoryLimitError struct {
+	Limit int64
+}
+
+func (e *MemoryLimitError) Error() string {
+	return fmt.Sprintf("memory limit exceeded: max %d bytes", e.Limit)
+}
+
+// The context is polled once in this number of steps, since polling a channel is much slower than a step.
+const pollInterval = 1024
+
+/*
+Counts steps and allocated bytes of an execution against its limits.
+A limit of zero means unlimited.
+*/
+type Meter struct {
+	MaxSteps  int64
+	MaxMemory int64
+
+	steps     int64
+	allocated int64
+	done      <-chan struct{}
+	ctx       context.Context
+}
+
+func NewMeter(maxSteps, maxMemory int64) *Meter {
+	return &Meter{MaxSteps: maxSteps, MaxMemory: maxMemory, ctx: context.Background()}
+}
+
+// Set the context which can cancel the execution.
+func (m *Meter) SetContext(ctx context.Context) {
+	m.ctx = ctx
+	m.done = ctx.Done() // nil for context.Background(), and then never polled.
+}
+
+func (m *Meter) Steps() int64     { return m.steps }
+func (m *Meter) Allocated() int64 { return m.allocated }
+
+// Count one step.
+func (m *Meter) Step() error {
+	m.steps++
+	if m.MaxSteps > 0 && m.steps > m.MaxSteps {
+		return &StepLimitError{Limit: m.MaxSteps}
+	}
+	if m.steps%pollInterval == 0 {
+		return m.Canceled()
+	}
+	return nil
+}
+
+// Returns a CanceledError if the context is done, without waiting for the next poll of Step.
+func (m *Meter) Canceled() error {
+	if m.done == nil {
+		return nil
+	}
+	select {
+	case <-m.done:
+		return &CanceledError{Err: m.ctx.Err()}
+	default:
+		return nil
+	}
+}
+
+// Returns the context set by SetContext.
+func (m *Meter) Context() context.Context { return m.ctx }
+
+// Count an allocation of the given (approximate) number of bytes.
+func (m *Meter) Allocate(size int64) error {
+	m.allocated += size
+	if m.MaxMemory > 0 && m.allocated > m.MaxMemory {
+		return &MemoryLimitError{Limit: m.MaxMemory}
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package budget
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestMeterStep(t *testing.T) {
+	meter := NewMeter(3, 0)
+	for i := 0; i < 3; i++ {
+		if err := meter.Step(); err != nil {
+			t.Fatalf("unexpected error at step %d: %s", i, err)
+		}
+	}
+
+	err := meter.Step()
+	if _, ok := err.(*StepLimitError); !ok {
+		t.Fatalf("error is not StepLimitError. got=%T (%v)", err, err)
+	}
+}
+
+func TestMeterAllocate(t *testing.T) {
+	meter := NewMeter(0, 100)
+	if err := meter.Allocate(100); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	err := meter.Allocate(1)
+	if _, ok := err.(*MemoryLimitError); !ok {
+		t.Fatalf("error is not MemoryLimitError. got=%T (%v)", err, err)
+	}
+}
+
+func TestMeterCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	meter := NewMeter(0, 0)
+	meter.SetContext(ctx)
+	cancel()
+
+	var err error
+	for i := 0; i < pollInterval && err == nil; i++ {
+		err = meter.Step()
+	}
+	if _, ok := err.(*CanceledError); !ok {
+		t.Fatalf("error is not CanceledError. got=%T (%v)", err, err)
+	}
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("error does not wrap context.Canceled. got=%v", err)
+	}
+}
+
+func TestMeterCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	meter := NewMeter(0, 0)
+	if err := meter.Canceled(); err != nil {
+		t.Fatalf("unexpected error without a context: %s", err)
+	}
+
+	meter.SetContext(ctx)
+	if err := meter.Canceled(); err != nil {
+		t.Fatalf("unexpected error before the cancellation: %s", err)
+	}
+	cancel()
+	if _, ok := meter.Canceled().(*CanceledError); !ok {
+		t.Fatalf("error is not CanceledError. got=%T", meter.Canceled())
+	}
+}
@@ -0,0 +1,38 @@
+package budget
+
+import "monkey/object"
+
+// Rough sizes in bytes, which do not need to match the Go runtime exactly.
+// They only have to grow with the amount of data a program creates.
+const (
+	headerSize = 16 // An interface value pointing to a heap object.
+	sliceSize  = 24
+	mapSize    = 48
+)
+
+/*
+Returns the approximate number of bytes newly allocated for the object.
+Objects which it refers to (e.g. elements of an array) are not counted, since they are allocated by themselves.
+*/
+func SizeOf(obj object.Object) int64 {
+	switch obj := obj.(type) {
+	case *object.Integer:
+		return headerSize + 8
+	case *object.String:
+		return headerSize + 16 + int64(len(obj.Value))
+	case *object.Array:
+		return headerSize + sliceSize + headerSize*int64(len(obj.Elements))
+	case *object.Hash:
+		return headerSize + mapSize + 2*headerSize*int64(len(obj.Pairs))
+	case *object.Closure:
+		return headerSize + 8 + sliceSize + headerSize*int64(len(obj.Free))
+	case *object.Function:
+		return headerSize + sliceSize + 16
+	case *object.Channel:
+		return headerSize + 96 + headerSize*int64(obj.Cap())
+	case nil:
+		return 0
+	default:
+		return headerSize
+	}
+}
@@ -0,0 +1,479 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"monkey/ast"
+	"monkey/compiler"
+	"monkey/dap"
+	"monkey/debugger"
+	"monkey/evaluator"
+	"monkey/format"
+	"monkey/lexer"
+	"monkey/lsp"
+	"monkey/object"
+	"monkey/parser"
+	"monkey/repl"
+	"monkey/testrunner"
+	"monkey/token"
+	"monkey/vm"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+)
+
+const usage = `Usage:
+  monkey [repl] [-engine vm|eval|diff]
+                         start the REPL, running the inputs with the VM, the evaluator,
+                         or both, reporting where their results differ
+  monkey run [-trace] <file>
+                         run a program (-trace prints each instruction executed
+                         and the stack to the standard error)
+  monkey parse [-trace] <file>
+                         print a program with its expressions in parentheses
+                         (-trace prints the parse functions called to the standard error)
+  monkey tokens <file>   print the tokens of a program as JSON
+  monkey ast <file>      print the syntax tree of a program as JSON
+  monkey debug <file>    debug a program interactively
+  monkey profile [-o profile.pb.gz] <file>
+                         run a program and print the time, calls and allocations
+                         of its functions, and the counts of the opcodes
+                         (-o also writes them for go tool pprof)
+  monkey dap             serve the Debug Adapter Protocol over stdio
+  monkey lsp             serve the Language Server Protocol over stdio
+  monkey fmt [-w | -check] [files...]
+                         format programs (standard input if no files are given)
+  monkey test [-v] [-junit report.xml] [paths...]
+                         run the test_* functions of the *_test.mk files
+                         in the paths (the current directory if none are given)
+                         (-v lists the tests which pass too, -junit also writes
+                         the results as JUnit XML)
+`
+
+func main() {
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		os.Exit(runCommand(os.Args[1], os.Args[2:]))
+	}
+	os.Exit(runREPL(os.Args[1:]))
+}
+
+// Start the REPL on the standard input and output.
+func runREPL(args []string) int {
+	flags := flag.NewFlagSet("repl", flag.ContinueOnError)
+	engine := flags.String("engine", repl.EngineVM, "run the inputs with the vm, the eval(uator), or diff(erentially) with both")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	switch *engine {
+	case repl.EngineVM, repl.EngineEval, repl.EngineDiff:
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		return 2
+	}
+	if flags.NArg() != 0 {
+		fmt.Fprint(os.Stderr, usage)
+		return 2
+	}
+
+	user, err := user.Current()
+	if err != nil {
+		panic(err)
+	}
+
+	fmt.Printf(
+		"Hello %s! This is the Monkey programming language!\n",
+		user.Username,
+	)
+	fmt.Printf(
+		"Feel free to type in commands\n",
+	)
+	options := []repl.Option{repl.WithEngine(*engine)}
+	if home, err := os.UserHomeDir(); err == nil {
+		options = append(options, repl.WithHistory(filepath.Join(home, ".monkey_history")))
+	}
+	repl.Start(os.Stdin, os.Stdout, options...)
+	return 0
+}
+
+// Run a subcommand and return the exit status.
+func runCommand(command string, args []string) int {
+	switch command {
+	case "repl":
+		return runREPL(args)
+	case "run":
+		flags := flag.NewFlagSet("run", flag.ContinueOnError)
+		trace := flags.Bool("trace", false, "print each instruction executed to the standard error")
+		if err := flags.Parse(args); err != nil {
+			return 2
+		}
+		if flags.NArg() != 1 {
+			fmt.Fprint(os.Stderr, usage)
+			return 2
+		}
+		return runFile(flags.Arg(0), *trace)
+	case "parse":
+		return runParse(args)
+	case "tokens":
+		if len(args) != 1 {
+			fmt.Fprint(os.Stderr, usage)
+			return 2
+		}
+		return runTokens(args[0])
+	case "ast":
+		if len(args) != 1 {
+			fmt.Fprint(os.Stderr, usage)
+			return 2
+		}
+		return runAST(args[0])
+	case "debug":
+		if len(args) != 1 {
+			fmt.Fprint(os.Stderr, usage)
+			return 2
+		}
+		source, err := ioutil.ReadFile(args[0])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		debugger.Start(args[0], string(source), os.Stdin, os.Stdout)
+		return 0
+	case "profile":
+		return runProfile(args)
+	case "dap":
+		if err := dap.NewServer(os.Stdin, os.Stdout).Serve(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		return 0
+	case "lsp":
+		if err := lsp.NewServer(os.Stdin, os.Stdout).Serve(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		return 0
+	case "fmt":
+		return runFmt(args)
+	case "test":
+		return runTests(args)
+	case "help", "-h", "--help":
+		fmt.Print(usage)
+		return 0
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		return 2
+	}
+}
+
+// Run the program in the file. Its imports are relative to the file.
+func runFile(path string, trace bool) int {
+	config := vm.DefaultConfig()
+	bytecode := compileFile(path, config)
+	if bytecode == nil {
+		return 1
+	}
+
+	machine := vm.New(bytecode, config)
+	if trace {
+		machine.SetTracer(vm.NewWriterTracer(os.Stderr))
+	}
+	if err := machine.Run(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// Parse the program in the file and print it, which shows how the operators are grouped.
+func runParse(args []string) int {
+	flags := flag.NewFlagSet("parse", flag.ContinueOnError)
+	trace := flags.Bool("trace", false, "print the parse functions called to the standard error")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		fmt.Fprint(os.Stderr, usage)
+		return 2
+	}
+
+	path := flags.Arg(0)
+	source, err := ioutil.ReadFile(path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	var options []parser.Option
+	if *trace {
+		options = append(options, parser.WithTrace(os.Stderr))
+	}
+	p := parser.New(lexer.New(string(source)), options...)
+	program := p.ParseProgram()
+	if len(p.ErrorDetails()) != 0 {
+		for _, e := range p.ErrorDetails() {
+			fmt.Fprintf(os.Stderr, "%s:%d:%d: %s\n", path, e.Line, e.Column, e.Msg)
+		}
+		return 1
+	}
+	for _, stmt := range program.Statements {
+		fmt.Println(stmt.String())
+	}
+	return 0
+}
+
+// Print the tokens of the program in the file as JSON, up to and including the EOF token.
+func runTokens(path string) int {
+	source, err := ioutil.ReadFile(path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	l := lexer.New(string(source))
+	var tokens []token.Token
+	for {
+		tok := l.NextToken()
+		tokens = append(tokens, tok)
+		if tok.Type == token.EOF {
+			break
+		}
+	}
+	out, err := ast.EncodeTokens(tokens)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Println(string(out))
+	return 0
+}
+
+// Print the syntax tree of the program in the file as JSON. Macros are not expanded.
+func runAST(path string) int {
+	source, err := ioutil.ReadFile(path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	p := parser.New(lexer.New(string(source)))
+	program := p.ParseProgram()
+	if len(p.ErrorDetails()) != 0 {
+		for _, e := range p.ErrorDetails() {
+			fmt.Fprintf(os.Stderr, "%s:%d:%d: %s\n", path, e.Line, e.Column, e.Msg)
+		}
+		return 1
+	}
+	out, err := ast.EncodeJSON(program)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Println(string(out))
+	return 0
+}
+
+// Run the program in the file with a profiler, and print its statistics to the standard error.
+func runProfile(args []string) int {
+	flags := flag.NewFlagSet("profile", flag.ContinueOnError)
+	output := flags.String("o", "", "write the profile in the pprof format to the file")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		fmt.Fprint(os.Stderr, usage)
+		return 2
+	}
+
+	config := vm.DefaultConfig()
+	bytecode := compileFile(flags.Arg(0), config)
+	if bytecode == nil {
+		return 1
+	}
+	machine := vm.New(bytecode, config)
+	profiler := vm.NewProfiler(machine)
+	status := 0
+	if err := machine.Run(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		status = 1
+	}
+
+	fmt.Fprintln(os.Stderr)
+	if err := profiler.WriteText(os.Stderr); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err == nil {
+			err = profiler.WritePprof(f)
+			if closeErr := f.Close(); err == nil {
+				err = closeErr
+			}
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+	return status
+}
+
+/*
+Compile the program in the file, whose macros run with the capabilities and the budgets of the config it runs with.
+Errors are printed, and nil is returned.
+*/
+func compileFile(path string, config vm.Config) *compiler.Bytecode {
+	source, err := ioutil.ReadFile(path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return nil
+	}
+
+	p := parser.New(lexer.New(string(source)))
+	program := p.ParseProgram()
+	if len(p.ErrorDetails()) != 0 {
+		for _, e := range p.ErrorDetails() {
+			fmt.Fprintf(os.Stderr, "%s:%d:%d: %s\n", path, e.Line, e.Column, e.Msg)
+		}
+		return nil
+	}
+
+	comp := compiler.New()
+	comp.SetLoader(compiler.NewLoader(), path)
+	err = comp.ExpandAndCompile(program, object.NewEnvironment(), config.Limits(), config.Capabilities)
+	switch e := err.(type) {
+	case nil:
+	case *evaluator.MacroError:
+		fmt.Fprintf(os.Stderr, "%s:%d:%d: %s\n", path, e.Line, e.Column, e.Msg)
+		return nil
+	case *compiler.Error:
+		fmt.Fprintf(os.Stderr, "%s:%d:%d: %s\n", path, e.Line, e.Column, e.Msg)
+		return nil
+	default:
+		fmt.Fprintf(os.Stderr, "%s: %s\n", path, err)
+		return nil
+	}
+
+	return comp.ByteCode()
+}
+
+/*
+Format the files and print the results, or with -w, overwrite the files which are not formatted.
+With -check, only list the files which are not formatted and fail if there are any, which is useful in CI.
+*/
+func runFmt(args []string) int {
+	flags := flag.NewFlagSet("fmt", flag.ContinueOnError)
+	write := flags.Bool("w", false, "write the result to the files instead of printing it")
+	check := flags.Bool("check", false, "list the files which are not formatted and exit with status 1 if any")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *write && *check {
+		fmt.Fprintln(os.Stderr, "fmt: -w and -check cannot be used together")
+		return 2
+	}
+
+	if flags.NArg() == 0 {
+		if *write {
+			fmt.Fprintln(os.Stderr, "fmt: -w needs files to write")
+			return 2
+		}
+		src, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		return formatFile("<stdin>", src, false, *check)
+	}
+
+	status := 0
+	for _, path := range flags.Args() {
+		src, err := ioutil.ReadFile(path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			status = 1
+			continue
+		}
+		if s := formatFile(path, src, *write, *check); s != 0 {
+			status = s
+		}
+	}
+	return status
+}
+
+func formatFile(path string, src []byte, write, check bool) int {
+	formatted, err := format.Source(src)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s:\n%s\n", path, err)
+		return 1
+	}
+
+	switch {
+	case check:
+		if !bytes.Equal(src, formatted) {
+			fmt.Println(path)
+			return 1
+		}
+	case write:
+		if !bytes.Equal(src, formatted) {
+			if err := ioutil.WriteFile(path, formatted, 0644); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return 1
+			}
+		}
+	default:
+		os.Stdout.Write(formatted)
+	}
+	return 0
+}
+
+// Run the tests in the paths, print the report, and fail if any test does not pass.
+func runTests(args []string) int {
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	verbose := flags.Bool("v", false, "list the tests which pass too")
+	junit := flags.String("junit", "", "write the results to the file in the JUnit XML format")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	paths := flags.Args()
+	if len(paths) == 0 {
+		paths = []string{"."}
+	}
+
+	files, err := testrunner.Discover(paths)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if len(files) == 0 {
+		fmt.Println("no test files")
+		return 0
+	}
+
+	report := &testrunner.Report{}
+	for _, path := range files {
+		report.Files = append(report.Files, testrunner.RunFile(path, vm.DefaultConfig()))
+	}
+	if err := report.WriteText(os.Stdout, *verbose); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if *junit != "" {
+		f, err := os.Create(*junit)
+		if err == nil {
+			err = report.WriteJUnit(f)
+			if closeErr := f.Close(); err == nil {
+				err = closeErr
+			}
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+	if !report.Passed() {
+		return 1
+	}
+	return 0
+}
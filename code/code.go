@@ -41,6 +41,31 @@ const (
 	OpClosure
 	OpGetFree
 	OpCurrentClosure // Used when calling the function itself recursively in a function in a local (not global) context.
+
+	// Wide variants. The compiler emits them instead of the ones above only when an operand does not fit in the narrow width.
+	OpConstantWide
+	OpJumpNotTruthyWide
+	OpJumpWide
+	OpGetGlobalWide
+	OpSetGlobalWide
+	OpArrayWide
+	OpHashWide
+	OpCallWide
+	OpGetLocalWide
+	OpSetLocalWide
+	OpGetBuiltinWide
+	OpClosureWide
+	OpGetFreeWide
+
+	OpThrow // Throws the value on the top of the stack to the innermost Handler.
+
+	OpYield        // Suspends the generator running the function, and gives the value on the top of the stack to its resumer.
+	OpIter         // Replaces the array or generator on the top of the stack with an iterator for a for-in loop.
+	OpIterNext     // Pushes the next value of the iterator, or pops the iterator and jumps to the operand when it is exhausted.
+	OpIterNextWide // Wide variant of OpIterNext.
+
+	OpSpawn     // Replaces the function and the operand number of arguments on the top of the stack with a task calling it.
+	OpSpawnWide // Wide variant of OpSpawn.
 )
 
 type Definition struct {
@@ -79,6 +104,130 @@ var definitions = map[Opcode]*Definition{
 	OpClosure:        {"OpClosure", []int{2, 1}}, // (index of its function in the constant pool, number of free variables)
 	OpGetFree:        {"OpGetFree", []int{1}},
 	OpCurrentClosure: {"OpCurrentClosure", []int{}},
+
+	OpConstantWide:      {"OpConstantWide", []int{4}},
+	OpJumpNotTruthyWide: {"OpJumpNotTruthyWide", []int{4}},
+	OpJumpWide:          {"OpJumpWide", []int{4}},
+	OpGetGlobalWide:     {"OpGetGlobalWide", []int{4}},
+	OpSetGlobalWide:     {"OpSetGlobalWide", []int{4}},
+	OpArrayWide:         {"OpArrayWide", []int{4}},
+	OpHashWide:          {"OpHashWide", []int{4}},
+	OpCallWide:          {"OpCallWide", []int{2}},
+	OpGetLocalWide:      {"OpGetLocalWide", []int{2}},
+	OpSetLocalWide:      {"OpSetLocalWide", []int{2}},
+	OpGetBuiltinWide:    {"OpGetBuiltinWide", []int{2}},
+	OpClosureWide:       {"OpClosureWide", []int{4, 2}},
+	OpGetFreeWide:       {"OpGetFreeWide", []int{2}},
+
+	OpThrow: {"OpThrow", []int{}},
+
+	OpYield:        {"OpYield", []int{}},
+	OpIter:         {"OpIter", []int{}},
+	OpIterNext:     {"OpIterNext", []int{2}},
+	OpIterNextWide: {"OpIterNextWide", []int{4}},
+
+	OpSpawn:     {"OpSpawn", []int{1}},
+	OpSpawnWide: {"OpSpawnWide", []int{2}},
+}
+
+var wideVariants = map[Opcode]Opcode{
+	OpConstant:      OpConstantWide,
+	OpJumpNotTruthy: OpJumpNotTruthyWide,
+	OpJump:          OpJumpWide,
+	OpGetGlobal:     OpGetGlobalWide,
+	OpSetGlobal:     OpSetGlobalWide,
+	OpArray:         OpArrayWide,
+	OpHash:          OpHashWide,
+	OpCall:          OpCallWide,
+	OpGetLocal:      OpGetLocalWide,
+	OpSetLocal:      OpSetLocalWide,
+	OpGetBuiltin:    OpGetBuiltinWide,
+	OpClosure:       OpClosureWide,
+	OpGetFree:       OpGetFreeWide,
+	OpIterNext:      OpIterNextWide,
+	OpSpawn:         OpSpawnWide,
+}
+
+/*
+An entry of the exception table of a function.
+An exception thrown by the instructions in [Start, End) is handled by the instructions at Target,
+which start with the exception pushed on top of Depth values above the local bindings.
+*/
+type Handler struct {
+	Start  int
+	End    int
+	Target int
+	Depth  int
+}
+
+/*
+Returns the change in the number of values on the stack made by the instruction.
+Instructions which leave the function, such as OpReturnValue, count the values they pop.
+*/
+func StackEffect(op Opcode, operands ...int) int {
+	switch op {
+	case OpConstant, OpConstantWide, OpTrue, OpFalse, OpNull,
+		OpGetGlobal, OpGetGlobalWide, OpGetLocal, OpGetLocalWide,
+		OpGetBuiltin, OpGetBuiltinWide, OpGetFree, OpGetFreeWide, OpCurrentClosure,
+		OpIterNext, OpIterNextWide: // Counted for the loop body. The iterator is popped at the end of the loop.
+		return 1
+	case OpAdd, OpSub, OpMul, OpDiv, OpEqual, OpNotEqual, OpGreaterThan, OpIndex,
+		OpPop, OpJumpNotTruthy, OpJumpNotTruthyWide, OpSetGlobal, OpSetGlobalWide,
+		OpSetLocal, OpSetLocalWide, OpReturnValue, OpThrow, OpYield:
+		return -1
+	case OpArray, OpArrayWide, OpHash, OpHashWide:
+		return 1 - operands[0]
+	case OpCall, OpCallWide, OpSpawn, OpSpawnWide:
+		return -operands[0] // The function and the arguments are replaced by the result, or the task.
+	case OpClosure, OpClosureWide:
+		return 1 - operands[1]
+	}
+	return 0
+}
+
+// Width of the first operand of each opcode. Used by the VM to avoid a map lookup per instruction.
+var firstOperandWidths [256]int
+
+func init() {
+	for op, def := range definitions {
+		if len(def.OperandWidths) > 0 {
+			firstOperandWidths[op] = def.OperandWidths[0]
+		}
+	}
+}
+
+// Returns the wide variant of the given opcode. The second value is false if it has none.
+func Wide(op Opcode) (Opcode, bool) {
+	wide, ok := wideVariants[op]
+	return wide, ok
+}
+
+func FirstOperandWidth(op Opcode) int {
+	return firstOperandWidths[op]
+}
+
+// Returns the largest value which can be encoded in an operand of the given width.
+func MaxOperand(width int) int {
+	return 1<<(8*width) - 1
+}
+
+/*
+Report whether all the operands can be encoded in the widths defined for the opcode.
+*/
+func Fits(op Opcode, operands ...int) bool {
+	def, ok := definitions[op]
+	if !ok {
+		return false
+	}
+	for i, o := range operands {
+		if i >= len(def.OperandWidths) {
+			return false
+		}
+		if o < 0 || MaxOperand(def.OperandWidths[i]) < o {
+			return false
+		}
+	}
+	return true
 }
 
 func Lookup(op byte) (*Definition, error) {
@@ -135,6 +284,8 @@ func (ins Instructions) fmtInstruction(def *Definition, operands []int) string {
 
 /*
 Build byte array (instrcution) from Opcode + Operands
+Panics when an operand does not fit in its width, rather than silently truncating it.
+Callers which cannot guarantee the range should check it with Fits() first.
 */
 func Make(op Opcode, operands ...int) []byte {
 	def, ok := definitions[op]
@@ -153,11 +304,16 @@ func Make(op Opcode, operands ...int) []byte {
 	offset := 1
 	for i, o := range operands {
 		width := def.OperandWidths[i]
+		if o < 0 || MaxOperand(width) < o {
+			panic(fmt.Sprintf("operand %d of %s out of range: %d", i, def.Name, o))
+		}
 		switch width {
 		case 1:
 			instruction[offset] = byte(o)
 		case 2:
 			binary.BigEndian.PutUint16(instruction[offset:], uint16(o))
+		case 4:
+			binary.BigEndian.PutUint32(instruction[offset:], uint32(o))
 		}
 		offset += width
 	}
@@ -175,6 +331,8 @@ func ReadOperands(def *Definition, ins Instructions) ([]int, int) {
 			operands[i] = int(ReadUint8(ins[offset : offset+width]))
 		case 2:
 			operands[i] = int(ReadUint16(ins[offset : offset+width]))
+		case 4:
+			operands[i] = int(ReadUint32(ins[offset : offset+width]))
 		}
 		offset += width
 	}
@@ -189,3 +347,20 @@ func ReadUint8(ins Instructions) uint8 {
 func ReadUint16(ins Instructions) uint16 {
 	return binary.BigEndian.Uint16(ins)
 }
+
+func ReadUint32(ins Instructions) uint32 {
+	return binary.BigEndian.Uint32(ins)
+}
+
+// Read an operand of the given width.
+func ReadOperand(ins Instructions, width int) int {
+	switch width {
+	case 1:
+		return int(ReadUint8(ins))
+	case 2:
+		return int(ReadUint16(ins))
+	case 4:
+		return int(ReadUint32(ins))
+	}
+	return 0
+}
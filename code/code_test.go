@@ -11,6 +11,9 @@ func TestMake(t *testing.T) {
 		{OpConstant, []int{65534}, []byte{byte(OpConstant), 255, 254}},
 		{OpGetLocal, []int{255}, []byte{byte(OpGetLocal), 255}},
 		{OpClosure, []int{65534, 255}, []byte{byte(OpClosure), 255, 254, 255}},
+		{OpConstantWide, []int{65536}, []byte{byte(OpConstantWide), 0, 1, 0, 0}},
+		{OpGetLocalWide, []int{256}, []byte{byte(OpGetLocalWide), 1, 0}},
+		{OpClosureWide, []int{65536, 256}, []byte{byte(OpClosureWide), 0, 1, 0, 0, 1, 0}},
 	}
 
 	for _, tt := range tests {
@@ -74,6 +77,9 @@ func TestReadOperands(t *testing.T) {
 		{OpAdd, []int{}, 0},
 		{OpGetLocal, []int{255}, 1},
 		{OpClosure, []int{65535, 255}, 3},
+		{OpJumpWide, []int{4294967295}, 4},
+		{OpCallWide, []int{65535}, 2},
+		{OpClosureWide, []int{65536, 256}, 6},
 	}
 
 	for _, tt := range tests {
@@ -101,3 +107,60 @@ func TestReadOperands(t *testing.T) {
 		}
 	}
 }
+
+func TestFits(t *testing.T) {
+	tests := []struct {
+		op       Opcode
+		operands []int
+		expected bool
+	}{
+		{OpGetLocal, []int{255}, true},
+		{OpGetLocal, []int{256}, false},
+		{OpGetLocalWide, []int{65535}, true},
+		{OpGetLocalWide, []int{65536}, false},
+		{OpConstant, []int{-1}, false},
+		{OpClosure, []int{65535, 256}, false},
+		{OpAdd, []int{1}, false},
+	}
+
+	for _, tt := range tests {
+		if Fits(tt.op, tt.operands...) != tt.expected {
+			t.Errorf("Fits(%d, %v) wrong. want=%t", tt.op, tt.operands, tt.expected)
+		}
+	}
+}
+
+func TestMakeOutOfRange(t *testing.T) {
+	defer func() {
+		if r := recover(); r == nil {
+			t.Errorf("Make did not panic for an operand out of range.")
+		}
+	}()
+	Make(OpGetLocal, 256)
+}
+
+func TestStackEffect(t *testing.T) {
+	tests := []struct {
+		op       Opcode
+		operands []int
+		expected int
+	}{
+		{OpConstant, []int{0}, 1},
+		{OpAdd, nil, -1},
+		{OpArray, []int{3}, -2},
+		{OpHash, []int{4}, -3},
+		{OpCall, []int{2}, -2},
+		{OpClosure, []int{0, 2}, -1},
+		{OpThrow, nil, -1},
+		{OpYield, nil, -1},
+		{OpIterNext, []int{0}, 1},
+		{OpSpawn, []int{2}, -2},
+		{OpJump, []int{0}, 0},
+	}
+
+	for _, tt := range tests {
+		if effect := StackEffect(tt.op, tt.operands...); effect != tt.expected {
+			t.Errorf("StackEffect(%d, %v) wrong. want=%d, got=%d", tt.op, tt.operands, tt.expected, effect)
+		}
+	}
+}
@@ -1,10 +1,13 @@
 package compiler
 
 import (
+	"errors"
 	"fmt"
 	"monkey/ast"
 	"monkey/code"
 	"monkey/object"
+	"monkey/token"
+	"path/filepath"
 	"sort"
 )
 
@@ -13,12 +16,54 @@ type Compiler struct {
 	symbolTable *SymbolTable
 	scopes      []CompilationScope
 	scopeIndex  int
+
+	functionsDebugInfo map[*object.CompiledFunction]*FunctionDebugInfo
+
+	loader  *Loader
+	file    string   // Path of the compiled file, which imports are relative to. Empty for the current directory.
+	module  string   // Path of the module being compiled. Empty for the program itself.
+	exports []string // Names exported by the top-level statements compiled so far.
 }
 
 type CompilationScope struct {
 	instructions        code.Instructions
 	lastInstruction     EmittedInstruction
 	previousInstruction EmittedInstruction
+
+	line  int         // Source line of the statement being compiled.
+	lines []LineEntry // Source lines of the instructions, recorded for the DebugTable.
+
+	depth    int            // Number of values on the operand stack above the local bindings, after the last instruction.
+	handlers []code.Handler // Exception table of the instructions.
+	tries    []*tryBlock    // Try expressions enclosing the code being compiled, the innermost last.
+
+	// Whether jumps in this scope are emitted as wide opcodes.
+	// Jump targets are unknown when jumps are emitted, so a scope is compiled again with this flag
+	// when a target turns out to be too far for a narrow jump.
+	wideJumps bool
+}
+
+// Upper limits of operands which even the wide opcodes cannot encode.
+var (
+	maxLocals   = code.MaxOperand(2) + 1
+	maxFree     = code.MaxOperand(2) + 1
+	maxBuiltins = code.MaxOperand(2) + 1
+	maxArgs     = code.MaxOperand(2)
+)
+
+var errJumpOutOfRange = errors.New("jump target is out of range of narrow jumps")
+
+// A compilation error with the position of the node which caused it.
+type Error struct {
+	Msg    string
+	Line   int
+	Column int
+}
+
+func (e *Error) Error() string { return e.Msg }
+
+func errorAt(tok token.Token, format string, a ...interface{}) error {
+	return &Error{Msg: fmt.Sprintf(format, a...), Line: tok.Line, Column: tok.Column}
 }
 
 type EmittedInstruction struct {
@@ -44,6 +89,10 @@ func New() *Compiler {
 		symbolTable: symbolTable,
 		scopes:      []CompilationScope{mainScope},
 		scopeIndex:  0,
+
+		functionsDebugInfo: map[*object.CompiledFunction]*FunctionDebugInfo{},
+
+		loader: NewLoader(),
 	}
 }
 
@@ -55,6 +104,15 @@ func NewWithState(s *SymbolTable, constants []object.Object) *Compiler {
 	return compiler
 }
 
+/*
+Import modules with the loader, relative to the file of the compiled program.
+The REPL keeps one loader across its compilers, so that a module is run once however many times it is imported.
+*/
+func (c *Compiler) SetLoader(loader *Loader, file string) {
+	c.loader = loader
+	c.file = file
+}
+
 func (c *Compiler) enterScope() {
 	scope := CompilationScope{
 		instructions:        code.Instructions{},
@@ -78,28 +136,26 @@ func (c *Compiler) leaveScope() code.Instructions {
 func (c *Compiler) Compile(node ast.Node) error {
 	switch node := node.(type) {
 	case *ast.Program:
-		for _, s := range node.Statements {
-			err := c.Compile(s)
-			if err != nil {
-				return err
-			}
-		}
+		return c.compileProgram(node)
 	case *ast.ExpressionStatement:
+		c.setLine(node.Token.Line)
 		err := c.Compile(node.Expression)
 		if err != nil {
 			return err
 		}
 		c.emit(code.OpPop)
 	case *ast.PrefixExpression:
+		err := c.Compile(node.Right)
+		if err != nil {
+			return err
+		}
 		switch node.Operator {
 		case "!":
-			c.Compile(node.Right)
 			c.emit(code.OpBang)
 		case "-":
-			c.Compile(node.Right)
 			c.emit(code.OpMinus)
 		default:
-			return fmt.Errorf("unknown operator %s", node.Operator)
+			return errorAt(node.Token, "unknown operator %s", node.Operator)
 		}
 	case *ast.InfixExpression:
 		if node.Operator == "<" {
@@ -139,7 +195,7 @@ func (c *Compiler) Compile(node ast.Node) error {
 		case "!=":
 			c.emit(code.OpNotEqual)
 		default:
-			return fmt.Errorf("unknown operator %s", node.Operator)
+			return errorAt(node.Token, "unknown operator %s", node.Operator)
 		}
 	case *ast.IntegerLiteral:
 		integer := &object.Integer{Value: node.Value}
@@ -161,61 +217,64 @@ func (c *Compiler) Compile(node ast.Node) error {
 
 		// Use backpatching here.
 		// Emit an `OpJumpNotTruthy` with a bogus value.
-		jumpNotTruthyPos := c.emit(code.OpJumpNotTruthy, 9999)
+		jumpNotTruthyPos := c.emit(c.jumpOpcode(code.OpJumpNotTruthy), 9999)
+		depth := c.scopes[c.scopeIndex].depth
 
-		err = c.Compile(node.Consequence)
+		err = c.compileBlockValue(node.Consequence)
 		if err != nil {
 			return err
 		}
 
-		if c.lastInstructionIs(code.OpPop) {
-			c.removeLastPop()
-		}
-
 		// Use backpatching here.
-		jumpPos := c.emit(code.OpJump, 9999)
+		jumpPos := c.emit(c.jumpOpcode(code.OpJump), 9999)
 
 		afterConsequencePos := len(c.currentInstructions())
-		c.changeOperand(jumpNotTruthyPos, afterConsequencePos)
+		err = c.changeOperand(jumpNotTruthyPos, afterConsequencePos)
+		if err != nil {
+			return err
+		}
 
 		// Does not reach here in vm when condition is evaluated to be true.
+		c.scopes[c.scopeIndex].depth = depth
 		if node.Alternative == nil {
 			c.emit(code.OpNull)
 		} else {
-			err = c.Compile(node.Alternative)
+			err = c.compileBlockValue(node.Alternative)
 			if err != nil {
 				return err
 			}
-			if c.lastInstructionIs(code.OpPop) {
-				c.removeLastPop()
-			}
 		}
+		c.scopes[c.scopeIndex].depth = depth + 1
 		afterAlternativePos := len(c.currentInstructions())
-		c.changeOperand(jumpPos, afterAlternativePos)
+		err = c.changeOperand(jumpPos, afterAlternativePos)
+		if err != nil {
+			return err
+		}
 	case *ast.BlockStatement:
+		// Instructions after the block belong to the line of the enclosing statement again.
+		line := c.scopes[c.scopeIndex].line
 		for _, s := range node.Statements {
 			err := c.Compile(s)
 			if err != nil {
 				return err
 			}
 		}
+		c.setLine(line)
+	case *ast.ImportStatement:
+		return errorAt(node.Token, "import is only allowed at the top level")
 	case *ast.LetStatement:
-		symbol := c.symbolTable.Define(node.Name.Value)
-		err := c.Compile(node.Value)
-		if err != nil {
-			return err
-		}
-		if symbol.Scope == GlobalScope {
-			c.emit(code.OpSetGlobal, symbol.Index)
-		} else {
-			c.emit(code.OpSetLocal, symbol.Index)
+		if node.Exported {
+			return errorAt(node.Token, "export is only allowed at the top level")
 		}
+		return c.compileLetStatement(node)
 	case *ast.Identifier:
 		symbol, ok := c.symbolTable.Resolve(node.Value)
 		if !ok {
-			return fmt.Errorf("undefined variable %s", node.Value)
+			return errorAt(node.Token, "undefined variable %s", node.Value)
+		}
+		if err := c.loadSymbol(symbol); err != nil {
+			return errorAt(node.Token, "%s", err)
 		}
-		c.loadSymbol(symbol)
 	case *ast.ArrayLiteral:
 		for _, el := range node.Elements {
 			err := c.Compile(el)
@@ -256,53 +315,34 @@ func (c *Compiler) Compile(node ast.Node) error {
 		}
 		c.emit(code.OpIndex)
 	case *ast.FunctionLiteral:
-		c.enterScope()
-
-		// Register a name of the called function in the FunctionScope of the symbolTable.
-		if node.Name != "" {
-			c.symbolTable.DefineFunctionName(node.Name)
+		numConstants := len(c.constants)
+		err := c.compileFunctionLiteral(node, false)
+		if err == errJumpOutOfRange {
+			// Drop constants added by the failed attempt, and compile again with wide jumps.
+			c.constants = c.constants[:numConstants]
+			err = c.compileFunctionLiteral(node, true)
 		}
-
-		for _, p := range node.Parameters {
-			// Arguments are already put on the bottom of the stack by the caller before calling this function.
-			// So we just have to reserve the indexes here.
-			c.symbolTable.Define(p.Value)
-		}
-
-		err := c.Compile(node.Body)
 		if err != nil {
 			return err
 		}
-		// when implicit return
-		if c.lastInstructionIs(code.OpPop) {
-			c.replaceLastPopWithReturn()
-		}
-		// when nothing to be returned (neither implicit return nor explicit return)
-		if !c.lastInstructionIs(code.OpReturnValue) {
-			c.emit(code.OpReturn)
-		}
-		freeSymbols := c.symbolTable.FreeSymbols
-		numLocals := c.symbolTable.numDefinitions
-		instructions := c.leaveScope()
-
-		for _, sym := range freeSymbols {
-			c.loadSymbol(sym)
-		}
-
-		compiledFn := &object.CompiledFunction{
-			Instructions:  instructions,
-			NumLocals:     numLocals,
-			NumParameters: len(node.Parameters),
-		}
-		fnIndex := c.addConstant(compiledFn)
-		c.emit(code.OpClosure, fnIndex, len(freeSymbols))
 	case *ast.ReturnStatement:
-		err := c.Compile(node.ReturnValue)
-		if err != nil {
-			return err
-		}
-		c.emit(code.OpReturnValue)
+		return c.compileReturnStatement(node)
+	case *ast.ThrowStatement:
+		return c.compileThrowStatement(node)
+	case *ast.YieldStatement:
+		return c.compileYieldStatement(node)
+	case *ast.ForStatement:
+		return c.compileForStatement(node)
+	case *ast.TryExpression:
+		return c.compileTryExpression(node)
+	case *ast.SpawnExpression:
+		return c.compileSpawnExpression(node)
+	case *ast.MacroLiteral:
+		return errorAt(node.Token, "macros can only be defined by top-level let statements")
 	case *ast.CallExpression:
+		if ident, ok := node.Function.(*ast.Identifier); ok && ident.Value == "quote" {
+			return c.compileQuote(node)
+		}
 		err := c.Compile(node.Function)
 		if err != nil {
 			return err
@@ -314,11 +354,199 @@ func (c *Compiler) Compile(node ast.Node) error {
 				return err
 			}
 		}
+		if len(node.Arguments) > maxArgs {
+			return errorAt(node.Token, "too many arguments in a call: max %d", maxArgs)
+		}
 		c.emit(code.OpCall, len(node.Arguments))
 	}
 	return nil
 }
 
+func (c *Compiler) compileProgram(program *ast.Program) error {
+	numConstants := len(c.constants)
+	numExports := len(c.exports)
+	symbols := c.symbolTable.snapshot()
+	modules := len(c.loader.order)
+	if c.module == "" && c.file != "" {
+		// A module which imports the program itself is a cycle too.
+		c.loader.loading = append(c.loader.loading, filepath.Clean(c.file))
+		defer func() { c.loader.loading = c.loader.loading[:len(c.loader.loading)-1] }()
+	}
+
+	err := c.compileTopLevel(program.Statements)
+	if err == errJumpOutOfRange && !c.scopes[c.scopeIndex].wideJumps {
+		// Roll back everything done by the failed attempt, and compile again with wide jumps.
+		c.constants = c.constants[:numConstants]
+		c.exports = c.exports[:numExports]
+		c.symbolTable.restore(symbols)
+		c.loader.release(modules)
+		c.scopes[c.scopeIndex] = CompilationScope{
+			instructions: code.Instructions{},
+			wideJumps:    true,
+		}
+		err = c.compileTopLevel(program.Statements)
+	}
+	if err != nil {
+		// The modules compiled by the failed compilation are never run.
+		c.loader.release(modules)
+	}
+	return err
+}
+
+// Compile the statements of a program, which unlike those of blocks can import and export.
+func (c *Compiler) compileTopLevel(statements []ast.Statement) error {
+	for _, s := range statements {
+		var err error
+		switch s := s.(type) {
+		case *ast.ImportStatement:
+			err = c.compileImport(s)
+		case *ast.LetStatement:
+			err = c.compileLetStatement(s)
+			if s.Exported {
+				c.exports = append(c.exports, s.Name.Value)
+			}
+		default:
+			err = c.Compile(s)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Compiler) compileLetStatement(node *ast.LetStatement) error {
+	c.setLine(node.Token.Line)
+	symbol := c.symbolTable.Define(node.Name.Value)
+	err := c.Compile(node.Value)
+	if err != nil {
+		return err
+	}
+	return c.storeSymbol(symbol, node.Name.Token)
+}
+
+// Pop the value on the stack into the binding of the symbol, which is defined at tok.
+func (c *Compiler) storeSymbol(symbol Symbol, tok token.Token) error {
+	if symbol.Scope == GlobalScope {
+		c.emit(code.OpSetGlobal, symbol.Index)
+	} else {
+		if symbol.Index >= maxLocals {
+			return errorAt(tok, "too many local bindings in a function: max %d", maxLocals)
+		}
+		c.emit(code.OpSetLocal, symbol.Index)
+	}
+	return nil
+}
+
+/*
+A quote is a constant, because the compiler cannot evaluate the arguments of unquote() at compile time.
+Macros, which are expanded before compilation, can use unquote().
+*/
+func (c *Compiler) compileQuote(call *ast.CallExpression) error {
+	if len(call.Arguments) != 1 {
+		return errorAt(call.Token, "wrong number of arguments to quote. got=%d, want=1", len(call.Arguments))
+	}
+
+	var unquote *ast.CallExpression
+	ast.Inspect(call.Arguments[0], func(node ast.Node) bool {
+		if ce, ok := node.(*ast.CallExpression); ok && unquote == nil {
+			if ident, ok := ce.Function.(*ast.Identifier); ok && ident.Value == "unquote" {
+				unquote = ce
+			}
+		}
+		return unquote == nil
+	})
+	if unquote != nil {
+		return errorAt(ast.StartToken(unquote), "unquote is only supported in macros and by the evaluator")
+	}
+
+	quote := &object.Quote{Node: ast.Copy(call.Arguments[0])}
+	c.emit(code.OpConstant, c.addConstant(quote))
+	return nil
+}
+
+func (c *Compiler) compileFunctionLiteral(node *ast.FunctionLiteral, wideJumps bool) error {
+	c.enterScope()
+	c.scopes[c.scopeIndex].wideJumps = wideJumps
+
+	// Register a name of the called function in the FunctionScope of the symbolTable.
+	if node.Name != "" {
+		c.symbolTable.DefineFunctionName(node.Name)
+	}
+
+	for _, p := range node.Parameters {
+		// Arguments are already put on the bottom of the stack by the caller before calling this function.
+		// So we just have to reserve the indexes here.
+		c.symbolTable.Define(p.Value)
+	}
+	if len(node.Parameters) > maxLocals {
+		c.leaveScope()
+		return errorAt(node.Token, "too many parameters in a function: max %d", maxLocals)
+	}
+
+	err := c.Compile(node.Body)
+	if err != nil {
+		c.leaveScope()
+		return err
+	}
+	// when implicit return
+	if c.lastInstructionIs(code.OpPop) {
+		c.replaceLastPopWithReturn()
+	}
+	// when nothing to be returned (neither implicit return nor explicit return)
+	if !c.lastInstructionIs(code.OpReturnValue) {
+		c.emit(code.OpReturn)
+	}
+	freeSymbols := c.symbolTable.FreeSymbols
+	numLocals := c.symbolTable.numDefinitions
+	debugInfo := &FunctionDebugInfo{
+		Name:   node.Name,
+		Locals: c.symbolTable.definitionNames(),
+		Free:   symbolNames(freeSymbols),
+		Lines:  c.scopes[c.scopeIndex].lines,
+		File:   c.module,
+	}
+	handlers := c.scopes[c.scopeIndex].handlers
+	instructions := c.leaveScope()
+
+	if len(freeSymbols) > maxFree {
+		return errorAt(node.Token, "too many free variables in a function: max %d", maxFree)
+	}
+	for _, sym := range freeSymbols {
+		err := c.loadSymbol(sym)
+		if err != nil {
+			return errorAt(node.Token, "%s", err)
+		}
+	}
+
+	compiledFn := &object.CompiledFunction{
+		Instructions:  instructions,
+		NumLocals:     numLocals,
+		NumParameters: len(node.Parameters),
+		Name:          node.Name,
+		Handlers:      handlers,
+		Generator:     node.Generator,
+	}
+	c.functionsDebugInfo[compiledFn] = debugInfo
+	fnIndex := c.addConstant(compiledFn)
+	c.emit(code.OpClosure, fnIndex, len(freeSymbols))
+	return nil
+}
+
+// Set the source line of the instructions emitted from now on in the current scope.
+func (c *Compiler) setLine(line int) {
+	c.scopes[c.scopeIndex].line = line
+}
+
+// Returns the given jump opcode, or its wide variant if the current scope needs wide jumps.
+func (c *Compiler) jumpOpcode(op code.Opcode) code.Opcode {
+	if c.scopes[c.scopeIndex].wideJumps {
+		wide, _ := code.Wide(op)
+		return wide
+	}
+	return op
+}
+
 func (c *Compiler) currentInstructions() code.Instructions {
 	return c.scopes[c.scopeIndex].instructions
 }
@@ -330,11 +558,18 @@ func (c *Compiler) addConstant(obj object.Object) int {
 
 /*
 Add instruction built from args to Compiler's instructions.
+The wide variant of the opcode is used instead when an operand does not fit in the narrow one.
 Returns an index of the newly added opcode.
 */
 func (c *Compiler) emit(op code.Opcode, operands ...int) int {
+	if !code.Fits(op, operands...) {
+		if wide, ok := code.Wide(op); ok {
+			op = wide
+		}
+	}
 	ins := code.Make(op, operands...)
 	pos := c.addInstruction(ins)
+	c.scopes[c.scopeIndex].depth += code.StackEffect(op, operands...)
 
 	c.setLastInstruction(op, pos)
 	return pos
@@ -349,9 +584,29 @@ func (c *Compiler) addInstruction(ins []byte) int {
 	updatedInstructions := append(c.currentInstructions(), ins...)
 
 	c.scopes[c.scopeIndex].instructions = updatedInstructions
+	c.recordLine(posNewInstruction)
 	return posNewInstruction
 }
 
+func (c *Compiler) recordLine(pos int) {
+	scope := &c.scopes[c.scopeIndex]
+	if scope.line == 0 {
+		return
+	}
+	if n := len(scope.lines); n > 0 && scope.lines[n-1].Line == scope.line {
+		return
+	}
+	scope.lines = append(scope.lines, LineEntry{Offset: pos, Line: scope.line})
+}
+
+// Drop line entries of instructions which have been removed.
+func (c *Compiler) truncateLines(length int) {
+	scope := &c.scopes[c.scopeIndex]
+	for len(scope.lines) > 0 && scope.lines[len(scope.lines)-1].Offset >= length {
+		scope.lines = scope.lines[:len(scope.lines)-1]
+	}
+}
+
 func (c *Compiler) setLastInstruction(op code.Opcode, pos int) {
 	previous := c.scopes[c.scopeIndex].lastInstruction
 	last := EmittedInstruction{Opcode: op, Position: pos}
@@ -378,13 +633,20 @@ func (c *Compiler) removeLastPop() {
 
 	c.scopes[c.scopeIndex].instructions = new
 	c.scopes[c.scopeIndex].lastInstruction = previous
+	c.scopes[c.scopeIndex].depth++
+	c.truncateLines(len(new))
 }
 
-func (c *Compiler) changeOperand(opPos int, operand int) {
+func (c *Compiler) changeOperand(opPos int, operand int) error {
 	op := code.Opcode(c.currentInstructions()[opPos])
+	if !code.Fits(op, operand) {
+		// The width of the instruction cannot be changed here without breaking the positions after it.
+		return errJumpOutOfRange
+	}
 	newInstruction := code.Make(op, operand)
 
 	c.replaceInstruction(opPos, newInstruction)
+	return nil
 }
 
 func (c *Compiler) replaceInstruction(pos int, newInstruction []byte) {
@@ -401,29 +663,47 @@ func (c *Compiler) replaceLastPopWithReturn() {
 	c.scopes[c.scopeIndex].lastInstruction.Opcode = code.OpReturnValue
 }
 
-func (c *Compiler) loadSymbol(symbol Symbol) {
+func (c *Compiler) loadSymbol(symbol Symbol) error {
 	switch symbol.Scope {
 	case GlobalScope:
 		c.emit(code.OpGetGlobal, symbol.Index)
 	case LocalScope:
+		if symbol.Index >= maxLocals {
+			return fmt.Errorf("too many local bindings in a function: max %d", maxLocals)
+		}
 		c.emit(code.OpGetLocal, symbol.Index)
 	case BuiltinScope:
+		if symbol.Index >= maxBuiltins {
+			return fmt.Errorf("too many builtins: max %d", maxBuiltins)
+		}
 		c.emit(code.OpGetBuiltin, symbol.Index)
 	case FreeScope:
+		if symbol.Index >= maxFree {
+			return fmt.Errorf("too many free variables in a function: max %d", maxFree)
+		}
 		c.emit(code.OpGetFree, symbol.Index)
 	case FunctionScope:
 		c.emit(code.OpCurrentClosure)
 	}
+	return nil
 }
 
 type Bytecode struct {
 	Instructions code.Instructions
+	Handlers     []code.Handler // Exception table of the instructions.
 	Constants    []object.Object
+	Debug        *DebugTable
 }
 
 func (c *Compiler) ByteCode() *Bytecode {
 	return &Bytecode{
 		Instructions: c.currentInstructions(),
+		Handlers:     c.scopes[c.scopeIndex].handlers,
 		Constants:    c.constants,
+		Debug: &DebugTable{
+			Main:      &FunctionDebugInfo{Lines: c.scopes[c.scopeIndex].lines},
+			Functions: c.functionsDebugInfo,
+			Globals:   c.symbolTable.definitionNames(),
+		},
 	}
 }
@@ -7,6 +7,8 @@ import (
 	"monkey/lexer"
 	"monkey/object"
 	"monkey/parser"
+	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -1054,6 +1056,348 @@ func TestClosures(t *testing.T) {
 	runCompilerTest(t, tests)
 }
 
+func TestWideOperands(t *testing.T) {
+	manyParams := []string{}
+	manyArgs := []string{}
+	for i := 0; i < 300; i++ {
+		manyParams = append(manyParams, "p"+identifierSuffix(i))
+		manyArgs = append(manyArgs, "1")
+	}
+
+	tests := []struct {
+		input    string
+		expected []code.Opcode // Opcodes expected somewhere in the main or function instructions.
+	}{
+		{
+			input: fmt.Sprintf(
+				"let f = fn(%s) { pln }; f(%s);",
+				strings.Join(manyParams, ", "), strings.Join(manyArgs, ", "),
+			),
+			expected: []code.Opcode{code.OpGetLocalWide, code.OpCallWide},
+		},
+		{
+			input:    strings.Repeat("1; ", 70000),
+			expected: []code.Opcode{code.OpConstantWide},
+		},
+		{
+			input:    "if (true) { " + strings.Repeat("1; ", 20000) + "}",
+			expected: []code.Opcode{code.OpJumpNotTruthyWide, code.OpJumpWide},
+		},
+		{
+			input:    "fn() { if (true) { " + strings.Repeat("1; ", 20000) + "} }",
+			expected: []code.Opcode{code.OpJumpNotTruthyWide, code.OpJumpWide},
+		},
+	}
+
+	for _, tt := range tests {
+		compiler := New()
+		err := compiler.Compile(parse(tt.input))
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+		bytecode := compiler.ByteCode()
+
+		found := map[code.Opcode]bool{}
+		collectOpcodes(bytecode.Instructions, found)
+		for _, c := range bytecode.Constants {
+			if fn, ok := c.(*object.CompiledFunction); ok {
+				collectOpcodes(fn.Instructions, found)
+			}
+		}
+
+		for _, op := range tt.expected {
+			if !found[op] {
+				def, _ := code.Lookup(byte(op))
+				t.Errorf("%s is not emitted.", def.Name)
+			}
+		}
+	}
+}
+
+func TestOperandLimits(t *testing.T) {
+	manyArgs := strings.Repeat("1, ", 65536)
+
+	tests := []struct {
+		input         string
+		expectedError string
+	}{
+		{
+			input:         "let f = fn() { 1 }; f(" + manyArgs + "1);",
+			expectedError: "too many arguments in a call: max 65535",
+		},
+	}
+
+	for _, tt := range tests {
+		compiler := New()
+		err := compiler.Compile(parse(tt.input))
+		if err == nil {
+			t.Fatalf("expected compiler error but resulted in none.")
+		}
+		if err.Error() != tt.expectedError {
+			t.Fatalf("wrong compiler error: want=%q, got=%q", tt.expectedError, err)
+		}
+	}
+}
+
+func TestQuote(t *testing.T) {
+	comp := New()
+	if err := comp.Compile(parse("quote(a + b)")); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	bytecode := comp.ByteCode()
+
+	err := testInstructions([]code.Instructions{code.Make(code.OpConstant, 0), code.Make(code.OpPop)}, bytecode.Instructions)
+	if err != nil {
+		t.Fatalf("testInstructions failed: %s", err)
+	}
+	quote, ok := bytecode.Constants[0].(*object.Quote)
+	if !ok {
+		t.Fatalf("constant is not *object.Quote. got=%T", bytecode.Constants[0])
+	}
+	if quote.Node.String() != "(a + b)" {
+		t.Errorf("wrong quoted node. want=%q, got=%q", "(a + b)", quote.Node.String())
+	}
+}
+
+func TestTryExpressions(t *testing.T) {
+	comp := New()
+	if err := comp.Compile(parse("try { 1 } catch (e) { e }")); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	bytecode := comp.ByteCode()
+
+	err := testInstructions([]code.Instructions{
+		code.Make(code.OpConstant, 0),
+		code.Make(code.OpJump, 12),
+		code.Make(code.OpSetGlobal, 0), // 0006: the handler
+		code.Make(code.OpGetGlobal, 0),
+		code.Make(code.OpPop), // 0012
+	}, bytecode.Instructions)
+	if err != nil {
+		t.Fatalf("testInstructions failed: %s", err)
+	}
+	expected := []code.Handler{{Start: 0, End: 3, Target: 6, Depth: 0}}
+	if !reflect.DeepEqual(bytecode.Handlers, expected) {
+		t.Errorf("wrong handlers. want=%+v, got=%+v", expected, bytecode.Handlers)
+	}
+
+	// The finally block is copied in front of the return, outside of the range of the handler.
+	comp = New()
+	if err := comp.Compile(parse("fn() { 1 + try { return 2 } finally { 3 } }")); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	fn := comp.ByteCode().Constants[5].(*object.CompiledFunction)
+	err = testInstructions([]code.Instructions{
+		code.Make(code.OpConstant, 0),
+		code.Make(code.OpConstant, 1),
+		code.Make(code.OpConstant, 2), // 0006: the finally block run by the return
+		code.Make(code.OpPop),
+		code.Make(code.OpReturnValue),
+		code.Make(code.OpConstant, 3), // 0011: the finally block run at the end of the try
+		code.Make(code.OpPop),
+		code.Make(code.OpJump, 23),
+		code.Make(code.OpConstant, 4), // 0018: the handler, which rethrows after the finally block
+		code.Make(code.OpPop),
+		code.Make(code.OpThrow),
+		code.Make(code.OpAdd), // 0023
+		code.Make(code.OpReturnValue),
+	}, fn.Instructions)
+	if err != nil {
+		t.Fatalf("testInstructions failed: %s", err)
+	}
+	expected = []code.Handler{{Start: 3, End: 6, Target: 18, Depth: 1}, {Start: 10, End: 11, Target: 18, Depth: 1}}
+	if !reflect.DeepEqual(fn.Handlers, expected) {
+		t.Errorf("wrong handlers. want=%+v, got=%+v", expected, fn.Handlers)
+	}
+}
+
+func TestForStatements(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:             `for (x in [1, 2]) { x; }`,
+			expectedConstants: []interface{}{1, 2},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpArray, 2),
+				code.Make(code.OpIter),
+				code.Make(code.OpIterNext, 23), // 0010
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpPop),
+				code.Make(code.OpJump, 10),
+			},
+		},
+		{
+			input: `fn(xs) { for (x in xs) { yield x; } }`,
+			expectedConstants: []interface{}{
+				[]code.Instructions{
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpIter),
+					code.Make(code.OpIterNext, 14), // 0003
+					code.Make(code.OpSetLocal, 1),
+					code.Make(code.OpGetLocal, 1),
+					code.Make(code.OpYield),
+					code.Make(code.OpJump, 3),
+					code.Make(code.OpReturn), // 0014
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 0, 0),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTest(t, tests)
+
+	comp := New()
+	if err := comp.Compile(parse("fn() { yield 1; }; fn() { 1 }")); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	constants := comp.ByteCode().Constants
+	if !constants[1].(*object.CompiledFunction).Generator || constants[3].(*object.CompiledFunction).Generator {
+		t.Errorf("wrong Generator flags of the functions")
+	}
+}
+
+func TestSpawnExpressions(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input: `let f = fn(a) { a }; spawn f(1);`,
+			expectedConstants: []interface{}{
+				[]code.Instructions{
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpReturnValue),
+				},
+				1,
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 0, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpSpawn, 1),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: `spawn fn() { 1 }`,
+			expectedConstants: []interface{}{
+				1,
+				[]code.Instructions{
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 1, 0),
+				code.Make(code.OpSpawn, 0),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTest(t, tests)
+}
+
+func TestErrorPositions(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected Error
+	}{
+		{"let x = 1;\nx + y", Error{Msg: "undefined variable y", Line: 2, Column: 5}},
+		{"let f = fn() {\n  let a = 1;\n  fn() { a + b }\n};", Error{Msg: "undefined variable b", Line: 3, Column: 14}},
+		{"let f = fn() { macro(x) { x } };", Error{Msg: "macros can only be defined by top-level let statements", Line: 1, Column: 16}},
+		{"quote(1 +\n unquote(2))", Error{Msg: "unquote is only supported in macros and by the evaluator", Line: 2, Column: 2}},
+	}
+
+	for _, tt := range tests {
+		err := New().Compile(parse(tt.input))
+		compileErr, ok := err.(*Error)
+		if !ok {
+			t.Fatalf("expected *Error, got=%T (%v)", err, err)
+		}
+		if *compileErr != tt.expected {
+			t.Errorf("wrong error. want=%+v, got=%+v", tt.expected, *compileErr)
+		}
+	}
+}
+
+func TestDebugTable(t *testing.T) {
+	input := `let x = 1;
+let f = fn(a) {
+	let b = a + x;
+	fn() { b }
+};
+f(2)`
+
+	compiler := New()
+	err := compiler.Compile(parse(input))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	bytecode := compiler.ByteCode()
+	debug := bytecode.Debug
+
+	if strings.Join(debug.Globals, ",") != "x,f" {
+		t.Errorf("wrong globals. got=%v", debug.Globals)
+	}
+
+	// 0000 OpConstant, 0003 OpSetGlobal (line 1), 0006 OpClosure, 0010 OpSetGlobal (line 2), 0013 OpGetGlobal ... (line 6)
+	expectedMainLines := []LineEntry{{Offset: 0, Line: 1}, {Offset: 6, Line: 2}, {Offset: 13, Line: 6}}
+	if fmt.Sprint(debug.Main.Lines) != fmt.Sprint(expectedMainLines) {
+		t.Errorf("wrong lines of main. want=%v, got=%v", expectedMainLines, debug.Main.Lines)
+	}
+	if debug.Main.LineAt(12) != 2 || !debug.Main.IsLineStart(13) || debug.Main.IsLineStart(14) {
+		t.Errorf("wrong line lookup of main.")
+	}
+
+	var outer, inner *FunctionDebugInfo
+	for _, c := range bytecode.Constants {
+		fn, ok := c.(*object.CompiledFunction)
+		if !ok {
+			continue
+		}
+		info := debug.Function(fn)
+		if info == nil {
+			t.Fatalf("no debug information for function %p", fn)
+		}
+		if info.Name == "f" {
+			outer = info
+		} else {
+			inner = info
+		}
+	}
+
+	if outer == nil || strings.Join(outer.Locals, ",") != "a,b" || len(outer.Free) != 0 {
+		t.Fatalf("wrong debug information of f. got=%+v", outer)
+	}
+	if outer.LineAt(0) != 3 || outer.OffsetOf(4) == -1 {
+		t.Errorf("wrong lines of f. got=%v", outer.Lines)
+	}
+	if inner == nil || len(inner.Locals) != 0 || strings.Join(inner.Free, ",") != "b" {
+		t.Fatalf("wrong debug information of the inner function. got=%+v", inner)
+	}
+}
+
+// Identifiers cannot contain digits, so index them with letters. e.g. 0 -> "aa", 27 -> "bb"
+func identifierSuffix(i int) string {
+	return string(rune('a'+i/26)) + string(rune('a'+i%26))
+}
+
+func collectOpcodes(ins code.Instructions, found map[code.Opcode]bool) {
+	for i := 0; i < len(ins); {
+		def, err := code.Lookup(ins[i])
+		if err != nil {
+			return
+		}
+		found[code.Opcode(ins[i])] = true
+		_, read := code.ReadOperands(def, ins[i+1:])
+		i += 1 + read
+	}
+}
+
 func runCompilerTest(t *testing.T, tests []compilerTestCase) {
 	t.Helper()
 
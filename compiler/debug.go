@@ -0,0 +1,75 @@
+package compiler
+
+import (
+	"monkey/object"
+	"sort"
+)
+
+/*
+Debug information emitted along with the bytecode.
+The VM does not need it to run, but debuggers and error messages do, since the SymbolTable is discarded after compilation.
+*/
+type DebugTable struct {
+	Main      *FunctionDebugInfo
+	Functions map[*object.CompiledFunction]*FunctionDebugInfo
+	Globals   []string // Names of global bindings, indexed by the operands of OpGetGlobal/OpSetGlobal.
+}
+
+type FunctionDebugInfo struct {
+	Name   string      // Empty for anonymous functions.
+	Locals []string    // Indexed by the operands of OpGetLocal/OpSetLocal. Parameters come first.
+	Free   []string    // Indexed by the operands of OpGetFree.
+	Lines  []LineEntry // Sorted by Offset.
+	File   string      // Path of the module which defines the function. Empty for the program itself.
+}
+
+// Instructions from Offset up to the Offset of the next entry are compiled from the source line Line.
+type LineEntry struct {
+	Offset int
+	Line   int
+}
+
+// Returns the debug information of the function, or Main if fn is nil. Returns nil if nothing is known.
+func (t *DebugTable) Function(fn *object.CompiledFunction) *FunctionDebugInfo {
+	if t == nil {
+		return nil
+	}
+	if fn == nil {
+		return t.Main
+	}
+	return t.Functions[fn]
+}
+
+// Returns the source line of the instruction at the offset, or 0 if unknown.
+func (f *FunctionDebugInfo) LineAt(offset int) int {
+	if f == nil {
+		return 0
+	}
+	i := sort.Search(len(f.Lines), func(i int) bool { return f.Lines[i].Offset > offset })
+	if i == 0 {
+		return 0
+	}
+	return f.Lines[i-1].Line
+}
+
+// Reports whether the instruction at the offset is the first one compiled from a source line.
+func (f *FunctionDebugInfo) IsLineStart(offset int) bool {
+	if f == nil {
+		return false
+	}
+	i := sort.Search(len(f.Lines), func(i int) bool { return f.Lines[i].Offset >= offset })
+	return i < len(f.Lines) && f.Lines[i].Offset == offset
+}
+
+// Returns the offset of the first instruction compiled from the line, or -1.
+func (f *FunctionDebugInfo) OffsetOf(line int) int {
+	if f == nil {
+		return -1
+	}
+	for _, entry := range f.Lines {
+		if entry.Line == line {
+			return entry.Offset
+		}
+	}
+	return -1
+}
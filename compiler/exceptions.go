@@ -0,0 +1,203 @@
+package compiler
+
+import (
+	"monkey/ast"
+	"monkey/code"
+)
+
+// A try expression being compiled, whose finally block is run by the return statements in it.
+type tryBlock struct {
+	finally *ast.BlockStatement // nil without a finally block.
+
+	// Ranges of the finally blocks copied in front of return statements.
+	// Those instructions run after leaving the try, so its handlers must not cover them.
+	holes [][2]int
+}
+
+/*
+Compile the try expression. The instructions are laid out as:
+
+	body                     covered by the catch handler and the finally handler
+	finally, jump to end
+	catch: bind, catch body  covered by the finally handler
+	finally, jump to end     only with a finally block
+	finally: finally, throw  rethrows the exception after running the finally block
+	end:
+
+The handlers restore the stack to the depth at the start of the try, so the try can be a part of any expression.
+*/
+func (c *Compiler) compileTryExpression(node *ast.TryExpression) error {
+	scope := &c.scopes[c.scopeIndex]
+	depth := scope.depth
+	try := &tryBlock{finally: node.Finally}
+
+	start := len(c.currentInstructions())
+	scope.tries = append(scope.tries, try)
+	err := c.compileBlockValue(node.Body)
+	scope = &c.scopes[c.scopeIndex]
+	scope.tries = scope.tries[:len(scope.tries)-1]
+	if err != nil {
+		return err
+	}
+	scope.depth = depth + 1
+	bodyEnd := len(c.currentInstructions())
+
+	jumps := []int{}
+	if err := c.compileFinally(node.Finally); err != nil {
+		return err
+	}
+	jumps = append(jumps, c.emit(c.jumpOpcode(code.OpJump), 9999))
+
+	handlers := []code.Handler{}
+	protected := [][2]int{{start, bodyEnd}}
+	if node.Catch != nil {
+		catchTarget := len(c.currentInstructions())
+		handlers = append(handlers, try.handlers(protected, catchTarget, depth)...)
+
+		c.scopes[c.scopeIndex].depth = depth + 1 // The exception pushed by the VM.
+		symbol := c.symbolTable.Define(node.CatchParameter.Value)
+		if err := c.storeSymbol(symbol, node.CatchParameter.Token); err != nil {
+			return err
+		}
+
+		scope := &c.scopes[c.scopeIndex]
+		scope.tries = append(scope.tries, try)
+		err := c.compileBlockValue(node.Catch)
+		scope = &c.scopes[c.scopeIndex]
+		scope.tries = scope.tries[:len(scope.tries)-1]
+		if err != nil {
+			return err
+		}
+		scope.depth = depth + 1
+		protected = append(protected, [2]int{catchTarget, len(c.currentInstructions())})
+
+		if node.Finally != nil {
+			if err := c.compileFinally(node.Finally); err != nil {
+				return err
+			}
+			jumps = append(jumps, c.emit(c.jumpOpcode(code.OpJump), 9999))
+		}
+	}
+
+	if node.Finally != nil {
+		finallyTarget := len(c.currentInstructions())
+		handlers = append(handlers, try.handlers(protected, finallyTarget, depth)...)
+
+		c.scopes[c.scopeIndex].depth = depth + 1
+		if err := c.compileFinally(node.Finally); err != nil {
+			return err
+		}
+		c.emit(code.OpThrow)
+	}
+
+	end := len(c.currentInstructions())
+	for _, pos := range jumps {
+		if err := c.changeOperand(pos, end); err != nil {
+			return err
+		}
+	}
+	scope = &c.scopes[c.scopeIndex]
+	scope.depth = depth + 1
+	// Handlers of the tries nested in this one are already added, and take precedence.
+	scope.handlers = append(scope.handlers, handlers...)
+	return nil
+}
+
+// Returns the handlers covering the ranges except for the holes of the try.
+func (t *tryBlock) handlers(ranges [][2]int, target, depth int) []code.Handler {
+	handlers := []code.Handler{}
+	for _, r := range ranges {
+		start := r[0]
+		for _, hole := range t.holes {
+			if hole[0] < start || hole[0] >= r[1] {
+				continue
+			}
+			if start < hole[0] {
+				handlers = append(handlers, code.Handler{Start: start, End: hole[0], Target: target, Depth: depth})
+			}
+			start = hole[1]
+		}
+		if start < r[1] {
+			handlers = append(handlers, code.Handler{Start: start, End: r[1], Target: target, Depth: depth})
+		}
+	}
+	return handlers
+}
+
+// Compile the finally block, if any, as statements whose values are discarded.
+func (c *Compiler) compileFinally(block *ast.BlockStatement) error {
+	if block == nil {
+		return nil
+	}
+	return c.Compile(block)
+}
+
+/*
+Compile the return statement. The finally blocks of the enclosing tries in the function
+are run before returning, from the innermost one out, with the return value kept on the stack.
+*/
+func (c *Compiler) compileReturnStatement(node *ast.ReturnStatement) error {
+	c.setLine(node.Token.Line)
+	err := c.Compile(node.ReturnValue)
+	if err != nil {
+		return err
+	}
+
+	tries := c.scopes[c.scopeIndex].tries
+	for i := len(tries) - 1; i >= 0; i-- {
+		if tries[i].finally == nil {
+			continue
+		}
+		// A return in the finally block itself only runs the finally blocks of the outer tries.
+		c.scopes[c.scopeIndex].tries = tries[:i]
+		start := len(c.currentInstructions())
+		err := c.compileFinally(tries[i].finally)
+		c.scopes[c.scopeIndex].tries = tries
+		if err != nil {
+			return err
+		}
+		c.setLine(node.Token.Line)
+
+		hole := [2]int{start, len(c.currentInstructions())}
+		for _, t := range tries[i:] {
+			t.holes = append(t.holes, hole)
+		}
+	}
+
+	c.emit(code.OpReturnValue)
+	return nil
+}
+
+func (c *Compiler) compileThrowStatement(node *ast.ThrowStatement) error {
+	c.setLine(node.Token.Line)
+	err := c.Compile(node.Value)
+	if err != nil {
+		return err
+	}
+	c.emit(code.OpThrow)
+	return nil
+}
+
+/*
+Compile the block as an expression, which leaves the value of its last expression statement on the stack,
+or null when the block does not end with one.
+*/
+func (c *Compiler) compileBlockValue(block *ast.BlockStatement) error {
+	start := len(c.currentInstructions())
+	err := c.Compile(block)
+	if err != nil {
+		return err
+	}
+
+	emitted := len(c.currentInstructions()) > start
+	last := c.scopes[c.scopeIndex].lastInstruction
+	switch {
+	case emitted && last.Opcode == code.OpPop:
+		c.removeLastPop()
+	case emitted && (last.Opcode == code.OpReturnValue || last.Opcode == code.OpThrow):
+		// The value is never used.
+	default:
+		c.emit(code.OpNull)
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package compiler
+
+import (
+	"monkey/ast"
+	"monkey/code"
+)
+
+func (c *Compiler) compileYieldStatement(node *ast.YieldStatement) error {
+	c.setLine(node.Token.Line)
+	err := c.Compile(node.Value)
+	if err != nil {
+		return err
+	}
+	c.emit(code.OpYield)
+	return nil
+}
+
+/*
+Compile the for-in loop. The instructions are laid out as:
+
+	iterable, OpIter
+	loop: OpIterNext end     pushes the next value, or pops the iterator and jumps to end
+	bind, body
+	jump to loop
+	end:
+
+The iterator stays on the stack while the body runs, so the body is compiled one value deeper.
+*/
+func (c *Compiler) compileForStatement(node *ast.ForStatement) error {
+	c.setLine(node.Token.Line)
+	err := c.Compile(node.Iterable)
+	if err != nil {
+		return err
+	}
+	c.emit(code.OpIter)
+	depth := c.scopes[c.scopeIndex].depth
+
+	loop := len(c.currentInstructions())
+	iterNextPos := c.emit(c.jumpOpcode(code.OpIterNext), 9999)
+
+	symbol := c.symbolTable.Define(node.Variable.Value)
+	if err := c.storeSymbol(symbol, node.Variable.Token); err != nil {
+		return err
+	}
+	if err := c.Compile(node.Body); err != nil {
+		return err
+	}
+	c.setLine(node.Token.Line)
+	c.emit(c.jumpOpcode(code.OpJump), loop)
+
+	if err := c.changeOperand(iterNextPos, len(c.currentInstructions())); err != nil {
+		return err
+	}
+	c.scopes[c.scopeIndex].depth = depth - 1
+	return nil
+}
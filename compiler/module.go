@@ -0,0 +1,200 @@
+package compiler
+
+import (
+	"context"
+	"io/ioutil"
+	"monkey/ast"
+	"monkey/budget"
+	"monkey/code"
+	"monkey/evaluator"
+	"monkey/lexer"
+	"monkey/object"
+	"monkey/parser"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Appended to import paths without an extension.
+const ModuleExtension = ".mk"
+
+/*
+A Loader reads the modules imported by a program and keeps them once they are compiled,
+so that a module imported by several files is compiled and run only once.
+A Loader belongs to the constants and the globals of one program, such as the ones kept by the REPL.
+*/
+type Loader struct {
+	ReadFile func(path string) ([]byte, error) // ioutil.ReadFile by default.
+
+	// Given to the macros of the modules, which are expanded in each module apart, as those of the importer are.
+	// Set by Compiler.ExpandMacros(). The zero value runs them as evaluator.ExpandMacros() does.
+	MacroLimits evaluator.Limits
+
+	modules map[string]*module // Keyed by resolved paths.
+	order   []string           // Paths of the modules in the order they were compiled.
+	loading []string           // Paths of the modules being compiled. The innermost import comes last.
+}
+
+// A compiled module.
+type module struct {
+	exports map[string]Symbol // Globals of the module, exported by `export let`.
+}
+
+func NewLoader() *Loader {
+	return &Loader{ReadFile: ioutil.ReadFile, modules: map[string]*module{}}
+}
+
+/*
+Returns the path of the module imported as importPath by the file from.
+A relative path is relative to the directory of the file, or to the current directory if from is empty.
+*/
+func (l *Loader) Resolve(from, importPath string) string {
+	if filepath.Ext(importPath) == "" {
+		importPath += ModuleExtension
+	}
+	if filepath.IsAbs(importPath) {
+		return filepath.Clean(importPath)
+	}
+	dir := "."
+	if from != "" {
+		dir = filepath.Dir(from)
+	}
+	return filepath.Join(dir, importPath)
+}
+
+// Forget the modules compiled after mark, when the compilation which compiled them is discarded.
+func (l *Loader) release(mark int) {
+	for _, path := range l.order[mark:] {
+		delete(l.modules, path)
+	}
+	l.order = l.order[:mark]
+}
+
+/*
+Compile the import statement: run the module unless it has been run already,
+then copy its exports into the globals of the importer.
+*/
+func (c *Compiler) compileImport(node *ast.ImportStatement) error {
+	c.setLine(node.Token.Line)
+	path := c.loader.Resolve(c.file, node.Path.Value)
+
+	mod, ok := c.loader.modules[path]
+	if !ok {
+		for i, loading := range c.loader.loading {
+			if loading == path {
+				cycle := append(append([]string{}, c.loader.loading[i:]...), path)
+				return errorAt(node.Token, "import cycle: %s", strings.Join(cycle, " -> "))
+			}
+		}
+
+		var err error
+		mod, err = c.compileModule(path, node)
+		if err != nil {
+			return err
+		}
+		c.loader.modules[path] = mod
+		c.loader.order = append(c.loader.order, path)
+	}
+
+	names := make([]string, 0, len(mod.exports))
+	for name := range mod.exports {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		c.emit(code.OpGetGlobal, mod.exports[name].Index)
+		c.emit(code.OpSetGlobal, c.symbolTable.Define(name).Index)
+	}
+	return nil
+}
+
+/*
+Define the macros of the program in the environment and expand them, with the budgets and the capabilities
+which the macros of the modules imported by the program get too when it is compiled.
+Call it after SetLoader(), since the limits are kept by the loader. The error is an *evaluator.MacroError.
+*/
+func (c *Compiler) ExpandMacros(program *ast.Program, macros *object.Environment, budgets budget.Limits, capabilities *object.Context) (*ast.Program, error) {
+	limits := evaluator.NewLimits(budgets, capabilities)
+	c.loader.MacroLimits = limits
+	evaluator.DefineMacros(program, macros)
+	expanded, err := evaluator.ExpandMacrosContext(context.Background(), program, macros, limits)
+	if err != nil {
+		return nil, err
+	}
+	return expanded.(*ast.Program), nil
+}
+
+// Expand the macros of the program as ExpandMacros() does, and compile it.
+func (c *Compiler) ExpandAndCompile(program *ast.Program, macros *object.Environment, budgets budget.Limits, capabilities *object.Context) error {
+	expanded, err := c.ExpandMacros(program, macros, budgets, capabilities)
+	if err != nil {
+		return err
+	}
+	return c.Compile(expanded)
+}
+
+/*
+Compile the module into a function which runs its top-level statements, and emit a call of it.
+The module is compiled with its own global table, whose globals are stored after those of the importer.
+Its macros are expanded first, and are not exported.
+*/
+func (c *Compiler) compileModule(path string, node *ast.ImportStatement) (*module, error) {
+	src, err := c.loader.ReadFile(path)
+	if err != nil {
+		return nil, errorAt(node.Token, "cannot import %q: %s", node.Path.Value, err)
+	}
+	p := parser.New(lexer.New(string(src)))
+	program := p.ParseProgram()
+	if errs := p.ErrorDetails(); len(errs) != 0 {
+		return nil, errorAt(node.Token, "%s:%d:%d: %s", path, errs[0].Line, errs[0].Column, errs[0].Msg)
+	}
+	macros := object.NewEnvironment()
+	evaluator.DefineMacros(program, macros)
+	expanded, err := evaluator.ExpandMacrosContext(context.Background(), program, macros, c.loader.MacroLimits)
+	if err != nil {
+		e := err.(*evaluator.MacroError)
+		return nil, errorAt(node.Token, "%s:%d:%d: %s", path, e.Line, e.Column, e.Msg)
+	}
+
+	symbolTable := NewModuleSymbolTable(c.symbolTable, path)
+	for i, v := range object.Builtins {
+		symbolTable.DefineBuiltin(i, v.Name)
+	}
+	child := &Compiler{
+		constants:          c.constants,
+		symbolTable:        symbolTable,
+		scopes:             []CompilationScope{{instructions: code.Instructions{}}},
+		functionsDebugInfo: c.functionsDebugInfo,
+		loader:             c.loader,
+		file:               path,
+		module:             path,
+	}
+
+	c.loader.loading = append(c.loader.loading, path)
+	err = child.compileProgram(expanded.(*ast.Program))
+	c.loader.loading = c.loader.loading[:len(c.loader.loading)-1]
+	if err != nil {
+		if e, ok := err.(*Error); ok {
+			return nil, errorAt(node.Token, "%s:%d:%d: %s", path, e.Line, e.Column, e.Msg)
+		}
+		return nil, errorAt(node.Token, "%s: %s", path, err)
+	}
+	child.emit(code.OpReturn)
+
+	mod := &module{exports: map[string]Symbol{}}
+	for _, name := range child.exports {
+		mod.exports[name], _ = symbolTable.Resolve(name)
+	}
+
+	init := &object.CompiledFunction{
+		Instructions: child.currentInstructions(),
+		Name:         "<module " + path + ">",
+		Handlers:     child.scopes[0].handlers,
+	}
+	c.constants = child.constants
+	c.functionsDebugInfo[init] = &FunctionDebugInfo{Name: init.Name, Lines: child.scopes[0].lines, File: path}
+	c.emit(code.OpClosure, c.addConstant(init), 0)
+	c.emit(code.OpCall, 0)
+	c.emit(code.OpPop)
+	return mod, nil
+}
@@ -0,0 +1,189 @@
+package compiler
+
+import (
+	"fmt"
+	"monkey/budget"
+	"monkey/evaluator"
+	"monkey/object"
+	"path/filepath"
+	"testing"
+)
+
+// A loader which reads the modules from the map instead of files.
+func testLoader(files map[string]string) *Loader {
+	loader := NewLoader()
+	loader.ReadFile = func(path string) ([]byte, error) {
+		src, ok := files[filepath.ToSlash(path)]
+		if !ok {
+			return nil, fmt.Errorf("open %s: no such file or directory", path)
+		}
+		return []byte(src), nil
+	}
+	return loader
+}
+
+func TestResolve(t *testing.T) {
+	tests := []struct {
+		from       string
+		importPath string
+		expected   string
+	}{
+		{"", "math", "math.mk"},
+		{"", "lib/math.mk", "lib/math.mk"},
+		{"main.mk", "./lib/math", "lib/math.mk"},
+		{"app/main.mk", "lib/math", "app/lib/math.mk"},
+		{"app/lib/math.mk", "../util", "app/util.mk"},
+		{"app/main.mk", "/usr/lib/math", "/usr/lib/math.mk"},
+	}
+
+	for _, tt := range tests {
+		got := filepath.ToSlash(NewLoader().Resolve(tt.from, tt.importPath))
+		if got != tt.expected {
+			t.Errorf("Resolve(%q, %q) wrong. want=%q, got=%q", tt.from, tt.importPath, tt.expected, got)
+		}
+	}
+}
+
+func TestModuleNamespaces(t *testing.T) {
+	files := map[string]string{
+		"app/lib/math.mk": `import "../util"; let x = 10; export let add = fn(a) { a + x + one };`,
+		"app/util.mk":     `export let one = 1; let x = 100;`,
+	}
+	comp := New()
+	comp.SetLoader(testLoader(files), "app/main.mk")
+	if err := comp.Compile(parse(`let x = 1; import "lib/math"; add(x)`)); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	// Every module has its own x, and the names are qualified by the modules in the debug table.
+	expected := []string{"x", "app/util.mk:one", "app/util.mk:x", "app/lib/math.mk:one",
+		"app/lib/math.mk:x", "app/lib/math.mk:add", "add"}
+	globals := comp.ByteCode().Debug.Globals
+	if fmt.Sprint(globals) != fmt.Sprint(expected) {
+		t.Errorf("wrong globals.\nwant=%q\ngot= %q", expected, globals)
+	}
+
+	// Names which are not exported are not visible to the importer.
+	comp = New()
+	comp.SetLoader(testLoader(files), "app/main.mk")
+	err := comp.Compile(parse(`import "lib/math"; one`))
+	if err == nil || err.Error() != "undefined variable one" {
+		t.Errorf("expected an error about one, got=%v", err)
+	}
+}
+
+func TestModuleIsCompiledOnce(t *testing.T) {
+	files := map[string]string{
+		"a.mk": `import "c"; export let a = c;`,
+		"b.mk": `import "c"; export let b = c;`,
+		"c.mk": `export let c = 1;`,
+	}
+	comp := New()
+	comp.SetLoader(testLoader(files), "")
+	if err := comp.Compile(parse(`import "a"; import "b"; import "c";`)); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	modules := 0
+	for _, constant := range comp.ByteCode().Constants {
+		if fn, ok := constant.(*object.CompiledFunction); ok && fn.Name == "<module c.mk>" {
+			modules++
+		}
+	}
+	if modules != 1 {
+		t.Errorf("module c is compiled %d times", modules)
+	}
+}
+
+func TestModuleErrors(t *testing.T) {
+	files := map[string]string{
+		"a.mk":         `import "b";`,
+		"b.mk":         "let x = 1;\nimport \"a\";",
+		"broken.mk":    "let = 1;",
+		"undefined.mk": "export let f = fn() {\n  y\n};",
+		"nested.mk":    "import \"undefined\";",
+		"self.mk":      "import \"main\";",
+		"macro.mk":     "let m = macro() { 1 };\nm();",
+	}
+
+	tests := []struct {
+		input    string
+		expected Error
+	}{
+		{"let x = 1;\nimport \"a\";", Error{Msg: "a.mk:1:1: b.mk:2:1: import cycle: a.mk -> b.mk -> a.mk", Line: 2, Column: 1}},
+		{`import "missing";`, Error{Msg: `cannot import "missing": open missing.mk: no such file or directory`, Line: 1, Column: 1}},
+		{`import "broken";`, Error{Msg: "broken.mk:1:5: expected next token to be IDENT, got = instead.", Line: 1, Column: 1}},
+		{`import "undefined";`, Error{Msg: "undefined.mk:2:3: undefined variable y", Line: 1, Column: 1}},
+		{`import "nested";`, Error{Msg: "nested.mk:1:1: undefined.mk:2:3: undefined variable y", Line: 1, Column: 1}},
+		{`import "macro";`, Error{Msg: "macro.mk:2:1: macro m: only a QUOTE can be returned from a macro, got INTEGER", Line: 1, Column: 1}},
+		{`import "self";`, Error{Msg: "self.mk:1:1: import cycle: main.mk -> self.mk -> main.mk", Line: 1, Column: 1}},
+		{`if (true) { import "a" }`, Error{Msg: "import is only allowed at the top level", Line: 1, Column: 13}},
+		{`let f = fn() { export let x = 1; };`, Error{Msg: "export is only allowed at the top level", Line: 1, Column: 23}},
+	}
+
+	for _, tt := range tests {
+		comp := New()
+		comp.SetLoader(testLoader(files), "main.mk")
+		err := comp.Compile(parse(tt.input))
+		compileErr, ok := err.(*Error)
+		if !ok {
+			t.Fatalf("expected *Error for %q, got=%T (%v)", tt.input, err, err)
+		}
+		if *compileErr != tt.expected {
+			t.Errorf("wrong error for %q.\nwant=%+v\ngot= %+v", tt.input, tt.expected, *compileErr)
+		}
+	}
+}
+
+// The macros of the imported modules run with the budgets given to the macros of the program.
+func TestExpandAndCompile(t *testing.T) {
+	loop := "let m = macro() { let f = fn(n) { if (n == 0) { quote(1) } else { f(n - 1) } }; f(1000) };\nm();"
+	files := map[string]string{"loop.mk": loop}
+	limits := budget.Limits{MaxSteps: 500}
+
+	comp := New()
+	comp.SetLoader(testLoader(files), "main.mk")
+	err := comp.ExpandAndCompile(parse(loop), object.NewEnvironment(), limits, &object.Context{})
+	if _, ok := err.(*evaluator.MacroError); !ok || err.Error() != "macro m: step limit exceeded: max 500 steps" {
+		t.Errorf("expected a step limit of the macro, got=%T (%v)", err, err)
+	}
+
+	comp = New()
+	comp.SetLoader(testLoader(files), "main.mk")
+	err = comp.ExpandAndCompile(parse(`import "loop";`), object.NewEnvironment(), limits, &object.Context{})
+	if err == nil || err.Error() != "loop.mk:2:1: macro m: step limit exceeded: max 500 steps" {
+		t.Errorf("expected a step limit of the macro in the module, got=%v", err)
+	}
+
+	comp = New()
+	comp.SetLoader(testLoader(files), "main.mk")
+	err = comp.ExpandAndCompile(parse(`import "loop";`), object.NewEnvironment(), budget.Limits{}, &object.Context{})
+	if err != nil {
+		t.Errorf("compiler error: %s", err)
+	}
+}
+
+// Modules compiled by a failed compilation are compiled again by the next one, since they have never run.
+func TestFailedCompilationReleasesModules(t *testing.T) {
+	loader := testLoader(map[string]string{"m.mk": `export let m = 1;`})
+	symbolTable := NewSymbolTable()
+	constants := []object.Object{}
+
+	comp := NewWithState(symbolTable, constants)
+	comp.SetLoader(loader, "")
+	if err := comp.Compile(parse(`import "m"; undefined`)); err == nil {
+		t.Fatalf("expected an error")
+	}
+	if len(loader.modules) != 0 {
+		t.Fatalf("modules are kept after the failure: %v", loader.order)
+	}
+
+	comp = NewWithState(symbolTable, constants)
+	comp.SetLoader(loader, "")
+	if err := comp.Compile(parse(`import "m"; m`)); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	if len(loader.modules) != 1 {
+		t.Errorf("module is not kept: %v", loader.order)
+	}
+}
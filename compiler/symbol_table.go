@@ -21,9 +21,22 @@ type SymbolTable struct {
 	store          map[string]Symbol
 	numDefinitions int
 	FreeSymbols    []Symbol // Note that Scopes of all the symbols are LocalScope.
+	names          []string // Names of the symbols defined by Define(), indexed by Symbol.Index.
+
+	// For the global table of an imported module, the global table of the program,
+	// which allocates the indexes of the globals of all the modules in the same globals store.
+	program *SymbolTable
+	module  string // Path of the module, which qualifies the names of its globals in the program's table.
 }
 
 func (s *SymbolTable) Define(name string) Symbol {
+	if s.program != nil {
+		symbol := s.program.Define(s.module + ":" + name)
+		symbol.Name = name
+		s.store[name] = symbol
+		return symbol
+	}
+
 	symbol := Symbol{Name: name, Index: s.numDefinitions}
 	if s.Outer == nil {
 		symbol.Scope = GlobalScope
@@ -33,6 +46,7 @@ func (s *SymbolTable) Define(name string) Symbol {
 
 	s.store[name] = symbol
 	s.numDefinitions++
+	s.names = append(s.names, name)
 	return symbol
 }
 
@@ -75,13 +89,76 @@ func (s *SymbolTable) Resolve(name string) (Symbol, bool) {
 	return obj, okInOuter
 }
 
+type symbolTableState struct {
+	store          map[string]Symbol
+	numDefinitions int
+	numFreeSymbols int
+}
+
+// Save the definitions of this table (not of its outer tables) so that they can be rolled back by restore().
+func (s *SymbolTable) snapshot() symbolTableState {
+	store := make(map[string]Symbol, len(s.store))
+	for name, symbol := range s.store {
+		store[name] = symbol
+	}
+	return symbolTableState{store: store, numDefinitions: s.numDefinitions, numFreeSymbols: len(s.FreeSymbols)}
+}
+
+func (s *SymbolTable) restore(state symbolTableState) {
+	s.store = state.store
+	s.numDefinitions = state.numDefinitions
+	s.FreeSymbols = s.FreeSymbols[:state.numFreeSymbols]
+	s.names = s.names[:state.numDefinitions]
+}
+
+// Returns a copy of the names of the symbols defined by Define(), indexed by Symbol.Index.
+func (s *SymbolTable) definitionNames() []string {
+	names := make([]string, len(s.names))
+	copy(names, s.names)
+	return names
+}
+
+func symbolNames(symbols []Symbol) []string {
+	names := make([]string, len(symbols))
+	for i, sym := range symbols {
+		names[i] = sym.Name
+	}
+	return names
+}
+
 func NewSymbolTable() *SymbolTable {
 	s := make(map[string]Symbol)
 	return &SymbolTable{store: s}
 }
 
+/*
+Create the global table of the module at the path, imported by a program with the global table.
+The module has its own namespace, but its globals are stored in the globals store of the program.
+*/
+func NewModuleSymbolTable(global *SymbolTable, path string) *SymbolTable {
+	if global.program != nil {
+		global = global.program
+	}
+	s := NewSymbolTable()
+	s.program = global
+	s.module = path
+	return s
+}
+
 func NewEnclosedSymbolTable(outer *SymbolTable) *SymbolTable {
 	s := NewSymbolTable()
 	s.Outer = outer
 	return s
 }
+
+/*
+Returns a copy of the table, in which symbols can be defined without changing the original.
+The REPL compiles inputs with it when they are not going to be run, e.g. to disassemble them.
+*/
+func (s *SymbolTable) Copy() *SymbolTable {
+	c := *s
+	c.store = s.snapshot().store
+	c.FreeSymbols = append([]Symbol(nil), s.FreeSymbols...)
+	c.names = append([]string(nil), s.names...)
+	return &c
+}
@@ -0,0 +1,45 @@
+package compiler
+
+import (
+	"monkey/ast"
+	"monkey/code"
+)
+
+/*
+Compile `spawn f(x)` like a call, except that OpSpawn calls the function in a new task.
+Any other operand is spawned as a call without arguments.
+*/
+func (c *Compiler) compileSpawnExpression(node *ast.SpawnExpression) error {
+	c.setLine(node.Token.Line)
+
+	call, ok := node.Function.(*ast.CallExpression)
+	if ok {
+		if ident, isIdent := call.Function.(*ast.Identifier); isIdent && ident.Value == "quote" {
+			ok = false
+		}
+	}
+	if !ok {
+		err := c.Compile(node.Function)
+		if err != nil {
+			return err
+		}
+		c.emit(code.OpSpawn, 0)
+		return nil
+	}
+
+	err := c.Compile(call.Function)
+	if err != nil {
+		return err
+	}
+	for _, a := range call.Arguments {
+		err := c.Compile(a)
+		if err != nil {
+			return err
+		}
+	}
+	if len(call.Arguments) > maxArgs {
+		return errorAt(call.Token, "too many arguments in a call: max %d", maxArgs)
+	}
+	c.emit(code.OpSpawn, len(call.Arguments))
+	return nil
+}
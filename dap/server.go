@@ -0,0 +1,454 @@
+/*
+Package dap implements a Debug Adapter Protocol server on top of vm.Debugger,
+so that editors can debug Monkey programs.
+*/
+package dap
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"monkey/compiler"
+	"monkey/evaluator"
+	"monkey/lexer"
+	"monkey/object"
+	"monkey/parser"
+	"monkey/vm"
+	"monkey/wire"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Monkey programs are single threaded, so there is only one thread to report.
+const threadID = 1
+
+/*
+A debug session serving one client.
+Requests are handled one at a time; the program runs while a request which resumes it is being handled.
+*/
+type Server struct {
+	in  *bufio.Reader
+	out io.Writer
+	mu  sync.Mutex // Guards writes to out and seq.
+	seq int
+
+	path        string
+	debug       *compiler.DebugTable
+	debugger    *vm.Debugger
+	stopOnEntry bool
+	noDebug     bool
+	breakpoints []int
+
+	// Variable references handed to the client. They are valid while the program is paused.
+	handles []handle
+}
+
+// A variable reference: either a scope of a frame or a structured value.
+type handle struct {
+	frame int
+	scope string
+	value object.Object
+}
+
+const (
+	scopeLocals  = "Locals"
+	scopeClosure = "Closure"
+	scopeGlobals = "Globals"
+)
+
+func NewServer(in io.Reader, out io.Writer) *Server {
+	return &Server{in: bufio.NewReader(in), out: out}
+}
+
+// Handle requests until the client disconnects or the input ends.
+func (s *Server) Serve() error {
+	for {
+		content, err := wire.ReadMessage(s.in)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		var req Request
+		if err := json.Unmarshal(content, &req); err != nil {
+			return fmt.Errorf("invalid message: %w", err)
+		}
+		if req.Type != "request" {
+			continue
+		}
+		if !s.handle(&req) {
+			return nil
+		}
+	}
+}
+
+// Handle one request. Returns false when the session should end.
+func (s *Server) handle(req *Request) bool {
+	switch req.Command {
+	case "initialize":
+		s.respond(req, Capabilities{
+			SupportsConfigurationDoneRequest: true,
+			SupportsEvaluateForHovers:        true,
+			SupportsTerminateRequest:         true,
+		})
+	case "launch":
+		var args LaunchArguments
+		if !s.decode(req, &args) {
+			break
+		}
+		if err := s.launch(args); err != nil {
+			s.fail(req, err.Error())
+			break
+		}
+		s.respond(req, nil)
+		s.event("initialized", nil)
+	case "setBreakpoints":
+		var args SetBreakpointsArguments
+		if s.decode(req, &args) {
+			s.respond(req, map[string]interface{}{"breakpoints": s.setBreakpoints(args)})
+		}
+	case "configurationDone":
+		if !s.requireLaunched(req) {
+			break
+		}
+		s.respond(req, nil)
+		if s.stopOnEntry && !s.noDebug {
+			s.stopped("entry")
+		} else {
+			s.run(s.debugger.Continue)
+		}
+	case "threads":
+		s.respond(req, map[string]interface{}{"threads": []Thread{{ID: threadID, Name: "main"}}})
+	case "stackTrace":
+		if s.requirePaused(req) {
+			frames := s.stackTrace()
+			s.respond(req, map[string]interface{}{"stackFrames": frames, "totalFrames": len(frames)})
+		}
+	case "scopes":
+		var args ScopesArguments
+		if s.decode(req, &args) && s.requirePaused(req) {
+			s.respond(req, map[string]interface{}{"scopes": s.scopes(args.FrameID - 1)})
+		}
+	case "variables":
+		var args VariablesArguments
+		if s.decode(req, &args) && s.requirePaused(req) {
+			s.respond(req, map[string]interface{}{"variables": s.variables(args.VariablesReference)})
+		}
+	case "evaluate":
+		var args EvaluateArguments
+		if s.decode(req, &args) && s.requirePaused(req) {
+			s.evaluate(req, args)
+		}
+	case "continue":
+		if s.requirePaused(req) {
+			s.respond(req, map[string]interface{}{"allThreadsContinued": true})
+			s.run(s.debugger.Continue)
+		}
+	case "next":
+		if s.requirePaused(req) {
+			s.respond(req, nil)
+			s.run(s.debugger.StepOver)
+		}
+	case "stepIn":
+		if s.requirePaused(req) {
+			s.respond(req, nil)
+			s.run(s.debugger.StepInto)
+		}
+	case "stepOut":
+		if s.requirePaused(req) {
+			s.respond(req, nil)
+			s.run(s.debugger.StepOut)
+		}
+	case "terminate":
+		s.respond(req, nil)
+		s.event("terminated", nil)
+	case "disconnect":
+		s.respond(req, nil)
+		return false
+	default:
+		s.fail(req, fmt.Sprintf("unsupported command: %s", req.Command))
+	}
+	return true
+}
+
+func (s *Server) launch(args LaunchArguments) error {
+	if args.Program == "" {
+		return fmt.Errorf("no program to debug")
+	}
+	source, err := ioutil.ReadFile(args.Program)
+	if err != nil {
+		return err
+	}
+
+	p := parser.New(lexer.New(string(source)))
+	program := p.ParseProgram()
+	if len(p.Errors()) != 0 {
+		return fmt.Errorf("parser errors:\n\t%s", strings.Join(p.Errors(), "\n\t"))
+	}
+	// Output of the program, and of its macros, must not be mixed into the protocol stream, so it is sent as output events.
+	config := vm.DefaultConfig()
+	config.Capabilities = object.DefaultContext()
+	config.Capabilities.Stdout = &outputWriter{s: s, category: "stdout"}
+	config.Capabilities.Stderr = &outputWriter{s: s, category: "stderr"}
+
+	comp := compiler.New()
+	comp.SetLoader(compiler.NewLoader(), args.Program)
+	err = comp.ExpandAndCompile(program, object.NewEnvironment(), config.Limits(), config.Capabilities)
+	if _, ok := err.(*evaluator.MacroError); ok {
+		return fmt.Errorf("macro expansion failed: %s", err)
+	} else if err != nil {
+		return fmt.Errorf("compilation failed: %s", err)
+	}
+
+	bytecode := comp.ByteCode()
+	s.path = args.Program
+	s.debug = bytecode.Debug
+	s.debugger = vm.NewDebugger(vm.New(bytecode, config))
+	s.stopOnEntry = args.StopOnEntry
+	s.noDebug = args.NoDebug
+	for _, line := range s.breakpoints {
+		s.debugger.SetBreakpoint(line)
+	}
+	return nil
+}
+
+func (s *Server) setBreakpoints(args SetBreakpointsArguments) []Breakpoint {
+	known := s.path == "" || sameFile(args.Source.Path, s.path)
+	if known {
+		s.breakpoints = nil
+		if s.debugger != nil {
+			s.debugger.ClearBreakpoints()
+		}
+	}
+
+	lines := s.codeLines()
+	result := []Breakpoint{}
+	for _, bp := range args.Breakpoints {
+		switch {
+		case !known:
+			result = append(result, Breakpoint{Line: bp.Line, Message: "not part of the program being debugged"})
+		case lines != nil && !lines[bp.Line]:
+			result = append(result, Breakpoint{Line: bp.Line, Message: "no code on this line"})
+		default:
+			s.breakpoints = append(s.breakpoints, bp.Line)
+			if s.debugger != nil {
+				s.debugger.SetBreakpoint(bp.Line)
+			}
+			result = append(result, Breakpoint{Verified: true, Line: bp.Line})
+		}
+	}
+	return result
+}
+
+// Returns the lines where a breakpoint can stop, or nil if no program has been launched.
+func (s *Server) codeLines() map[int]bool {
+	if s.debug == nil {
+		return nil
+	}
+	lines := map[int]bool{}
+	add := func(info *compiler.FunctionDebugInfo) {
+		for _, entry := range info.Lines {
+			lines[entry.Line] = true
+		}
+	}
+	add(s.debug.Main)
+	for _, info := range s.debug.Functions {
+		add(info)
+	}
+	return lines
+}
+
+// Resume the program and report where it stopped.
+func (s *Server) run(resume func() (vm.StopReason, error)) {
+	s.handles = nil
+	if s.noDebug {
+		s.debugger.ClearBreakpoints()
+	}
+
+	reason, err := resume()
+	switch reason {
+	case vm.StopBreakpoint:
+		s.stopped("breakpoint")
+	case vm.StopStep:
+		s.stopped("step")
+	case vm.StopExit:
+		exitCode := 0
+		if err != nil {
+			exitCode = 1
+			s.event("output", OutputEventBody{Category: "stderr", Output: err.Error() + "\n"})
+		} else if result := s.debugger.Result(); result != nil {
+			s.event("output", OutputEventBody{Category: "console", Output: result.Inspect() + "\n"})
+		}
+		s.event("exited", ExitedEventBody{ExitCode: exitCode})
+		s.event("terminated", nil)
+	}
+}
+
+func (s *Server) stopped(reason string) {
+	s.event("stopped", StoppedEventBody{Reason: reason, ThreadID: threadID, AllThreadsStopped: true})
+}
+
+func (s *Server) stackTrace() []StackFrame {
+	source := Source{Name: filepath.Base(s.path), Path: s.path}
+	frames := []StackFrame{}
+	for i, f := range s.debugger.Frames() {
+		frames = append(frames, StackFrame{ID: i + 1, Name: f.Name, Source: source, Line: f.Line, Column: 1})
+	}
+	return frames
+}
+
+func (s *Server) scopes(frame int) []Scope {
+	scopes := []Scope{}
+	if frame < len(s.debugger.Frames())-1 { // Only functions have locals and free variables.
+		scopes = append(scopes, Scope{Name: scopeLocals, VariablesReference: s.newHandle(handle{frame: frame, scope: scopeLocals})})
+		if len(s.debugger.FreeVariables(frame)) != 0 {
+			scopes = append(scopes, Scope{Name: scopeClosure, VariablesReference: s.newHandle(handle{frame: frame, scope: scopeClosure})})
+		}
+	}
+	scopes = append(scopes, Scope{Name: scopeGlobals, VariablesReference: s.newHandle(handle{scope: scopeGlobals})})
+	return scopes
+}
+
+func (s *Server) variables(reference int) []Variable {
+	if reference < 1 || len(s.handles) < reference {
+		return []Variable{}
+	}
+	h := s.handles[reference-1]
+
+	switch value := h.value.(type) {
+	case *object.Array:
+		variables := []Variable{}
+		for i, element := range value.Elements {
+			variables = append(variables, s.variable(fmt.Sprintf("[%d]", i), element))
+		}
+		return variables
+	case *object.Hash:
+		variables := []Variable{}
+		for _, pair := range value.Pairs {
+			variables = append(variables, s.variable(pair.Key.Inspect(), pair.Value))
+		}
+		sort.Slice(variables, func(i, j int) bool { return variables[i].Name < variables[j].Name })
+		return variables
+	}
+
+	var bindings []vm.Variable
+	switch h.scope {
+	case scopeLocals:
+		bindings = s.debugger.Locals(h.frame)
+	case scopeClosure:
+		bindings = s.debugger.FreeVariables(h.frame)
+	case scopeGlobals:
+		bindings = s.debugger.Globals()
+	}
+	variables := []Variable{}
+	for _, b := range bindings {
+		variables = append(variables, s.variable(b.Name, b.Value))
+	}
+	return variables
+}
+
+func (s *Server) variable(name string, value object.Object) Variable {
+	if value == nil {
+		return Variable{Name: name, Value: "<unset>"}
+	}
+	v := Variable{Name: name, Value: value.Inspect(), Type: string(value.Type())}
+	switch value.(type) {
+	case *object.Array, *object.Hash:
+		v.VariablesReference = s.newHandle(handle{value: value})
+	}
+	return v
+}
+
+// Only names of bindings can be evaluated, which is enough for hovers and watches.
+func (s *Server) evaluate(req *Request, args EvaluateArguments) {
+	name := strings.TrimSpace(args.Expression)
+	value, ok := s.debugger.Lookup(name)
+	if !ok || value == nil {
+		s.fail(req, fmt.Sprintf("%s is not defined here", name))
+		return
+	}
+	v := s.variable(name, value)
+	s.respond(req, map[string]interface{}{"result": v.Value, "type": v.Type, "variablesReference": v.VariablesReference})
+}
+
+func (s *Server) newHandle(h handle) int {
+	s.handles = append(s.handles, h)
+	return len(s.handles)
+}
+
+func (s *Server) requireLaunched(req *Request) bool {
+	if s.debugger == nil {
+		s.fail(req, "no program has been launched")
+		return false
+	}
+	return true
+}
+
+func (s *Server) requirePaused(req *Request) bool {
+	if !s.requireLaunched(req) {
+		return false
+	}
+	if s.debugger.Exited() {
+		s.fail(req, "the program is not running")
+		return false
+	}
+	return true
+}
+
+func (s *Server) decode(req *Request, args interface{}) bool {
+	if len(req.Arguments) == 0 {
+		return true
+	}
+	if err := json.Unmarshal(req.Arguments, args); err != nil {
+		s.fail(req, fmt.Sprintf("invalid arguments: %s", err))
+		return false
+	}
+	return true
+}
+
+func (s *Server) respond(req *Request, body interface{}) {
+	s.send(func(seq int) interface{} {
+		return Response{Seq: seq, Type: "response", RequestSeq: req.Seq, Success: true, Command: req.Command, Body: body}
+	})
+}
+
+func (s *Server) fail(req *Request, message string) {
+	s.send(func(seq int) interface{} {
+		return Response{Seq: seq, Type: "response", RequestSeq: req.Seq, Command: req.Command, Message: message}
+	})
+}
+
+func (s *Server) event(event string, body interface{}) {
+	s.send(func(seq int) interface{} {
+		return Event{Seq: seq, Type: "event", Event: event, Body: body}
+	})
+}
+
+func (s *Server) send(message func(seq int) interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.seq++
+	// A client which stopped reading is noticed when its next request fails to arrive.
+	wire.WriteMessage(s.out, message(s.seq))
+}
+
+// Sends the output of the program to the client.
+type outputWriter struct {
+	s        *Server
+	category string
+}
+
+func (w *outputWriter) Write(p []byte) (int, error) {
+	w.s.event("output", OutputEventBody{Category: w.category, Output: string(p)})
+	return len(p), nil
+}
+
+func sameFile(a, b string) bool {
+	return filepath.Clean(a) == filepath.Clean(b)
+}
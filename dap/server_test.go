@@ -0,0 +1,290 @@
+package dap
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"monkey/wire"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const program = `let add = fn(a, b) {
+  let sum = a + b;
+  sum
+};
+let xs = [1, 2];
+puts("hello");
+let x = add(xs[0], xs[1]);
+x * 2
+`
+
+func TestDebugSession(t *testing.T) {
+	c := startClient(t, program)
+
+	c.request("initialize", map[string]interface{}{"adapterID": "monkey"})
+	c.request("launch", map[string]interface{}{"program": c.path})
+	c.expectEvent("initialized")
+
+	bps := c.request("setBreakpoints", map[string]interface{}{
+		"source":      map[string]string{"path": c.path},
+		"breakpoints": []map[string]int{{"line": 2}, {"line": 4}},
+	})
+	var breakpoints struct{ Breakpoints []Breakpoint }
+	decodeBody(t, bps, &breakpoints)
+	if len(breakpoints.Breakpoints) != 2 ||
+		!breakpoints.Breakpoints[0].Verified || breakpoints.Breakpoints[1].Verified {
+		t.Fatalf("wrong breakpoints: %+v", breakpoints.Breakpoints)
+	}
+
+	c.request("configurationDone", nil)
+	output := c.expectEvent("output")
+	if body := output["body"].(map[string]interface{}); body["output"] != "hello\n" {
+		t.Errorf("wrong program output: %v", body)
+	}
+	c.expectStopped("breakpoint")
+
+	var trace struct{ StackFrames []StackFrame }
+	decodeBody(t, c.request("stackTrace", map[string]int{"threadId": threadID}), &trace)
+	if len(trace.StackFrames) != 2 ||
+		trace.StackFrames[0].Name != "add" || trace.StackFrames[0].Line != 2 ||
+		trace.StackFrames[1].Name != "<main>" || trace.StackFrames[1].Line != 7 {
+		t.Fatalf("wrong stack trace: %+v", trace.StackFrames)
+	}
+
+	var scopes struct{ Scopes []Scope }
+	decodeBody(t, c.request("scopes", map[string]int{"frameId": trace.StackFrames[0].ID}), &scopes)
+	if len(scopes.Scopes) != 2 || scopes.Scopes[0].Name != scopeLocals || scopes.Scopes[1].Name != scopeGlobals {
+		t.Fatalf("wrong scopes: %+v", scopes.Scopes)
+	}
+	c.expectVariables(scopes.Scopes[0].VariablesReference, map[string]string{"a": "1", "b": "2", "sum": "<unset>"})
+
+	globals := c.expectVariables(scopes.Scopes[1].VariablesReference, map[string]string{"add": "", "xs": "[1, 2]"})
+	c.expectVariables(globals["xs"].VariablesReference, map[string]string{"[0]": "1", "[1]": "2"})
+
+	c.request("next", map[string]int{"threadId": threadID})
+	c.expectStopped("step")
+	decodeBody(t, c.request("stackTrace", map[string]int{"threadId": threadID}), &trace)
+	if trace.StackFrames[0].Line != 3 {
+		t.Errorf("expected to stop at line 3, got=%d", trace.StackFrames[0].Line)
+	}
+
+	var evaluated struct{ Result string }
+	decodeBody(t, c.request("evaluate", map[string]interface{}{"expression": "sum", "frameId": 1}), &evaluated)
+	if evaluated.Result != "3" {
+		t.Errorf("wrong evaluation of sum: %q", evaluated.Result)
+	}
+
+	c.request("stepOut", map[string]int{"threadId": threadID})
+	c.expectStopped("step")
+
+	c.request("continue", map[string]int{"threadId": threadID})
+	result := c.expectEvent("output")
+	if body := result["body"].(map[string]interface{}); body["output"] != "6\n" {
+		t.Errorf("wrong result output: %v", body)
+	}
+	exited := c.expectEvent("exited")
+	if code := exited["body"].(map[string]interface{})["exitCode"]; code != 0.0 {
+		t.Errorf("wrong exit code: %v", code)
+	}
+	c.expectEvent("terminated")
+
+	c.request("disconnect", nil)
+	c.expectClosed()
+}
+
+func TestStopOnEntryAndRuntimeError(t *testing.T) {
+	c := startClient(t, "let x = 1;\nx + true\n")
+
+	c.request("initialize", nil)
+	c.request("launch", map[string]interface{}{"program": c.path, "stopOnEntry": true})
+	c.expectEvent("initialized")
+	c.request("configurationDone", nil)
+	c.expectStopped("entry")
+
+	c.request("stepIn", map[string]int{"threadId": threadID})
+	c.expectStopped("step")
+	c.request("continue", map[string]int{"threadId": threadID})
+
+	output := c.expectEvent("output")
+	if body := output["body"].(map[string]interface{}); body["category"] != "stderr" {
+		t.Errorf("expected the error on stderr, got=%v", body)
+	}
+	exited := c.expectEvent("exited")
+	if code := exited["body"].(map[string]interface{})["exitCode"]; code != 1.0 {
+		t.Errorf("wrong exit code: %v", code)
+	}
+	c.expectEvent("terminated")
+
+	if resp := c.send("stackTrace", map[string]int{"threadId": threadID}); resp["success"] != false {
+		t.Errorf("expected stackTrace to fail after the program ended, got=%v", resp)
+	}
+}
+
+func TestLaunchErrors(t *testing.T) {
+	c := startClient(t, "let = 1;")
+
+	c.request("initialize", nil)
+	resp := c.send("launch", map[string]interface{}{"program": c.path})
+	if resp["success"] != false || resp["message"] == "" {
+		t.Errorf("expected launch to fail with a message, got=%v", resp)
+	}
+	resp = c.send("launch", map[string]interface{}{"program": filepath.Join(filepath.Dir(c.path), "missing.mk")})
+	if resp["success"] != false {
+		t.Errorf("expected launch of a missing file to fail, got=%v", resp)
+	}
+	if resp := c.send("frobnicate", nil); resp["success"] != false {
+		t.Errorf("expected an unknown command to fail, got=%v", resp)
+	}
+}
+
+// A scripted DAP client talking to a server through pipes.
+type client struct {
+	t        *testing.T
+	path     string
+	w        io.Writer
+	messages chan map[string]interface{}
+	seq      int
+}
+
+func startClient(t *testing.T, source string) *client {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "dap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "program.mk")
+	if err := ioutil.WriteFile(path, []byte(source), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	clientReader, serverWriter := io.Pipe()
+	serverReader, clientWriter := io.Pipe()
+	go func() {
+		NewServer(serverReader, serverWriter).Serve()
+		serverWriter.Close()
+	}()
+	t.Cleanup(func() { clientWriter.Close() })
+
+	c := &client{t: t, path: path, w: clientWriter, messages: make(chan map[string]interface{}, 100)}
+	go func() {
+		r := bufio.NewReader(clientReader)
+		for {
+			content, err := wire.ReadMessage(r)
+			if err != nil {
+				close(c.messages)
+				return
+			}
+			var message map[string]interface{}
+			json.Unmarshal(content, &message)
+			c.messages <- message
+		}
+	}()
+	return c
+}
+
+// Send a request and return its response.
+func (c *client) send(command string, arguments interface{}) map[string]interface{} {
+	c.t.Helper()
+	c.seq++
+	req := map[string]interface{}{"seq": c.seq, "type": "request", "command": command}
+	if arguments != nil {
+		req["arguments"] = arguments
+	}
+	if err := wire.WriteMessage(c.w, req); err != nil {
+		c.t.Fatalf("sending %s: %s", command, err)
+	}
+
+	message := c.next()
+	if message["type"] != "response" || message["request_seq"] != float64(c.seq) {
+		c.t.Fatalf("expected the response to %s, got=%v", command, message)
+	}
+	return message
+}
+
+// Send a request which has to succeed.
+func (c *client) request(command string, arguments interface{}) map[string]interface{} {
+	c.t.Helper()
+	resp := c.send(command, arguments)
+	if resp["success"] != true {
+		c.t.Fatalf("%s failed: %v", command, resp["message"])
+	}
+	return resp
+}
+
+func (c *client) next() map[string]interface{} {
+	c.t.Helper()
+	select {
+	case message, ok := <-c.messages:
+		if !ok {
+			c.t.Fatalf("the server closed the connection")
+		}
+		return message
+	case <-time.After(5 * time.Second):
+		c.t.Fatalf("timed out waiting for a message")
+	}
+	return nil
+}
+
+func (c *client) expectEvent(event string) map[string]interface{} {
+	c.t.Helper()
+	message := c.next()
+	if message["type"] != "event" || message["event"] != event {
+		c.t.Fatalf("expected the %s event, got=%v", event, message)
+	}
+	return message
+}
+
+func (c *client) expectStopped(reason string) {
+	c.t.Helper()
+	stopped := c.expectEvent("stopped")
+	if got := stopped["body"].(map[string]interface{})["reason"]; got != reason {
+		c.t.Fatalf("wrong stop reason. want=%s, got=%v", reason, got)
+	}
+}
+
+// Check the values of the variables by name. An empty expected value matches anything.
+func (c *client) expectVariables(reference int, expected map[string]string) map[string]Variable {
+	c.t.Helper()
+	var body struct{ Variables []Variable }
+	decodeBody(c.t, c.request("variables", map[string]int{"variablesReference": reference}), &body)
+
+	variables := map[string]Variable{}
+	for _, v := range body.Variables {
+		variables[v.Name] = v
+	}
+	if len(variables) != len(expected) {
+		c.t.Fatalf("wrong variables. want=%v, got=%+v", expected, body.Variables)
+	}
+	for name, value := range expected {
+		v, ok := variables[name]
+		if !ok || (value != "" && v.Value != value) {
+			c.t.Errorf("wrong variable %s. want=%q, got=%+v", name, value, v)
+		}
+	}
+	return variables
+}
+
+func (c *client) expectClosed() {
+	c.t.Helper()
+	select {
+	case message, ok := <-c.messages:
+		if ok {
+			c.t.Fatalf("expected the connection to be closed, got=%v", message)
+		}
+	case <-time.After(5 * time.Second):
+		c.t.Fatalf("timed out waiting for the server to close")
+	}
+}
+
+func decodeBody(t *testing.T, message map[string]interface{}, v interface{}) {
+	t.Helper()
+	body, _ := json.Marshal(message["body"])
+	if err := json.Unmarshal(body, v); err != nil {
+		t.Fatalf("decoding body: %s", err)
+	}
+}
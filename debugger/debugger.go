@@ -0,0 +1,248 @@
+package debugger
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"monkey/compiler"
+	"monkey/evaluator"
+	"monkey/lexer"
+	"monkey/object"
+	"monkey/parser"
+	"monkey/vm"
+	"strconv"
+	"strings"
+)
+
+const PROMPT = "(mdb) "
+
+const HELP = `Commands:
+  break <line>     (b)   set a breakpoint
+  delete <line>    (d)   delete a breakpoint
+  breakpoints            list breakpoints
+  continue         (c)   run until a breakpoint or the end
+  step             (s)   step into the next line
+  next             (n)   step over to the next line
+  out              (o)   run until the current function returns
+  backtrace        (bt)  show the call stack
+  locals [frame]         show local bindings
+  free [frame]           show free variables
+  globals                show global bindings
+  stack                  show the operand stack
+  print <name>     (p)   show the value of a binding
+  list             (l)   show the source around the current line
+  help             (h)   show this help
+  quit             (q)   exit the debugger
+`
+
+/*
+Start an interactive debugging session of the source code, read from the file at path.
+Imports are resolved relative to the path. The program is paused before its first instruction.
+*/
+func Start(path, source string, in io.Reader, out io.Writer) {
+	p := parser.New(lexer.New(source))
+	program := p.ParseProgram()
+	if len(p.Errors()) != 0 {
+		io.WriteString(out, "parser errors:\n")
+		for _, msg := range p.Errors() {
+			io.WriteString(out, "\t"+msg+"\n")
+		}
+		return
+	}
+
+	// The macros run with the capabilities and the budgets of the program.
+	config := vm.DefaultConfig()
+	comp := compiler.New()
+	comp.SetLoader(compiler.NewLoader(), path)
+	err := comp.ExpandAndCompile(program, object.NewEnvironment(), config.Limits(), config.Capabilities)
+	if _, ok := err.(*evaluator.MacroError); ok {
+		fmt.Fprintf(out, "Woops! Macro expansion failed:\n %s\n", err)
+		return
+	} else if err != nil {
+		fmt.Fprintf(out, "Woops! Compilation failed:\n %s\n", err)
+		return
+	}
+
+	s := &session{
+		lines: strings.Split(source, "\n"),
+		d:     vm.NewDebugger(vm.New(comp.ByteCode(), config)),
+		out:   out,
+	}
+	fmt.Fprintf(out, "Program loaded (%d lines). Type `help` for commands.\n", len(s.lines))
+
+	scanner := bufio.NewScanner(in)
+	for {
+		fmt.Fprint(out, PROMPT)
+		if !scanner.Scan() {
+			return
+		}
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if !s.execute(fields[0], fields[1:]) {
+			return
+		}
+	}
+}
+
+type session struct {
+	lines []string
+	d     *vm.Debugger
+	out   io.Writer
+}
+
+// Execute one command. Returns false when the session should end.
+func (s *session) execute(command string, args []string) bool {
+	switch command {
+	case "break", "b":
+		if line, ok := s.lineArg(args); ok {
+			s.d.SetBreakpoint(line)
+			fmt.Fprintf(s.out, "Breakpoint at line %d\n", line)
+		}
+	case "delete", "d":
+		if line, ok := s.lineArg(args); ok {
+			s.d.ClearBreakpoint(line)
+			fmt.Fprintf(s.out, "Deleted breakpoint at line %d\n", line)
+		}
+	case "breakpoints":
+		for _, line := range s.d.Breakpoints() {
+			fmt.Fprintf(s.out, "line %d\n", line)
+		}
+	case "continue", "c":
+		s.report(s.d.Continue())
+	case "step", "s":
+		s.report(s.d.StepInto())
+	case "next", "n":
+		s.report(s.d.StepOver())
+	case "out", "o", "finish":
+		s.report(s.d.StepOut())
+	case "backtrace", "bt":
+		if s.requirePaused() {
+			for i, f := range s.d.Frames() {
+				fmt.Fprintf(s.out, "#%d %s at line %d (offset %d)\n", i, f.Name, f.Line, f.Offset)
+			}
+		}
+	case "locals":
+		if frame, ok := s.frameArg(args); ok && s.requirePaused() {
+			s.printVariables(s.d.Locals(frame))
+		}
+	case "free":
+		if frame, ok := s.frameArg(args); ok && s.requirePaused() {
+			s.printVariables(s.d.FreeVariables(frame))
+		}
+	case "globals":
+		s.printVariables(s.d.Globals())
+	case "stack":
+		if s.requirePaused() {
+			for i, obj := range s.d.OperandStack() {
+				fmt.Fprintf(s.out, "[%d] %s\n", i, inspect(obj))
+			}
+		}
+	case "print", "p":
+		if len(args) != 1 {
+			fmt.Fprintln(s.out, "usage: print <name>")
+			break
+		}
+		if value, ok := s.d.Lookup(args[0]); ok {
+			fmt.Fprintf(s.out, "%s = %s\n", args[0], inspect(value))
+		} else {
+			fmt.Fprintf(s.out, "%s is not defined here\n", args[0])
+		}
+	case "list", "l":
+		if s.requirePaused() {
+			s.list(s.d.Location().Line)
+		}
+	case "help", "h":
+		io.WriteString(s.out, HELP)
+	case "quit", "q":
+		return false
+	default:
+		fmt.Fprintf(s.out, "unknown command %q. Type `help` for commands.\n", command)
+	}
+	return true
+}
+
+func (s *session) report(reason vm.StopReason, err error) {
+	if reason == vm.StopExit {
+		if err != nil {
+			fmt.Fprintf(s.out, "Program failed:\n %s\n", err)
+		} else {
+			fmt.Fprintf(s.out, "Program finished. Result: %s\n", inspect(s.d.Result()))
+		}
+		return
+	}
+
+	location := s.d.Location()
+	what := "Stepped"
+	if reason == vm.StopBreakpoint {
+		what = "Breakpoint"
+	}
+	fmt.Fprintf(s.out, "%s in %s at line %d\n", what, location.Name, location.Line)
+	s.printLine(location.Line, true)
+}
+
+func (s *session) requirePaused() bool {
+	if s.d.Exited() {
+		fmt.Fprintln(s.out, "The program is not running.")
+		return false
+	}
+	return true
+}
+
+func (s *session) list(current int) {
+	for line := current - 3; line <= current+3; line++ {
+		if 1 <= line && line <= len(s.lines) {
+			s.printLine(line, line == current)
+		}
+	}
+}
+
+func (s *session) printLine(line int, current bool) {
+	if line < 1 || len(s.lines) < line {
+		return
+	}
+	marker := " "
+	if current {
+		marker = ">"
+	}
+	fmt.Fprintf(s.out, "%s %4d  %s\n", marker, line, s.lines[line-1])
+}
+
+func (s *session) printVariables(variables []vm.Variable) {
+	for _, v := range variables {
+		fmt.Fprintf(s.out, "%s = %s\n", v.Name, inspect(v.Value))
+	}
+}
+
+func (s *session) lineArg(args []string) (int, bool) {
+	if len(args) != 1 {
+		fmt.Fprintln(s.out, "a line number is required")
+		return 0, false
+	}
+	line, err := strconv.Atoi(args[0])
+	if err != nil || line < 1 {
+		fmt.Fprintf(s.out, "invalid line number %q\n", args[0])
+		return 0, false
+	}
+	return line, true
+}
+
+func (s *session) frameArg(args []string) (int, bool) {
+	if len(args) == 0 {
+		return 0, true
+	}
+	frame, err := strconv.Atoi(args[0])
+	if err != nil || frame < 0 || len(s.d.Frames()) <= frame {
+		fmt.Fprintf(s.out, "invalid frame %q\n", args[0])
+		return 0, false
+	}
+	return frame, true
+}
+
+func inspect(obj object.Object) string {
+	if obj == nil {
+		return "<unset>"
+	}
+	return obj.Inspect()
+}
@@ -6,10 +6,22 @@ import (
 
 // Holds builtin functions.
 var builtins = map[string]*object.Builtin{
-	"len":   object.GetBuiltinByName("len"),
-	"puts":  object.GetBuiltinByName("puts"),
-	"first": object.GetBuiltinByName("first"),
-	"last":  object.GetBuiltinByName("last"),
-	"rest":  object.GetBuiltinByName("rest"),
-	"push":  object.GetBuiltinByName("push"),
+	"len":      object.GetBuiltinByName("len"),
+	"puts":     object.GetBuiltinByName("puts"),
+	"first":    object.GetBuiltinByName("first"),
+	"last":     object.GetBuiltinByName("last"),
+	"rest":     object.GetBuiltinByName("rest"),
+	"push":     object.GetBuiltinByName("push"),
+	"eputs":    object.GetBuiltinByName("eputs"),
+	"readFile": object.GetBuiltinByName("readFile"),
+	"now":      object.GetBuiltinByName("now"),
+	"random":   object.GetBuiltinByName("random"),
+	"getenv":   object.GetBuiltinByName("getenv"),
+	"next":     object.GetBuiltinByName("next"),
+	"channel":  object.GetBuiltinByName("channel"),
+	"send":     object.GetBuiltinByName("send"),
+	"recv":     object.GetBuiltinByName("recv"),
+	"close":    object.GetBuiltinByName("close"),
+	"select":   object.GetBuiltinByName("select"),
+	"wait":     object.GetBuiltinByName("wait"),
 }
@@ -1,33 +1,184 @@
 package evaluator
 
 import (
+	"context"
 	"fmt"
 	"monkey/ast"
+	"monkey/budget"
 	"monkey/object"
 )
 
 var (
 	// Use a singleton pattern
-	NULL  = &object.Null{}
-	TRUE  = &object.Boolean{Value: true}
-	FALSE = &object.Boolean{Value: false}
+	NULL  = object.NULL
+	TRUE  = object.TRUE
+	FALSE = object.FALSE
 )
 
+// Depth of nested function calls allowed when Limits.MaxDepth is zero, which is vm.MaxFrames too.
+const MaxDepth = 1024
+
+// Budgets of an evaluation. Zero means unlimited.
+type Limits struct {
+	MaxSteps  int64 // Number of evaluated AST nodes.
+	MaxMemory int64 // Approximate bytes of created objects.
+
+	// Maximum depth of nested function calls. Zero means MaxDepth, not unlimited,
+	// since each call nests the evaluation on the Go stack, whose overflow cannot be recovered.
+	MaxDepth int
+
+	// Capabilities given to the builtins. nil means object.DefaultContext(); &object.Context{} grants none.
+	Capabilities *object.Context
+
+	// Owns the generators started by the evaluation, which later evaluations can resume until it is closed,
+	// as a REPL does with its bindings. nil means they are closed when the evaluation returns.
+	Generators *Generators
+}
+
+// Returns the limits of an evaluation with the budgets, such as those of a VM, and the capabilities.
+func NewLimits(budgets budget.Limits, capabilities *object.Context) Limits {
+	return Limits{
+		MaxSteps:     budgets.MaxSteps,
+		MaxMemory:    budgets.MaxMemory,
+		MaxDepth:     budgets.MaxDepth,
+		Capabilities: capabilities,
+	}
+}
+
+// State of one evaluation, shared by all the nested calls of eval().
+type evaluator struct {
+	meter        *budget.Meter
+	capabilities *object.Context
+	err          error      // Set when the evaluation is aborted by the meter or by the depth limit.
+	coroutine    *coroutine // The generator whose function is being evaluated. nil outside of generators.
+	depth        int        // Number of function calls being evaluated on the goroutine of this evaluator.
+	maxDepth     int
+	generators   *Generators // Owns the generators started by the evaluation. Shared with their evaluators.
+}
+
+// Returned from EvalContext() when a function call would exceed Limits.MaxDepth.
+type RecursionError struct {
+	MaxDepth int
+}
+
+func (e *RecursionError) Error() string {
+	return fmt.Sprintf("maximum recursion depth exceeded (max depth: %d)", e.MaxDepth)
+}
+
 func Eval(node ast.Node, env *object.Environment) object.Object {
+	capabilities := object.DefaultContext()
+	capabilities.Tasks = object.NewTaskGroup()
+	e := &evaluator{meter: budget.NewMeter(0, 0), capabilities: capabilities, maxDepth: MaxDepth, generators: &Generators{}}
+	defer e.generators.Close()
+	return uncaught(e.eval(node, env))
+}
+
+/*
+Evaluate the node until it finishes, ctx is done, or a budget in limits is used up.
+Each case is reported as an error of a distinct type of the budget package, and exceeding Limits.MaxDepth
+as a *RecursionError, while errors of the Monkey program itself are still returned as *object.Error.
+*/
+func EvalContext(
+	ctx context.Context,
+	node ast.Node,
+	env *object.Environment,
+	limits Limits,
+) (object.Object, error) {
+	capabilities := limits.Capabilities
+	if capabilities == nil {
+		capabilities = object.DefaultContext()
+	}
+	withDone := *capabilities
+	withDone.Done = ctx.Done()
+	withDone.Tasks = object.NewTaskGroup()
+
+	maxDepth := limits.MaxDepth
+	if maxDepth <= 0 {
+		maxDepth = MaxDepth
+	}
+
+	e := &evaluator{
+		meter:        budget.NewMeter(limits.MaxSteps, limits.MaxMemory),
+		capabilities: &withDone,
+		maxDepth:     maxDepth,
+		generators:   limits.Generators,
+	}
+	if e.generators == nil {
+		e.generators = &Generators{}
+		defer e.generators.Close()
+	}
+	e.meter.SetContext(ctx)
+
+	result := e.eval(node, env)
+	if e.err != nil {
+		return nil, e.err
+	}
+	return uncaught(result), nil
+}
+
+func (e *evaluator) eval(node ast.Node, env *object.Environment) object.Object {
+	if e.err != nil {
+		return e.abort()
+	}
+	err := e.meter.Step()
+	if err != nil {
+		e.err = err
+		return e.abort()
+	}
+
+	result := e.evalNode(node, env)
+
+	switch node.(type) {
+	case *ast.IntegerLiteral, *ast.StringLiteral, *ast.PrefixExpression, *ast.InfixExpression,
+		*ast.FunctionLiteral, *ast.ArrayLiteral, *ast.HashLiteral, *ast.CallExpression:
+		// These nodes create a new object, except for a few cases counted anyway for simplicity.
+		err := e.meter.Allocate(budget.SizeOf(result))
+		if err != nil && e.err == nil {
+			e.err = err
+		}
+	}
+	if e.err != nil {
+		return e.abort()
+	}
+	return result
+}
+
+// An error which unwinds the evaluation after e.err is set.
+func (e *evaluator) abort() object.Object {
+	return newError("%s", e.err)
+}
+
+func (e *evaluator) evalNode(node ast.Node, env *object.Environment) object.Object {
 	switch node := node.(type) {
 	case *ast.Program:
-		return evalProgram(node.Statements, env)
+		return e.evalProgram(node.Statements, env)
 	// Statement
 	case *ast.ExpressionStatement:
-		return Eval(node.Expression, env)
+		return e.eval(node.Expression, env)
 	case *ast.ReturnStatement:
-		val := Eval(node.ReturnValue, env)
+		val := e.eval(node.ReturnValue, env)
 		if isError(val) {
 			return val
 		}
 		return &object.ReturnValue{Value: val}
+	case *ast.ThrowStatement:
+		val := e.eval(node.Value, env)
+		if isError(val) {
+			return val
+		}
+		return throw(val)
+	case *ast.YieldStatement:
+		val := e.eval(node.Value, env)
+		if isError(val) {
+			return val
+		}
+		return e.yield(val)
+	case *ast.ForStatement:
+		return e.evalForStatement(node, env)
+	case *ast.ImportStatement:
+		return newError("import is only supported by the compiler")
 	case *ast.LetStatement:
-		val := Eval(node.Value, env)
+		val := e.eval(node.Value, env)
 		if isError(val) {
 			return val
 		}
@@ -42,7 +193,7 @@ func Eval(node ast.Node, env *object.Environment) object.Object {
 	case *ast.FunctionLiteral:
 		params := node.Parameters
 		body := node.Body
-		return &object.Function{Parameters: params, Env: env, Body: body}
+		return &object.Function{Parameters: params, Env: env, Body: body, Generator: node.Generator}
 	case *ast.Identifier:
 		if val, ok := env.Get(node.Value); ok {
 			return val
@@ -52,37 +203,49 @@ func Eval(node ast.Node, env *object.Environment) object.Object {
 		}
 		return newError("identifier not found: " + node.Value)
 	case *ast.PrefixExpression:
-		right := Eval(node.Right, env)
+		right := e.eval(node.Right, env)
 		if isError(right) {
 			return right
 		}
 		return evalPrefixExpression(node.Operator, right)
 	case *ast.InfixExpression:
-		left := Eval(node.Left, env)
+		left := e.eval(node.Left, env)
 		if isError(left) {
 			return left
 		}
-		right := Eval(node.Right, env)
+		right := e.eval(node.Right, env)
 		if isError(right) {
 			return right
 		}
 		return evalInfixExpression(node.Operator, left, right)
 	case *ast.BlockStatement:
-		return evalBlockStatement(node, env)
+		return e.evalBlockStatement(node, env)
 	case *ast.IfExpression:
-		return evalIfExpression(node, env)
+		return e.evalIfExpression(node, env)
+	case *ast.TryExpression:
+		return e.evalTryExpression(node, env)
+	case *ast.SpawnExpression:
+		return newError("spawn is only supported by the compiler")
+	case *ast.MacroLiteral:
+		return newError("macros can only be defined by top-level let statements")
 	case *ast.CallExpression:
-		function := Eval(node.Function, env)
+		if isCallOf(node, "quote") {
+			if len(node.Arguments) != 1 {
+				return newError("wrong number of arguments to quote. got=%d, want=1", len(node.Arguments))
+			}
+			return e.quote(node.Arguments[0], env)
+		}
+		function := e.eval(node.Function, env)
 		if isError(function) {
 			return function
 		}
-		args := evalExpressions(node.Arguments, env)
+		args := e.evalExpressions(node.Arguments, env)
 		if len(args) == 1 && isError(args[0]) { // Error handling.
 			return args[0]
 		}
-		return applyFunction(function, args)
+		return e.applyFunction(function, args)
 	case *ast.ArrayLiteral:
-		elements := evalExpressions(node.Elements, env)
+		elements := e.evalExpressions(node.Elements, env)
 		if len(elements) == 1 && isError(elements[0]) {
 			return elements[0]
 		}
@@ -90,7 +253,7 @@ func Eval(node ast.Node, env *object.Environment) object.Object {
 	case *ast.HashLiteral:
 		pairs := make(map[object.HashKey]object.HashPair)
 		for key, val := range node.Pairs {
-			keyObject := Eval(key, env)
+			keyObject := e.eval(key, env)
 			if isError(keyObject) {
 				return keyObject
 			}
@@ -99,19 +262,19 @@ func Eval(node ast.Node, env *object.Environment) object.Object {
 				return newError("unusable as hash key: %s", keyObject.Type())
 			}
 
-			valObject := Eval(val, env)
-			if isError(keyObject) {
-				return keyObject
+			valObject := e.eval(val, env)
+			if isError(valObject) {
+				return valObject
 			}
 			pairs[hashableKey.HashKey()] = object.HashPair{Key: keyObject, Value: valObject}
 		}
 		return &object.Hash{Pairs: pairs}
 	case *ast.IndexExpression:
-		left := Eval(node.Left, env)
+		left := e.eval(node.Left, env)
 		if isError(left) {
 			return left
 		}
-		index := Eval(node.Index, env)
+		index := e.eval(node.Index, env)
 		if isError(index) {
 			return index
 		}
@@ -121,15 +284,15 @@ func Eval(node ast.Node, env *object.Environment) object.Object {
 }
 
 // Returns the evaluation result of the whole statements.
-func evalProgram(program []ast.Statement, env *object.Environment) object.Object {
+func (e *evaluator) evalProgram(program []ast.Statement, env *object.Environment) object.Object {
 	var result object.Object
 	for _, stmt := range program { // Multiple statements can exist in one line.
-		result = Eval(stmt, env)
+		result = e.eval(stmt, env)
 
 		switch result := result.(type) {
 		case *object.ReturnValue:
 			return result.Value
-		case *object.Error:
+		case *thrownValue:
 			return result
 		}
 	}
@@ -205,6 +368,9 @@ func evalIntegerInfixExpression(operator string, left, right object.Object) obje
 	case "*":
 		return &object.Integer{Value: leftVal * rightVal}
 	case "/":
+		if rightVal == 0 {
+			return newError("division by zero")
+		}
 		return &object.Integer{Value: leftVal / rightVal}
 	case "<":
 		return nativeBoolToBooleanObject(leftVal < rightVal)
@@ -231,15 +397,15 @@ func evalStringInfixExpression(
 	return &object.String{Value: leftVal + rightVal}
 }
 
-func evalIfExpression(ie *ast.IfExpression, env *object.Environment) object.Object {
-	condition := Eval(ie.Condition, env)
+func (e *evaluator) evalIfExpression(ie *ast.IfExpression, env *object.Environment) object.Object {
+	condition := e.eval(ie.Condition, env)
 	if isError(condition) {
 		return condition
 	}
 	if isTruthy(condition) {
-		return Eval(ie.Consequence, env)
+		return e.eval(ie.Consequence, env)
 	} else if ie.Alternative != nil {
-		return Eval(ie.Alternative, env)
+		return e.eval(ie.Alternative, env)
 	}
 	return NULL
 }
@@ -256,15 +422,15 @@ func isTruthy(obj object.Object) bool {
 	return true
 }
 
-func evalBlockStatement(block *ast.BlockStatement, env *object.Environment) object.Object {
+func (e *evaluator) evalBlockStatement(block *ast.BlockStatement, env *object.Environment) object.Object {
 	var result object.Object
 
 	for _, stmt := range block.Statements {
-		result = Eval(stmt, env)
+		result = e.eval(stmt, env)
 
 		if result != nil {
 			rt := result.Type()
-			if rt == object.RETURN_VALUE_OBJ || rt == object.ERROR_OBJ {
+			if rt == object.RETURN_VALUE_OBJ || rt == thrownObj {
 				return result
 			}
 		}
@@ -273,14 +439,14 @@ func evalBlockStatement(block *ast.BlockStatement, env *object.Environment) obje
 }
 
 // evaluates multiple expressions and returns the slice of evaluated objects
-func evalExpressions(
+func (e *evaluator) evalExpressions(
 	exps []ast.Expression,
 	env *object.Environment,
 ) []object.Object {
 	var result []object.Object
 
-	for _, e := range exps {
-		evaluated := Eval(e, env)
+	for _, exp := range exps {
+		evaluated := e.eval(exp, env)
 		if isError(evaluated) {
 			return []object.Object{evaluated}
 		}
@@ -289,14 +455,42 @@ func evalExpressions(
 	return result
 }
 
-func applyFunction(fn object.Object, args []object.Object) object.Object {
+func (e *evaluator) applyFunction(fn object.Object, args []object.Object) object.Object {
 	switch fn := fn.(type) {
 	case *object.Function:
+		if fn.Generator {
+			return newGenerator(fn, args)
+		}
+		if e.depth >= e.maxDepth {
+			e.err = &RecursionError{MaxDepth: e.maxDepth}
+			return e.abort()
+		}
+		e.depth++
+		defer func() { e.depth-- }()
+
 		extendedEnv := extendFunctionEnv(fn, args)
-		evaluated := Eval(fn.Body, extendedEnv)
+		evaluated := e.eval(fn.Body, extendedEnv)
 		return unwrapReturnValue(evaluated)
 	case *object.Builtin:
-		if result := fn.Fn(args...); result != nil {
+		if fn == nextBuiltin && len(args) == 1 {
+			if gen, ok := args[0].(*object.Generator); ok && isCoroutine(gen) {
+				value, _ := e.resume(gen)
+				return value
+			}
+		}
+		result := fn.Fn(e.capabilities, args...)
+		if errObj, ok := result.(*object.Error); ok {
+			// A builtin which blocks, such as `recv`, returns an error when the evaluation is canceled.
+			if err := e.meter.Canceled(); err != nil {
+				e.err = err
+				return e.abort()
+			}
+			if errObj.Value != nil { // `wait` for a task which threw a value other than an error.
+				return throw(errObj.Value)
+			}
+			return throw(errObj)
+		}
+		if result != nil {
 			return result
 		}
 		return NULL
@@ -324,8 +518,9 @@ func unwrapReturnValue(obj object.Object) object.Object {
 	return obj
 }
 
-func newError(format string, a ...interface{}) *object.Error {
-	return &object.Error{Message: fmt.Sprintf(format, a...)}
+// Returns the error thrown.
+func newError(format string, a ...interface{}) object.Object {
+	return throw(&object.Error{Message: fmt.Sprintf(format, a...)})
 }
 
 func evalIndexExpression(left, index object.Object) object.Object {
@@ -363,9 +558,8 @@ func evalHashIndexExpression(hash, key object.Object) object.Object {
 	return hashPair.Value
 }
 
+// Reports whether the object is a value in flight, which unwinds the evaluation. A caught error is not.
 func isError(obj object.Object) bool {
-	if obj != nil {
-		return obj.Type() == object.ERROR_OBJ
-	}
-	return false
+	_, ok := obj.(*thrownValue)
+	return ok
 }
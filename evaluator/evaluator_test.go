@@ -1,10 +1,15 @@
 package evaluator
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"monkey/budget"
 	"monkey/lexer"
 	"monkey/object"
 	"monkey/parser"
 	"testing"
+	"time"
 )
 
 func TestEvalIntegerExpression(t *testing.T) {
@@ -173,6 +178,18 @@ if (10 > 1) {
 			`{"name": "Monkey"}[fn(x){ x }]`,
 			"unusable as hash key: FUNCTION",
 		},
+		{
+			`{"a": 1 + true}`,
+			"type mismatch: INTEGER + BOOLEAN",
+		},
+		{
+			"10 / (5 - 5)",
+			"division by zero",
+		},
+		{
+			"spawn fn() { 1 }",
+			"spawn is only supported by the compiler",
+		},
 	}
 
 	for _, tt := range tests {
@@ -283,6 +300,10 @@ func TestBuiltinFunctions(t *testing.T) {
 		{`len("hello world")`, 11},
 		{`len(1)`, "argument to `len` not supported, got=INTEGER"},
 		{`len("one", "two")`, "wrong number of arguments. got=2, want=1"},
+		// The program is the only task, so nothing can unblock it.
+		{`recv(channel())`, "deadlock: all tasks are blocked"},
+		{`let c = channel(1); send(c, 1); send(c, 2)`, "deadlock: all tasks are blocked"},
+		{`let c = channel(1); send(c, 1); recv(c)`, 1},
 	}
 
 	for _, tt := range tests {
@@ -489,6 +510,124 @@ func TestReturnStatementsInFunctions(t *testing.T) {
 	}
 }
 
+func TestEvalContext(t *testing.T) {
+	fibonacci := `
+	let fibonacci = fn(x) {
+		if (x < 2) {
+			return x;
+		}
+		fibonacci(x - 1) + fibonacci(x - 2)
+	};
+	fibonacci(35);`
+	concat := `
+	let concat = fn(s, n) {
+		if (n == 0) {
+			return s;
+		}
+		concat(s + "monkey", n - 1)
+	};
+	concat("", 100);`
+
+	tests := []struct {
+		input   string
+		limits  Limits
+		timeout time.Duration
+		check   func(err error) bool
+	}{
+		{
+			input:   fibonacci,
+			timeout: 10 * time.Millisecond,
+			check: func(err error) bool {
+				_, ok := err.(*budget.CanceledError)
+				return ok && errors.Is(err, context.DeadlineExceeded)
+			},
+		},
+		{
+			// A builtin blocked for good fails at once rather than when the execution is canceled.
+			input:   `try { recv(channel()) } catch (e) { 1 }`,
+			timeout: time.Minute,
+			check:   func(err error) bool { return err == nil },
+		},
+		{
+			input:  fibonacci,
+			limits: Limits{MaxSteps: 1000},
+			check: func(err error) bool {
+				stepErr, ok := err.(*budget.StepLimitError)
+				return ok && stepErr.Limit == 1000
+			},
+		},
+		{
+			input:  concat,
+			limits: Limits{MaxMemory: 10000},
+			check: func(err error) bool {
+				memErr, ok := err.(*budget.MemoryLimitError)
+				return ok && memErr.Limit == 10000
+			},
+		},
+		{
+			input:  concat,
+			limits: Limits{MaxSteps: 100000, MaxMemory: 1000000},
+			check:  func(err error) bool { return err == nil },
+		},
+		{
+			// The recursion is not caught, and does not overflow the Go stack whatever the other limits are.
+			input:  `let f = fn(x) { f(x + 1) }; try { f(1) } catch (e) { 0 }`,
+			limits: Limits{MaxSteps: 1e8, MaxMemory: 1 << 30},
+			check: func(err error) bool {
+				depthErr, ok := err.(*RecursionError)
+				return ok && depthErr.MaxDepth == MaxDepth
+			},
+		},
+		{
+			input:  `let f = fn(x) { if (x == 0) { return 0 } f(x - 1) }; f(50)`,
+			limits: Limits{MaxDepth: 10},
+			check: func(err error) bool {
+				depthErr, ok := err.(*RecursionError)
+				return ok && depthErr.MaxDepth == 10
+			},
+		},
+		{
+			input:  `let f = fn(x) { if (x == 0) { return 0 } f(x - 1) }; f(9)`,
+			limits: Limits{MaxDepth: 10},
+			check:  func(err error) bool { return err == nil },
+		},
+	}
+
+	for _, tt := range tests {
+		program := parser.New(lexer.New(tt.input)).ParseProgram()
+
+		ctx := context.Background()
+		if tt.timeout != 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, tt.timeout)
+			defer cancel()
+		}
+
+		_, err := EvalContext(ctx, program, object.NewEnvironment(), tt.limits)
+		if !tt.check(err) {
+			t.Errorf("unexpected error. got=%T (%v)", err, err)
+		}
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+	var out bytes.Buffer
+	program := parser.New(lexer.New(`puts("sandboxed"); getenv("HOME")`)).ParseProgram()
+	limits := Limits{Capabilities: &object.Context{Stdout: &out}}
+
+	result, err := EvalContext(context.Background(), program, object.NewEnvironment(), limits)
+	if err != nil {
+		t.Fatalf("EvalContext failed: %s", err)
+	}
+	errObj, ok := result.(*object.Error)
+	if !ok || errObj.Message != "`getenv` is not permitted: no environment" {
+		t.Errorf("getenv is not denied. got=%T (%+v)", result, result)
+	}
+	if out.String() != "sandboxed\n" {
+		t.Errorf("puts does not write to the given stdout. got=%q", out.String())
+	}
+}
+
 func testEval(input string) object.Object {
 	l := lexer.New(input)
 	p := parser.New(l)
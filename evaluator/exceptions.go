@@ -0,0 +1,60 @@
+package evaluator
+
+import (
+	"monkey/ast"
+	"monkey/object"
+)
+
+const thrownObj = "THROWN"
+
+/*
+A value in flight, which unwinds the evaluation up to the innermost try, as a ReturnValue does up to the function.
+Errors of builtins and of operations are thrown as ERROR objects. Once caught, a value is an ordinary one,
+even an error, so that it can be bound and passed around as in the VM.
+*/
+type thrownValue struct {
+	value object.Object
+}
+
+func (t *thrownValue) Type() object.ObjectType { return thrownObj }
+func (t *thrownValue) Inspect() string         { return "thrown: " + t.value.Inspect() }
+
+func throw(value object.Object) object.Object {
+	return &thrownValue{value: value}
+}
+
+/*
+Returns the result of an evaluation as it is given to the callers of Eval(), which see an uncaught value as an error.
+An error is reported as it is. Any other value is kept in the error.
+*/
+func uncaught(result object.Object) object.Object {
+	t, ok := result.(*thrownValue)
+	if !ok {
+		return result
+	}
+	if errObj, ok := t.value.(*object.Error); ok {
+		return errObj
+	}
+	return &object.Error{Message: "uncaught exception: " + t.value.Inspect(), Value: t.value}
+}
+
+func (e *evaluator) evalTryExpression(te *ast.TryExpression, env *object.Environment) object.Object {
+	result := e.eval(te.Body, env)
+	// An evaluation aborted by the meter cannot be caught.
+	if t, ok := result.(*thrownValue); ok && te.Catch != nil && e.err == nil {
+		env.Set(te.CatchParameter.Value, t.value)
+		result = e.eval(te.Catch, env)
+	}
+
+	if te.Finally != nil && e.err == nil {
+		// An error or a return in the finally block takes the place of the result.
+		finally := e.eval(te.Finally, env)
+		if _, ok := finally.(*object.ReturnValue); ok || isError(finally) {
+			return finally
+		}
+	}
+	if result == nil {
+		return NULL
+	}
+	return result
+}
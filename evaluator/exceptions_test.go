@@ -0,0 +1,79 @@
+package evaluator
+
+import (
+	"monkey/object"
+	"testing"
+)
+
+func TestTryExpressions(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{`try { throw 1; 2 } catch (e) { e + 10 }`, 11},
+		{`try { 5 } catch (e) { 10 }`, 5},
+		{`try { } catch (e) { 1 }`, nil},
+		{`let f = fn() { throw "boom" }; try { f() } catch (e) { e }`, "boom"},
+		{`try { len(1) } catch (e) { e }`, "ERROR: argument to `len` not supported, got=INTEGER"},
+		{`let f = fn() { throw 2 }; 1 + try { 2 + f() } catch (e) { 10 }`, 11},
+		{`try { try { throw 1 } catch (e) { throw e + 1 } } catch (e) { e * 10 }`, 20},
+		{`try { try { throw 1 } finally { 2 } } catch (e) { e }`, 1},
+		{`try { try { throw 1 } finally { throw 2 } } catch (e) { e }`, 2},
+		{`try { try { 1 } finally { throw 3 } } catch (e) { e }`, 3},
+		{`try { try { throw 1 } catch (e) { 5 } finally { throw 4 } } catch (e) { e }`, 4},
+		{`try { try { throw 1 } catch (e) { 5 } finally { 6 } } catch (e) { e }`, 5},
+		{`let f = fn() { try { return 1 } finally { 2 } }; f()`, 1},
+		{`let f = fn() { try { return 1 } finally { throw 2 } }; try { f() } catch (e) { e }`, 2},
+		{`let f = fn() { try { return 1 } catch (e) { 100 } finally { throw 2 } }; try { f() } catch (e) { e }`, 2},
+		{`fn() { try { return 1; } finally { return 2; } }()`, 2},
+		{`fn() { try { throw 1 } catch (e) { return e + 1 } finally { 0 } }()`, 2},
+		{`let f = fn() { try { throw 5 } catch (e) { fn() { e } } }; f()()`, 5},
+		{`let g = fn(x) { let y = x * 2; throw y }; let f = fn() { let a = 1; a + try { g(5) } catch (e) { e } }; f()`, 11},
+		{`let f = fn(n) { if (n == 0) { throw "done" } f(n - 1) }; try { f(50) } catch (e) { e }`, "done"},
+		// A caught error is an ordinary value, which is not thrown again where it is used.
+		{`let x = try { len(1) } catch (err) { err }; 5`, 5},
+		{`try { len(1) } catch (e) { [e] }`, "[ERROR: argument to `len` not supported, got=INTEGER]"},
+		{`let f = fn(e) { 7 }; f(try { 1 / 0 } catch (e) { e })`, 7},
+		{`let e = try { 1 / 0 } catch (e) { e }; if (e) { {"error": e}["error"] } else { 0 }`, "ERROR: division by zero"},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+		switch expected := tt.expected.(type) {
+		case int:
+			testIntegerObject(t, evaluated, int64(expected))
+		case string:
+			if evaluated == nil || evaluated.Inspect() != expected {
+				t.Errorf("wrong result for %q. want=%q, got=%+v", tt.input, expected, evaluated)
+			}
+		case nil:
+			testNullObject(t, evaluated)
+		}
+	}
+}
+
+func TestUncaughtExceptions(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`throw 5; 6`, "uncaught exception: 5"},
+		{`let f = fn() { throw [1, "a"] }; f()`, "uncaught exception: [1, a]"},
+		{`try { throw 1 } catch (e) { throw len(e) }`, "argument to `len` not supported, got=INTEGER"},
+		{`try { throw 1 } finally { 2 }`, "uncaught exception: 1"},
+		{`let e = try { len(1) } catch (e) { e }; throw e`, "argument to `len` not supported, got=INTEGER"},
+		{`let e = try { len(1) } catch (e) { e }; e + 1`, "type mismatch: ERROR + INTEGER"},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+		errObj, ok := evaluated.(*object.Error)
+		if !ok {
+			t.Errorf("no error for %q. got=%T (%+v)", tt.input, evaluated, evaluated)
+			continue
+		}
+		if errObj.Message != tt.expected {
+			t.Errorf("wrong error message. want=%q, got=%q", tt.expected, errObj.Message)
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package evaluator
+
+import (
+	"errors"
+	"monkey/ast"
+	"monkey/object"
+)
+
+var nextBuiltin = object.GetBuiltinByName("next")
+
+/*
+The state of a generator created by the evaluator. The body of its function is evaluated by a goroutine,
+which takes turns with the resumer, so that the evaluation can be suspended in the middle of the tree.
+Only one of them runs at a time, so they share the meter of the resumer without locks.
+The goroutine is started by the first resume, and closed with the Generators of the evaluation which started it.
+*/
+type coroutine struct {
+	body    *ast.BlockStatement
+	env     *object.Environment
+	resumes chan *evaluator // Each resume sends the resumer, whose meter and capabilities the function uses until it yields.
+	turns   chan turn       // The function gives back each value it yields, and finally its result.
+	exited  chan struct{}   // Closed when the goroutine returns.
+	started bool
+	running bool
+	closed  bool
+}
+
+// Given back to the resumer when the function yields or finishes.
+type turn struct {
+	value object.Object
+	done  bool
+	err   error // The error which aborted the evaluation of the function. Set only when done.
+}
+
+// Unwinds the goroutine of a generator which is closed while it is suspended.
+var errClosed = errors.New("the generator is closed")
+
+func newGenerator(fn *object.Function, args []object.Object) *object.Generator {
+	co := &coroutine{
+		body:    fn.Body,
+		env:     extendFunctionEnv(fn, args),
+		resumes: make(chan *evaluator),
+		turns:   make(chan turn),
+		exited:  make(chan struct{}),
+	}
+	return &object.Generator{State: co}
+}
+
+func (co *coroutine) run() {
+	defer close(co.exited)
+	e := &evaluator{coroutine: co}
+	e.continueWith(<-co.resumes)
+
+	result := e.eval(co.body, co.env)
+	if e.err == errClosed {
+		return
+	}
+	co.turns <- turn{value: unwrapReturnValue(result), done: true, err: e.err}
+}
+
+// Use the meter, the capabilities and the depth limit of the evaluation which resumed the generator.
+// The depth is counted apart, since the function is evaluated on a goroutine of its own.
+func (e *evaluator) continueWith(resumer *evaluator) {
+	e.meter = resumer.meter
+	e.capabilities = resumer.capabilities
+	e.maxDepth = resumer.maxDepth
+	e.generators = resumer.generators
+}
+
+/*
+The generators started by evaluations, whose goroutines stay suspended between resumes until Close().
+The evaluations sharing it must not run at the same time.
+*/
+type Generators struct {
+	started []*coroutine
+}
+
+// Keep the coroutine, forgetting those whose functions have finished.
+func (g *Generators) add(co *coroutine) {
+	running := g.started[:0]
+	for _, started := range g.started {
+		select {
+		case <-started.exited:
+		default:
+			running = append(running, started)
+		}
+	}
+	g.started = append(running, co)
+}
+
+/*
+Close the generators. The goroutines of those which are suspended are unwound without running their finally blocks,
+and waited for, so that none outlives its owner. Resuming a closed generator throws an error.
+*/
+func (g *Generators) Close() {
+	for _, co := range g.started {
+		if !co.closed {
+			co.closed = true
+			close(co.resumes)
+			<-co.exited
+		}
+	}
+	g.started = nil
+}
+
+/*
+Run the function of the generator up to its next yield, and return the yielded value and true.
+When the function finishes, it returns null and false, or the error which the function has thrown.
+*/
+func (e *evaluator) resume(gen *object.Generator) (object.Object, bool) {
+	co := gen.State.(*coroutine)
+	if co.running {
+		return newError("the generator is already running"), false
+	}
+	if co.closed {
+		return newError("%s", errClosed), false
+	}
+	if !co.started {
+		co.started = true
+		e.generators.add(co)
+		go co.run()
+	}
+
+	co.running = true
+	co.resumes <- e
+	t := <-co.turns
+	co.running = false
+	if !t.done {
+		return t.value, true
+	}
+
+	gen.Done = true
+	gen.State = nil
+	switch {
+	case t.err != nil:
+		e.err = t.err
+		return e.abort(), false
+	case isError(t.value):
+		return t.value, false
+	}
+	return NULL, false
+}
+
+// Suspend the goroutine of the generator until the next resume, giving the value to the resumer.
+func (e *evaluator) yield(value object.Object) object.Object {
+	co := e.coroutine
+	if co == nil {
+		return newError("yield outside of a generator")
+	}
+
+	co.turns <- turn{value: value}
+	resumer, ok := <-co.resumes
+	if !ok {
+		e.err = errClosed
+		return e.abort()
+	}
+	e.continueWith(resumer)
+	return nil
+}
+
+// Whether the generator is created by the evaluator, and can be resumed by it.
+func isCoroutine(gen *object.Generator) bool {
+	_, ok := gen.State.(*coroutine)
+	return ok
+}
+
+func (e *evaluator) evalForStatement(fs *ast.ForStatement, env *object.Environment) object.Object {
+	iterable := e.eval(fs.Iterable, env)
+	if isError(iterable) {
+		return iterable
+	}
+
+	var next func() (object.Object, bool)
+	switch iterable := iterable.(type) {
+	case *object.Array:
+		i := 0
+		next = func() (object.Object, bool) {
+			if i == len(iterable.Elements) {
+				return nil, false
+			}
+			i++
+			return iterable.Elements[i-1], true
+		}
+	case *object.Generator:
+		if !iterable.Done && !isCoroutine(iterable) {
+			return newError("the generator can only be resumed by the engine which created it")
+		}
+		next = func() (object.Object, bool) {
+			if iterable.Done {
+				return nil, false
+			}
+			return e.resume(iterable)
+		}
+	default:
+		return newError("cannot iterate over %s", iterable.Type())
+	}
+
+	for {
+		value, ok := next()
+		if isError(value) {
+			return value
+		}
+		if !ok {
+			return nil
+		}
+		env.Set(fs.Variable.Value, value)
+
+		result := e.eval(fs.Body, env)
+		if _, ok := result.(*object.ReturnValue); ok || isError(result) {
+			return result
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package evaluator
+
+import (
+	"bytes"
+	"context"
+	"monkey/budget"
+	"monkey/lexer"
+	"monkey/object"
+	"monkey/parser"
+	"runtime"
+	"testing"
+)
+
+func TestGenerators(t *testing.T) {
+	prelude := `
+	let collect = fn(gen, acc) { let x = next(gen); if (x) { collect(gen, push(acc, x)) } else { acc } };
+	let range = fn(from, to) { if (from < to) { yield from; for (x in range(from + 1, to)) { yield x; } } };
+	`
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{`let g = fn() { yield 1; yield 2; }; let it = g(); let a = next(it); [a, next(it)]`, "[1, 2]"},
+		{`let g = fn() { yield 1; }; let it = g(); next(it); next(it); next(it)`, nil},
+		{`let g = fn() { yield 1; throw "unreachable"; }; next(g())`, 1},
+		{`let g = fn(a, b) { let c = a * b; yield c; yield c + a; }; let it = g(2, 3); let x = next(it); [x, next(it)]`, "[6, 8]"},
+		{`let g = fn(a) { let f = fn(x) { x + a }; yield f(1); yield f(2); }; collect(g(10), [])`, "[11, 12]"},
+		{`collect(range(0, 5), [])`, "[0, 1, 2, 3, 4]"},
+		{`let double = fn(gen) { for (x in gen) { yield x * 2; } }; collect(double(range(0, 4)), [])`, "[0, 2, 4, 6]"},
+		{`let g = fn(xs) { for (x in xs) { yield x * 10; } }; collect(g([1, 2, 3]), [])`, "[10, 20, 30]"},
+		{`let g = fn() { yield 1; return 5; yield 2; }; collect(g(), [])`, "[1]"},
+		{`let g = fn() { let a = 10 + if (true) { yield 1; 2 }; yield a; }; collect(g(), [])`, "[1, 12]"},
+		{`let g = fn() { let a = [5, try { yield 1; 2 } finally { 3 }]; yield a[0] + a[1]; }; collect(g(), [])`, "[1, 7]"},
+		{`let g = fn() { try { yield 1; throw 2; } catch (e) { yield e * 10; } }; collect(g(), [])`, "[1, 20]"},
+		{`let g = fn() { yield 1; throw "boom"; }; let it = g(); next(it); try { next(it) } catch (e) { e }`, "boom"},
+		{`let g = fn() { yield 1; throw "boom"; }; let it = g(); next(it); try { next(it) } catch (e) { 0 }; next(it)`, nil},
+		{`try { next(1) } catch (e) { e }`, "ERROR: argument to `next` must be GENERATOR, got=INTEGER"},
+		{`let find = fn(xs, y) { for (x in xs) { if (x == y) { return true; } }; false }; find([1, 2, 3], 2)`, true},
+		{`let find = fn(xs, y) { for (x in xs) { if (x == y) { return true; } }; false }; find([1, 2, 3], 5)`, false},
+		{`let first = fn(gen) { for (x in gen) { return x; } }; first(range(3, 10))`, 3},
+		{`for (x in []) { throw "unreachable"; }; 5`, 5},
+		{`1 + fn() { for (x in [1, 2]) { x; }; 2 }()`, 3},
+		{`try { for (x in 5) { } } catch (e) { e }`, "ERROR: cannot iterate over INTEGER"},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(prelude + tt.input)
+		switch expected := tt.expected.(type) {
+		case int:
+			testIntegerObject(t, evaluated, int64(expected))
+		case bool:
+			testBooleanObject(t, evaluated, expected)
+		case string:
+			if evaluated == nil || evaluated.Inspect() != expected {
+				t.Errorf("wrong result for %q. want=%q, got=%+v", tt.input, expected, evaluated)
+			}
+		case nil:
+			testNullObject(t, evaluated)
+		}
+	}
+}
+
+func TestGeneratorsUseTheResumer(t *testing.T) {
+	env := object.NewEnvironment()
+	generators := &Generators{}
+	eval := func(input string, limits Limits) (object.Object, error) {
+		program := parser.New(lexer.New(input)).ParseProgram()
+		limits.Generators = generators
+		return EvalContext(context.Background(), program, env, limits)
+	}
+
+	_, err := eval(`let g = fn() { puts("first"); yield 1; puts("second"); yield 2; let f = fn(n) { f(n + 1) }; f(0) }; let it = g();`, Limits{})
+	if err != nil {
+		t.Fatalf("EvalContext failed: %s", err)
+	}
+
+	// Each resume runs with the capabilities and the budget of the evaluation which resumes the generator.
+	for i, want := range []string{"first\n", "second\n"} {
+		var out bytes.Buffer
+		result, err := eval(`next(it)`, Limits{Capabilities: &object.Context{Stdout: &out}})
+		if err != nil {
+			t.Fatalf("EvalContext failed: %s", err)
+		}
+		testIntegerObject(t, result, int64(i+1))
+		if out.String() != want {
+			t.Errorf("wrong output of resume %d. want=%q, got=%q", i, want, out.String())
+		}
+	}
+
+	_, err = eval(`next(it)`, Limits{MaxSteps: 1000})
+	if stepErr, ok := err.(*budget.StepLimitError); !ok || stepErr.Limit != 1000 {
+		t.Errorf("the step limit is not applied to the generator. got=%T (%v)", err, err)
+	}
+	result, err := eval(`next(it)`, Limits{})
+	if err != nil || result != NULL {
+		t.Errorf("the generator is not finished by the error. got=%v, err=%v", result, err)
+	}
+
+	// The generators are closed with their owner.
+	_, err = eval(`let it = g(); next(it);`, Limits{Capabilities: &object.Context{Stdout: &bytes.Buffer{}}})
+	if err != nil {
+		t.Fatalf("EvalContext failed: %s", err)
+	}
+	generators.Close()
+	result, err = eval(`next(it)`, Limits{})
+	if errObj, ok := result.(*object.Error); err != nil || !ok || errObj.Message != "the generator is closed" {
+		t.Errorf("the generator is not closed. got=%v, err=%v", result, err)
+	}
+}
+
+func TestGeneratorsAreClosed(t *testing.T) {
+	inputs := []string{
+		`let g = fn() { yield 1; yield 2; }; next(g())`,
+		`let inner = fn() { yield 1; yield 2; }; let outer = fn() { for (x in inner()) { yield x; } }; next(outer())`,
+		`let g = fn() { try { yield 1; } finally { puts("unreachable"); } }; next(g())`,
+	}
+
+	before := runtime.NumGoroutine()
+	for _, input := range inputs {
+		program := parser.New(lexer.New(input)).ParseProgram()
+		for i := 0; i < 300; i++ {
+			var out bytes.Buffer
+			_, err := EvalContext(context.Background(), program, object.NewEnvironment(), Limits{Capabilities: &object.Context{Stdout: &out}})
+			if err != nil || out.Len() != 0 {
+				t.Fatalf("wrong evaluation of %q. err=%v, output=%q", input, err, out.String())
+			}
+			testIntegerObject(t, Eval(program, object.NewEnvironment()), 1)
+		}
+	}
+	// The goroutines of the generators have returned, though they may not have been counted out yet.
+	if after := runtime.NumGoroutine(); after > before+10 {
+		t.Errorf("the goroutines of the generators leak. before=%d, after=%d", before, after)
+	}
+}
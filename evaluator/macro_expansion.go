@@ -0,0 +1,148 @@
+package evaluator
+
+import (
+	"context"
+	"fmt"
+	"monkey/ast"
+	"monkey/object"
+)
+
+// Nested expansions deeper than this fail, which stops a macro which keeps expanding into calls of itself.
+const maxExpansionDepth = 100
+
+// An error of the expansion of a macro call, at the position of the call.
+type MacroError struct {
+	Msg    string
+	Line   int
+	Column int
+	Err    error // The error of EvalContext() which stopped the macro, such as a *budget.StepLimitError, if any.
+}
+
+func (e *MacroError) Error() string { return e.Msg }
+func (e *MacroError) Unwrap() error { return e.Err }
+
+/*
+Define the macros bound by the top-level let statements of the program in env,
+and remove those statements from the program.
+Both the evaluator and the compiler run the program after DefineMacros() and ExpandMacros().
+*/
+func DefineMacros(program *ast.Program, env *object.Environment) {
+	statements := []ast.Statement{}
+	for _, statement := range program.Statements {
+		let, ok := statement.(*ast.LetStatement)
+		if !ok {
+			statements = append(statements, statement)
+			continue
+		}
+		macro, ok := let.Value.(*ast.MacroLiteral)
+		if !ok {
+			statements = append(statements, statement)
+			continue
+		}
+		env.Set(let.Name.Value, &object.Macro{Parameters: macro.Parameters, Body: macro.Body, Env: env})
+	}
+	program.Statements = statements
+}
+
+/*
+Replace the calls of the macros in env by the results of the macros, and return the expanded node.
+A macro is called with its arguments quoted, and has to return a quote of an expression.
+Macro calls in the result are expanded too.
+The macros run with the capabilities of the process, and without budgets.
+*/
+func ExpandMacros(node ast.Node, env *object.Environment) (ast.Node, error) {
+	return ExpandMacrosContext(context.Background(), node, env, Limits{})
+}
+
+/*
+Expand the macros as ExpandMacros() does, running each of them as EvalContext() does with ctx and limits.
+The budgets apply to each macro call apart. A macro which uses one up fails with a *MacroError wrapping its error.
+*/
+func ExpandMacrosContext(ctx context.Context, node ast.Node, env *object.Environment, limits Limits) (ast.Node, error) {
+	x := &expansion{ctx: ctx, limits: limits}
+	return x.expand(node, env, 0)
+}
+
+type expansion struct {
+	ctx    context.Context
+	limits Limits
+}
+
+func (x *expansion) expand(node ast.Node, env *object.Environment, depth int) (ast.Node, error) {
+	var err error
+	expanded := ast.Modify(node, func(node ast.Node) ast.Node {
+		call, ok := node.(*ast.CallExpression)
+		if !ok || err != nil {
+			return node
+		}
+		name, macro, ok := macroOf(call, env)
+		if !ok {
+			return node
+		}
+		// The error of EvalContext() is kept as the cause, so that callers can tell a budget used up.
+		var cause error
+		fail := func(format string, a ...interface{}) ast.Node {
+			tok := ast.StartToken(call)
+			err = &MacroError{Msg: fmt.Sprintf(format, a...), Line: tok.Line, Column: tok.Column, Err: cause}
+			return node
+		}
+
+		if depth == maxExpansionDepth {
+			return fail("macro %s: expansion is nested too deeply", name)
+		}
+		if len(call.Arguments) != len(macro.Parameters) {
+			return fail("macro %s: wrong number of arguments. got=%d, want=%d", name, len(call.Arguments), len(macro.Parameters))
+		}
+
+		evaluated, cause := EvalContext(x.ctx, macro.Body, extendMacroEnv(macro, call.Arguments), x.limits)
+		if cause != nil {
+			return fail("macro %s: %s", name, cause)
+		}
+		evaluated = unwrapReturnValue(evaluated)
+		if errObj, ok := evaluated.(*object.Error); ok {
+			return fail("macro %s: %s", name, errObj.Message)
+		}
+		quote, ok := evaluated.(*object.Quote)
+		if !ok {
+			return fail("macro %s: only a QUOTE can be returned from a macro, got %s", name, typeOf(evaluated))
+		}
+
+		result, expandErr := x.expand(quote.Node, env, depth+1)
+		if expandErr != nil {
+			err = expandErr
+			return node
+		}
+		return result
+	})
+	return expanded, err
+}
+
+// Returns the macro called by the call, if the callee is a name bound to a macro.
+func macroOf(call *ast.CallExpression, env *object.Environment) (string, *object.Macro, bool) {
+	ident, ok := call.Function.(*ast.Identifier)
+	if !ok {
+		return "", nil, false
+	}
+	obj, ok := env.Get(ident.Value)
+	if !ok {
+		return "", nil, false
+	}
+	macro, ok := obj.(*object.Macro)
+	return ident.Value, macro, ok
+}
+
+// Bind the parameters of the macro to the arguments, quoted.
+func extendMacroEnv(macro *object.Macro, args []ast.Expression) *object.Environment {
+	env := object.NewEnclosedEnvironment(macro.Env)
+	for i, param := range macro.Parameters {
+		env.Set(param.Value, &object.Quote{Node: args[i]})
+	}
+	return env
+}
+
+func typeOf(obj object.Object) object.ObjectType {
+	if obj == nil {
+		return object.NULL_OBJ
+	}
+	return obj.Type()
+}
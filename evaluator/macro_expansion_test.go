@@ -0,0 +1,237 @@
+package evaluator
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"monkey/ast"
+	"monkey/budget"
+	"monkey/lexer"
+	"monkey/object"
+	"monkey/parser"
+	"testing"
+)
+
+func TestDefineMacros(t *testing.T) {
+	input := `
+	let number = 1;
+	let function = fn(x, y) { x + y };
+	let mymacro = macro(x, y) { x + y; };
+	`
+
+	env := object.NewEnvironment()
+	program := testParseProgram(input)
+
+	DefineMacros(program, env)
+
+	if len(program.Statements) != 2 {
+		t.Fatalf("wrong number of statements. got=%d", len(program.Statements))
+	}
+	if _, ok := env.Get("number"); ok {
+		t.Fatalf("number should not be defined")
+	}
+	if _, ok := env.Get("function"); ok {
+		t.Fatalf("function should not be defined")
+	}
+
+	obj, ok := env.Get("mymacro")
+	if !ok {
+		t.Fatalf("macro not in environment.")
+	}
+	macro, ok := obj.(*object.Macro)
+	if !ok {
+		t.Fatalf("object is not Macro. got=%T (%+v)", obj, obj)
+	}
+	if len(macro.Parameters) != 2 {
+		t.Fatalf("Wrong number of macro parameters. got=%d", len(macro.Parameters))
+	}
+	if macro.Parameters[0].String() != "x" || macro.Parameters[1].String() != "y" {
+		t.Fatalf("parameters are not 'x' and 'y'. got=%v", macro.Parameters)
+	}
+	if macro.Body.String() != "(x + y)" {
+		t.Fatalf("body is not %q. got=%q", "(x + y)", macro.Body.String())
+	}
+}
+
+func TestExpandMacros(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{
+			`
+			let infixExpression = macro() { quote(1 + 2); };
+			infixExpression();
+			`,
+			`(1 + 2)`,
+		},
+		{
+			`
+			let reverse = macro(a, b) { quote(unquote(b) - unquote(a)); };
+			reverse(2 + 2, 10 - 5);
+			`,
+			`(10 - 5) - (2 + 2)`,
+		},
+		{
+			`
+			let unless = macro(condition, consequence, alternative) {
+				quote(if (!(unquote(condition))) {
+					unquote(consequence);
+				} else {
+					unquote(alternative);
+				});
+			};
+			unless(10 > 5, puts("not greater"), puts("greater"));
+			`,
+			`if (!(10 > 5)) { puts("not greater") } else { puts("greater") }`,
+		},
+		// Macro calls in arguments and in results are expanded too.
+		{
+			`
+			let double = macro(x) { return quote(unquote(x) * 2); };
+			let quadruple = macro(x) { quote(double(double(unquote(x)))) };
+			quadruple(double(a));
+			`,
+			`((a * 2) * 2) * 2`,
+		},
+	}
+
+	for _, tt := range tests {
+		expected := testParseProgram(tt.expected)
+		program := testParseProgram(tt.input)
+
+		env := object.NewEnvironment()
+		DefineMacros(program, env)
+		expanded, err := ExpandMacros(program, env)
+		if err != nil {
+			t.Fatalf("ExpandMacros returned an error: %s", err)
+		}
+
+		if expanded.String() != expected.String() {
+			t.Errorf("not equal. want=%q, got=%q", expected.String(), expanded.String())
+		}
+	}
+}
+
+func TestExpandMacrosErrors(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected MacroError
+	}{
+		{
+			"let m = macro(x) { x };\nlet a = 1;\n  m(1, 2)",
+			MacroError{Msg: "macro m: wrong number of arguments. got=2, want=1", Line: 3, Column: 3},
+		},
+		{
+			"let m = macro() { 1 };\nm()",
+			MacroError{Msg: "macro m: only a QUOTE can be returned from a macro, got INTEGER", Line: 2, Column: 1},
+		},
+		{
+			"let m = macro() { foo };\nm()",
+			MacroError{Msg: "macro m: identifier not found: foo", Line: 2, Column: 1},
+		},
+		{
+			"let m = macro() { quote(m()) };\nm()",
+			MacroError{Msg: "macro m: expansion is nested too deeply", Line: 1, Column: 25},
+		},
+	}
+
+	for _, tt := range tests {
+		program := testParseProgram(tt.input)
+		env := object.NewEnvironment()
+		DefineMacros(program, env)
+
+		_, err := ExpandMacros(program, env)
+		macroErr, ok := err.(*MacroError)
+		if !ok {
+			t.Errorf("expected a *MacroError for %q. got=%T (%v)", tt.input, err, err)
+			continue
+		}
+		if *macroErr != tt.expected {
+			t.Errorf("wrong error. want=%+v, got=%+v", tt.expected, *macroErr)
+		}
+	}
+}
+
+func TestExpandMacrosContext(t *testing.T) {
+	var out bytes.Buffer
+	limits := Limits{MaxSteps: 10000, Capabilities: &object.Context{Stdout: &out}}
+	tests := []struct {
+		input string
+		msg   string
+		check func(err error) bool
+	}{
+		{
+			input: `let m = macro() { puts("sandboxed"); quote(1) }; m()`,
+			check: func(err error) bool { return err == nil },
+		},
+		{
+			// The error of a builtin is the error of the macro, which the expansion cannot go on with.
+			input: `let m = macro() { getenv("HOME"); quote(1) }; m()`,
+			msg:   "macro m: `getenv` is not permitted: no environment",
+			check: func(err error) bool { return errors.Unwrap(err) == nil },
+		},
+		{
+			input: `let m = macro() { let f = fn(x) { f(x) }; f(1) }; m()`,
+			msg:   "macro m: maximum recursion depth exceeded (max depth: 1024)",
+			check: func(err error) bool {
+				var depthErr *RecursionError
+				return errors.As(err, &depthErr)
+			},
+		},
+		{
+			input: `let m = macro() { let f = fn(x) { if (x == 0) { return quote(1) } f(x - 1) }; f(1000) }; m()`,
+			msg:   "macro m: step limit exceeded: max 10000 steps",
+			check: func(err error) bool {
+				var stepErr *budget.StepLimitError
+				return errors.As(err, &stepErr)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		program := testParseProgram(tt.input)
+		env := object.NewEnvironment()
+		DefineMacros(program, env)
+
+		_, err := ExpandMacrosContext(context.Background(), program, env, limits)
+		if tt.msg != "" && (err == nil || err.Error() != tt.msg) {
+			t.Errorf("wrong error for %q. want=%q, got=%v", tt.input, tt.msg, err)
+		}
+		if !tt.check(err) {
+			t.Errorf("unexpected error for %q. got=%T (%v)", tt.input, err, err)
+		}
+	}
+	if out.String() != "sandboxed\n" {
+		t.Errorf("puts does not write to the given stdout. got=%q", out.String())
+	}
+}
+
+// Programs evaluate with the macros of unless and assert expanded.
+func TestEvalExpandedMacros(t *testing.T) {
+	input := `
+	let unless = macro(condition, consequence, alternative) {
+		quote(if (!(unquote(condition))) { unquote(consequence) } else { unquote(alternative) });
+	};
+	let assert = macro(condition, message) {
+		quote(if (!(unquote(condition))) { unquote(message) } else { true });
+	};
+	let results = [unless(1 > 2, 10, 20), assert(1 < 2, "failed")];
+	results[0] + len(results)
+	`
+
+	program := testParseProgram(input)
+	env := object.NewEnvironment()
+	DefineMacros(program, env)
+	expanded, err := ExpandMacros(program, env)
+	if err != nil {
+		t.Fatalf("ExpandMacros returned an error: %s", err)
+	}
+	testIntegerObject(t, Eval(expanded, object.NewEnvironment()), 12)
+}
+
+func testParseProgram(input string) *ast.Program {
+	l := lexer.New(input)
+	p := parser.New(l)
+	return p.ParseProgram()
+}
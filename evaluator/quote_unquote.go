@@ -0,0 +1,97 @@
+package evaluator
+
+import (
+	"fmt"
+	"monkey/ast"
+	"monkey/object"
+	"monkey/token"
+)
+
+/*
+Return the node unevaluated, except for the calls of unquote() in it,
+which are replaced by the nodes of their evaluated arguments.
+The node is copied, so a quote in a function or a macro gives a fresh node for each call.
+*/
+func (e *evaluator) quote(node ast.Node, env *object.Environment) object.Object {
+	var err object.Object
+	node = ast.Modify(ast.Copy(node), func(node ast.Node) ast.Node {
+		call, ok := node.(*ast.CallExpression)
+		if !ok || err != nil || !isCallOf(call, "unquote") {
+			return node
+		}
+		if len(call.Arguments) != 1 {
+			err = newError("wrong number of arguments to unquote. got=%d, want=1", len(call.Arguments))
+			return node
+		}
+
+		unquoted := e.eval(call.Arguments[0], env)
+		if isError(unquoted) {
+			err = unquoted
+			return node
+		}
+		converted, convErr := objectToNode(unquoted, call.Token)
+		if convErr != nil {
+			err = newError("%s", convErr)
+			return node
+		}
+		return converted
+	})
+	if err != nil {
+		return err
+	}
+	return &object.Quote{Node: node}
+}
+
+// Reports whether the call is a call of the identifier name, such as quote(x).
+func isCallOf(call *ast.CallExpression, name string) bool {
+	ident, ok := call.Function.(*ast.Identifier)
+	return ok && ident.Value == name
+}
+
+// Convert an unquoted value into an expression, whose tokens are placed at the position of tok.
+func objectToNode(obj object.Object, tok token.Token) (ast.Expression, error) {
+	at := func(t token.TokenType, literal string) token.Token {
+		return token.Token{Type: t, Literal: literal, Line: tok.Line, Column: tok.Column}
+	}
+
+	switch obj := obj.(type) {
+	case *object.Integer:
+		return &ast.IntegerLiteral{Token: at(token.INT, fmt.Sprintf("%d", obj.Value)), Value: obj.Value}, nil
+	case *object.Boolean:
+		if obj.Value {
+			return &ast.Boolean{Token: at(token.TRUE, "true"), Value: true}, nil
+		}
+		return &ast.Boolean{Token: at(token.FALSE, "false"), Value: false}, nil
+	case *object.String:
+		return &ast.StringLiteral{Token: at(token.STRING, obj.Value), Value: obj.Value}, nil
+	case *object.Array:
+		elements := make([]ast.Expression, len(obj.Elements))
+		for i, el := range obj.Elements {
+			node, err := objectToNode(el, tok)
+			if err != nil {
+				return nil, err
+			}
+			elements[i] = node
+		}
+		return &ast.ArrayLiteral{Token: at(token.LBRACKET, "["), Elements: elements}, nil
+	case *object.Hash:
+		pairs := make(map[ast.Expression]ast.Expression, len(obj.Pairs))
+		for _, pair := range obj.Pairs {
+			key, err := objectToNode(pair.Key, tok)
+			if err != nil {
+				return nil, err
+			}
+			value, err := objectToNode(pair.Value, tok)
+			if err != nil {
+				return nil, err
+			}
+			pairs[key] = value
+		}
+		return &ast.HashLiteral{Token: at(token.LBRACE, "{"), Pairs: pairs}, nil
+	case *object.Quote:
+		if expr, ok := obj.Node.(ast.Expression); ok {
+			return ast.Copy(expr).(ast.Expression), nil
+		}
+	}
+	return nil, fmt.Errorf("cannot unquote a value of type %s", obj.Type())
+}
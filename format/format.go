@@ -0,0 +1,444 @@
+/*
+Package format prints Monkey programs in the canonical layout:
+one statement per line, blocks indented by four spaces, and only the parentheses which are necessary.
+Comments and single blank lines between statements are preserved.
+*/
+package format
+
+import (
+	"bytes"
+	"fmt"
+	"monkey/ast"
+	"monkey/lexer"
+	"monkey/parser"
+	"strings"
+)
+
+const indentation = "    "
+
+// Format the source code. Fails when the source code has parse errors, which would lose parts of it.
+func Source(src []byte) ([]byte, error) {
+	l := lexer.New(string(src))
+	p := parser.New(l)
+	program := p.ParseProgram()
+	if len(p.ErrorDetails()) != 0 {
+		msgs := []string{}
+		for _, e := range p.ErrorDetails() {
+			msgs = append(msgs, fmt.Sprintf("%d:%d: %s", e.Line, e.Column, e.Msg))
+		}
+		return nil, fmt.Errorf("%s", strings.Join(msgs, "\n"))
+	}
+	return Program(program, l.Comments()), nil
+}
+
+// Print the program with the comments, which are taken from the lexer which read it.
+func Program(program *ast.Program, comments []lexer.Comment) []byte {
+	p := &printer{comments: comments}
+	p.statements(program.Statements, 0, -1)
+	for p.next < len(p.comments) {
+		p.comment()
+	}
+	if p.buf.Len() != 0 {
+		p.buf.WriteString("\n")
+	}
+	return p.buf.Bytes()
+}
+
+// Print a node without comments. Blocks are laid out on multiple lines as in Program().
+func Node(node ast.Node) string {
+	p := &printer{}
+	switch node := node.(type) {
+	case *ast.Program:
+		p.statements(node.Statements, 0, -1)
+	case ast.Statement:
+		p.statement(node, true)
+	case ast.Expression:
+		p.expression(node, parser.LOWEST)
+	}
+	return p.buf.String()
+}
+
+type printer struct {
+	buf    bytes.Buffer
+	indent int
+
+	comments []lexer.Comment
+	next     int             // Index of the first comment which has not been printed or passed over. It only moves forward.
+	pending  []lexer.Comment // Comments passed over inside the current statement, printed after it.
+
+	line  int  // Source line of the item printed last.
+	first bool // Whether no item has been printed in the current block.
+}
+
+/*
+Print the statements of a block, each on its own line.
+Comments from the begin line up to before the end line are printed among them.
+end is -1 for the whole program.
+*/
+func (p *printer) statements(statements []ast.Statement, begin, end int) {
+	p.first = true
+	for i, s := range statements {
+		for p.hasComment(begin, startLine(s)) {
+			p.comment()
+		}
+
+		p.startItem(startLine(s))
+		p.statement(s, i == len(statements)-1 || needsNoSemicolon(s, statements[i+1]))
+		p.line = lastLine(s)
+		before := p.line + 1
+		if end != -1 && before > end { // The comments on the line which closes the block follow it.
+			before = end
+		}
+		p.skip(before)
+		p.trail()
+	}
+	if end != -1 {
+		for p.hasComment(begin, end) {
+			p.comment()
+		}
+	}
+}
+
+// Reports whether the next comment is in the lines [begin, before).
+func (p *printer) hasComment(begin, before int) bool {
+	if p.next == len(p.comments) {
+		return false
+	}
+	line := p.comments[p.next].Line
+	return begin <= line && line < before
+}
+
+// Pass over the comments before the line, which are inside an expression, to print them after its statement.
+func (p *printer) skip(before int) {
+	for p.next < len(p.comments) && p.comments[p.next].Line < before {
+		p.pending = append(p.pending, p.comments[p.next])
+		p.next++
+	}
+}
+
+// Print the comments inside the statement printed last. The first one trails it, and the others follow on lines of their own.
+func (p *printer) trail() {
+	for i, c := range p.pending {
+		if i == 0 {
+			p.buf.WriteString(" " + c.Text)
+			continue
+		}
+		p.newline()
+		p.buf.WriteString(c.Text)
+	}
+	p.pending = nil
+}
+
+func (p *printer) comment() {
+	c := p.comments[p.next]
+	p.next++
+	p.startItem(c.Line)
+	p.buf.WriteString(c.Text)
+	p.line = c.Line
+}
+
+// Start a new line for a statement or a comment, keeping a blank line which separated it from the previous item.
+func (p *printer) startItem(line int) {
+	if !p.first && line > p.line+1 {
+		p.buf.WriteString("\n")
+	}
+	p.first = false
+	if p.buf.Len() != 0 {
+		p.newline()
+	}
+}
+
+func (p *printer) newline() {
+	p.buf.WriteString("\n" + strings.Repeat(indentation, p.indent))
+}
+
+func (p *printer) statement(s ast.Statement, last bool) {
+	switch s := s.(type) {
+	case *ast.LetStatement:
+		if s.Exported {
+			p.buf.WriteString("export ")
+		}
+		p.buf.WriteString("let " + s.Name.Value + " = ")
+		p.expression(s.Value, parser.LOWEST)
+		p.buf.WriteString(";")
+	case *ast.ImportStatement:
+		p.buf.WriteString(`import "` + s.Path.Value + `";`)
+	case *ast.ReturnStatement:
+		p.buf.WriteString("return")
+		if s.ReturnValue != nil {
+			p.buf.WriteString(" ")
+			p.expression(s.ReturnValue, parser.LOWEST)
+		}
+		p.buf.WriteString(";")
+	case *ast.ThrowStatement:
+		p.buf.WriteString("throw ")
+		p.expression(s.Value, parser.LOWEST)
+		p.buf.WriteString(";")
+	case *ast.YieldStatement:
+		p.buf.WriteString("yield ")
+		p.expression(s.Value, parser.LOWEST)
+		p.buf.WriteString(";")
+	case *ast.ForStatement:
+		p.buf.WriteString("for (" + s.Variable.Value + " in ")
+		p.expression(s.Iterable, parser.LOWEST)
+		p.buf.WriteString(") ")
+		p.block(s.Body)
+	case *ast.ExpressionStatement:
+		p.expression(s.Expression, parser.LOWEST)
+		if !last {
+			p.buf.WriteString(";")
+		}
+	case *ast.BlockStatement:
+		p.block(s)
+	}
+}
+
+/*
+The value of the last expression statement of a block is its result, so it is not followed by a semicolon.
+Nor is an if or try expression, unless the next statement would be parsed as its continuation, such as `-x` or `(x)`.
+*/
+func needsNoSemicolon(s, next ast.Statement) bool {
+	es, ok := s.(*ast.ExpressionStatement)
+	if !ok {
+		return false
+	}
+	switch es.Expression.(type) {
+	case *ast.IfExpression, *ast.TryExpression:
+	default:
+		return false
+	}
+	nextStatement, ok := next.(*ast.ExpressionStatement)
+	return !ok || !startsWithOperator(nextStatement.Expression)
+}
+
+// Reports whether the printed expression starts with a token which can continue a previous expression.
+func startsWithOperator(e ast.Expression) bool {
+	switch e := e.(type) {
+	case *ast.PrefixExpression, *ast.ArrayLiteral:
+		return true
+	case *ast.InfixExpression:
+		return precedenceOf(e.Left) < parser.Precedence(e.Token.Type) || startsWithOperator(e.Left)
+	case *ast.CallExpression:
+		return precedenceOf(e.Function) < parser.CALL || startsWithOperator(e.Function)
+	case *ast.IndexExpression:
+		return precedenceOf(e.Left) < parser.CALL || startsWithOperator(e.Left)
+	}
+	return false
+}
+
+// Comments before the block which have not been printed are inside the enclosing expression, and are passed over.
+func (p *printer) block(b *ast.BlockStatement) {
+	p.skip(b.Token.Line)
+	if len(b.Statements) == 0 && !p.hasComment(b.Token.Line, b.EndToken.Line) {
+		p.buf.WriteString("{}")
+		return
+	}
+
+	first, line, pending := p.first, p.line, p.pending
+	p.pending = nil
+	p.buf.WriteString("{")
+	p.indent++
+	p.trailComment(b.Token.Line, len(b.Statements) == 0 || startLine(b.Statements[0]) > b.Token.Line)
+	p.statements(b.Statements, b.Token.Line, b.EndToken.Line)
+	p.indent--
+	p.newline()
+	p.buf.WriteString("}")
+	p.first, p.line, p.pending = first, line, pending
+}
+
+// Print the comment on the line as a trailing one, if nothing else follows the item printed last on that line.
+func (p *printer) trailComment(line int, alone bool) {
+	if alone && p.hasComment(line, line+1) {
+		p.buf.WriteString(" " + p.comments[p.next].Text)
+		p.next++
+	}
+}
+
+// Print an expression which is an operand of an operator of the precedence.
+func (p *printer) expression(e ast.Expression, precedence int) {
+	if precedenceOf(e) < precedence {
+		p.buf.WriteString("(")
+		defer p.buf.WriteString(")")
+	}
+
+	switch e := e.(type) {
+	case *ast.Identifier:
+		p.buf.WriteString(e.Value)
+	case *ast.IntegerLiteral:
+		p.buf.WriteString(e.Token.Literal)
+	case *ast.StringLiteral:
+		p.buf.WriteString(`"` + e.Value + `"`)
+	case *ast.Boolean:
+		p.buf.WriteString(e.Token.Literal)
+	case *ast.PrefixExpression:
+		p.buf.WriteString(e.Operator)
+		p.expression(e.Right, parser.PREFIX)
+	case *ast.SpawnExpression:
+		p.buf.WriteString("spawn ")
+		p.expression(e.Function, parser.PREFIX)
+	case *ast.InfixExpression:
+		operator := parser.Precedence(e.Token.Type)
+		p.expression(e.Left, operator)
+		p.buf.WriteString(" " + e.Operator + " ")
+		p.expression(e.Right, operator+1) // Operators are left associative.
+	case *ast.IfExpression:
+		p.buf.WriteString("if (")
+		p.expression(e.Condition, parser.LOWEST)
+		p.buf.WriteString(") ")
+		p.block(e.Consequence)
+		if e.Alternative != nil {
+			p.buf.WriteString(" else ")
+			p.block(e.Alternative)
+		}
+	case *ast.TryExpression:
+		p.buf.WriteString("try ")
+		p.block(e.Body)
+		if e.Catch != nil {
+			p.buf.WriteString(" catch (" + e.CatchParameter.Value + ") ")
+			p.block(e.Catch)
+		}
+		if e.Finally != nil {
+			p.buf.WriteString(" finally ")
+			p.block(e.Finally)
+		}
+	case *ast.FunctionLiteral:
+		p.buf.WriteString("fn(" + parameters(e.Parameters) + ") ")
+		p.block(e.Body)
+	case *ast.MacroLiteral:
+		p.buf.WriteString("macro(" + parameters(e.Parameters) + ") ")
+		p.block(e.Body)
+	case *ast.CallExpression:
+		p.expression(e.Function, parser.CALL)
+		p.buf.WriteString("(")
+		p.expressions(e.Arguments)
+		p.buf.WriteString(")")
+	case *ast.IndexExpression:
+		p.expression(e.Left, parser.CALL)
+		p.buf.WriteString("[")
+		p.expression(e.Index, parser.LOWEST)
+		p.buf.WriteString("]")
+	case *ast.ArrayLiteral:
+		p.buf.WriteString("[")
+		p.skip(e.Token.Line)
+		if p.hasComment(e.Token.Line, e.EndToken.Line) {
+			p.elements(e.Elements, e.Token.Line, e.EndToken.Line)
+		} else {
+			p.expressions(e.Elements)
+		}
+		p.buf.WriteString("]")
+	case *ast.HashLiteral:
+		p.buf.WriteString("{")
+		for i, key := range e.SortedKeys() {
+			if i > 0 {
+				p.buf.WriteString(", ")
+			}
+			p.expression(key, parser.LOWEST)
+			p.buf.WriteString(": ")
+			p.expression(e.Pairs[key], parser.LOWEST)
+		}
+		p.buf.WriteString("}")
+	}
+}
+
+func (p *printer) expressions(list []ast.Expression) {
+	for i, e := range list {
+		if i > 0 {
+			p.buf.WriteString(", ")
+		}
+		p.expression(e, parser.LOWEST)
+	}
+}
+
+/*
+Print the elements of a literal which has comments between its brackets, on the lines [begin, end), one element per line
+with the comments among them. Comments inside the elements other than in their blocks are passed over.
+*/
+func (p *printer) elements(list []ast.Expression, begin, end int) {
+	p.indent++
+	p.trailComment(begin, len(list) == 0 || startLine(list[0]) > begin)
+	line := begin + 1
+	for i, e := range list {
+		for p.hasComment(line, startLine(e)) {
+			p.newline()
+			p.buf.WriteString(p.comments[p.next].Text)
+			p.next++
+		}
+		p.newline()
+		p.expression(e, parser.LOWEST)
+		if i < len(list)-1 {
+			p.buf.WriteString(",")
+		}
+		line = lastLine(e)
+		p.skip(line)
+		// A comment after an element trails it, unless another element or the closing bracket follows on the same line.
+		if i < len(list)-1 && startLine(list[i+1]) > line || i == len(list)-1 && line < end {
+			p.trailComment(line, true)
+			line++
+		}
+	}
+	for p.hasComment(line, end) {
+		p.newline()
+		p.buf.WriteString(p.comments[p.next].Text)
+		p.next++
+	}
+	p.indent--
+	p.newline()
+}
+
+func parameters(list []*ast.Identifier) string {
+	params := []string{}
+	for _, param := range list {
+		params = append(params, param.Value)
+	}
+	return strings.Join(params, ", ")
+}
+
+// Operators bind their operands tighter than this precedence. Other expressions never need parentheses.
+func precedenceOf(e ast.Expression) int {
+	switch e := e.(type) {
+	case *ast.InfixExpression:
+		return parser.Precedence(e.Token.Type)
+	case *ast.PrefixExpression, *ast.SpawnExpression:
+		return parser.PREFIX
+	}
+	return parser.INDEX + 1
+}
+
+func startLine(node ast.Node) int {
+	return ast.StartToken(node).Line
+}
+
+// Returns the last source line of the node, as far as the positions of its tokens tell.
+func lastLine(node ast.Node) int {
+	line := startLine(node)
+	ast.Inspect(node, func(n ast.Node) bool {
+		if n == nil {
+			return false
+		}
+		if l := startLine(n); l > line {
+			line = l
+		}
+		if l := endLine(n); l > line {
+			line = l
+		}
+		return true
+	})
+	return line
+}
+
+// Returns the line of the token which closes the node, or 0 if it has none.
+func endLine(node ast.Node) int {
+	switch n := node.(type) {
+	case *ast.BlockStatement:
+		return n.EndToken.Line
+	case *ast.CallExpression:
+		return n.EndToken.Line
+	case *ast.ArrayLiteral:
+		return n.EndToken.Line
+	case *ast.HashLiteral:
+		return n.EndToken.Line
+	case *ast.IndexExpression:
+		return n.EndToken.Line
+	}
+	return 0
+}
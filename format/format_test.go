@@ -0,0 +1,237 @@
+package format
+
+import (
+	"flag"
+	"io/ioutil"
+	"monkey/ast"
+	"monkey/lexer"
+	"monkey/parser"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files of testdata with the output")
+
+func TestSource(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"", ""},
+		{"let x=1;x", "let x = 1;\nx\n"},
+		{`import "lib/math" export let f=fn(){add(1)}`, "import \"lib/math\";\nexport let f = fn() {\n    add(1)\n};\n"},
+		{"let x = 1 let y = 2", "let x = 1;\nlet y = 2;\n"},
+		{"puts(1) puts(2)", "puts(1);\nputs(2)\n"},
+		{
+			"let add = fn(a,b){ return a+b; }; add(1,2)",
+			"let add = fn(a, b) {\n    return a + b;\n};\nadd(1, 2)\n",
+		},
+		{
+			"let m = macro(a,b){ quote(unquote(a)+unquote(b)) }; m(1,2)",
+			"let m = macro(a, b) {\n    quote(unquote(a) + unquote(b))\n};\nm(1, 2)\n",
+		},
+		{
+			"let f = fn() { }; if (true) {} else { 1 }",
+			"let f = fn() {};\nif (true) {} else {\n    1\n}\n",
+		},
+		// Only the necessary parentheses are kept.
+		{"(1 + 2) * 3 - (4 - 5) - 6 / (7 * 8)", "(1 + 2) * 3 - (4 - 5) - 6 / (7 * 8)\n"},
+		{"((a + b)) + (c * d) + -(e) + -(f + g) + !(-h)", "a + b + c * d + -e + -(f + g) + !-h\n"},
+		{"(a < b) == (c > d) != true", "a < b == c > d != true\n"},
+		{"(-a)[0] + (f)(1)[2] + (fn(x) { x })(3)", "(-a)[0] + f(1)[2] + fn(x) {\n    x\n}(3)\n"},
+		{`let h = {"b": 1, "a": [1, 2], 3: true};h["a"]`, "let h = {\"b\": 1, \"a\": [1, 2], 3: true};\nh[\"a\"]\n"},
+		{
+			"if (x) { if (y) { 1 } else { 2 } }",
+			"if (x) {\n    if (y) {\n        1\n    } else {\n        2\n    }\n}\n",
+		},
+		// An if expression is followed by a semicolon only when the next statement could continue it.
+		{"if (x) { 1 }; -1", "if (x) {\n    1\n};\n-1\n"},
+		{"if (x) { 1 }; (a + b)(1)", "if (x) {\n    1\n};\n(a + b)(1)\n"},
+		{"if (x) { 1 }; [1]", "if (x) {\n    1\n};\n[1]\n"},
+		{"if (x) { 1 }; y", "if (x) {\n    1\n}\ny\n"},
+		{"if (x) { 1 }; let y = 2;", "if (x) {\n    1\n}\nlet y = 2;\n"},
+		{"try { f() } catch (e) { throw e; } finally { g() }; -1",
+			"try {\n    f()\n} catch (e) {\n    throw e;\n} finally {\n    g()\n};\n-1\n"},
+		{"try { f() } finally { g() }", "try {\n    f()\n} finally {\n    g()\n}\n"},
+		{"let g = fn(xs) { for (x in xs) { yield x * 2; } };", "let g = fn(xs) {\n    for (x in xs) {\n        yield x * 2;\n    }\n};\n"},
+		{"let t = spawn worker(ch,1); spawn fn() { send(ch, 2) }", "let t = spawn worker(ch, 1);\nspawn fn() {\n    send(ch, 2)\n}\n"},
+		{"(spawn f) + 1", "spawn f + 1\n"},
+		{"spawn (a + b)", "spawn (a + b)\n"},
+		// Single blank lines are kept, more are collapsed.
+		{"let a = 1;\n\n\n\nlet b = 2;\nlet c = 3;", "let a = 1;\n\nlet b = 2;\nlet c = 3;\n"},
+		{"\n\nlet f = fn() {\n\n  1;\n\n  2\n\n};", "let f = fn() {\n    1;\n\n    2\n};\n"},
+	}
+
+	for _, tt := range tests {
+		output, err := Source([]byte(tt.input))
+		if err != nil {
+			t.Fatalf("Source(%q) returned an error: %s", tt.input, err)
+		}
+		if string(output) != tt.expected {
+			t.Errorf("wrong output for %q.\nwant=%q\ngot= %q", tt.input, tt.expected, output)
+		}
+		checkEquivalent(t, tt.input, string(output))
+		checkIdempotent(t, string(output))
+	}
+}
+
+func TestComments(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"// only a comment", "// only a comment\n"},
+		{
+			"// header\n\n// about x\nlet x = 1; // one\n// footer",
+			"// header\n\n// about x\nlet x = 1; // one\n// footer\n",
+		},
+		{
+			"let f = fn(a) { // on the brace\n  // inside\n  a // the result\n  // at the end\n}; // after",
+			"let f = fn(a) { // on the brace\n    // inside\n    a // the result\n    // at the end\n}; // after\n",
+		},
+		{"let f = fn() { // nothing yet\n};", "let f = fn() { // nothing yet\n};\n"},
+		{"if (x) { 1 } else { // never\n  2 }", "if (x) {\n    1\n} else { // never\n    2\n}\n"},
+		{"if (x) { 1 } // after the block", "if (x) {\n    1\n} // after the block\n"},
+		{"if (x) { if (y) { // both\n  1 } }", "if (x) {\n    if (y) { // both\n        1\n    }\n}\n"},
+		{
+			"if (x) {\n  // nothing yet\n} else {\n  2\n}",
+			"if (x) {\n    // nothing yet\n} else {\n    2\n}\n",
+		},
+		// An array with comments between its elements is laid out one element per line.
+		{
+			"let a = [1, // one\n  2];\nlet b = 3;",
+			"let a = [\n    1, // one\n    2\n];\nlet b = 3;\n",
+		},
+		{
+			"let a = [ // numbers\n  // the first ones\n  1, 2, // two\n  fn() { 3 }\n  // more later\n];",
+			"let a = [ // numbers\n    // the first ones\n    1,\n    2, // two\n    fn() {\n        3\n    }\n    // more later\n];\n",
+		},
+		{"let a = [ // none\n];", "let a = [ // none\n];\n"},
+		// Comments inside other expressions are moved after their statement.
+		{"let a = f(1, // one\n  2);", "let a = f(1, 2); // one\n"},
+		{
+			"let h = {\n  // the key\n  \"a\": fn() { 1 }\n};",
+			"let h = {\"a\": fn() {\n    1\n}}; // the key\n",
+		},
+		{"let x = 10 / 2; //no space", "let x = 10 / 2; //no space\n"},
+		// A comment inside an expression does not move the comments of the blocks after it out of them.
+		{
+			"let h = {\n  \"a\": 1, // one\n  \"b\": fn() {\n    // inside\n    2\n  }\n};\nlet c = 3; // three",
+			"let h = {\"a\": 1, \"b\": fn() {\n    // inside\n    2\n}}; // one\nlet c = 3; // three\n",
+		},
+		{
+			"f(1, // first\n  fn(x) {\n    // body\n    x\n  }, // second\n  2);",
+			"f(1, fn(x) {\n    // body\n    x\n}, 2) // first\n// second\n",
+		},
+		{
+			"let g = fn(a, // the first\n  b) {\n  // sum\n  a + b // result\n};",
+			"let g = fn(a, b) {\n    // sum\n    a + b // result\n}; // the first\n",
+		},
+		{
+			"let f = fn() {\n  let h = {\"a\": [1, // one\n    2], \"b\": fn() {\n      // nested\n      3\n    }};\n  // after h\n  h\n};",
+			"let f = fn() {\n    let h = {\"a\": [\n        1, // one\n        2\n    ], \"b\": fn() {\n        // nested\n        3\n    }};\n    // after h\n    h\n};\n",
+		},
+	}
+
+	for _, tt := range tests {
+		output, err := Source([]byte(tt.input))
+		if err != nil {
+			t.Fatalf("Source(%q) returned an error: %s", tt.input, err)
+		}
+		if string(output) != tt.expected {
+			t.Errorf("wrong output for %q.\nwant=%q\ngot= %q", tt.input, tt.expected, output)
+		}
+		checkEquivalent(t, tt.input, string(output))
+		checkIdempotent(t, string(output))
+	}
+}
+
+// Each testdata/*.mk is formatted into the .golden file next to it, which formats into itself.
+func TestGolden(t *testing.T) {
+	inputs, err := filepath.Glob(filepath.Join("testdata", "*.mk"))
+	if err != nil || len(inputs) == 0 {
+		t.Fatalf("no inputs in testdata: %v", err)
+	}
+
+	for _, input := range inputs {
+		src, err := ioutil.ReadFile(input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		output, err := Source(src)
+		if err != nil {
+			t.Fatalf("%s: %s", input, err)
+		}
+
+		golden := strings.TrimSuffix(input, ".mk") + ".golden"
+		if *update {
+			if err := ioutil.WriteFile(golden, output, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		expected, err := ioutil.ReadFile(golden)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(output) != string(expected) {
+			t.Errorf("%s: wrong output.\nwant=\n%s\ngot=\n%s", input, expected, output)
+		}
+		checkEquivalent(t, string(src), string(output))
+		checkIdempotent(t, string(expected))
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	_, err := Source([]byte("let x = 1;\nlet = 2;"))
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	expected := "2:5: expected next token to be IDENT, got = instead.\n2:5: no prefix parse function for = found"
+	if err.Error() != expected {
+		t.Errorf("wrong error.\nwant=%q\ngot= %q", expected, err)
+	}
+}
+
+func TestNode(t *testing.T) {
+	program := parseProgram(t, "let f = fn(x) { x * (2 + 3) };")
+	let := program.Statements[0].(*ast.LetStatement)
+
+	if got := Node(let.Value); got != "fn(x) {\n    x * (2 + 3)\n}" {
+		t.Errorf("wrong expression: %q", got)
+	}
+	if got := Node(let); got != "let f = fn(x) {\n    x * (2 + 3)\n};" {
+		t.Errorf("wrong statement: %q", got)
+	}
+}
+
+// The output has to be parsed into the same program as the input.
+func checkEquivalent(t *testing.T, input, output string) {
+	t.Helper()
+	want := parseProgram(t, input).String()
+	got := parseProgram(t, output).String()
+	if want != got {
+		t.Errorf("formatting changed the program.\ninput=%q\noutput=%q\nwant=%s\ngot= %s", input, output, want, got)
+	}
+}
+
+func checkIdempotent(t *testing.T, formatted string) {
+	t.Helper()
+	again, err := Source([]byte(formatted))
+	if err != nil {
+		t.Fatalf("formatted source has errors: %s\n%s", err, formatted)
+	}
+	if string(again) != formatted {
+		t.Errorf("formatting is not idempotent.\nonce= %q\ntwice=%q", formatted, again)
+	}
+}
+
+func parseProgram(t *testing.T, input string) *ast.Program {
+	t.Helper()
+	p := parser.New(lexer.New(input))
+	program := p.ParseProgram()
+	if len(p.Errors()) != 0 {
+		t.Fatalf("parser errors for %q: %v", input, p.Errors())
+	}
+	return program
+}
@@ -0,0 +1,25 @@
+// Comments after an opening brace stay on its line.
+let clamp = fn(x, low, high) { // both bounds are inclusive
+  if (x < low) { // too small
+    return low;
+  }
+  if (x > high) { return high; } // too large
+  x
+};
+
+let empty = fn() { // to do
+};
+
+// Comments between the elements of an array stay in it.
+let primes = [ // the first ones
+  2, 3, // the odd ones follow
+  5,
+  // seven is next
+  7
+  // and so on
+];
+
+let table = [[1, // one
+  2], fn(x) { // a function
+    x
+  }];
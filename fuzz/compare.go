@@ -0,0 +1,168 @@
+package fuzz
+
+import (
+	"context"
+	"fmt"
+	"monkey/ast"
+	"monkey/budget"
+	"monkey/compiler"
+	"monkey/evaluator"
+	"monkey/lexer"
+	"monkey/object"
+	"monkey/parser"
+	"monkey/vm"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Budgets of each engine, which stop the programs running too long. These are not compared.
+const (
+	maxSteps        = 1000000
+	maxInstructions = 1000000
+)
+
+// A program on which the engines disagree.
+type Divergence struct {
+	Program string
+	VM      string // The result of the VM, as described by object.Describe.
+	Eval    string // The result of the evaluator.
+}
+
+func (d *Divergence) Error() string {
+	return fmt.Sprintf("the engines diverge:\n  vm:   %s\n  eval: %s\nprogram:\n%s", d.VM, d.Eval, d.Program)
+}
+
+/*
+Errors which the engines word differently, each rewritten to a common wording before the messages are compared.
+Any other difference of the messages is a divergence.
+*/
+var equivalentMessages = []struct {
+	eval, vm *regexp.Regexp
+	common   string
+}{
+	// The VM describes neither the operator nor the types, and swaps the operands of <.
+	{
+		eval:   regexp.MustCompile(`^(?:type mismatch|unknown operator): \w+ [<>] \w+$`),
+		vm:     regexp.MustCompile(`^unknown operator: \d+, \(.*\)$`),
+		common: "unsupported operand types of a comparison",
+	},
+	{
+		eval:   regexp.MustCompile(`^(?:type mismatch|unknown operator): (\w+) \S+ (\w+)$`),
+		vm:     regexp.MustCompile(`^unsupported types for binary operation: (\w+) (\w+)$`),
+		common: "unsupported operand types: $1 $2",
+	},
+	{
+		eval:   regexp.MustCompile(`^unknown operator: -(\w+)$`),
+		vm:     regexp.MustCompile(`^unsupported type for negation: (\w+)$`),
+		common: "unsupported operand type: -$1",
+	},
+}
+
+// Returns the message of an error of the engine in the common wording, if it has one.
+func normalize(message string, vm bool) string {
+	for _, m := range equivalentMessages {
+		pattern := m.eval
+		if vm {
+			pattern = m.vm
+		}
+		if pattern.MatchString(message) {
+			return pattern.ReplaceAllString(message, m.common)
+		}
+	}
+	return message
+}
+
+/*
+Run the program on the evaluator and on the VM, and return a *Divergence if their results differ.
+The results are a value, a runtime error, a value thrown and not caught, or a compile error.
+The messages of the errors are compared once normalized, both of the uncaught errors and of the caught ones.
+Programs which use up a budget, or which do not parse, are skipped and return nil.
+*/
+func Compare(src string) error {
+	p := parser.New(lexer.New(src))
+	program := p.ParseProgram()
+	if len(p.Errors()) != 0 {
+		return nil
+	}
+	// The evaluator returns a caught error and an uncaught one alike, so the last value is put in an array.
+	if n := len(program.Statements); n != 0 {
+		if last, ok := program.Statements[n-1].(*ast.ExpressionStatement); ok {
+			last.Expression = &ast.ArrayLiteral{Token: last.Token, Elements: []ast.Expression{last.Expression}}
+		}
+	}
+
+	evaluated, ok := runEval(ast.Copy(program))
+	if !ok {
+		return nil
+	}
+	compiled, ok := runVM(program)
+	if !ok {
+		return nil
+	}
+	if evaluated != compiled {
+		return &Divergence{Program: src, VM: compiled, Eval: evaluated}
+	}
+	return nil
+}
+
+// Returns the described result of the evaluator, or false if it used up a budget.
+func runEval(program ast.Node) (string, bool) {
+	result, err := evaluator.EvalContext(context.Background(), program, object.NewEnvironment(), evaluator.Limits{MaxSteps: maxSteps})
+	if err != nil {
+		return "", false
+	}
+	if errObj, ok := result.(*object.Error); ok {
+		if errObj.Value != nil {
+			return "uncaught exception: " + describe(errObj.Value, false), true
+		}
+		return "runtime error: " + normalize(errObj.Message, false), true
+	}
+	return describe(result, false), true
+}
+
+// Returns the described result of the VM, or false if it used up a budget.
+func runVM(program ast.Node) (string, bool) {
+	comp := compiler.New()
+	if err := comp.Compile(program); err != nil {
+		return "compile error", true
+	}
+	config := vm.DefaultConfig()
+	config.MaxInstructions = maxInstructions
+	machine := vm.New(comp.ByteCode(), config)
+	err := machine.Run()
+	switch err := err.(type) {
+	case nil:
+		return describe(machine.LastPoppedStackElem(), true), true
+	case *vm.UncaughtError:
+		if errObj, ok := err.Value.(*object.Error); ok {
+			return "runtime error: " + normalize(errObj.Message, true), true
+		}
+		return "uncaught exception: " + describe(err.Value, true), true
+	case *budget.StepLimitError, *budget.MemoryLimitError, *vm.RecursionError:
+		return "", false
+	}
+	return "error: " + err.Error(), true
+}
+
+// Describes the value of the engine as object.Describe does, except for caught errors, whose messages are normalized.
+func describe(o object.Object, vm bool) string {
+	switch o := o.(type) {
+	case *object.Error:
+		return "<error: " + normalize(o.Message, vm) + ">"
+	case *object.Array:
+		elements := make([]string, len(o.Elements))
+		for i, e := range o.Elements {
+			elements[i] = describe(e, vm)
+		}
+		return "[" + strings.Join(elements, ", ") + "]"
+	case *object.Hash:
+		pairs := make([]string, 0, len(o.Pairs))
+		for _, pair := range o.Pairs {
+			pairs = append(pairs, describe(pair.Key, vm)+": "+describe(pair.Value, vm))
+		}
+		sort.Strings(pairs)
+		return "{" + strings.Join(pairs, ", ") + "}"
+	}
+	return object.Describe(o)
+}
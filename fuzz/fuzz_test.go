@@ -0,0 +1,136 @@
+package fuzz
+
+import (
+	"monkey/ast"
+	"monkey/lexer"
+	"monkey/parser"
+	"testing"
+)
+
+func TestGeneratedProgramsParse(t *testing.T) {
+	for seed := int64(0); seed < 200; seed++ {
+		src := NewGenerator(seed).Program()
+		p := parser.New(lexer.New(src))
+		p.ParseProgram()
+		if len(p.Errors()) != 0 {
+			t.Fatalf("program of seed %d has parser errors %q:\n%s", seed, p.Errors(), src)
+		}
+	}
+}
+
+func TestGeneratorIsDeterministic(t *testing.T) {
+	for seed := int64(0); seed < 20; seed++ {
+		first, second := NewGenerator(seed).Program(), NewGenerator(seed).Program()
+		if first != second {
+			t.Fatalf("programs of seed %d differ:\n%s\n%s", seed, first, second)
+		}
+	}
+}
+
+func TestCompare(t *testing.T) {
+	tests := []string{
+		"1 + 2 * 3",
+		`{"a": [1, 2], "b": fn(x) { x }}`,
+		"10 / 0",
+		`let f = fn(x) { throw x }; try { f(1) } catch (e) { e + 1 }`,
+		"[1, 2][5] + 1",
+		`let x = try { len(1) } catch (e) { e }; [x, 1]`,
+		`try { 1 + true } catch (e) { e }`,
+		"let = ;", // Not parsed, so skipped.
+	}
+
+	for _, tt := range tests {
+		if err := Compare(tt); err != nil {
+			t.Errorf("%s", err)
+		}
+	}
+}
+
+func TestOutcomes(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"1 + true", "runtime error: unsupported operand types: INTEGER BOOLEAN"},
+		{"-[1]", "runtime error: unsupported operand type: -ARRAY"},
+		{"1 < true", "runtime error: unsupported operand types of a comparison"},
+		{"10 / 0", "runtime error: division by zero"},
+		{"throw [1, 2]", `uncaught exception: [1, 2]`},
+		{`let e = try { len(1) } catch (e) { e }; throw e`, "runtime error: argument to `len` not supported, got=INTEGER"},
+		{`[try { len(1) } catch (e) { e }, "a"]`, "[<error: argument to `len` not supported, got=INTEGER>, \"a\"]"},
+		{`{"a": fn() { 1 }}`, `{"a": <function>}`},
+	}
+
+	for _, tt := range tests {
+		program := parser.New(lexer.New(tt.input)).ParseProgram()
+		evaluated, ok := runEval(ast.Copy(program))
+		if !ok || evaluated != tt.expected {
+			t.Errorf("wrong outcome of the evaluator for %q. want=%q, got=%q", tt.input, tt.expected, evaluated)
+		}
+		compiled, ok := runVM(program)
+		if !ok || compiled != tt.expected {
+			t.Errorf("wrong outcome of the VM for %q. want=%q, got=%q", tt.input, tt.expected, compiled)
+		}
+	}
+}
+
+// The engines have to disagree on the example of each known divergence, or it is no longer one.
+func TestKnownDivergences(t *testing.T) {
+	for name, known := range knownDivergences {
+		if _, ok := Compare(known.example).(*Divergence); !ok {
+			t.Errorf("the engines agree on the example of %q, which can be removed from the allowlist", name)
+		}
+	}
+}
+
+// The constructs of the known divergences are generated too, so that their bugs are found once these are fixed.
+func TestGeneratorMakesKnownDivergences(t *testing.T) {
+	made := map[string]bool{}
+	for seed := int64(0); seed < 200; seed++ {
+		g := NewGenerator(seed)
+		g.Program()
+		for _, name := range g.Known() {
+			made[name] = true
+		}
+	}
+	for name := range knownDivergences {
+		if !made[name] {
+			t.Errorf("no program has the construct of the known divergence %q", name)
+		}
+	}
+}
+
+func TestGeneratedPrograms(t *testing.T) {
+	seeds := int64(2000)
+	if testing.Short() {
+		seeds = 200
+	}
+	for seed := int64(0); seed < seeds; seed++ {
+		if err := compareGenerated(seed); err != nil {
+			t.Fatalf("seed %d: %s", seed, err)
+		}
+	}
+}
+
+// Neither engine may panic, and both must give the same result on every generated program.
+func FuzzDifferential(f *testing.F) {
+	for seed := int64(0); seed < 10; seed++ {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, seed int64) {
+		if err := compareGenerated(seed); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+// Compare the engines on the program of the seed. Its divergence is not reported if it has a known one.
+func compareGenerated(seed int64) error {
+	g := NewGenerator(seed)
+	err := Compare(g.Program())
+	if len(g.Known()) != 0 {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,292 @@
+/*
+Package fuzz generates random Monkey programs and runs them on both the evaluator and the VM,
+to find the programs on which the engines disagree, or crash.
+
+Run the differential fuzzer with:
+
+	go test ./fuzz -run XXX -fuzz FuzzDifferential
+*/
+package fuzz
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The types of the values the generated expressions evaluate to, which keep the programs mostly free of type errors.
+type valueType int
+
+const (
+	intType valueType = iota
+	boolType
+	stringType
+	arrayType // Of integers.
+	hashType  // From strings to integers.
+	funcType  // From an integer to an integer.
+	numTypes
+)
+
+// A construct on which the engines are known to disagree.
+type knownDivergence struct {
+	reason  string
+	example string // A program on which the engines disagree because of the construct.
+}
+
+/*
+The allowlist of the known divergences, by the names the generator records them with. The generator makes these
+constructs as any other, and the divergences of a program which has one of them are not reported.
+An entry is to be removed once the engines agree on its example.
+*/
+var knownDivergences = map[string]knownDivergence{
+	"string equality": {
+		reason:  "the evaluator has no == and != on strings, and the VM compares the identities of the strings",
+		example: `"a" == "a"`,
+	},
+}
+
+/*
+Generates well-formed programs: variables are bound before they are used, and the operands of the operators have
+the types these expect. Runtime errors may still occur, e.g. on a division by zero or an uncaught throw.
+Loops run over arrays only and functions do not recurse, so the programs always terminate.
+*/
+type Generator struct {
+	rand     *rand.Rand
+	scopes   [][]variable // The innermost last.
+	depth    int          // Of the expression being generated.
+	maxDepth int
+	names    int             // Number of names made so far, which keeps them unique.
+	known    map[string]bool // The known divergences of the constructs in the program made last.
+}
+
+type variable struct {
+	name string
+	typ  valueType
+}
+
+func NewGenerator(seed int64) *Generator {
+	return &Generator{rand: rand.New(rand.NewSource(seed)), maxDepth: 4}
+}
+
+// Returns a new program, which binds a few variables and ends with an expression.
+func (g *Generator) Program() string {
+	g.scopes = [][]variable{nil}
+	g.names = 0
+	g.known = map[string]bool{}
+
+	var out strings.Builder
+	for i := g.rand.Intn(5); i > 0; i-- {
+		out.WriteString(g.statement())
+		out.WriteString("\n")
+	}
+	out.WriteString(g.expression(valueType(g.rand.Intn(int(numTypes)))))
+	out.WriteString("\n")
+	return out.String()
+}
+
+// Returns the names of the known divergences of the constructs in the program made last, sorted.
+func (g *Generator) Known() []string {
+	names := []string{}
+	for name := range g.known {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Record the construct of the known divergence in the program.
+func (g *Generator) use(divergence string) {
+	if _, ok := knownDivergences[divergence]; !ok {
+		panic("not a known divergence: " + divergence)
+	}
+	g.known[divergence] = true
+}
+
+func (g *Generator) statement() string {
+	if g.rand.Intn(4) == 0 {
+		return g.forStatement()
+	}
+	typ := valueType(g.rand.Intn(int(numTypes)))
+	value := g.expression(typ)
+	name := g.define(typ)
+	return fmt.Sprintf("let %s = %s;", name, value)
+}
+
+// A for-in loop, whose body binds variables of its own and is run for its side effects on none.
+func (g *Generator) forStatement() string {
+	iterable := g.expression(arrayType)
+	g.scopes = append(g.scopes, nil)
+	defer func() { g.scopes = g.scopes[:len(g.scopes)-1] }()
+	name := g.define(intType)
+	return fmt.Sprintf("for (%s in %s) { %s }", name, iterable, g.expression(intType))
+}
+
+func (g *Generator) define(typ valueType) string {
+	name := g.name()
+	g.scopes[len(g.scopes)-1] = append(g.scopes[len(g.scopes)-1], variable{name: name, typ: typ})
+	return name
+}
+
+// Returns a new name, which has letters only as identifiers do.
+func (g *Generator) name() string {
+	name := "v"
+	for n := g.names; ; n = n/26 - 1 {
+		name += string(rune('a' + n%26))
+		if n < 26 {
+			break
+		}
+	}
+	g.names++
+	return name
+}
+
+// Returns a variable of the type in scope, if any.
+func (g *Generator) lookup(typ valueType) (string, bool) {
+	var names []string
+	for _, scope := range g.scopes {
+		for _, v := range scope {
+			if v.typ == typ {
+				names = append(names, v.name)
+			}
+		}
+	}
+	if len(names) == 0 {
+		return "", false
+	}
+	return names[g.rand.Intn(len(names))], true
+}
+
+func (g *Generator) expression(typ valueType) string {
+	g.depth++
+	defer func() { g.depth-- }()
+
+	// Leaves get likelier as the expression gets deeper.
+	if g.depth > g.maxDepth || g.rand.Intn(g.maxDepth+1) < g.depth {
+		if name, ok := g.lookup(typ); ok && g.rand.Intn(2) == 0 {
+			return name
+		}
+		return g.literal(typ)
+	}
+
+	switch g.rand.Intn(8) {
+	case 0:
+		return fmt.Sprintf("if (%s) { %s } else { %s }", g.expression(boolType), g.expression(typ), g.expression(typ))
+	case 1:
+		return fmt.Sprintf("%s(%s)", g.function(typ), g.expression(intType))
+	case 2:
+		// The catch parameter is bound to the integer thrown unless the condition is false,
+		// or to the error of the body, which is an ordinary value once caught.
+		g.scopes = append(g.scopes, nil)
+		e := g.define(intType)
+		catch := g.expression(typ)
+		g.scopes = g.scopes[:len(g.scopes)-1]
+		return fmt.Sprintf("try { if (%s) { throw %s }; %s } catch (%s) { %s }",
+			g.expression(boolType), g.expression(intType), g.expression(typ), e, catch)
+	}
+
+	switch typ {
+	case intType:
+		return g.intExpression()
+	case boolType:
+		return g.boolExpression()
+	case stringType:
+		return fmt.Sprintf("(%s + %s)", g.expression(stringType), g.expression(stringType))
+	case arrayType:
+		switch g.rand.Intn(3) {
+		case 0:
+			return fmt.Sprintf("push(%s, %s)", g.expression(arrayType), g.expression(intType))
+		case 1:
+			return fmt.Sprintf("rest(%s)", g.expression(arrayType))
+		}
+		return g.literal(arrayType)
+	case hashType:
+		return g.literal(hashType)
+	}
+	return g.function(intType)
+}
+
+func (g *Generator) intExpression() string {
+	switch g.rand.Intn(6) {
+	case 0:
+		return fmt.Sprintf("-%s", g.expression(intType))
+	case 1:
+		return fmt.Sprintf("len(%s)", g.expression([]valueType{stringType, arrayType}[g.rand.Intn(2)]))
+	case 2:
+		// An index out of range gives null, which is an error only when it is used.
+		return fmt.Sprintf("%s[%s]", g.expression(arrayType), g.expression(intType))
+	case 3:
+		return fmt.Sprintf("%s[%s]", g.expression(hashType), g.literal(stringType))
+	}
+	operator := []string{"+", "-", "*", "/"}[g.rand.Intn(4)]
+	return fmt.Sprintf("(%s %s %s)", g.expression(intType), operator, g.expression(intType))
+}
+
+func (g *Generator) boolExpression() string {
+	switch g.rand.Intn(3) {
+	case 0:
+		return fmt.Sprintf("!%s", g.expression(boolType))
+	case 1:
+		operator := []string{"==", "!="}[g.rand.Intn(2)]
+		typ := []valueType{intType, boolType, stringType, arrayType}[g.rand.Intn(4)]
+		if typ == stringType {
+			g.use("string equality")
+		}
+		return fmt.Sprintf("(%s %s %s)", g.expression(typ), operator, g.expression(typ))
+	}
+	operator := []string{"<", ">", "==", "!="}[g.rand.Intn(4)]
+	return fmt.Sprintf("(%s %s %s)", g.expression(intType), operator, g.expression(intType))
+}
+
+// Returns an expression of a function from an integer to a value of the type.
+func (g *Generator) function(typ valueType) string {
+	if typ == intType {
+		if name, ok := g.lookup(funcType); ok && g.rand.Intn(2) == 0 {
+			return name
+		}
+	}
+
+	g.scopes = append(g.scopes, nil)
+	defer func() { g.scopes = g.scopes[:len(g.scopes)-1] }()
+	parameter := g.define(intType)
+
+	var body strings.Builder
+	for i := g.rand.Intn(3); i > 0; i-- {
+		value := g.expression(intType)
+		fmt.Fprintf(&body, "let %s = %s; ", g.define(intType), value)
+	}
+	if g.rand.Intn(2) == 0 {
+		fmt.Fprintf(&body, "return %s;", g.expression(typ))
+	} else {
+		body.WriteString(g.expression(typ))
+	}
+	return fmt.Sprintf("fn(%s) { %s }", parameter, body.String())
+}
+
+func (g *Generator) literal(typ valueType) string {
+	switch typ {
+	case intType:
+		return strconv.Itoa(g.rand.Intn(21) - 5) // Mostly small, so that they are valid indexes.
+	case boolType:
+		return []string{"true", "false"}[g.rand.Intn(2)]
+	case stringType:
+		return strconv.Quote([]string{"", "a", "bc", "monkey"}[g.rand.Intn(4)])
+	case arrayType:
+		elements := make([]string, g.rand.Intn(4))
+		for i := range elements {
+			elements[i] = g.expression(intType)
+		}
+		return "[" + strings.Join(elements, ", ") + "]"
+	case hashType:
+		// The keys are distinct, since the order of the pairs of a hash literal is not kept, nor which of equal keys wins.
+		keys := []string{"", "a", "bc", "monkey"}
+		g.rand.Shuffle(len(keys), func(i, j int) { keys[i], keys[j] = keys[j], keys[i] })
+		pairs := make([]string, g.rand.Intn(3))
+		for i := range pairs {
+			pairs[i] = fmt.Sprintf("%s: %s", strconv.Quote(keys[i]), g.expression(intType))
+		}
+		return "{" + strings.Join(pairs, ", ") + "}"
+	}
+	return g.function(intType)
+}
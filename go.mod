@@ -1,3 +1,3 @@
 module monkey
 
-go 1.16
+go 1.18
@@ -2,6 +2,7 @@ package lexer
 
 import (
 	"monkey/token"
+	"strings"
 )
 
 type Lexer struct {
@@ -9,15 +10,31 @@ type Lexer struct {
 	position     int  // current index in input string
 	readPosition int  // next index
 	ch           byte // current char
+	line         int  // 1-based position of the current char
+	column       int
+	comments     []Comment
+}
+
+// A `//` comment, which is skipped like a white space but kept for tools such as the formatter.
+type Comment struct {
+	Text   string // Including the leading "//", excluding the line break.
+	Line   int
+	Column int
 }
 
 func New(input string) *Lexer {
-	l := &Lexer{input: input}
+	l := &Lexer{input: input, line: 1}
 	l.readChar() // just set the cursor to the first char
 	return l
 }
 
 func (l *Lexer) readChar() {
+	if l.ch == '\n' {
+		l.line++
+		l.column = 0
+	}
+	l.column++
+
 	if l.readPosition >= len(l.input) {
 		l.ch = 0
 	} else {
@@ -34,10 +51,20 @@ func (l *Lexer) peekChar() byte {
 	return l.input[l.readPosition]
 }
 
+// Returns the comments skipped so far, in the order of appearance.
+func (l *Lexer) Comments() []Comment {
+	return l.comments
+}
+
 func (l *Lexer) NextToken() token.Token {
 	var tok token.Token
 
 	l.skipWhiteSpace()
+	for l.ch == '/' && l.peekChar() == '/' {
+		l.skipComment()
+		l.skipWhiteSpace()
+	}
+	line, column := l.line, l.column
 
 	switch l.ch {
 	case '=':
@@ -97,10 +124,12 @@ func (l *Lexer) NextToken() token.Token {
 		if isLetter(l.ch) {
 			tok.Literal = l.readIdentifier()
 			tok.Type = token.LookupIdent(tok.Literal)
+			tok.Line, tok.Column = line, column
 			return tok
 		} else if isDigit(l.ch) {
 			tok.Type = token.INT
 			tok.Literal = l.readNumber()
+			tok.Line, tok.Column = line, column
 			return tok
 		} else {
 			tok = newToken(token.ILLEGAL, l.ch)
@@ -108,6 +137,7 @@ func (l *Lexer) NextToken() token.Token {
 	}
 
 	l.readChar()
+	tok.Line, tok.Column = line, column
 	return tok
 }
 
@@ -137,6 +167,15 @@ func (l *Lexer) skipWhiteSpace() {
 	}
 }
 
+func (l *Lexer) skipComment() {
+	position, line, column := l.position, l.line, l.column
+	for l.ch != '\n' && l.ch != 0 {
+		l.readChar()
+	}
+	text := strings.TrimRight(l.input[position:l.position], "\r")
+	l.comments = append(l.comments, Comment{Text: text, Line: line, Column: column})
+}
+
 func isLetter(ch byte) bool {
 	return 'a' <= ch && ch <= 'z' || 'A' <= ch && ch <= 'Z' || ch == '_'
 }
@@ -27,6 +27,10 @@ if (5 < 10){
 10 != 9;
 [1, 2];
 {"foo": "bar"}
+macro(x, y) { x + y; };
+try { throw e; } catch (e) {} finally {}
+for (x in xs) { yield x; }
+spawn f(ch);
 `
 
 	tests := []struct {
@@ -124,6 +128,51 @@ if (5 < 10){
 		{token.COLON, ":"},
 		{token.STRING, "bar"},
 		{token.RBRACE, "}"},
+		{token.MACRO, "macro"},
+		{token.LPAREN, "("},
+		{token.IDENT, "x"},
+		{token.COMMA, ","},
+		{token.IDENT, "y"},
+		{token.RPAREN, ")"},
+		{token.LBRACE, "{"},
+		{token.IDENT, "x"},
+		{token.PLUS, "+"},
+		{token.IDENT, "y"},
+		{token.SEMICOLON, ";"},
+		{token.RBRACE, "}"},
+		{token.SEMICOLON, ";"},
+		{token.TRY, "try"},
+		{token.LBRACE, "{"},
+		{token.THROW, "throw"},
+		{token.IDENT, "e"},
+		{token.SEMICOLON, ";"},
+		{token.RBRACE, "}"},
+		{token.CATCH, "catch"},
+		{token.LPAREN, "("},
+		{token.IDENT, "e"},
+		{token.RPAREN, ")"},
+		{token.LBRACE, "{"},
+		{token.RBRACE, "}"},
+		{token.FINALLY, "finally"},
+		{token.LBRACE, "{"},
+		{token.RBRACE, "}"},
+		{token.FOR, "for"},
+		{token.LPAREN, "("},
+		{token.IDENT, "x"},
+		{token.IN, "in"},
+		{token.IDENT, "xs"},
+		{token.RPAREN, ")"},
+		{token.LBRACE, "{"},
+		{token.YIELD, "yield"},
+		{token.IDENT, "x"},
+		{token.SEMICOLON, ";"},
+		{token.RBRACE, "}"},
+		{token.SPAWN, "spawn"},
+		{token.IDENT, "f"},
+		{token.LPAREN, "("},
+		{token.IDENT, "ch"},
+		{token.RPAREN, ")"},
+		{token.SEMICOLON, ";"},
 		{token.EOF, ""},
 	}
 
@@ -147,3 +196,123 @@ if (5 < 10){
 		}
 	}
 }
+
+func TestTokenPositions(t *testing.T) {
+	input := `let five = 5;
+let add = fn(x, y) {
+	x + y;
+};
+"multi
+line" five`
+
+	tests := []struct {
+		expectedLiteral string
+		expectedLine    int
+		expectedColumn  int
+	}{
+		{"let", 1, 1},
+		{"five", 1, 5},
+		{"=", 1, 10},
+		{"5", 1, 12},
+		{";", 1, 13},
+		{"let", 2, 1},
+		{"add", 2, 5},
+		{"=", 2, 9},
+		{"fn", 2, 11},
+		{"(", 2, 13},
+		{"x", 2, 14},
+		{",", 2, 15},
+		{"y", 2, 17},
+		{")", 2, 18},
+		{"{", 2, 20},
+		{"x", 3, 2},
+		{"+", 3, 4},
+		{"y", 3, 6},
+		{";", 3, 7},
+		{"}", 4, 1},
+		{";", 4, 2},
+		{"multi\nline", 5, 1},
+		{"five", 6, 7},
+		{"", 6, 11},
+	}
+
+	l := New(input)
+
+	for i, tt := range tests {
+		tok := l.NextToken()
+
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf(
+				"tests[%d] - literal wrong. expected=%q, got=%q",
+				i, tt.expectedLiteral, tok.Literal,
+			)
+		}
+
+		if tok.Line != tt.expectedLine || tok.Column != tt.expectedColumn {
+			t.Fatalf(
+				"tests[%d] - position of %q wrong. expected=%d:%d, got=%d:%d",
+				i, tt.expectedLiteral, tt.expectedLine, tt.expectedColumn, tok.Line, tok.Column,
+			)
+		}
+	}
+}
+
+func TestComments(t *testing.T) {
+	input := "// leading\r\nlet x = 10 / 2; // trailing\n  //indented\nx // at the end"
+
+	expectedTokens := []token.TokenType{
+		token.LET, token.IDENT, token.ASSIGN, token.INT, token.SLASH, token.INT, token.SEMICOLON,
+		token.IDENT, token.EOF,
+	}
+	l := New(input)
+	for i, expected := range expectedTokens {
+		tok := l.NextToken()
+		if tok.Type != expected {
+			t.Fatalf("tests[%d] - tokentype wrong. expected=%q, got=%q", i, expected, tok.Type)
+		}
+	}
+
+	expectedComments := []Comment{
+		{Text: "// leading", Line: 1, Column: 1},
+		{Text: "// trailing", Line: 2, Column: 17},
+		{Text: "//indented", Line: 3, Column: 3},
+		{Text: "// at the end", Line: 4, Column: 3},
+	}
+	comments := l.Comments()
+	if len(comments) != len(expectedComments) {
+		t.Fatalf("wrong number of comments. expected=%d, got=%d (%+v)", len(expectedComments), len(comments), comments)
+	}
+	for i, expected := range expectedComments {
+		if comments[i] != expected {
+			t.Errorf("comments[%d] wrong. expected=%+v, got=%+v", i, expected, comments[i])
+		}
+	}
+}
+
+// The lexer must never panic, and must reach EOF within a token per byte of the input.
+func FuzzNextToken(f *testing.F) {
+	for _, seed := range []string{
+		"let add = fn(x, y) { x + y; };",
+		`"unterminated`,
+		"a != b == c // comment",
+		"x = 0x1f; @#\x00\xff",
+	} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, input string) {
+		l := New(input)
+		for i := 0; ; i++ {
+			tok := l.NextToken()
+			if tok.Type == token.EOF {
+				break
+			}
+			if i > len(input) {
+				t.Fatalf("no EOF after %d tokens of %q", i, input)
+			}
+			if tok.Line < 1 || tok.Column < 1 {
+				t.Fatalf("token %+v of %q has no position", tok, input)
+			}
+		}
+	})
+}
@@ -0,0 +1,455 @@
+package lsp
+
+import (
+	"io/ioutil"
+	"monkey/ast"
+	"monkey/budget"
+	"monkey/compiler"
+	"monkey/evaluator"
+	"monkey/lexer"
+	"monkey/object"
+	"monkey/parser"
+	"monkey/token"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+type definitionKind int
+
+const (
+	kindGlobal definitionKind = iota
+	kindLocal
+	kindParameter
+	kindBuiltin
+)
+
+// A binding which identifiers can refer to.
+type definition struct {
+	name  string
+	kind  definitionKind
+	ident *ast.Identifier      // nil for builtins.
+	fn    *ast.FunctionLiteral // The bound value, if it is a function literal.
+	doc   *document            // Which declares the binding: the document or a module it imports. nil for builtins.
+}
+
+// An identifier in the source and the binding it refers to.
+type occurrence struct {
+	ident       *ast.Identifier
+	def         *definition
+	declaration bool
+}
+
+// An analyzed version of a text document.
+type document struct {
+	uri   string
+	lines []string
+
+	diagnostics []Diagnostic
+	occurrences []occurrence // Sorted by position.
+	symbols     []DocumentSymbol
+}
+
+func newDocument(uri, text string) *document {
+	d := &document{uri: uri, lines: strings.Split(text, "\n")}
+
+	p := parser.New(lexer.New(text))
+	program := p.ParseProgram()
+	d.diagnostics = []Diagnostic{}
+	for _, e := range p.ErrorDetails() {
+		d.diagnostics = append(d.diagnostics, d.diagnostic(e.Line, e.Column, e.Msg))
+	}
+	if len(p.Errors()) == 0 {
+		if line, column, err := compile(program, uri); err != nil {
+			d.diagnostics = append(d.diagnostics, d.diagnostic(line, column, err.Error()))
+		}
+	}
+
+	// Even a program with errors is analyzed as far as it was parsed.
+	a := d.analyze(program, filePath(uri))
+	d.symbols = d.documentSymbols(a.functions)
+	return d
+}
+
+// A module imported by a document, with the bindings it exports.
+type module struct {
+	doc     *document
+	exports map[string]*definition
+}
+
+// Analyze the source of the module, without its diagnostics and its own imports.
+func newModule(uri, text string) *module {
+	d := &document{uri: uri, lines: strings.Split(text, "\n")}
+	program := parser.New(lexer.New(text)).ParseProgram()
+	return &module{doc: d, exports: d.analyze(program, "").exports}
+}
+
+// Resolve the identifiers of the program, whose imports are relative to the file. Imports are not followed without one.
+func (d *document) analyze(program *ast.Program, file string) *analyzer {
+	a := newAnalyzer(d, file)
+	ast.Walk(a, program)
+	sort.Slice(a.occurrences, func(i, j int) bool {
+		return before(a.occurrences[i].ident.Token, a.occurrences[j].ident.Token)
+	})
+	d.occurrences = a.occurrences
+	return a
+}
+
+// Returns the path of a "file:" URI, or "" for the other documents.
+func filePath(uri string) string {
+	if u, err := url.Parse(uri); err == nil && u.Scheme == "file" {
+		return filepath.FromSlash(u.Path)
+	}
+	return ""
+}
+
+// Returns the "file:" URI of the path.
+func fileURI(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	return (&url.URL{Scheme: "file", Path: filepath.ToSlash(path)}).String()
+}
+
+/*
+The macros of a document run on every change, in the process of the server, so they are given no capabilities:
+output to stdout would corrupt the protocol stream. Their budgets keep a looping or recursive macro from hanging
+or crashing the server.
+*/
+var macroLimits = budget.Limits{MaxSteps: 100000, MaxMemory: 16 << 20, MaxDepth: 200}
+
+/*
+Compile a copy of the program with its macros expanded, and return the position of the error if any.
+Imports are read from the disk, relative to the document if it is a file.
+*/
+func compile(program *ast.Program, uri string) (int, int, error) {
+	comp := compiler.New()
+	if path := filePath(uri); path != "" {
+		comp.SetLoader(compiler.NewLoader(), path)
+	}
+	err := comp.ExpandAndCompile(ast.Copy(program).(*ast.Program), object.NewEnvironment(), macroLimits, &object.Context{})
+	switch e := err.(type) {
+	case nil:
+		return 0, 0, nil
+	case *evaluator.MacroError:
+		return e.Line, e.Column, err
+	case *compiler.Error:
+		return e.Line, e.Column, err
+	}
+	return 1, 1, err
+}
+
+// Returns the occurrence of an identifier at the position, which may also be just after the identifier.
+func (d *document) occurrenceAt(pos Position) (occurrence, bool) {
+	line, column := d.column(pos)
+	for _, o := range d.occurrences {
+		tok := o.ident.Token
+		if tok.Line == line && tok.Column <= column && column <= tok.Column+len(tok.Literal) {
+			return o, true
+		}
+	}
+	return occurrence{}, false
+}
+
+// Returns the occurrences which refer to the definition.
+func (d *document) references(def *definition, includeDeclaration bool) []occurrence {
+	refs := []occurrence{}
+	for _, o := range d.occurrences {
+		if o.def == def && (includeDeclaration || !o.declaration) {
+			refs = append(refs, o)
+		}
+	}
+	return refs
+}
+
+func (d *document) identRange(ident *ast.Identifier) Range {
+	start := d.position(ident.Token.Line, ident.Token.Column)
+	end := d.position(ident.Token.Line, ident.Token.Column+len(ident.Token.Literal))
+	return Range{Start: start, End: end}
+}
+
+func (d *document) diagnostic(line, column int, msg string) Diagnostic {
+	start := d.position(line, column)
+	end := start
+	if line-1 < len(d.lines) && column-1 < len(d.lines[line-1]) {
+		_, size := utf8.DecodeRuneInString(d.lines[line-1][column-1:])
+		end = d.position(line, column+size)
+	}
+	return Diagnostic{Range: Range{Start: start, End: end}, Severity: severityError, Source: "monkey", Message: msg}
+}
+
+// Converts a 1-based line and byte column, as in tokens, to an LSP position.
+func (d *document) position(line, column int) Position {
+	if line < 1 || len(d.lines) < line {
+		return Position{Line: line - 1}
+	}
+	text := d.lines[line-1]
+	if column-1 < len(text) {
+		text = text[:column-1]
+	}
+	return Position{Line: line - 1, Character: len(utf16.Encode([]rune(text)))}
+}
+
+// Converts an LSP position to a 1-based line and byte column, as in tokens.
+func (d *document) column(pos Position) (int, int) {
+	if pos.Line < 0 || len(d.lines) <= pos.Line {
+		return pos.Line + 1, 1
+	}
+	units := 0
+	for i, r := range d.lines[pos.Line] {
+		if units >= pos.Character {
+			return pos.Line + 1, i + 1
+		}
+		units += len(utf16.Encode([]rune{r}))
+	}
+	return pos.Line + 1, len(d.lines[pos.Line]) + 1
+}
+
+func (d *document) documentSymbols(functions []*function) []DocumentSymbol {
+	symbols := []DocumentSymbol{}
+	for _, f := range functions {
+		let := d.position(f.let.Line, f.let.Column)
+		name := d.identRange(f.def.ident)
+		symbols = append(symbols, DocumentSymbol{
+			Name:           f.def.name,
+			Detail:         signature(f.def.fn),
+			Kind:           symbolKindFunction,
+			Range:          Range{Start: let, End: name.End},
+			SelectionRange: name,
+			Children:       d.documentSymbols(f.children),
+		})
+	}
+	return symbols
+}
+
+// A `let`-bound function and the ones defined in its body.
+type function struct {
+	let      token.Token
+	def      *definition
+	children []*function
+}
+
+// A scope of bindings, backed by the same symbol tables as the compiler uses.
+type scope struct {
+	table    *compiler.SymbolTable
+	outer    *scope
+	defs     map[compiler.Symbol]*definition
+	function *definition // The binding of the function itself, which is in FunctionScope.
+}
+
+func (s *scope) definition(symbol compiler.Symbol) *definition {
+	switch symbol.Scope {
+	case compiler.GlobalScope:
+		for s.outer != nil {
+			s = s.outer
+		}
+		return s.defs[symbol]
+	case compiler.LocalScope:
+		return s.defs[symbol]
+	case compiler.FreeScope:
+		return s.outer.definition(s.table.FreeSymbols[symbol.Index])
+	case compiler.FunctionScope:
+		return s.function
+	}
+	return nil
+}
+
+// Resolves identifiers in the same way as the compiler does.
+type analyzer struct {
+	doc         *document
+	file        string // Which the imports are relative to. Empty if they are not followed.
+	scope       *scope
+	builtins    map[string]*definition
+	occurrences []occurrence
+	exports     map[string]*definition // The bindings declared by `export let`.
+
+	functionNames map[*ast.FunctionLiteral]*definition
+	functions     []*function
+	enclosing     *function // The innermost `let`-bound function being walked.
+}
+
+func newAnalyzer(doc *document, file string) *analyzer {
+	a := &analyzer{
+		doc:           doc,
+		file:          file,
+		scope:         &scope{table: compiler.NewSymbolTable(), defs: map[compiler.Symbol]*definition{}},
+		builtins:      map[string]*definition{},
+		exports:       map[string]*definition{},
+		functionNames: map[*ast.FunctionLiteral]*definition{},
+	}
+	for i, v := range object.Builtins {
+		a.scope.table.DefineBuiltin(i, v.Name)
+		a.builtins[v.Name] = &definition{name: v.Name, kind: kindBuiltin}
+	}
+	return a
+}
+
+/*
+Resolve the identifiers in the tree of the node. The nodes which define bindings are walked by hand,
+in the order in which the compiler defines them, and the others by ast.Walk.
+*/
+func (a *analyzer) Visit(node ast.Node) ast.Visitor {
+	switch node := node.(type) {
+	case *ast.Identifier:
+		a.resolve(node)
+	case *ast.LetStatement:
+		a.let(node)
+		return nil
+	case *ast.ImportStatement:
+		a.importModule(node)
+		return nil
+	case *ast.ForStatement:
+		ast.Walk(a, node.Iterable)
+		// The compiler defines the loop variable in the enclosing scope.
+		if node.Variable != nil {
+			a.define(node.Variable, a.bindingKind())
+		}
+		ast.Walk(a, node.Body)
+		return nil
+	case *ast.TryExpression:
+		ast.Walk(a, node.Body)
+		// The compiler defines the catch parameter in the enclosing scope.
+		if node.CatchParameter != nil {
+			a.define(node.CatchParameter, a.bindingKind())
+		}
+		ast.Walk(a, node.Catch)
+		ast.Walk(a, node.Finally)
+		return nil
+	case *ast.FunctionLiteral:
+		a.enterScope()
+		if def := a.functionNames[node]; def != nil && node.Name != "" {
+			a.scope.table.DefineFunctionName(node.Name)
+			a.scope.function = def
+		}
+		a.walkBody(node.Parameters, node.Body)
+		return nil
+	case *ast.MacroLiteral:
+		a.enterScope()
+		a.walkBody(node.Parameters, node.Body)
+		return nil
+	}
+	return a
+}
+
+func (a *analyzer) resolve(ident *ast.Identifier) {
+	symbol, ok := a.scope.table.Resolve(ident.Value)
+	if !ok {
+		return
+	}
+	def := a.scope.definition(symbol)
+	if symbol.Scope == compiler.BuiltinScope {
+		def = a.builtins[symbol.Name]
+	}
+	if def != nil {
+		a.occurrences = append(a.occurrences, occurrence{ident: ident, def: def})
+	}
+}
+
+func (a *analyzer) let(node *ast.LetStatement) {
+	if node.Name == nil {
+		return
+	}
+	def := a.define(node.Name, a.bindingKind())
+	if node.Exported && a.scope.outer == nil {
+		a.exports[def.name] = def
+	}
+
+	fn, ok := node.Value.(*ast.FunctionLiteral)
+	if !ok || fn == nil {
+		ast.Walk(a, node.Value)
+		return
+	}
+	def.fn = fn
+	a.functionNames[fn] = def
+
+	f := &function{let: node.Token, def: def}
+	if a.enclosing != nil {
+		a.enclosing.children = append(a.enclosing.children, f)
+	} else {
+		a.functions = append(a.functions, f)
+	}
+	enclosing := a.enclosing
+	a.enclosing = f
+	ast.Walk(a, fn)
+	a.enclosing = enclosing
+}
+
+/*
+Define the names exported by the module, as the compiler does, to the definitions in the module.
+The imports are read from the disk, relative to the document. Those of the modules themselves are not followed.
+*/
+func (a *analyzer) importModule(node *ast.ImportStatement) {
+	if a.file == "" || node.Path == nil {
+		return
+	}
+	path := compiler.NewLoader().Resolve(a.file, node.Path.Value)
+	src, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+	module := newModule(fileURI(path), string(src))
+	names := make([]string, 0, len(module.exports))
+	for name := range module.exports {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		a.scope.defs[a.scope.table.Define(name)] = module.exports[name]
+	}
+}
+
+// The kind of the bindings defined in the current scope.
+func (a *analyzer) bindingKind() definitionKind {
+	if a.scope.outer == nil {
+		return kindGlobal
+	}
+	return kindLocal
+}
+
+func (a *analyzer) enterScope() {
+	a.scope = &scope{
+		table: compiler.NewEnclosedSymbolTable(a.scope.table),
+		outer: a.scope,
+		defs:  map[compiler.Symbol]*definition{},
+	}
+}
+
+// Define the parameters in the scope of the function or the macro, walk its body, and leave the scope.
+func (a *analyzer) walkBody(parameters []*ast.Identifier, body *ast.BlockStatement) {
+	for _, p := range parameters {
+		if p != nil {
+			a.define(p, kindParameter)
+		}
+	}
+	ast.Walk(a, body)
+	a.scope = a.scope.outer
+}
+
+func (a *analyzer) define(ident *ast.Identifier, kind definitionKind) *definition {
+	symbol := a.scope.table.Define(ident.Value)
+	def := &definition{name: ident.Value, kind: kind, ident: ident, doc: a.doc}
+	a.scope.defs[symbol] = def
+	a.occurrences = append(a.occurrences, occurrence{ident: ident, def: def, declaration: true})
+	return def
+}
+
+func before(a, b token.Token) bool {
+	if a.Line != b.Line {
+		return a.Line < b.Line
+	}
+	return a.Column < b.Column
+}
+
+// Returns "fn(a, b)" for the function literal.
+func signature(fn *ast.FunctionLiteral) string {
+	params := []string{}
+	for _, p := range fn.Parameters {
+		if p != nil {
+			params = append(params, p.Value)
+		}
+	}
+	return "fn(" + strings.Join(params, ", ") + ")"
+}
@@ -0,0 +1,26 @@
+package lsp
+
+// Signatures and descriptions of object.Builtins shown on hover.
+var builtinDocs = map[string]struct {
+	signature   string
+	description string
+}{
+	"len":      {"len(value)", "Returns the number of elements of an array, or the length of a string."},
+	"puts":     {"puts(values...)", "Prints each value on its own line and returns null."},
+	"first":    {"first(array)", "Returns the first element of an array, or null if it is empty."},
+	"last":     {"last(array)", "Returns the last element of an array, or null if it is empty."},
+	"rest":     {"rest(array)", "Returns a new array without the first element, or null if the array is empty."},
+	"push":     {"push(array, value)", "Returns a new array with the value appended."},
+	"eputs":    {"eputs(values...)", "Prints each value on its own line to the standard error and returns null."},
+	"readFile": {"readFile(path)", "Returns the content of the file as a string."},
+	"now":      {"now()", "Returns the current time in milliseconds since the Unix epoch."},
+	"random":   {"random(n)", "Returns a random integer from 0 up to n, excluding n."},
+	"getenv":   {"getenv(name)", "Returns the value of the environment variable, or null if it is not set."},
+	"next":     {"next(generator)", "Resumes the generator and returns the next value it yields, or null when it has finished."},
+	"channel":  {"channel(size)", "Returns a new channel, buffering up to size values (0 when omitted)."},
+	"send":     {"send(channel, value)", "Sends the value on the channel, waiting for a receiver or buffer space."},
+	"recv":     {"recv(channel)", "Receives the next value from the channel, or null when it is closed and drained."},
+	"close":    {"close(channel)", "Closes the channel. Receivers get null once its buffered values are drained."},
+	"select":   {"select(cases, default)", "Waits for the first case which can proceed: a channel to receive from, or a [channel, value] pair to send. Returns [index, value], or default without waiting if it is given."},
+	"wait":     {"wait(task)", "Waits for the task started by spawn and returns its result, or throws its error."},
+}
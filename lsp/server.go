@@ -0,0 +1,261 @@
+/*
+Package lsp implements a Language Server Protocol server for Monkey,
+providing diagnostics, go-to-definition, references, hover, rename and document symbols.
+*/
+package lsp
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"monkey/lexer"
+	"monkey/token"
+	"monkey/wire"
+)
+
+// A language server serving one client. Documents are analyzed from scratch on every change.
+type Server struct {
+	in  *bufio.Reader
+	out io.Writer
+
+	documents map[string]*document
+	shutdown  bool
+}
+
+func NewServer(in io.Reader, out io.Writer) *Server {
+	return &Server{in: bufio.NewReader(in), out: out, documents: map[string]*document{}}
+}
+
+// Handle messages until the client sends `exit` or the input ends.
+func (s *Server) Serve() error {
+	for {
+		content, err := wire.ReadMessage(s.in)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		var msg Message
+		if err := json.Unmarshal(content, &msg); err != nil {
+			return fmt.Errorf("invalid message: %w", err)
+		}
+		if msg.Method == "exit" {
+			if !s.shutdown {
+				return fmt.Errorf("exit without shutdown")
+			}
+			return nil
+		}
+		if msg.ID == nil {
+			s.notification(&msg)
+		} else if msg.Method != "" {
+			s.request(&msg)
+		}
+	}
+}
+
+func (s *Server) notification(msg *Message) {
+	switch msg.Method {
+	case "textDocument/didOpen":
+		var params DidOpenTextDocumentParams
+		if json.Unmarshal(msg.Params, &params) == nil {
+			s.update(params.TextDocument.URI, params.TextDocument.Text)
+		}
+	case "textDocument/didChange":
+		var params DidChangeTextDocumentParams
+		if json.Unmarshal(msg.Params, &params) == nil && len(params.ContentChanges) != 0 {
+			// With full synchronization, the last change holds the whole document.
+			s.update(params.TextDocument.URI, params.ContentChanges[len(params.ContentChanges)-1].Text)
+		}
+	case "textDocument/didClose":
+		var params DidCloseTextDocumentParams
+		if json.Unmarshal(msg.Params, &params) == nil {
+			delete(s.documents, params.TextDocument.URI)
+			s.notify("textDocument/publishDiagnostics", PublishDiagnosticsParams{URI: params.TextDocument.URI, Diagnostics: []Diagnostic{}})
+		}
+	}
+}
+
+func (s *Server) request(msg *Message) {
+	switch msg.Method {
+	case "initialize":
+		s.respond(msg, InitializeResult{
+			Capabilities: ServerCapabilities{
+				TextDocumentSync:       textDocumentSyncFull,
+				DefinitionProvider:     true,
+				ReferencesProvider:     true,
+				HoverProvider:          true,
+				DocumentSymbolProvider: true,
+				RenameProvider:         true,
+			},
+			ServerInfo: ServerInfo{Name: "monkey"},
+		})
+	case "shutdown":
+		s.shutdown = true
+		s.respond(msg, nil)
+	case "textDocument/definition":
+		var params TextDocumentPositionParams
+		if doc, ok := s.decode(msg, &params); ok {
+			s.respond(msg, definitionLocation(doc, params.Position))
+		}
+	case "textDocument/references":
+		var params ReferenceParams
+		if doc, ok := s.decode(msg, &params); ok {
+			s.respond(msg, referenceLocations(doc, params.Position, params.Context.IncludeDeclaration))
+		}
+	case "textDocument/hover":
+		var params TextDocumentPositionParams
+		if doc, ok := s.decode(msg, &params); ok {
+			s.respond(msg, hover(doc, params.Position))
+		}
+	case "textDocument/rename":
+		var params RenameParams
+		if doc, ok := s.decode(msg, &params); ok {
+			if edit, err := rename(doc, params.Position, params.NewName); err != nil {
+				s.fail(msg, codeInvalidParams, err.Error())
+			} else {
+				s.respond(msg, edit)
+			}
+		}
+	case "textDocument/documentSymbol":
+		var params DocumentSymbolParams
+		if doc, ok := s.decode(msg, &params); ok {
+			s.respond(msg, doc.symbols)
+		}
+	default:
+		s.fail(msg, codeMethodNotFound, fmt.Sprintf("unsupported method: %s", msg.Method))
+	}
+}
+
+func (s *Server) update(uri, text string) {
+	doc := newDocument(uri, text)
+	s.documents[uri] = doc
+	s.notify("textDocument/publishDiagnostics", PublishDiagnosticsParams{URI: uri, Diagnostics: doc.diagnostics})
+}
+
+// Decode the params and look up the document they refer to.
+func (s *Server) decode(msg *Message, params interface{}) (*document, bool) {
+	if err := json.Unmarshal(msg.Params, params); err != nil {
+		s.fail(msg, codeInvalidParams, err.Error())
+		return nil, false
+	}
+	var target struct {
+		TextDocument TextDocumentIdentifier `json:"textDocument"`
+	}
+	json.Unmarshal(msg.Params, &target)
+	doc, ok := s.documents[target.TextDocument.URI]
+	if !ok {
+		s.fail(msg, codeInvalidParams, fmt.Sprintf("unknown document: %s", target.TextDocument.URI))
+	}
+	return doc, ok
+}
+
+func (s *Server) respond(msg *Message, result interface{}) {
+	if result == nil {
+		// A null result has to be sent explicitly, which omitempty would drop.
+		raw := json.RawMessage("null")
+		result = &raw
+	}
+	wire.WriteMessage(s.out, Message{JSONRPC: "2.0", ID: msg.ID, Result: result})
+}
+
+func (s *Server) fail(msg *Message, code int, message string) {
+	wire.WriteMessage(s.out, Message{JSONRPC: "2.0", ID: msg.ID, Error: &ResponseError{Code: code, Message: message}})
+}
+
+func (s *Server) notify(method string, params interface{}) {
+	raw, _ := json.Marshal(params)
+	wire.WriteMessage(s.out, Message{JSONRPC: "2.0", Method: method, Params: raw})
+}
+
+func definitionLocation(doc *document, pos Position) interface{} {
+	o, ok := doc.occurrenceAt(pos)
+	if !ok || o.def.ident == nil { // Builtins are not defined in the source.
+		return nil
+	}
+	return Location{URI: o.def.doc.uri, Range: o.def.doc.identRange(o.def.ident)}
+}
+
+func referenceLocations(doc *document, pos Position, includeDeclaration bool) interface{} {
+	o, ok := doc.occurrenceAt(pos)
+	if !ok {
+		return nil
+	}
+	locations := []Location{}
+	for _, d := range documentsOf(doc, o.def) {
+		for _, ref := range d.references(o.def, includeDeclaration) {
+			locations = append(locations, Location{URI: d.uri, Range: d.identRange(ref.ident)})
+		}
+	}
+	return locations
+}
+
+// Returns the documents where the definition may occur: the document, and the module which declares it if any.
+func documentsOf(doc *document, def *definition) []*document {
+	if def.doc != nil && def.doc != doc {
+		return []*document{doc, def.doc}
+	}
+	return []*document{doc}
+}
+
+/*
+Rename the binding of the identifier at the position in the document, and in the module which declares it if it is
+imported. Other importers of the module are unknown, and so are not renamed.
+*/
+func rename(doc *document, pos Position, newName string) (interface{}, error) {
+	if !isIdentifier(newName) {
+		return nil, fmt.Errorf("not an identifier: %q", newName)
+	}
+	o, ok := doc.occurrenceAt(pos)
+	if !ok {
+		return nil, nil
+	}
+	if o.def.kind == kindBuiltin {
+		return nil, fmt.Errorf("cannot rename the builtin %s", o.def.name)
+	}
+
+	edit := WorkspaceEdit{Changes: map[string][]TextEdit{}}
+	for _, d := range documentsOf(doc, o.def) {
+		for _, ref := range d.references(o.def, true) {
+			edit.Changes[d.uri] = append(edit.Changes[d.uri], TextEdit{Range: d.identRange(ref.ident), NewText: newName})
+		}
+	}
+	return edit, nil
+}
+
+func isIdentifier(name string) bool {
+	l := lexer.New(name)
+	tok := l.NextToken()
+	return tok.Type == token.IDENT && tok.Literal == name && l.NextToken().Type == token.EOF
+}
+
+func hover(doc *document, pos Position) interface{} {
+	o, ok := doc.occurrenceAt(pos)
+	if !ok {
+		return nil
+	}
+
+	var text string
+	switch def := o.def; {
+	case def.kind == kindBuiltin:
+		builtin := builtinDocs[def.name]
+		text = codeBlock(builtin.signature) + "\n" + builtin.description
+	case def.fn != nil:
+		text = codeBlock(fmt.Sprintf("let %s = %s", def.name, signature(def.fn)))
+	case def.doc != doc:
+		text = codeBlock("let "+def.name) + "\nImported binding"
+	case def.kind == kindParameter:
+		text = codeBlock("parameter " + def.name)
+	case def.kind == kindGlobal:
+		text = codeBlock("let "+def.name) + "\nGlobal binding"
+	default:
+		text = codeBlock("let "+def.name) + "\nLocal binding"
+	}
+	return Hover{Contents: MarkupContent{Kind: "markdown", Value: text}, Range: doc.identRange(o.ident)}
+}
+
+func codeBlock(code string) string {
+	return "```monkey\n" + code + "\n```\n"
+}
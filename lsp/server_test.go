@@ -0,0 +1,514 @@
+package lsp
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"monkey/object"
+	"monkey/wire"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const uri = "file:///program.mk"
+
+const source = `let total = 0;
+let add = fn(a, b) {
+  let sum = a + b;
+  let twice = fn() { sum * 2 };
+  twice()
+};
+let count = fn(n) { if (n == 0) { 0 } else { count(n - 1) } };
+add(total, len("ü😀x"));
+try { throw 1; } catch (err) { err }
+for (item in [1, 2]) { item }
+`
+
+func TestDiagnostics(t *testing.T) {
+	c := startClient(t)
+	c.initialize()
+
+	tests := []struct {
+		text     string
+		expected []Diagnostic
+	}{
+		{source, []Diagnostic{}},
+		{
+			"let x = 1;\nlet = 2;",
+			[]Diagnostic{
+				{Range: lineRange(1, 4, 5), Severity: severityError, Source: "monkey", Message: "expected next token to be IDENT, got = instead."},
+				{Range: lineRange(1, 4, 5), Severity: severityError, Source: "monkey", Message: "no prefix parse function for = found"},
+			},
+		},
+		{
+			"let x = 1;\nlet f = fn() { x + y };",
+			[]Diagnostic{
+				{Range: lineRange(1, 19, 20), Severity: severityError, Source: "monkey", Message: "undefined variable y"},
+			},
+		},
+		{"let m = macro(x) { quote(unquote(x) + 1) };\nm(2) + m(3);", []Diagnostic{}},
+		{
+			"let m = macro(x) { x };\nm(1, 2);",
+			[]Diagnostic{
+				{Range: lineRange(1, 0, 1), Severity: severityError, Source: "monkey", Message: "macro m: wrong number of arguments. got=2, want=1"},
+			},
+		},
+		{
+			"let m = macro() { puts(1); quote(1) };\nm();",
+			[]Diagnostic{
+				{Range: lineRange(1, 0, 1), Severity: severityError, Source: "monkey", Message: "macro m: `puts` is not permitted: no stdout"},
+			},
+		},
+		{
+			"let m = macro() { let f = fn() { f() }; f() };\nm();",
+			[]Diagnostic{
+				{Range: lineRange(1, 0, 1), Severity: severityError, Source: "monkey", Message: "macro m: maximum recursion depth exceeded (max depth: 200)"},
+			},
+		},
+		{
+			"let m = macro() { let f = fn(n) { if (n > 0) { f(n - 1); f(n - 1) } }; f(40) };\nm();",
+			[]Diagnostic{
+				{Range: lineRange(1, 0, 1), Severity: severityError, Source: "monkey", Message: "macro m: step limit exceeded: max 100000 steps"},
+			},
+		},
+	}
+
+	for i, tt := range tests {
+		if i == 0 {
+			c.notify("textDocument/didOpen", DidOpenTextDocumentParams{TextDocument: TextDocumentItem{URI: uri, Version: 1, Text: tt.text}})
+		} else {
+			c.notify("textDocument/didChange", map[string]interface{}{
+				"textDocument":   map[string]interface{}{"uri": uri, "version": i + 1},
+				"contentChanges": []map[string]string{{"text": tt.text}},
+			})
+		}
+
+		var params PublishDiagnosticsParams
+		c.expectNotification("textDocument/publishDiagnostics", &params)
+		if params.URI != uri {
+			t.Errorf("wrong uri: %s", params.URI)
+		}
+		if !equalJSON(t, params.Diagnostics, tt.expected) {
+			t.Errorf("wrong diagnostics for %q.\nwant=%+v\ngot=%+v", tt.text, tt.expected, params.Diagnostics)
+		}
+	}
+}
+
+func TestDefinitionAndReferences(t *testing.T) {
+	c := startClient(t)
+	c.initialize()
+	c.open(source)
+
+	tests := []struct {
+		name       string
+		at         Position
+		definition interface{} // A Range, or nil.
+		references []Range     // Including the declaration.
+	}{
+		{"global", Position{7, 4}, lineRange(0, 4, 9), []Range{lineRange(0, 4, 9), lineRange(7, 4, 9)}},
+		{"parameter", Position{2, 12}, lineRange(1, 13, 14), []Range{lineRange(1, 13, 14), lineRange(2, 12, 13)}},
+		{"free variable", Position{3, 21}, lineRange(2, 6, 9), []Range{lineRange(2, 6, 9), lineRange(3, 21, 24)}},
+		{"local function", Position{4, 2}, lineRange(3, 6, 11), []Range{lineRange(3, 6, 11), lineRange(4, 2, 7)}},
+		{"recursive function", Position{6, 47}, lineRange(6, 4, 9), []Range{lineRange(6, 4, 9), lineRange(6, 45, 50)}},
+		{"end of identifier", Position{7, 9}, lineRange(0, 4, 9), []Range{lineRange(0, 4, 9), lineRange(7, 4, 9)}},
+		{"catch parameter", Position{8, 31}, lineRange(8, 24, 27), []Range{lineRange(8, 24, 27), lineRange(8, 31, 34)}},
+		{"loop variable", Position{9, 24}, lineRange(9, 5, 9), []Range{lineRange(9, 5, 9), lineRange(9, 23, 27)}},
+		{"builtin", Position{7, 12}, nil, []Range{lineRange(7, 11, 14)}},
+		{"no identifier", Position{7, 10}, nil, nil},
+	}
+
+	for _, tt := range tests {
+		params := TextDocumentPositionParams{TextDocument: TextDocumentIdentifier{URI: uri}, Position: tt.at}
+
+		var definition *Location
+		c.request("textDocument/definition", params, &definition)
+		switch {
+		case tt.definition == nil && definition != nil:
+			t.Errorf("%s: expected no definition, got=%+v", tt.name, definition)
+		case tt.definition != nil && (definition == nil || definition.Range != tt.definition || definition.URI != uri):
+			t.Errorf("%s: wrong definition. want=%+v, got=%+v", tt.name, tt.definition, definition)
+		}
+
+		var references []Location
+		c.request("textDocument/references", map[string]interface{}{
+			"textDocument": params.TextDocument,
+			"position":     params.Position,
+			"context":      map[string]bool{"includeDeclaration": true},
+		}, &references)
+		got := []Range{}
+		for _, l := range references {
+			got = append(got, l.Range)
+		}
+		if len(got) != len(tt.references) {
+			t.Errorf("%s: wrong references. want=%+v, got=%+v", tt.name, tt.references, got)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.references[i] {
+				t.Errorf("%s: wrong reference %d. want=%+v, got=%+v", tt.name, i, tt.references[i], got[i])
+			}
+		}
+	}
+
+	var withoutDeclaration []Location
+	c.request("textDocument/references", map[string]interface{}{
+		"textDocument": map[string]string{"uri": uri},
+		"position":     Position{0, 5},
+		"context":      map[string]bool{"includeDeclaration": false},
+	}, &withoutDeclaration)
+	if len(withoutDeclaration) != 1 || withoutDeclaration[0].Range != lineRange(7, 4, 9) {
+		t.Errorf("wrong references without the declaration: %+v", withoutDeclaration)
+	}
+}
+
+func TestHover(t *testing.T) {
+	c := startClient(t)
+	c.initialize()
+	c.open(source)
+
+	tests := []struct {
+		at       Position
+		expected string // A substring of the hover text, or "" for no hover.
+	}{
+		{Position{7, 12}, "len(value)"},
+		{Position{7, 1}, "let add = fn(a, b)"},
+		{Position{2, 12}, "parameter a"},
+		{Position{7, 5}, "Global binding"},
+		{Position{3, 22}, "Local binding"},
+		{Position{7, 17}, ""},
+	}
+
+	for _, tt := range tests {
+		var hover *Hover
+		c.request("textDocument/hover", TextDocumentPositionParams{TextDocument: TextDocumentIdentifier{URI: uri}, Position: tt.at}, &hover)
+		if tt.expected == "" {
+			if hover != nil {
+				t.Errorf("expected no hover at %+v, got=%+v", tt.at, hover)
+			}
+			continue
+		}
+		if hover == nil || !strings.Contains(hover.Contents.Value, tt.expected) {
+			t.Errorf("wrong hover at %+v. want to contain %q, got=%+v", tt.at, tt.expected, hover)
+		}
+	}
+}
+
+const library = `let offset = 1;
+export let add = fn(a, b) { a + b + offset };
+export let twice = fn(x) { add(x, x) };
+`
+
+const importer = `import "lib";
+let three = add(1, 2);
+twice(three)
+`
+
+// Write the library next to the importer, and returns the URIs of both.
+func writeLibrary(t *testing.T) (string, string) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "lib.mk")
+	if err := ioutil.WriteFile(path, []byte(library), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return fileURI(path), fileURI(filepath.Join(dir, "main.mk"))
+}
+
+func TestImports(t *testing.T) {
+	libURI, mainURI := writeLibrary(t)
+	c := startClient(t)
+	c.initialize()
+	c.openAt(mainURI, importer)
+
+	at := TextDocumentPositionParams{TextDocument: TextDocumentIdentifier{URI: mainURI}, Position: Position{1, 13}}
+	var definition *Location
+	c.request("textDocument/definition", at, &definition)
+	if definition == nil || *definition != (Location{URI: libURI, Range: lineRange(1, 11, 14)}) {
+		t.Errorf("wrong definition of the imported name: %+v", definition)
+	}
+
+	var hover *Hover
+	c.request("textDocument/hover", at, &hover)
+	if hover == nil || !strings.Contains(hover.Contents.Value, "let add = fn(a, b)") {
+		t.Errorf("wrong hover of the imported function: %+v", hover)
+	}
+
+	var references []Location
+	c.request("textDocument/references", map[string]interface{}{
+		"textDocument": at.TextDocument,
+		"position":     at.Position,
+		"context":      map[string]bool{"includeDeclaration": true},
+	}, &references)
+	expected := []Location{
+		{URI: mainURI, Range: lineRange(1, 12, 15)},
+		{URI: libURI, Range: lineRange(1, 11, 14)},
+		{URI: libURI, Range: lineRange(2, 27, 30)},
+	}
+	if !equalJSON(t, references, expected) {
+		t.Errorf("wrong references of the imported name. want=%+v, got=%+v", expected, references)
+	}
+}
+
+func TestRename(t *testing.T) {
+	libURI, mainURI := writeLibrary(t)
+	c := startClient(t)
+	c.initialize()
+	c.openAt(mainURI, importer)
+
+	rename := func(at Position, newName string, edit interface{}) *ResponseError {
+		return c.call("textDocument/rename", RenameParams{
+			TextDocumentPositionParams: TextDocumentPositionParams{TextDocument: TextDocumentIdentifier{URI: mainURI}, Position: at},
+			NewName:                    newName,
+		}, edit)
+	}
+
+	var edit WorkspaceEdit
+	if err := rename(Position{1, 13}, "sum", &edit); err != nil {
+		t.Fatalf("renaming the imported name failed: %+v", err)
+	}
+	expected := WorkspaceEdit{Changes: map[string][]TextEdit{
+		mainURI: {{Range: lineRange(1, 12, 15), NewText: "sum"}},
+		libURI:  {{Range: lineRange(1, 11, 14), NewText: "sum"}, {Range: lineRange(2, 27, 30), NewText: "sum"}},
+	}}
+	if !equalJSON(t, edit, expected) {
+		t.Errorf("wrong edit. want=%+v, got=%+v", expected, edit)
+	}
+
+	var local WorkspaceEdit
+	if err := rename(Position{1, 5}, "four", &local); err != nil {
+		t.Fatalf("renaming the global failed: %+v", err)
+	}
+	expected = WorkspaceEdit{Changes: map[string][]TextEdit{
+		mainURI: {{Range: lineRange(1, 4, 9), NewText: "four"}, {Range: lineRange(2, 6, 11), NewText: "four"}},
+	}}
+	if !equalJSON(t, local, expected) {
+		t.Errorf("wrong edit. want=%+v, got=%+v", expected, local)
+	}
+
+	for _, newName := range []string{"", "let", "a b", "1x"} {
+		if err := rename(Position{1, 5}, newName, &local); err == nil || err.Code != codeInvalidParams {
+			t.Errorf("expected renaming to %q to fail, got=%+v", newName, err)
+		}
+	}
+	if err := rename(Position{1, 2}, "x", &local); err != nil {
+		t.Errorf("expected no edit outside of an identifier, got=%+v", err)
+	}
+}
+
+func TestDocumentSymbols(t *testing.T) {
+	c := startClient(t)
+	c.initialize()
+	c.open(source)
+
+	var symbols []DocumentSymbol
+	c.request("textDocument/documentSymbol", DocumentSymbolParams{TextDocument: TextDocumentIdentifier{URI: uri}}, &symbols)
+
+	expected := []DocumentSymbol{
+		{
+			Name: "add", Detail: "fn(a, b)", Kind: symbolKindFunction,
+			Range: lineRange(1, 0, 7), SelectionRange: lineRange(1, 4, 7),
+			Children: []DocumentSymbol{
+				{Name: "twice", Detail: "fn()", Kind: symbolKindFunction, Range: lineRange(3, 2, 11), SelectionRange: lineRange(3, 6, 11)},
+			},
+		},
+		{Name: "count", Detail: "fn(n)", Kind: symbolKindFunction, Range: lineRange(6, 0, 9), SelectionRange: lineRange(6, 4, 9)},
+	}
+	if !equalJSON(t, symbols, expected) {
+		t.Errorf("wrong symbols.\nwant=%+v\ngot=%+v", expected, symbols)
+	}
+}
+
+func TestUTF16Positions(t *testing.T) {
+	d := newDocument(uri, `let s = "😀"; let x = s;`)
+	// The emoji takes 4 bytes, but 2 UTF-16 code units, so x is at the byte column 21.
+	o, ok := d.occurrenceAt(Position{0, 18})
+	if !ok || o.ident.Value != "x" || o.ident.Token.Column != 21 {
+		t.Fatalf("expected x at character 18, got=%+v", o)
+	}
+	if r := d.identRange(o.ident); r != lineRange(0, 18, 19) {
+		t.Errorf("wrong range of x: %+v", r)
+	}
+}
+
+func TestBuiltinDocs(t *testing.T) {
+	for _, b := range object.Builtins {
+		if _, ok := builtinDocs[b.Name]; !ok {
+			t.Errorf("no hover documentation for builtin %s", b.Name)
+		}
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	c := startClient(t)
+	c.initialize()
+
+	var unknown json.RawMessage
+	if err := c.call("textDocument/frobnicate", map[string]string{}, &unknown); err == nil || err.Code != codeMethodNotFound {
+		t.Errorf("expected method not found, got=%+v", err)
+	}
+	if err := c.call("textDocument/hover", TextDocumentPositionParams{TextDocument: TextDocumentIdentifier{URI: "file:///unknown.mk"}}, &unknown); err == nil {
+		t.Errorf("expected an error for an unknown document")
+	}
+
+	c.request("shutdown", nil, &unknown)
+	c.notify("exit", nil)
+	select {
+	case err := <-c.done:
+		if err != nil {
+			t.Errorf("Serve() returned an error: %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the server did not exit")
+	}
+}
+
+func lineRange(line, start, end int) Range {
+	return Range{Start: Position{line, start}, End: Position{line, end}}
+}
+
+func equalJSON(t *testing.T, a, b interface{}) bool {
+	t.Helper()
+	x, err := json.Marshal(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	y, err := json.Marshal(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(x) == string(y)
+}
+
+// A scripted LSP client talking to a server through pipes.
+type client struct {
+	t        *testing.T
+	w        io.Writer
+	messages chan Message
+	done     chan error
+	id       int
+}
+
+func startClient(t *testing.T) *client {
+	clientReader, serverWriter := io.Pipe()
+	serverReader, clientWriter := io.Pipe()
+	c := &client{t: t, w: clientWriter, messages: make(chan Message, 100), done: make(chan error, 1)}
+	go func() {
+		c.done <- NewServer(serverReader, serverWriter).Serve()
+		serverWriter.Close()
+	}()
+	t.Cleanup(func() { clientWriter.Close() })
+
+	go func() {
+		r := bufio.NewReader(clientReader)
+		for {
+			content, err := wire.ReadMessage(r)
+			if err != nil {
+				close(c.messages)
+				return
+			}
+			var msg Message
+			var raw struct {
+				Result json.RawMessage `json:"result"`
+			}
+			json.Unmarshal(content, &msg)
+			json.Unmarshal(content, &raw)
+			msg.Result = raw.Result
+			c.messages <- msg
+		}
+	}()
+	return c
+}
+
+func (c *client) initialize() {
+	c.t.Helper()
+	var result InitializeResult
+	c.request("initialize", map[string]interface{}{"processId": nil, "capabilities": map[string]interface{}{}}, &result)
+	if !result.Capabilities.DefinitionProvider || result.Capabilities.TextDocumentSync != textDocumentSyncFull {
+		c.t.Fatalf("wrong capabilities: %+v", result.Capabilities)
+	}
+	c.notify("initialized", map[string]interface{}{})
+}
+
+func (c *client) open(text string) {
+	c.t.Helper()
+	c.openAt(uri, text)
+}
+
+// Open the document at the URI, which has to have no diagnostics.
+func (c *client) openAt(uri, text string) {
+	c.t.Helper()
+	c.notify("textDocument/didOpen", DidOpenTextDocumentParams{TextDocument: TextDocumentItem{URI: uri, Version: 1, Text: text}})
+	var params PublishDiagnosticsParams
+	c.expectNotification("textDocument/publishDiagnostics", &params)
+	if len(params.Diagnostics) != 0 {
+		c.t.Fatalf("unexpected diagnostics: %+v", params.Diagnostics)
+	}
+}
+
+func (c *client) send(msg map[string]interface{}) {
+	c.t.Helper()
+	msg["jsonrpc"] = "2.0"
+	if err := wire.WriteMessage(c.w, msg); err != nil {
+		c.t.Fatalf("sending %v: %s", msg["method"], err)
+	}
+}
+
+func (c *client) notify(method string, params interface{}) {
+	c.t.Helper()
+	c.send(map[string]interface{}{"method": method, "params": params})
+}
+
+// Send a request and decode its result. Returns the error of the response, if any.
+func (c *client) call(method string, params interface{}, result interface{}) *ResponseError {
+	c.t.Helper()
+	c.id++
+	c.send(map[string]interface{}{"id": c.id, "method": method, "params": params})
+
+	msg := c.next()
+	var id int
+	if msg.ID == nil || json.Unmarshal(*msg.ID, &id) != nil || id != c.id {
+		c.t.Fatalf("expected the response to %s, got=%+v", method, msg)
+	}
+	if msg.Error != nil {
+		return msg.Error
+	}
+	if err := json.Unmarshal(msg.Result.(json.RawMessage), result); err != nil {
+		c.t.Fatalf("decoding the result of %s: %s", method, err)
+	}
+	return nil
+}
+
+// Send a request which has to succeed.
+func (c *client) request(method string, params interface{}, result interface{}) {
+	c.t.Helper()
+	if err := c.call(method, params, result); err != nil {
+		c.t.Fatalf("%s failed: %+v", method, err)
+	}
+}
+
+func (c *client) expectNotification(method string, params interface{}) {
+	c.t.Helper()
+	msg := c.next()
+	if msg.ID != nil || msg.Method != method {
+		c.t.Fatalf("expected the %s notification, got=%+v", method, msg)
+	}
+	if err := json.Unmarshal(msg.Params, params); err != nil {
+		c.t.Fatalf("decoding %s: %s", method, err)
+	}
+}
+
+func (c *client) next() Message {
+	c.t.Helper()
+	select {
+	case msg, ok := <-c.messages:
+		if !ok {
+			c.t.Fatalf("the server closed the connection")
+		}
+		return msg
+	case <-time.After(5 * time.Second):
+		c.t.Fatalf("timed out waiting for a message")
+	}
+	return Message{}
+}
@@ -0,0 +1,195 @@
+/*
+Package monkey embeds the Monkey programming language in Go programs.
+
+A Runtime compiles and runs programs on the bytecode VM, keeping the global bindings between runs
+as the REPL does. Go functions registered to a Runtime are callable from its programs,
+and Monkey functions are callable from Go.
+
+Compile makes a vm.Program instead, which many VMs can run at the same time with globals of their own.
+*/
+package monkey
+
+import (
+	"fmt"
+	"monkey/ast"
+	"monkey/code"
+	"monkey/compiler"
+	"monkey/lexer"
+	"monkey/object"
+	"monkey/parser"
+	"monkey/vm"
+	"reflect"
+	"strings"
+)
+
+type Runtime struct {
+	config      vm.Config
+	symbolTable *compiler.SymbolTable
+	constants   []object.Object
+	globals     []object.Object
+	macros      *object.Environment
+	loader      *compiler.Loader
+}
+
+// Create a runtime with the default VM configuration. Imports are relative to the current directory.
+func NewRuntime() *Runtime {
+	return NewRuntimeWithConfig(vm.DefaultConfig())
+}
+
+func NewRuntimeWithConfig(config vm.Config) *Runtime {
+	symbolTable := compiler.NewSymbolTable()
+	for i, v := range object.Builtins {
+		symbolTable.DefineBuiltin(i, v.Name)
+	}
+	globalsSize := config.GlobalsSize
+	if globalsSize <= 0 {
+		globalsSize = vm.GlobalsSize
+	}
+
+	return &Runtime{
+		config:      config,
+		symbolTable: symbolTable,
+		constants:   []object.Object{},
+		globals:     make([]object.Object, globalsSize),
+		macros:      object.NewEnvironment(),
+		loader:      compiler.NewLoader(),
+	}
+}
+
+/*
+Bind the Go function to the name in the programs of this runtime only.
+The binding is a global, so a program can shadow it with its own let statement.
+*/
+func (rt *Runtime) Register(name string, fn object.BuiltinFunction) {
+	symbol := rt.symbolTable.Define(name)
+	rt.globals[symbol.Index] = &object.Builtin{Fn: fn}
+}
+
+/*
+Compile the source into a program for vm.NewFromProgram or vm.NewPool, which can run it many times in parallel.
+Imports are relative to the current directory. The macros run with the capabilities of the process.
+*/
+func Compile(src string) (*vm.Program, error) {
+	return CompileWithConfig(src, vm.DefaultConfig())
+}
+
+// Compile the source as Compile() does, running its macros with the capabilities and the budgets of the config.
+func CompileWithConfig(src string, config vm.Config) (*vm.Program, error) {
+	program, err := parse(src)
+	if err != nil {
+		return nil, err
+	}
+
+	comp := compiler.New()
+	err = comp.ExpandAndCompile(program, object.NewEnvironment(), config.Limits(), config.Capabilities)
+	if err != nil {
+		return nil, err
+	}
+	return vm.NewProgram(comp.ByteCode()), nil
+}
+
+// Parse the source, reporting the positions of all the parser errors.
+func parse(src string) (*ast.Program, error) {
+	p := parser.New(lexer.New(src))
+	program := p.ParseProgram()
+	if len(p.ErrorDetails()) != 0 {
+		msgs := []string{}
+		for _, e := range p.ErrorDetails() {
+			msgs = append(msgs, fmt.Sprintf("%d:%d: %s", e.Line, e.Column, e.Msg))
+		}
+		return nil, fmt.Errorf("parser errors:\n%s", strings.Join(msgs, "\n"))
+	}
+	return program, nil
+}
+
+// Run the program, and return the value of its last expression statement.
+func (rt *Runtime) Run(src string) (object.Object, error) {
+	program, err := parse(src)
+	if err != nil {
+		return nil, err
+	}
+
+	comp := compiler.NewWithState(rt.symbolTable, rt.constants)
+	comp.SetLoader(rt.loader, "")
+	if err := comp.ExpandAndCompile(program, rt.macros, rt.config.Limits(), rt.config.Capabilities); err != nil {
+		return nil, err
+	}
+	bytecode := comp.ByteCode()
+	rt.constants = bytecode.Constants
+
+	machine := vm.NewWithGlobalsStore(bytecode, rt.globals, rt.config)
+	if err := machine.Run(); err != nil {
+		return nil, err
+	}
+	return machine.LastPoppedStackElem(), nil
+}
+
+// Returns the value of the global binding, including the ones made by Register().
+func (rt *Runtime) Get(name string) (object.Object, bool) {
+	symbol, ok := rt.symbolTable.Resolve(name)
+	if !ok || symbol.Scope != compiler.GlobalScope || rt.globals[symbol.Index] == nil {
+		return nil, false
+	}
+	return rt.globals[symbol.Index], true
+}
+
+// Call the function, which is a closure from Get() or a builtin, with the arguments. A nil argument is passed as null.
+func (rt *Runtime) Call(fn object.Object, args ...object.Object) (object.Object, error) {
+	callable := false // Neither a nil object nor a nil pointer is.
+	switch fn := fn.(type) {
+	case nil:
+	case *object.Closure:
+		callable = fn != nil
+	case *object.Builtin:
+		callable = fn != nil && fn.Fn != nil
+	default:
+		return nil, fmt.Errorf("not a function: %s", fn.Type())
+	}
+	if !callable {
+		return nil, fmt.Errorf("not a function: nil")
+	}
+
+	// Closures refer to the constants by their indexes, so the call is appended to the constants of the runtime.
+	constants := append(rt.constants[:len(rt.constants):len(rt.constants)], fn)
+	for i, arg := range args {
+		if arg == nil {
+			arg = vm.Null
+		} else if v := reflect.ValueOf(arg); v.Kind() == reflect.Ptr && v.IsNil() {
+			return nil, fmt.Errorf("argument %d is a nil %s", i+1, v.Type())
+		}
+		constants = append(constants, arg)
+	}
+	ins := code.Instructions{}
+	for i := 0; i <= len(args); i++ {
+		constant, err := instruction(code.OpConstant, len(rt.constants)+i)
+		if err != nil {
+			return nil, err
+		}
+		ins = append(ins, constant...)
+	}
+	call, err := instruction(code.OpCall, len(args))
+	if err != nil {
+		maxArgs := code.MaxOperand(code.FirstOperandWidth(code.OpCallWide))
+		return nil, fmt.Errorf("too many arguments. got=%d, max=%d", len(args), maxArgs)
+	}
+	ins = append(ins, call...)
+	ins = append(ins, code.Make(code.OpPop)...)
+
+	machine := vm.NewWithGlobalsStore(&compiler.Bytecode{Instructions: ins, Constants: constants}, rt.globals, rt.config)
+	if err := machine.Run(); err != nil {
+		return nil, err
+	}
+	return machine.LastPoppedStackElem(), nil
+}
+
+// Encode the instruction, as its wide variant when the operand does not fit, as the compiler does.
+func instruction(op code.Opcode, operand int) ([]byte, error) {
+	if !code.Fits(op, operand) {
+		wide, ok := code.Wide(op)
+		if !ok || !code.Fits(wide, operand) {
+			return nil, fmt.Errorf("operand out of range: %d", operand)
+		}
+		op = wide
+	}
+	return code.Make(op, operand), nil
+}
@@ -0,0 +1,221 @@
+package monkey
+
+import (
+	"bytes"
+	"errors"
+	"monkey/budget"
+	"monkey/object"
+	"monkey/vm"
+	"strings"
+	"testing"
+)
+
+func TestRunKeepsGlobals(t *testing.T) {
+	rt := NewRuntime()
+	if _, err := rt.Run(`let add = fn(a, b) { a + b }; let base = 10;`); err != nil {
+		t.Fatalf("Run failed: %s", err)
+	}
+	result, err := rt.Run(`add(base, 5)`)
+	if err != nil {
+		t.Fatalf("Run failed: %s", err)
+	}
+	testInteger(t, result, 15)
+
+	base, ok := rt.Get("base")
+	if !ok {
+		t.Fatalf("base is not found")
+	}
+	testInteger(t, base, 10)
+
+	if _, ok := rt.Get("undefined"); ok {
+		t.Errorf("undefined is found")
+	}
+	if _, ok := rt.Get("len"); ok {
+		t.Errorf("builtins are not globals")
+	}
+}
+
+func TestRegister(t *testing.T) {
+	rt := NewRuntime()
+	calls := 0
+	rt.Register("double", func(ctx *object.Context, args ...object.Object) object.Object {
+		calls++
+		return &object.Integer{Value: args[0].(*object.Integer).Value * 2}
+	})
+
+	result, err := rt.Run(`let f = fn(x) { double(x) + 1 }; f(20)`)
+	if err != nil {
+		t.Fatalf("Run failed: %s", err)
+	}
+	testInteger(t, result, 41)
+	if calls != 1 {
+		t.Errorf("double is called %d times", calls)
+	}
+
+	// Registered functions belong to their runtime.
+	if _, err := NewRuntime().Run(`double(1)`); err == nil || err.Error() != "undefined variable double" {
+		t.Errorf("expected an undefined variable, got=%v", err)
+	}
+}
+
+func TestCall(t *testing.T) {
+	rt := NewRuntime()
+	_, err := rt.Run(`
+	let offset = 100;
+	let add = fn(a, b) { a + b + offset };
+	let makeAdder = fn(x) { fn(y) { add(x, y) } };
+	`)
+	if err != nil {
+		t.Fatalf("Run failed: %s", err)
+	}
+
+	add, _ := rt.Get("add")
+	result, err := rt.Call(add, &object.Integer{Value: 1}, &object.Integer{Value: 2})
+	if err != nil {
+		t.Fatalf("Call failed: %s", err)
+	}
+	testInteger(t, result, 103)
+
+	makeAdder, _ := rt.Get("makeAdder")
+	adder, err := rt.Call(makeAdder, &object.Integer{Value: 5})
+	if err != nil {
+		t.Fatalf("Call failed: %s", err)
+	}
+	result, err = rt.Call(adder, &object.Integer{Value: 6})
+	if err != nil {
+		t.Fatalf("Call failed: %s", err)
+	}
+	testInteger(t, result, 111)
+
+	if _, err := rt.Call(add, &object.Integer{Value: 1}); err == nil {
+		t.Errorf("expected an error about the number of arguments")
+	}
+	if _, err := rt.Call(&object.Integer{Value: 1}); err == nil || err.Error() != "not a function: INTEGER" {
+		t.Errorf("expected an error about a non-function, got=%v", err)
+	}
+	result, err = rt.Call(add, nil, &object.Integer{Value: 2})
+	if err == nil || !strings.Contains(err.Error(), "NULL") {
+		t.Errorf("a nil argument is not passed as null. got=%v, err=%v", result, err)
+	}
+	show, _ := rt.Run(`fn(x) { x }`)
+	if result, err := rt.Call(show, nil); err != nil || result != vm.Null {
+		t.Errorf("a nil argument is not passed as null. got=%v, err=%v", result, err)
+	}
+	if _, err := rt.Call(add, (*object.Integer)(nil), nil); err == nil || err.Error() != "argument 1 is a nil *object.Integer" {
+		t.Errorf("expected an error about a nil argument, got=%v", err)
+	}
+	for _, fn := range []object.Object{nil, (*object.Closure)(nil), (*object.Builtin)(nil)} {
+		if _, err := rt.Call(fn); err == nil || err.Error() != "not a function: nil" {
+			t.Errorf("expected an error about a nil function, got=%v", err)
+		}
+	}
+}
+
+// The operands of the call are encoded in their wide variants when they do not fit.
+func TestCallManyArguments(t *testing.T) {
+	rt := NewRuntimeWithConfig(vm.Config{StackSize: 1 << 17})
+	rt.Register("count", func(ctx *object.Context, args ...object.Object) object.Object {
+		return &object.Integer{Value: int64(len(args))}
+	})
+	count, _ := rt.Get("count")
+
+	args := make([]object.Object, 70000)
+	for i := range args {
+		args[i] = &object.Integer{Value: int64(i)}
+	}
+	result, err := rt.Call(count, args[:300]...)
+	if err != nil {
+		t.Fatalf("Call failed: %s", err)
+	}
+	testInteger(t, result, 300)
+
+	// Constants past 65535 need wide operands too.
+	result, err = rt.Call(count, args[:65535]...)
+	if err != nil {
+		t.Fatalf("Call failed: %s", err)
+	}
+	testInteger(t, result, 65535)
+
+	if _, err := rt.Call(count, args...); err == nil || err.Error() != "too many arguments. got=70000, max=65535" {
+		t.Errorf("expected an error about the number of arguments, got=%v", err)
+	}
+}
+
+func TestRunErrors(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"let = 1;", "parser errors:\n1:5: expected next token to be IDENT, got = instead.\n1:5: no prefix parse function for = found"},
+		{"let m = macro(x) { x }; m()", "macro m: wrong number of arguments. got=0, want=1"},
+		{"x", "undefined variable x"},
+		{"1 + true", "unsupported types for binary operation: INTEGER BOOLEAN"},
+	}
+
+	for _, tt := range tests {
+		_, err := NewRuntime().Run(tt.input)
+		if err == nil || err.Error() != tt.expected {
+			t.Errorf("wrong error for %q.\nwant=%q\ngot= %v", tt.input, tt.expected, err)
+		}
+	}
+}
+
+// The macros run in the sandbox of the runtime, as its programs do.
+func TestMacroCapabilities(t *testing.T) {
+	var out bytes.Buffer
+	config := vm.Config{Capabilities: &object.Context{Stdout: &out}, MaxInstructions: 10000}
+	rt := NewRuntimeWithConfig(config)
+
+	_, err := rt.Run(`let leak = macro() { puts("ESCAPED: " + getenv("HOME")); quote(1) }; leak()`)
+	if err == nil || err.Error() != "macro leak: `getenv` is not permitted: no environment" {
+		t.Errorf("getenv is not denied in the macro. got=%v", err)
+	}
+	if _, err := rt.Run(`let hello = macro() { puts("hello"); quote(1) }; hello()`); err != nil {
+		t.Errorf("Run failed: %s", err)
+	}
+	if out.String() != "hello\n" {
+		t.Errorf("puts does not write to the stdout of the runtime. got=%q", out.String())
+	}
+
+	_, err = rt.Run(`let spin = macro() { let f = fn(x) { if (x == 0) { return quote(1) } f(x - 1) }; f(1000) }; spin()`)
+	var stepErr *budget.StepLimitError
+	if !errors.As(err, &stepErr) {
+		t.Errorf("the macro does not use up the instructions. got=%T (%v)", err, err)
+	}
+
+	if _, err := CompileWithConfig(`let m = macro() { getenv("HOME"); quote(1) }; m()`, config); err == nil {
+		t.Errorf("getenv is not denied in the macro by CompileWithConfig")
+	}
+}
+
+func TestCompile(t *testing.T) {
+	program, err := Compile(`let m = macro(x) { quote(unquote(x) * 2) }; let f = fn(x) { m(x) + 1 }; f(20)`)
+	if err != nil {
+		t.Fatalf("Compile failed: %s", err)
+	}
+
+	pool := vm.NewPool(program, vm.DefaultConfig())
+	for i := 0; i < 2; i++ {
+		machine := pool.Get()
+		if err := machine.Run(); err != nil {
+			t.Fatalf("Run failed: %s", err)
+		}
+		testInteger(t, machine.LastPoppedStackElem(), 41)
+		pool.Put(machine)
+	}
+
+	if _, err := Compile("let = 1;"); err == nil {
+		t.Errorf("expected parser errors")
+	}
+}
+
+func testInteger(t *testing.T, obj object.Object, expected int64) {
+	t.Helper()
+	integer, ok := obj.(*object.Integer)
+	if !ok {
+		t.Fatalf("object is not Integer. got=%T (%+v)", obj, obj)
+	}
+	if integer.Value != expected {
+		t.Errorf("wrong value. want=%d, got=%d", expected, integer.Value)
+	}
+}
@@ -1,6 +1,10 @@
 package object
 
-import "fmt"
+import (
+	"fmt"
+	"io"
+	"io/fs"
+)
 
 func GetBuiltinByName(name string) *Builtin {
 	for _, def := range Builtins {
@@ -17,7 +21,7 @@ var Builtins = []struct {
 }{
 	{
 		"len",
-		&Builtin{Fn: func(args ...Object) Object {
+		&Builtin{Fn: func(ctx *Context, args ...Object) Object {
 			if len(args) != 1 {
 				return newError("wrong number of arguments. got=%d, want=1", len(args))
 			}
@@ -33,16 +37,17 @@ var Builtins = []struct {
 	},
 	{
 		"puts",
-		&Builtin{Fn: func(args ...Object) Object {
-			for _, arg := range args {
-				fmt.Println(arg.Inspect())
+		&Builtin{Fn: func(ctx *Context, args ...Object) Object {
+			if ctx.Stdout == nil {
+				return notPermitted("puts", "stdout")
 			}
+			writeLines(ctx.Stdout, args)
 			return nil
 		}},
 	},
 	{
 		"first",
-		&Builtin{Fn: func(args ...Object) Object {
+		&Builtin{Fn: func(ctx *Context, args ...Object) Object {
 			if len(args) != 1 {
 				return newError("wrong number of arguments. got=%d, want=1", len(args))
 			}
@@ -60,7 +65,7 @@ var Builtins = []struct {
 	},
 	{
 		"last",
-		&Builtin{Fn: func(args ...Object) Object {
+		&Builtin{Fn: func(ctx *Context, args ...Object) Object {
 			if len(args) != 1 {
 				return newError("wrong number of arguments. got=%d, want=1", len(args))
 			}
@@ -78,7 +83,7 @@ var Builtins = []struct {
 	},
 	{
 		"rest",
-		&Builtin{Fn: func(args ...Object) Object {
+		&Builtin{Fn: func(ctx *Context, args ...Object) Object {
 			if len(args) != 1 {
 				return newError("wrong number of arguments, got=%d, want=1", len(args))
 			}
@@ -97,7 +102,7 @@ var Builtins = []struct {
 	},
 	{
 		"push",
-		&Builtin{Fn: func(args ...Object) Object {
+		&Builtin{Fn: func(ctx *Context, args ...Object) Object {
 			if len(args) != 2 {
 				return newError("wrong number of arguments. got=%d, want=2", len(args))
 			}
@@ -115,6 +120,116 @@ var Builtins = []struct {
 			return &Array{Elements: newElements}
 		}},
 	},
+	{
+		"eputs",
+		&Builtin{Fn: func(ctx *Context, args ...Object) Object {
+			if ctx.Stderr == nil {
+				return notPermitted("eputs", "stderr")
+			}
+			writeLines(ctx.Stderr, args)
+			return nil
+		}},
+	},
+	{
+		"readFile",
+		&Builtin{Fn: func(ctx *Context, args ...Object) Object {
+			if len(args) != 1 {
+				return newError("wrong number of arguments. got=%d, want=1", len(args))
+			}
+			path, ok := args[0].(*String)
+			if !ok {
+				return newError("argument to `readFile` must be STRING, got=%s", args[0].Type())
+			}
+			if ctx.FS == nil {
+				return notPermitted("readFile", "filesystem")
+			}
+			content, err := fs.ReadFile(ctx.FS, path.Value)
+			if err != nil {
+				return newError("%s", err)
+			}
+			return &String{Value: string(content)}
+		}},
+	},
+	{
+		"now",
+		&Builtin{Fn: func(ctx *Context, args ...Object) Object {
+			if len(args) != 0 {
+				return newError("wrong number of arguments. got=%d, want=0", len(args))
+			}
+			if ctx.Now == nil {
+				return notPermitted("now", "clock")
+			}
+			// Milliseconds since the Unix epoch.
+			return &Integer{Value: ctx.Now().UnixNano() / 1e6}
+		}},
+	},
+	{
+		"random",
+		&Builtin{Fn: func(ctx *Context, args ...Object) Object {
+			if len(args) != 1 {
+				return newError("wrong number of arguments. got=%d, want=1", len(args))
+			}
+			n, ok := args[0].(*Integer)
+			if !ok {
+				return newError("argument to `random` must be INTEGER, got=%s", args[0].Type())
+			}
+			if n.Value <= 0 {
+				return newError("argument to `random` must be positive, got=%d", n.Value)
+			}
+			if ctx.Rand == nil {
+				return notPermitted("random", "random source")
+			}
+			return &Integer{Value: ctx.Rand.Int63n(n.Value)}
+		}},
+	},
+	{
+		"getenv",
+		&Builtin{Fn: func(ctx *Context, args ...Object) Object {
+			if len(args) != 1 {
+				return newError("wrong number of arguments. got=%d, want=1", len(args))
+			}
+			name, ok := args[0].(*String)
+			if !ok {
+				return newError("argument to `getenv` must be STRING, got=%s", args[0].Type())
+			}
+			if ctx.LookupEnv == nil {
+				return notPermitted("getenv", "environment")
+			}
+			if value, ok := ctx.LookupEnv(name.Value); ok {
+				return &String{Value: value}
+			}
+			return NULL
+		}},
+	},
+	{
+		// Resuming a generator runs Monkey code, so the engines handle `next` of a generator which is not done.
+		"next",
+		&Builtin{Fn: func(ctx *Context, args ...Object) Object {
+			if len(args) != 1 {
+				return newError("wrong number of arguments. got=%d, want=1", len(args))
+			}
+			gen, ok := args[0].(*Generator)
+			if !ok {
+				return newError("argument to `next` must be GENERATOR, got=%s", args[0].Type())
+			}
+			if gen.Done {
+				return NULL
+			}
+			return newError("the generator can only be resumed by the engine which created it")
+		}},
+	},
+	{"channel", &Builtin{Fn: channelBuiltin}},
+	{"send", &Builtin{Fn: sendBuiltin}},
+	{"recv", &Builtin{Fn: recvBuiltin}},
+	{"close", &Builtin{Fn: closeBuiltin}},
+	{"select", &Builtin{Fn: selectBuiltin}},
+	{"wait", &Builtin{Fn: waitBuiltin}},
+}
+
+func writeLines(w io.Writer, args []Object) {
+	for _, arg := range args {
+		fmt.Fprintln(w, arg.Inspect())
+	}
 }
 
 func newError(format string, a ...interface{}) *Error {
@@ -0,0 +1,155 @@
+package object
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func TestCapabilityBuiltins(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	ctx := &Context{
+		Stdout: &stdout,
+		Stderr: &stderr,
+		FS:     fstest.MapFS{"data/config.txt": {Data: []byte("retries=3")}},
+		Now:    func() time.Time { return time.Unix(1700000000, 5e6) },
+		Rand:   rand.New(rand.NewSource(1)),
+		LookupEnv: func(name string) (string, bool) {
+			if name == "HOME" {
+				return "/home/monkey", true
+			}
+			return "", false
+		},
+	}
+
+	tests := []struct {
+		name     string
+		args     []Object
+		expected string
+	}{
+		{"puts", []Object{&Integer{Value: 1}, &String{Value: "a"}}, "null"},
+		{"eputs", []Object{&String{Value: "oops"}}, "null"},
+		{"readFile", []Object{&String{Value: "data/config.txt"}}, "retries=3"},
+		{"readFile", []Object{&String{Value: "missing.txt"}}, "ERROR: open missing.txt: file does not exist"},
+		{"readFile", []Object{&Integer{Value: 1}}, "ERROR: argument to `readFile` must be STRING, got=INTEGER"},
+		{"now", nil, "1700000000005"},
+		{"now", []Object{&Integer{Value: 1}}, "ERROR: wrong number of arguments. got=1, want=0"},
+		{"random", []Object{&Integer{Value: 1}}, "0"},
+		{"random", []Object{&Integer{Value: 0}}, "ERROR: argument to `random` must be positive, got=0"},
+		{"getenv", []Object{&String{Value: "HOME"}}, "/home/monkey"},
+		{"getenv", []Object{&String{Value: "UNSET"}}, "null"},
+	}
+
+	for _, tt := range tests {
+		result := GetBuiltinByName(tt.name).Fn(ctx, tt.args...)
+		if result == nil {
+			result = NULL
+		}
+		if result.Inspect() != tt.expected {
+			t.Errorf("%s(%v) wrong. want=%q, got=%q", tt.name, tt.args, tt.expected, result.Inspect())
+		}
+	}
+
+	if stdout.String() != "1\na\n" {
+		t.Errorf("wrong stdout. got=%q", stdout.String())
+	}
+	if stderr.String() != "oops\n" {
+		t.Errorf("wrong stderr. got=%q", stderr.String())
+	}
+}
+
+func TestBuiltinsWithoutCapabilities(t *testing.T) {
+	tests := []struct {
+		name     string
+		args     []Object
+		expected string
+	}{
+		{"puts", []Object{&Integer{Value: 1}}, "`puts` is not permitted: no stdout"},
+		{"eputs", []Object{&Integer{Value: 1}}, "`eputs` is not permitted: no stderr"},
+		{"readFile", []Object{&String{Value: "a.txt"}}, "`readFile` is not permitted: no filesystem"},
+		{"now", nil, "`now` is not permitted: no clock"},
+		{"random", []Object{&Integer{Value: 10}}, "`random` is not permitted: no random source"},
+		{"getenv", []Object{&String{Value: "HOME"}}, "`getenv` is not permitted: no environment"},
+	}
+
+	for _, tt := range tests {
+		result := GetBuiltinByName(tt.name).Fn(&Context{}, tt.args...)
+		errObj, ok := result.(*Error)
+		if !ok {
+			t.Errorf("%s did not fail. got=%T (%+v)", tt.name, result, result)
+			continue
+		}
+		if errObj.Message != tt.expected {
+			t.Errorf("wrong error for %s. want=%q, got=%q", tt.name, tt.expected, errObj.Message)
+		}
+	}
+
+	// Builtins without side effects need no capabilities.
+	result := GetBuiltinByName("len").Fn(&Context{}, &String{Value: "abc"})
+	if result.Inspect() != "3" {
+		t.Errorf("len wrong without capabilities. got=%q", result.Inspect())
+	}
+}
+
+func TestChannelBuiltins(t *testing.T) {
+	ch := GetBuiltinByName("channel").Fn(&Context{}, &Integer{Value: 2})
+	done := make(chan struct{})
+	ctx := &Context{Done: done}
+
+	tests := []struct {
+		name     string
+		args     []Object
+		expected string
+	}{
+		{"send", []Object{ch, &Integer{Value: 1}}, "null"},
+		{"select", []Object{&Array{Elements: []Object{&Array{Elements: []Object{ch, &Integer{Value: 2}}}}}}, "[0, null]"},
+		{"select", []Object{&Array{Elements: []Object{&Array{Elements: []Object{ch, &Integer{Value: 3}}}}}, &String{Value: "full"}}, "full"},
+		{"recv", []Object{ch}, "1"},
+		{"select", []Object{&Array{Elements: []Object{ch}}}, "[0, 2]"},
+		{"close", []Object{ch}, "null"},
+		{"recv", []Object{ch}, "null"},
+		{"close", []Object{ch}, "ERROR: close of closed channel"},
+		{"send", []Object{ch, &Integer{Value: 1}}, "ERROR: send on closed channel"},
+		{"recv", []Object{&Integer{Value: 1}}, "ERROR: argument to `recv` must be CHANNEL, got=INTEGER"},
+		{"channel", []Object{&Integer{Value: -1}}, "ERROR: argument to `channel` must be from 0 to 65536, got=-1"},
+	}
+
+	for _, tt := range tests {
+		result := GetBuiltinByName(tt.name).Fn(ctx, tt.args...)
+		if result == nil {
+			result = NULL
+		}
+		if result.Inspect() != tt.expected {
+			t.Errorf("%s(%v) wrong. want=%q, got=%q", tt.name, tt.args, tt.expected, result.Inspect())
+		}
+	}
+
+	// The builtins which block return when the execution is canceled.
+	close(done)
+	blocked := []struct {
+		name string
+		args []Object
+	}{
+		{"recv", []Object{NewChannel(0)}},
+		{"send", []Object{NewChannel(0), NULL}},
+		{"select", []Object{&Array{Elements: []Object{NewChannel(0)}}}},
+		{"wait", []Object{NewTask()}},
+	}
+	for _, tt := range blocked {
+		result := GetBuiltinByName(tt.name).Fn(ctx, tt.args...)
+		if result.Inspect() != "ERROR: execution canceled" {
+			t.Errorf("%s is not canceled. got=%q", tt.name, result.Inspect())
+		}
+	}
+
+	// Nothing can unblock the only task of an execution, so they fail at once.
+	ctx = &Context{Tasks: NewTaskGroup()}
+	for _, tt := range blocked {
+		result := GetBuiltinByName(tt.name).Fn(ctx, tt.args...)
+		if result.Inspect() != "ERROR: deadlock: all tasks are blocked" {
+			t.Errorf("%s is not deadlocked. got=%q", tt.name, result.Inspect())
+		}
+	}
+}
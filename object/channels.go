@@ -0,0 +1,428 @@
+package object
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"sync/atomic"
+)
+
+/*
+A channel of values between tasks, created by `channel`.
+Every value can be sent: all of them are immutable, except generators,
+which the VM only lets the task which created them resume.
+*/
+type Channel struct {
+	ch     chan Object
+	closed int32 // Set atomically by `close`, for the TaskGroup to see that it unblocks the tasks.
+}
+
+// The largest buffer of a channel, so that `channel` cannot allocate more memory than the budgets can account for.
+const MaxChannelSize = 1 << 16
+
+func NewChannel(size int) *Channel {
+	return &Channel{ch: make(chan Object, size)}
+}
+
+// Returns the size of the buffer of the channel.
+func (c *Channel) Cap() int { return cap(c.ch) }
+
+func (c *Channel) Type() ObjectType { return CHANNEL_OBJ }
+func (c *Channel) Inspect() string  { return fmt.Sprintf("Channel[%p]", c) }
+
+// A function running concurrently in its own VM, created by `spawn`. `wait` returns its result.
+type Task struct {
+	done   chan struct{}
+	result Object
+}
+
+func NewTask() *Task {
+	return &Task{done: make(chan struct{})}
+}
+
+func (t *Task) Type() ObjectType { return TASK_OBJ }
+func (t *Task) Inspect() string  { return fmt.Sprintf("Task[%p]", t) }
+
+/*
+Record the result of the task and wake up the tasks waiting for it. It must be called exactly once.
+The result of a task which fails is an *Error, whose Value is the thrown value if it is not an error itself.
+*/
+func (t *Task) Finish(result Object) {
+	t.result = result
+	close(t.done)
+}
+
+// Returned by the builtins which block when the execution is canceled. The engines report the cancellation instead.
+func canceled() *Error {
+	return newError("execution canceled")
+}
+
+/*
+The tasks of one execution: the program and the tasks it spawns. The builtins which block report to the group,
+so that when every task is blocked and none can proceed, as when the program receives from a channel no task sends to,
+they all return an error, like a Go program whose goroutines are all asleep panics.
+The channels are expected to be used by the tasks of one execution: the group cannot know
+that a task of another execution, or the host, might unblock its tasks.
+
+A task which is woken up still counts as blocked until it reports it, so when no task runs, a round of checks starts:
+the blocked tasks confirm that they are still blocked, and only once all of them have,
+the operations which they are blocked on tell whether any of them can proceed.
+*/
+type TaskGroup struct {
+	lock     sync.Mutex
+	running  int              // Tasks which are not blocked.
+	blocked  map[*waiter]bool // Operations which the other tasks are blocked on.
+	round    int              // Of the checks, counted from 1.
+	suspect  chan struct{}    // Closed to start the next round, then replaced.
+	deadlock chan struct{}    // Closed when a round finds the blocked tasks deadlocked, then replaced.
+}
+
+// Returns the group of an execution, whose only task is the program.
+func NewTaskGroup() *TaskGroup {
+	return &TaskGroup{
+		running:  1,
+		blocked:  map[*waiter]bool{},
+		suspect:  make(chan struct{}),
+		deadlock: make(chan struct{}),
+	}
+}
+
+// Count a task spawned by one of the group. It must call Exit() once it finishes.
+func (g *TaskGroup) Spawn() {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.running++
+}
+
+// Called by a task of the group when it finishes.
+func (g *TaskGroup) Exit() {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.running--
+	if g.running == 0 && len(g.blocked) != 0 {
+		g.startRound()
+	}
+}
+
+// An operation which a task is blocked on: receiving from or sending to one of the channels, or waiting for the task.
+type waiter struct {
+	recvs []*Channel
+	sends []*Channel
+	task  *Task
+	round int // The last round in which the task confirmed that it is blocked.
+}
+
+/*
+Block the task on the cases until one of them proceeds, the execution is canceled, or the tasks are deadlocked.
+w describes the cases for the group. Returns the case chosen as reflect.Select() does, or an error.
+*/
+func (ctx *Context) block(cases []reflect.SelectCase, w *waiter) (int, reflect.Value, bool, *Error) {
+	g := ctx.Tasks
+	var suspect, deadlock <-chan struct{}
+	if g != nil {
+		suspect, deadlock = g.enter(w)
+		defer g.leave(w)
+	}
+
+	n := len(cases)
+	cases = append(cases[:n:n],
+		reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ctx.Done)},
+		reflect.SelectCase{Dir: reflect.SelectRecv},
+		reflect.SelectCase{Dir: reflect.SelectRecv},
+	)
+	for {
+		cases[n+1].Chan = reflect.ValueOf(deadlock)
+		cases[n+2].Chan = reflect.ValueOf(suspect)
+		chosen, value, ok := reflect.Select(cases)
+		switch chosen {
+		case n:
+			return 0, reflect.Value{}, false, canceled()
+		case n + 1:
+			return 0, reflect.Value{}, false, deadlocked()
+		case n + 2:
+			suspect, deadlock = g.confirm(w)
+		default:
+			return chosen, value, ok, nil
+		}
+	}
+}
+
+// Count the task as blocked on the operation. Returns the channels which the task must watch while it is.
+func (g *TaskGroup) enter(w *waiter) (suspect, deadlock <-chan struct{}) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.running--
+	g.blocked[w] = true
+	if g.running == 0 {
+		g.startRound()
+	}
+	return g.confirmed(w)
+}
+
+// Count the task as running again.
+func (g *TaskGroup) leave(w *waiter) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.running++
+	delete(g.blocked, w)
+}
+
+// Called by a blocked task when a round starts.
+func (g *TaskGroup) confirm(w *waiter) (suspect, deadlock <-chan struct{}) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return g.confirmed(w)
+}
+
+// Record that the task is blocked in the current round, and end the round if it was the last one to confirm.
+func (g *TaskGroup) confirmed(w *waiter) (suspect, deadlock <-chan struct{}) {
+	w.round = g.round
+	suspect, deadlock = g.suspect, g.deadlock
+	g.endRound()
+	return suspect, deadlock
+}
+
+// Wake up the blocked tasks, which confirm that they are still blocked.
+func (g *TaskGroup) startRound() {
+	g.round++
+	close(g.suspect)
+	g.suspect = make(chan struct{})
+}
+
+// Once every blocked task has confirmed, and none runs, wake them up with an error if none of them can proceed.
+func (g *TaskGroup) endRound() {
+	if g.running > 0 || len(g.blocked) == 0 {
+		return
+	}
+	for w := range g.blocked {
+		if w.round != g.round {
+			return
+		}
+	}
+	for w := range g.blocked {
+		if g.canProceed(w) {
+			return
+		}
+	}
+	close(g.deadlock)
+	g.deadlock = make(chan struct{})
+}
+
+/*
+Whether the operation can complete without another task running: a channel has a value or room for one,
+or is closed, or another blocked task sends or receives the other end of it, or the task waited for has finished.
+*/
+func (g *TaskGroup) canProceed(w *waiter) bool {
+	if w.task != nil {
+		select {
+		case <-w.task.done:
+			return true
+		default:
+		}
+	}
+	for _, c := range w.recvs {
+		if len(c.ch) > 0 || atomic.LoadInt32(&c.closed) != 0 || g.pairs(w, c, func(other *waiter) []*Channel { return other.sends }) {
+			return true
+		}
+	}
+	for _, c := range w.sends {
+		if len(c.ch) < cap(c.ch) || atomic.LoadInt32(&c.closed) != 0 || g.pairs(w, c, func(other *waiter) []*Channel { return other.recvs }) {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether a blocked task other than w has the channel among the ends returned by ends.
+func (g *TaskGroup) pairs(w *waiter, c *Channel, ends func(*waiter) []*Channel) bool {
+	for other := range g.blocked {
+		if other == w {
+			continue
+		}
+		for _, end := range ends(other) {
+			if end == c {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Returned by the builtins which block when all the tasks of the execution are blocked for good.
+func deadlocked() *Error {
+	return newError("deadlock: all tasks are blocked")
+}
+
+func channelBuiltin(ctx *Context, args ...Object) Object {
+	if len(args) > 1 {
+		return newError("wrong number of arguments. got=%d, want=0 or 1", len(args))
+	}
+	if len(args) == 0 {
+		return NewChannel(0)
+	}
+	size, ok := args[0].(*Integer)
+	if !ok {
+		return newError("argument to `channel` must be INTEGER, got=%s", args[0].Type())
+	}
+	if size.Value < 0 || size.Value > MaxChannelSize {
+		return newError("argument to `channel` must be from 0 to %d, got=%d", MaxChannelSize, size.Value)
+	}
+	return NewChannel(int(size.Value))
+}
+
+func sendBuiltin(ctx *Context, args ...Object) (result Object) {
+	if len(args) != 2 {
+		return newError("wrong number of arguments. got=%d, want=2", len(args))
+	}
+	ch, ok := args[0].(*Channel)
+	if !ok {
+		return newError("first argument to `send` must be CHANNEL, got=%s", args[0].Type())
+	}
+
+	defer func() {
+		if recover() != nil {
+			result = newError("send on closed channel")
+		}
+	}()
+	select {
+	case ch.ch <- args[1]:
+		return nil
+	default:
+	}
+	send := reflect.SelectCase{Dir: reflect.SelectSend, Chan: reflect.ValueOf(ch.ch), Send: reflect.ValueOf(&args[1]).Elem()}
+	if _, _, _, err := ctx.block([]reflect.SelectCase{send}, &waiter{sends: []*Channel{ch}}); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Returns null when the channel is closed and drained.
+func recvBuiltin(ctx *Context, args ...Object) Object {
+	if len(args) != 1 {
+		return newError("wrong number of arguments. got=%d, want=1", len(args))
+	}
+	ch, ok := args[0].(*Channel)
+	if !ok {
+		return newError("argument to `recv` must be CHANNEL, got=%s", args[0].Type())
+	}
+
+	select {
+	case value, ok := <-ch.ch:
+		if !ok {
+			return NULL
+		}
+		return value
+	default:
+	}
+	recv := reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ch.ch)}
+	_, value, ok, err := ctx.block([]reflect.SelectCase{recv}, &waiter{recvs: []*Channel{ch}})
+	switch {
+	case err != nil:
+		return err
+	case !ok:
+		return NULL
+	}
+	return value.Interface().(Object)
+}
+
+func closeBuiltin(ctx *Context, args ...Object) (result Object) {
+	if len(args) != 1 {
+		return newError("wrong number of arguments. got=%d, want=1", len(args))
+	}
+	ch, ok := args[0].(*Channel)
+	if !ok {
+		return newError("argument to `close` must be CHANNEL, got=%s", args[0].Type())
+	}
+
+	defer func() {
+		if recover() != nil {
+			result = newError("close of closed channel")
+		}
+	}()
+	close(ch.ch)
+	atomic.StoreInt32(&ch.closed, 1)
+	return nil
+}
+
+/*
+`select(cases)` blocks until one of the cases can proceed, and returns [index, value] for it.
+A case is a channel to receive from, or a [channel, value] pair to send to, whose value in the result is null.
+`select(cases, default)` returns the default instead of blocking when no case can proceed.
+*/
+func selectBuiltin(ctx *Context, args ...Object) (result Object) {
+	if len(args) != 1 && len(args) != 2 {
+		return newError("wrong number of arguments. got=%d, want=1 or 2", len(args))
+	}
+	cases, ok := args[0].(*Array)
+	if !ok {
+		return newError("first argument to `select` must be ARRAY, got=%s", args[0].Type())
+	}
+
+	selectCases := make([]reflect.SelectCase, len(cases.Elements), len(cases.Elements)+2)
+	w := &waiter{}
+	for i, c := range cases.Elements {
+		if ch, ok := c.(*Channel); ok {
+			selectCases[i] = reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ch.ch)}
+			w.recvs = append(w.recvs, ch)
+			continue
+		}
+		if pair, ok := c.(*Array); ok && len(pair.Elements) == 2 {
+			if ch, ok := pair.Elements[0].(*Channel); ok {
+				selectCases[i] = reflect.SelectCase{
+					Dir:  reflect.SelectSend,
+					Chan: reflect.ValueOf(ch.ch),
+					Send: reflect.ValueOf(&pair.Elements[1]).Elem(),
+				}
+				w.sends = append(w.sends, ch)
+				continue
+			}
+		}
+		return newError("case %d of `select` must be CHANNEL or [CHANNEL, value], got=%s", i, c.Inspect())
+	}
+
+	defer func() {
+		if recover() != nil {
+			result = newError("send on closed channel")
+		}
+	}()
+	// A case which can proceed is chosen without blocking, and so is the default if there is one.
+	chosen, received, ok := reflect.Select(append(selectCases, reflect.SelectCase{Dir: reflect.SelectDefault}))
+	if chosen == len(cases.Elements) && len(args) == 2 {
+		return args[1]
+	}
+	if chosen == len(cases.Elements) {
+		var err *Error
+		chosen, received, ok, err = ctx.block(selectCases, w)
+		if err != nil {
+			return err
+		}
+	}
+
+	var value Object = NULL
+	if ok {
+		value = received.Interface().(Object)
+	}
+	return &Array{Elements: []Object{&Integer{Value: int64(chosen)}, value}}
+}
+
+// Returns the result of the task, or throws its error.
+func waitBuiltin(ctx *Context, args ...Object) Object {
+	if len(args) != 1 {
+		return newError("wrong number of arguments. got=%d, want=1", len(args))
+	}
+	task, ok := args[0].(*Task)
+	if !ok {
+		return newError("argument to `wait` must be TASK, got=%s", args[0].Type())
+	}
+
+	select {
+	case <-task.done:
+		return task.result
+	default:
+	}
+	done := reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(task.done)}
+	if _, _, _, err := ctx.block([]reflect.SelectCase{done}, &waiter{task: task}); err != nil {
+		return err
+	}
+	return task.result
+}
@@ -0,0 +1,48 @@
+package object
+
+import (
+	"io"
+	"io/fs"
+	"math/rand"
+	"os"
+	"time"
+)
+
+/*
+The capabilities which builtins are given by the engine calling them.
+A nil capability is not granted, and the builtins which need it return an error instead,
+so the zero Context runs untrusted programs without any I/O.
+*/
+type Context struct {
+	Stdout    io.Writer                        // Written by `puts`.
+	Stderr    io.Writer                        // Written by `eputs`.
+	FS        fs.FS                            // Files read by `readFile`.
+	Now       func() time.Time                 // Clock read by `now`.
+	Rand      *rand.Rand                       // Source of `random`.
+	LookupEnv func(name string) (string, bool) // Environment variables read by `getenv`.
+
+	// Closed when the execution calling the builtins is canceled, so that the builtins which block,
+	// such as `recv`, return. Set by the engines; nil never closes.
+	Done <-chan struct{}
+
+	// The tasks of the execution, which the builtins that block report to, so that a deadlock is an error
+	// rather than a hang. Set by the engines; nil never detects a deadlock.
+	Tasks *TaskGroup
+}
+
+// Returns a context with the capabilities of the process. Files are read relative to the current directory.
+func DefaultContext() *Context {
+	return &Context{
+		Stdout:    os.Stdout,
+		Stderr:    os.Stderr,
+		FS:        os.DirFS("."),
+		Now:       time.Now,
+		Rand:      rand.New(rand.NewSource(time.Now().UnixNano())),
+		LookupEnv: os.LookupEnv,
+	}
+}
+
+// Returned by a builtin which needs a capability the context does not grant.
+func notPermitted(builtin, capability string) *Error {
+	return newError("`%s` is not permitted: no %s", builtin, capability)
+}
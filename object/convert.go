@@ -0,0 +1,472 @@
+package object
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// Returned when a value cannot be converted between Go and Monkey.
+type ConversionError struct {
+	Msg  string
+	Path string // Where the value is within the converted value, such as `.Items[2]`. Empty for the value itself.
+}
+
+func (e *ConversionError) Error() string {
+	if e.Path == "" {
+		return e.Msg
+	}
+	return e.Msg + " at " + e.Path
+}
+
+var (
+	objectType  = reflect.TypeOf((*Object)(nil)).Elem()
+	errorType   = reflect.TypeOf((*error)(nil)).Elem()
+	contextType = reflect.TypeOf((*Context)(nil))
+	anyType     = reflect.TypeOf((*interface{})(nil)).Elem()
+)
+
+/*
+Convert a Go value into an object:
+
+	integers           -> INTEGER
+	bool               -> BOOLEAN
+	string, []byte     -> STRING
+	slices and arrays  -> ARRAY
+	maps               -> HASH, whose keys must be integers, booleans or strings
+	structs            -> HASH keyed by the field names, or by the names in `monkey:"name"` tags
+	functions          -> BUILTIN, which converts its arguments with ToGo() and its results with FromGo()
+	nil                -> NULL
+
+Pointers and interfaces are converted into the values they point to, and objects are returned as they are.
+A value which contains itself, through pointers, maps or slices, cannot be converted.
+A function whose first parameter is a *Context is given the context of the builtin call.
+A function may return an error as its last result, which is turned into an ERROR object when it is not nil.
+*/
+func FromGo(v interface{}) (Object, error) {
+	if v == nil {
+		return NULL, nil
+	}
+	return fromGo(reflect.ValueOf(v), "")
+}
+
+func fromGo(v reflect.Value, path string) (Object, error) {
+	c := &goConverter{visiting: map[visit]bool{}}
+	return c.fromGo(v, path)
+}
+
+// The state of a conversion from Go.
+type goConverter struct {
+	visiting map[visit]bool // The pointers, maps and slices on the path to the value being converted.
+}
+
+type visit struct {
+	ptr uintptr
+	typ reflect.Type
+}
+
+// Mark the pointer, map or slice as being converted until leave is called, failing if it already is.
+func (c *goConverter) enter(v reflect.Value, path string) (leave func(), err error) {
+	key := visit{ptr: v.Pointer(), typ: v.Type()}
+	if c.visiting[key] {
+		return nil, &ConversionError{Msg: fmt.Sprintf("cyclic value of type %s", v.Type()), Path: path}
+	}
+	c.visiting[key] = true
+	return func() { delete(c.visiting, key) }, nil
+}
+
+func (c *goConverter) fromGo(v reflect.Value, path string) (Object, error) {
+	if v.Type().Implements(objectType) && (v.Kind() != reflect.Ptr && v.Kind() != reflect.Interface || !v.IsNil()) {
+		return v.Interface().(Object), nil
+	}
+
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return NULL, nil
+		}
+		if v.Kind() == reflect.Ptr {
+			leave, err := c.enter(v, path)
+			if err != nil {
+				return nil, err
+			}
+			defer leave()
+		}
+		return c.fromGo(v.Elem(), path)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return &Integer{Value: v.Int()}, nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		u := v.Uint()
+		if int64(u) < 0 {
+			return nil, &ConversionError{Msg: fmt.Sprintf("%d overflows INTEGER", u), Path: path}
+		}
+		return &Integer{Value: int64(u)}, nil
+	case reflect.Bool:
+		if v.Bool() {
+			return TRUE, nil
+		}
+		return FALSE, nil
+	case reflect.String:
+		return &String{Value: v.String()}, nil
+	case reflect.Slice, reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return &String{Value: string(bytesOf(v))}, nil
+		}
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			return NULL, nil
+		}
+		if v.Kind() == reflect.Slice && v.Len() != 0 {
+			leave, err := c.enter(v, path)
+			if err != nil {
+				return nil, err
+			}
+			defer leave()
+		}
+		elements := make([]Object, v.Len())
+		for i := range elements {
+			el, err := c.fromGo(v.Index(i), fmt.Sprintf("%s[%d]", path, i))
+			if err != nil {
+				return nil, err
+			}
+			elements[i] = el
+		}
+		return &Array{Elements: elements}, nil
+	case reflect.Map:
+		if v.IsNil() {
+			return NULL, nil
+		}
+		leave, err := c.enter(v, path)
+		if err != nil {
+			return nil, err
+		}
+		defer leave()
+		pairs := make(map[HashKey]HashPair, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			keyPath := fmt.Sprintf("%s[%v]", path, iter.Key())
+			key, err := c.fromGo(iter.Key(), keyPath)
+			if err != nil {
+				return nil, err
+			}
+			hashable, ok := key.(Hashable)
+			if !ok {
+				return nil, &ConversionError{Msg: fmt.Sprintf("unusable as hash key: %s", key.Type()), Path: keyPath}
+			}
+			value, err := c.fromGo(iter.Value(), keyPath)
+			if err != nil {
+				return nil, err
+			}
+			pairs[hashable.HashKey()] = HashPair{Key: key, Value: value}
+		}
+		return &Hash{Pairs: pairs}, nil
+	case reflect.Struct:
+		pairs := map[HashKey]HashPair{}
+		for _, f := range fieldsOf(v.Type()) {
+			value, err := c.fromGo(v.Field(f.index), path+"."+f.goName)
+			if err != nil {
+				return nil, err
+			}
+			key := &String{Value: f.name}
+			pairs[key.HashKey()] = HashPair{Key: key, Value: value}
+		}
+		return &Hash{Pairs: pairs}, nil
+	case reflect.Func:
+		if v.IsNil() {
+			return NULL, nil
+		}
+		return wrapFunc(v), nil
+	}
+	return nil, &ConversionError{Msg: fmt.Sprintf("unsupported Go type %s", v.Type()), Path: path}
+}
+
+func bytesOf(v reflect.Value) []byte {
+	if v.Kind() == reflect.Slice {
+		return v.Bytes()
+	}
+	b := make([]byte, v.Len())
+	reflect.Copy(reflect.ValueOf(b), v)
+	return b
+}
+
+// Wrap the function into a builtin. Conversion errors of its arguments and results are returned as ERROR objects.
+func wrapFunc(fn reflect.Value) *Builtin {
+	t := fn.Type()
+	takesContext := t.NumIn() > 0 && t.In(0) == contextType
+	return &Builtin{Fn: func(ctx *Context, args ...Object) Object {
+		numIn := t.NumIn()
+		in := []reflect.Value{}
+		if takesContext {
+			in = append(in, reflect.ValueOf(ctx))
+			numIn--
+		}
+		if t.IsVariadic() && len(args) < numIn-1 {
+			return newError("wrong number of arguments. got=%d, want at least %d", len(args), numIn-1)
+		}
+		if !t.IsVariadic() && len(args) != numIn {
+			return newError("wrong number of arguments. got=%d, want=%d", len(args), numIn)
+		}
+
+		for i, arg := range args {
+			var paramType reflect.Type
+			if t.IsVariadic() && i >= numIn-1 {
+				paramType = t.In(t.NumIn() - 1).Elem()
+			} else {
+				paramType = t.In(t.NumIn() - numIn + i)
+			}
+			param := reflect.New(paramType).Elem()
+			if err := toGo(arg, param, fmt.Sprintf("argument %d", i+1)); err != nil {
+				return newError("%s", err)
+			}
+			in = append(in, param)
+		}
+
+		out := fn.Call(in)
+		if n := len(out); n > 0 && t.Out(n-1) == errorType {
+			if err := out[n-1]; !err.IsNil() {
+				return newError("%s", err.Interface())
+			}
+			out = out[:n-1]
+		}
+		switch len(out) {
+		case 0:
+			return nil
+		case 1:
+			result, err := fromGo(out[0], "result")
+			if err != nil {
+				return newError("%s", err)
+			}
+			return result
+		}
+		results := make([]Object, len(out))
+		for i, o := range out {
+			result, err := fromGo(o, fmt.Sprintf("result %d", i+1))
+			if err != nil {
+				return newError("%s", err)
+			}
+			results[i] = result
+		}
+		return &Array{Elements: results}
+	}}
+}
+
+/*
+Convert an object into the Go value which target points to.
+The conversions are the reverse of those of FromGo(). In addition:
+
+	interface{}          <- INTEGER as int64, BOOLEAN as bool, STRING as string,
+	                        ARRAY as []interface{}, HASH as map[interface{}]interface{}, NULL as nil
+	Object interfaces    <- the object itself
+	any type             <- NULL as the zero value
+
+Keys of a hash which do not name a field of a struct are ignored.
+Functions of Monkey cannot be converted, since they can only be called by the engine which created them.
+*/
+func ToGo(obj Object, target interface{}) error {
+	v := reflect.ValueOf(target)
+	if v.Kind() != reflect.Ptr || v.IsNil() {
+		return &ConversionError{Msg: fmt.Sprintf("target must be a non-nil pointer, got %T", target)}
+	}
+	return toGo(obj, v.Elem(), "")
+}
+
+func toGo(obj Object, v reflect.Value, path string) error {
+	if obj == nil {
+		return &ConversionError{Msg: "cannot convert a nil object", Path: path}
+	}
+	t := v.Type()
+	if t == anyType {
+		natural, err := naturalGo(obj, path)
+		if err != nil {
+			return err
+		}
+		if natural == nil {
+			v.Set(reflect.Zero(t))
+		} else {
+			v.Set(reflect.ValueOf(natural))
+		}
+		return nil
+	}
+	if t.Kind() == reflect.Interface && reflect.TypeOf(obj).Implements(t) {
+		v.Set(reflect.ValueOf(obj))
+		return nil
+	}
+	if _, ok := obj.(*Null); ok {
+		v.Set(reflect.Zero(t))
+		return nil
+	}
+
+	mismatch := func() error {
+		return &ConversionError{Msg: fmt.Sprintf("cannot convert %s to %s", obj.Type(), t), Path: path}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		elem := reflect.New(t.Elem())
+		if err := toGo(obj, elem.Elem(), path); err != nil {
+			return err
+		}
+		v.Set(elem)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		integer, ok := obj.(*Integer)
+		if !ok {
+			return mismatch()
+		}
+		if v.OverflowInt(integer.Value) {
+			return &ConversionError{Msg: fmt.Sprintf("%d overflows %s", integer.Value, t), Path: path}
+		}
+		v.SetInt(integer.Value)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		integer, ok := obj.(*Integer)
+		if !ok {
+			return mismatch()
+		}
+		if integer.Value < 0 || v.OverflowUint(uint64(integer.Value)) {
+			return &ConversionError{Msg: fmt.Sprintf("%d overflows %s", integer.Value, t), Path: path}
+		}
+		v.SetUint(uint64(integer.Value))
+	case reflect.Bool:
+		boolean, ok := obj.(*Boolean)
+		if !ok {
+			return mismatch()
+		}
+		v.SetBool(boolean.Value)
+	case reflect.String:
+		str, ok := obj.(*String)
+		if !ok {
+			return mismatch()
+		}
+		v.SetString(str.Value)
+	case reflect.Slice, reflect.Array:
+		if str, ok := obj.(*String); ok && t.Elem().Kind() == reflect.Uint8 {
+			if t.Kind() == reflect.Array {
+				if len(str.Value) != t.Len() {
+					return &ConversionError{Msg: fmt.Sprintf("cannot convert a string of %d bytes to %s", len(str.Value), t), Path: path}
+				}
+				reflect.Copy(v, reflect.ValueOf([]byte(str.Value)))
+			} else {
+				v.SetBytes([]byte(str.Value))
+			}
+			return nil
+		}
+		array, ok := obj.(*Array)
+		if !ok {
+			return mismatch()
+		}
+		if t.Kind() == reflect.Array && len(array.Elements) != t.Len() {
+			return &ConversionError{Msg: fmt.Sprintf("cannot convert an array of %d elements to %s", len(array.Elements), t), Path: path}
+		}
+		if t.Kind() == reflect.Slice {
+			v.Set(reflect.MakeSlice(t, len(array.Elements), len(array.Elements)))
+		}
+		for i, el := range array.Elements {
+			if err := toGo(el, v.Index(i), fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		hash, ok := obj.(*Hash)
+		if !ok {
+			return mismatch()
+		}
+		m := reflect.MakeMapWithSize(t, len(hash.Pairs))
+		for _, pair := range hash.Pairs {
+			keyPath := fmt.Sprintf("%s[%s]", path, pair.Key.Inspect())
+			key := reflect.New(t.Key()).Elem()
+			if err := toGo(pair.Key, key, keyPath); err != nil {
+				return err
+			}
+			value := reflect.New(t.Elem()).Elem()
+			if err := toGo(pair.Value, value, keyPath); err != nil {
+				return err
+			}
+			m.SetMapIndex(key, value)
+		}
+		v.Set(m)
+	case reflect.Struct:
+		hash, ok := obj.(*Hash)
+		if !ok {
+			return mismatch()
+		}
+		for _, f := range fieldsOf(t) {
+			pair, ok := hash.Pairs[(&String{Value: f.name}).HashKey()]
+			if !ok {
+				continue
+			}
+			if err := toGo(pair.Value, v.Field(f.index), path+"."+f.goName); err != nil {
+				return err
+			}
+		}
+	default:
+		return mismatch()
+	}
+	return nil
+}
+
+// Returns the plain Go value of the object, for a target of interface{}.
+func naturalGo(obj Object, path string) (interface{}, error) {
+	switch obj := obj.(type) {
+	case nil:
+		return nil, &ConversionError{Msg: "cannot convert a nil object", Path: path}
+	case *Null:
+		return nil, nil
+	case *Integer:
+		return obj.Value, nil
+	case *Boolean:
+		return obj.Value, nil
+	case *String:
+		return obj.Value, nil
+	case *Array:
+		elements := make([]interface{}, len(obj.Elements))
+		for i, el := range obj.Elements {
+			natural, err := naturalGo(el, fmt.Sprintf("%s[%d]", path, i))
+			if err != nil {
+				return nil, err
+			}
+			elements[i] = natural
+		}
+		return elements, nil
+	case *Hash:
+		m := make(map[interface{}]interface{}, len(obj.Pairs))
+		for _, pair := range obj.Pairs {
+			keyPath := fmt.Sprintf("%s[%s]", path, pair.Key.Inspect())
+			key, err := naturalGo(pair.Key, keyPath)
+			if err != nil {
+				return nil, err
+			}
+			value, err := naturalGo(pair.Value, keyPath)
+			if err != nil {
+				return nil, err
+			}
+			m[key] = value
+		}
+		return m, nil
+	}
+	return nil, &ConversionError{Msg: fmt.Sprintf("cannot convert %s to a Go value", obj.Type()), Path: path}
+}
+
+type field struct {
+	index  int
+	name   string // Key in the hash.
+	goName string
+}
+
+// Returns the exported fields of the struct type, named by their `monkey` tags if any. `monkey:"-"` skips a field.
+func fieldsOf(t reflect.Type) []field {
+	fields := []field{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" { // Unexported.
+			continue
+		}
+		name := f.Name
+		if tag, ok := f.Tag.Lookup("monkey"); ok {
+			if tag == "-" {
+				continue
+			}
+			if tag != "" {
+				name = tag
+			}
+		}
+		fields = append(fields, field{index: i, name: name, goName: f.Name})
+	}
+	return fields
+}
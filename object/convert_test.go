@@ -0,0 +1,284 @@
+package object
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math"
+	"reflect"
+	"testing"
+)
+
+type config struct {
+	Name    string   `monkey:"name"`
+	Retries int      `monkey:"retries"`
+	Tags    []string `monkey:"tags"`
+	Debug   bool
+	Secret  string `monkey:"-"`
+	private int
+}
+
+func TestFromGo(t *testing.T) {
+	five := 5
+	tests := []struct {
+		input    interface{}
+		expected string
+	}{
+		{nil, "null"},
+		{5, "5"},
+		{int8(-3), "-3"},
+		{uint32(7), "7"},
+		{&five, "5"},
+		{true, "true"},
+		{"monkey", "monkey"},
+		{[]byte("bytes"), "bytes"},
+		{[]int{1, 2, 3}, "[1, 2, 3]"},
+		{[2]bool{true, false}, "[true, false]"},
+		{[]interface{}{1, "two", nil}, "[1, two, null]"},
+		{[]int(nil), "null"},
+		{map[string]int{"a": 1}, "{a: 1}"},
+		{config{Name: "x", Secret: "hidden", private: 1}, ""},
+		{&Integer{Value: 9}, "9"},
+	}
+
+	for _, tt := range tests {
+		obj, err := FromGo(tt.input)
+		if err != nil {
+			t.Errorf("FromGo(%#v) failed: %s", tt.input, err)
+			continue
+		}
+		if tt.expected != "" && obj.Inspect() != tt.expected {
+			t.Errorf("FromGo(%#v) wrong. want=%q, got=%q", tt.input, tt.expected, obj.Inspect())
+		}
+	}
+}
+
+func TestFromGoStruct(t *testing.T) {
+	obj, err := FromGo(config{Name: "x", Retries: 3, Tags: []string{"a"}, Debug: true, Secret: "hidden"})
+	if err != nil {
+		t.Fatalf("FromGo failed: %s", err)
+	}
+	hash, ok := obj.(*Hash)
+	if !ok {
+		t.Fatalf("obj is not Hash. got=%T (%+v)", obj, obj)
+	}
+
+	expected := map[string]string{"name": "x", "retries": "3", "tags": "[a]", "Debug": "true"}
+	if len(hash.Pairs) != len(expected) {
+		t.Fatalf("hash has wrong number of pairs. want=%d, got=%d", len(expected), len(hash.Pairs))
+	}
+	for key, value := range expected {
+		pair, ok := hash.Pairs[(&String{Value: key}).HashKey()]
+		if !ok {
+			t.Errorf("no pair for key %q", key)
+			continue
+		}
+		if pair.Value.Inspect() != value {
+			t.Errorf("wrong value for key %q. want=%q, got=%q", key, value, pair.Value.Inspect())
+		}
+	}
+}
+
+func TestFromGoErrors(t *testing.T) {
+	tests := []struct {
+		input    interface{}
+		expected string
+	}{
+		{1.5, "unsupported Go type float64"},
+		{uint64(math.MaxUint64), "18446744073709551615 overflows INTEGER"},
+		{[]interface{}{1, []float32{2}}, "unsupported Go type float32 at [1][0]"},
+		{map[float64]int{1: 1}, "unsupported Go type float64 at [1]"},
+		{struct{ Ch chan int }{}, "unsupported Go type chan int at .Ch"},
+		{cyclicNode(), "cyclic value of type *object.node at .Next.Next"},
+		{cyclicMap(), "cyclic value of type map[string]interface {} at [self]"},
+		{cyclicSlice(), "cyclic value of type []interface {} at [0]"},
+	}
+
+	for _, tt := range tests {
+		_, err := FromGo(tt.input)
+		if err == nil {
+			t.Errorf("FromGo(%#v) did not fail", tt.input)
+			continue
+		}
+		if err.Error() != tt.expected {
+			t.Errorf("wrong error for %#v. want=%q, got=%q", tt.input, tt.expected, err)
+		}
+	}
+}
+
+type node struct {
+	Value int
+	Next  *node
+}
+
+func cyclicNode() *node {
+	a := &node{Value: 1}
+	a.Next = &node{Value: 2, Next: a}
+	return a
+}
+
+func cyclicMap() map[string]interface{} {
+	m := map[string]interface{}{}
+	m["self"] = m
+	return m
+}
+
+func cyclicSlice() []interface{} {
+	s := []interface{}{nil}
+	s[0] = s
+	return s
+}
+
+// A value shared by several parts of the converted value is not a cycle.
+func TestFromGoShared(t *testing.T) {
+	shared := &node{Value: 1}
+	obj, err := FromGo([]*node{shared, shared})
+	if err != nil {
+		t.Fatalf("FromGo failed: %s", err)
+	}
+	if len(obj.(*Array).Elements) != 2 {
+		t.Errorf("wrong result: %s", obj.Inspect())
+	}
+}
+
+func TestFromGoFunc(t *testing.T) {
+	tests := []struct {
+		fn       interface{}
+		args     []Object
+		expected string
+	}{
+		{func(a, b int) int { return a + b }, []Object{&Integer{Value: 1}, &Integer{Value: 2}}, "3"},
+		{func(s string, n ...int) int { return len(s) + len(n) }, []Object{&String{Value: "ab"}, &Integer{Value: 1}}, "3"},
+		{func(c config) string { return c.Name }, []Object{mustFromGo(t, config{Name: "x"})}, "x"},
+		{func() (int, string) { return 1, "a" }, nil, "[1, a]"},
+		{func() (int, error) { return 1, nil }, nil, "1"},
+		{func() (int, error) { return 0, errors.New("failed") }, nil, "ERROR: failed"},
+		{func(int) {}, nil, "ERROR: wrong number of arguments. got=0, want=1"},
+		{func(string, ...int) {}, nil, "ERROR: wrong number of arguments. got=0, want at least 1"},
+		{func(int8) {}, []Object{&Integer{Value: 300}}, "ERROR: 300 overflows int8 at argument 1"},
+		{func(int, bool) {}, []Object{&Integer{Value: 1}, &Integer{Value: 1}}, "ERROR: cannot convert INTEGER to bool at argument 2"},
+		{func() float64 { return 1 }, nil, "ERROR: unsupported Go type float64 at result"},
+		{func(ctx *Context, s string) bool { _, err := io.WriteString(ctx.Stdout, s); return err == nil }, []Object{&String{Value: "out"}}, "true"},
+		{func(ctx *Context, n int) {}, nil, "ERROR: wrong number of arguments. got=0, want=1"},
+	}
+
+	var out bytes.Buffer
+	for _, tt := range tests {
+		obj := mustFromGo(t, tt.fn)
+		builtin, ok := obj.(*Builtin)
+		if !ok {
+			t.Fatalf("obj is not Builtin. got=%T (%+v)", obj, obj)
+		}
+		result := builtin.Fn(&Context{Stdout: &out}, tt.args...)
+		if result == nil {
+			result = NULL
+		}
+		if result.Inspect() != tt.expected {
+			t.Errorf("wrong result for %T. want=%q, got=%q", tt.fn, tt.expected, result.Inspect())
+		}
+	}
+	if out.String() != "out" {
+		t.Errorf("the context is not passed to the function. output=%q", out.String())
+	}
+}
+
+func TestToGo(t *testing.T) {
+	var n int
+	if err := ToGo(&Integer{Value: 42}, &n); err != nil || n != 42 {
+		t.Errorf("ToGo into int wrong. got=%d, err=%v", n, err)
+	}
+
+	var p *string
+	if err := ToGo(&String{Value: "s"}, &p); err != nil || p == nil || *p != "s" {
+		t.Errorf("ToGo into *string wrong. got=%v, err=%v", p, err)
+	}
+
+	var c config
+	c.Secret = "kept"
+	input := mustFromGo(t, map[string]interface{}{"name": "x", "retries": 2, "tags": []string{"a", "b"}, "Secret": "ignored", "other": 1})
+	if err := ToGo(input, &c); err != nil {
+		t.Fatalf("ToGo into struct failed: %s", err)
+	}
+	expected := config{Name: "x", Retries: 2, Tags: []string{"a", "b"}, Secret: "kept"}
+	if !reflect.DeepEqual(c, expected) {
+		t.Errorf("ToGo into struct wrong. want=%+v, got=%+v", expected, c)
+	}
+
+	var m map[string]int
+	if err := ToGo(mustFromGo(t, map[string]int{"a": 1, "b": 2}), &m); err != nil {
+		t.Fatalf("ToGo into map failed: %s", err)
+	}
+	if !reflect.DeepEqual(m, map[string]int{"a": 1, "b": 2}) {
+		t.Errorf("ToGo into map wrong. got=%v", m)
+	}
+
+	var any interface{} = "previous"
+	if err := ToGo(mustFromGo(t, []interface{}{1, true, "s", nil}), &any); err != nil {
+		t.Fatalf("ToGo into interface{} failed: %s", err)
+	}
+	if !reflect.DeepEqual(any, []interface{}{int64(1), true, "s", nil}) {
+		t.Errorf("ToGo into interface{} wrong. got=%#v", any)
+	}
+	if err := ToGo(NULL, &any); err != nil || any != nil {
+		t.Errorf("ToGo of NULL into interface{} wrong. got=%#v, err=%v", any, err)
+	}
+
+	var obj Object
+	integer := &Integer{Value: 1}
+	if err := ToGo(integer, &obj); err != nil || obj != integer {
+		t.Errorf("ToGo into Object wrong. got=%v, err=%v", obj, err)
+	}
+
+	b := []byte("x")
+	if err := ToGo(NULL, &b); err != nil || b != nil {
+		t.Errorf("ToGo of NULL wrong. got=%v, err=%v", b, err)
+	}
+}
+
+func TestToGoErrors(t *testing.T) {
+	var n int8
+	var u uint
+	var s []string
+	var c config
+	var arr [2]int
+	var any interface{}
+
+	tests := []struct {
+		obj      Object
+		target   interface{}
+		expected string
+	}{
+		{&Integer{Value: 1}, n, "target must be a non-nil pointer, got int8"},
+		{&Integer{Value: 128}, &n, "128 overflows int8"},
+		{&Integer{Value: -1}, &u, "-1 overflows uint"},
+		{&String{Value: "1"}, &n, "cannot convert STRING to int8"},
+		{mustFromGo(t, []interface{}{"a", 1}), &s, "cannot convert INTEGER to string at [1]"},
+		{mustFromGo(t, map[string]interface{}{"tags": []int{1}}), &c, "cannot convert INTEGER to string at .Tags[0]"},
+		{mustFromGo(t, []int{1}), &arr, "cannot convert an array of 1 elements to [2]int"},
+		{&Builtin{}, &any, "cannot convert BUILTIN to a Go value"},
+		{nil, &n, "cannot convert a nil object"},
+		{nil, &any, "cannot convert a nil object"},
+		{&Array{Elements: []Object{nil}}, &any, "cannot convert a nil object at [0]"},
+		{&Array{Elements: []Object{nil}}, &s, "cannot convert a nil object at [0]"},
+	}
+
+	for _, tt := range tests {
+		err := ToGo(tt.obj, tt.target)
+		if err == nil {
+			t.Errorf("ToGo(%v, %T) did not fail", tt.obj, tt.target)
+			continue
+		}
+		if err.Error() != tt.expected {
+			t.Errorf("wrong error. want=%q, got=%q", tt.expected, err)
+		}
+	}
+}
+
+func mustFromGo(t *testing.T, v interface{}) Object {
+	t.Helper()
+	obj, err := FromGo(v)
+	if err != nil {
+		t.Fatalf("FromGo(%#v) failed: %s", v, err)
+	}
+	return obj
+}
@@ -0,0 +1,43 @@
+package object
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+Describe the value so that equal values have the same description whichever engine made them,
+although their functions are of different types and the order of the pairs of hashes is not fixed.
+Used to compare the results of the evaluator and the VM.
+*/
+func Describe(o Object) string {
+	switch o := o.(type) {
+	case nil:
+		return "nil"
+	case *String:
+		return strconv.Quote(o.Value)
+	case *Array:
+		elements := make([]string, len(o.Elements))
+		for i, e := range o.Elements {
+			elements[i] = Describe(e)
+		}
+		return "[" + strings.Join(elements, ", ") + "]"
+	case *Hash:
+		pairs := make([]string, 0, len(o.Pairs))
+		for _, pair := range o.Pairs {
+			pairs = append(pairs, Describe(pair.Key)+": "+Describe(pair.Value))
+		}
+		sort.Strings(pairs)
+		return "{" + strings.Join(pairs, ", ") + "}"
+	case *Function, *Closure, *CompiledFunction:
+		return "<function>"
+	case *Generator:
+		return "<generator>"
+	case *Task:
+		return "<task>"
+	case *Channel:
+		return "<channel>"
+	}
+	return o.Inspect()
+}
@@ -24,6 +24,11 @@ const (
 	HASH_OBJ              = "HASH"
 	COMPILED_FUNCTION_OBJ = "COMPILED_FUNCTION_OBJ"
 	CLOSURE_OBJECT        = "CLOSURE_OBJECT"
+	QUOTE_OBJ             = "QUOTE"
+	MACRO_OBJ             = "MACRO"
+	GENERATOR_OBJ         = "GENERATOR"
+	CHANNEL_OBJ           = "CHANNEL"
+	TASK_OBJ              = "TASK"
 )
 
 type Object interface {
@@ -76,6 +81,13 @@ type Null struct{}
 func (n *Null) Type() ObjectType { return NULL_OBJ }
 func (n *Null) Inspect() string  { return "null" }
 
+// Shared by the evaluator and the VM, which compare booleans and null by identity.
+var (
+	TRUE  = &Boolean{Value: true}
+	FALSE = &Boolean{Value: false}
+	NULL  = &Null{}
+)
+
 type ReturnValue struct {
 	Value Object
 }
@@ -87,6 +99,7 @@ type Function struct {
 	Parameters []*ast.Identifier
 	Body       *ast.BlockStatement
 	Env        *Environment
+	Generator  bool // Whether a call returns a Generator instead of evaluating the body.
 }
 
 func (f *Function) Type() ObjectType { return FUNCTION_OBJ }
@@ -106,7 +119,31 @@ func (f *Function) Inspect() string {
 	return out.String()
 }
 
-type BuiltinFunction func(args ...Object) Object
+// An unevaluated piece of the program, created by quote().
+type Quote struct {
+	Node ast.Node
+}
+
+func (q *Quote) Type() ObjectType { return QUOTE_OBJ }
+func (q *Quote) Inspect() string  { return "QUOTE(" + q.Node.String() + ")" }
+
+type Macro struct {
+	Parameters []*ast.Identifier
+	Body       *ast.BlockStatement
+	Env        *Environment
+}
+
+func (m *Macro) Type() ObjectType { return MACRO_OBJ }
+func (m *Macro) Inspect() string {
+	params := []string{}
+	for _, p := range m.Parameters {
+		params = append(params, p.String())
+	}
+	return "macro(" + strings.Join(params, ", ") + ") {\n" + m.Body.String() + "\n}"
+}
+
+// Builtins are called with the capabilities granted by the engine.
+type BuiltinFunction func(ctx *Context, args ...Object) Object
 
 type Builtin struct {
 	Fn BuiltinFunction
@@ -172,6 +209,9 @@ type CompiledFunction struct {
 	Instructions  code.Instructions
 	NumLocals     int
 	NumParameters int
+	Name          string         // Empty for anonymous functions.
+	Handlers      []code.Handler // Exception table. Inner handlers come before the outer ones.
+	Generator     bool           // Whether a call returns a Generator instead of running the function.
 }
 
 func (cf *CompiledFunction) Type() ObjectType { return COMPILED_FUNCTION_OBJ }
@@ -185,8 +225,21 @@ type Closure struct {
 func (c *Closure) Type() ObjectType { return CLOSURE_OBJECT }
 func (c *Closure) Inspect() string  { return fmt.Sprintf("Closure[%p]", c) }
 
+/*
+Returned by a call of a function which yields. The function runs lazily up to the next `yield`
+each time the generator is resumed by `next` or a for-in loop, and is suspended in between.
+*/
+type Generator struct {
+	Done  bool        // Set when the function has returned, or has thrown an exception.
+	State interface{} // The suspended function, whose representation is private to the engine which runs it.
+}
+
+func (g *Generator) Type() ObjectType { return GENERATOR_OBJ }
+func (g *Generator) Inspect() string  { return fmt.Sprintf("Generator[%p]", g) }
+
 type Error struct {
 	Message string
+	Value   Object // The thrown value when the evaluator propagates an uncaught `throw` of a non-error. nil otherwise.
 }
 
 func (e *Error) Type() ObjectType { return ERROR_OBJ }
@@ -1,10 +1,12 @@
 package parser
 
 import (
+	"bytes"
 	"fmt"
 	"monkey/ast"
 	"monkey/lexer"
 	"strconv"
+	"strings"
 	"testing"
 )
 
@@ -882,6 +884,207 @@ func TestFunctionLiteralWithName(t *testing.T) {
 	}
 }
 
+func TestImportAndExportStatements(t *testing.T) {
+	input := `import "lib/math"; export let x = 1; let y = 2;`
+
+	p := New(lexer.New(input))
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	if len(program.Statements) != 3 {
+		t.Fatalf("program.Statements does not contain 3 statements. got=%d", len(program.Statements))
+	}
+	stmt, ok := program.Statements[0].(*ast.ImportStatement)
+	if !ok {
+		t.Fatalf("program.Statements[0] is not *ast.ImportStatement. got=%T", program.Statements[0])
+	}
+	if stmt.Path.Value != "lib/math" {
+		t.Errorf("wrong path. want=%q, got=%q", "lib/math", stmt.Path.Value)
+	}
+
+	for i, exported := range []bool{true, false} {
+		let := program.Statements[i+1].(*ast.LetStatement)
+		if let.Exported != exported {
+			t.Errorf("wrong Exported of %s. want=%t, got=%t", let.Name, exported, let.Exported)
+		}
+	}
+	if program.String() != `import "lib/math";export let x = 1;let y = 2;` {
+		t.Errorf("wrong program.String(): %q", program.String())
+	}
+
+	for _, input := range []string{`import lib;`, `export fn() {}`} {
+		p := New(lexer.New(input))
+		p.ParseProgram()
+		if len(p.Errors()) == 0 {
+			t.Errorf("expected parser errors for %q", input)
+		}
+	}
+}
+
+func TestTryExpressionAndThrowStatement(t *testing.T) {
+	input := `try { throw x + 1; } catch (e) { e } finally { cleanup(); }`
+
+	p := New(lexer.New(input))
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	if len(program.Statements) != 1 {
+		t.Fatalf("program.Statements does not contain 1 statement. got=%d", len(program.Statements))
+	}
+	stmt := program.Statements[0].(*ast.ExpressionStatement)
+	try, ok := stmt.Expression.(*ast.TryExpression)
+	if !ok {
+		t.Fatalf("stmt.Expression is not *ast.TryExpression. got=%T", stmt.Expression)
+	}
+
+	throw, ok := try.Body.Statements[0].(*ast.ThrowStatement)
+	if !ok {
+		t.Fatalf("try.Body.Statements[0] is not *ast.ThrowStatement. got=%T", try.Body.Statements[0])
+	}
+	if !testInfixExpression(t, throw.Value, "x", "+", 1) {
+		return
+	}
+	if !testIdentifier(t, try.CatchParameter, "e") {
+		return
+	}
+	if len(try.Catch.Statements) != 1 || len(try.Finally.Statements) != 1 {
+		t.Errorf("wrong catch or finally block. got=%q, %q", try.Catch, try.Finally)
+	}
+	if program.String() != "try throw (x + 1);catch(e) efinally cleanup()" {
+		t.Errorf("wrong program.String(): %q", program.String())
+	}
+
+	for _, input := range []string{`try { 1 } finally { 2 }`, `try { 1 } catch (e) { 2 }`} {
+		p := New(lexer.New(input))
+		p.ParseProgram()
+		checkParserErrors(t, p)
+	}
+	for _, input := range []string{`try { 1 }`, `try { 1 } catch { 2 }`, `try { 1 } catch (1) { 2 }`} {
+		p := New(lexer.New(input))
+		p.ParseProgram()
+		if len(p.Errors()) == 0 {
+			t.Errorf("expected parser errors for %q", input)
+		}
+	}
+}
+
+func TestYieldAndForStatements(t *testing.T) {
+	input := `let gen = fn(xs) { for (x in xs) { yield x * 2; }; let inner = fn() { 1 }; };`
+
+	p := New(lexer.New(input))
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	let := program.Statements[0].(*ast.LetStatement)
+	fn, ok := let.Value.(*ast.FunctionLiteral)
+	if !ok {
+		t.Fatalf("let.Value is not *ast.FunctionLiteral. got=%T", let.Value)
+	}
+	if !fn.Generator {
+		t.Errorf("fn.Generator is false")
+	}
+	inner := fn.Body.Statements[1].(*ast.LetStatement).Value.(*ast.FunctionLiteral)
+	if inner.Generator {
+		t.Errorf("inner.Generator is true, though only the outer function yields")
+	}
+
+	loop, ok := fn.Body.Statements[0].(*ast.ForStatement)
+	if !ok {
+		t.Fatalf("fn.Body.Statements[0] is not *ast.ForStatement. got=%T", fn.Body.Statements[0])
+	}
+	if !testIdentifier(t, loop.Variable, "x") || !testIdentifier(t, loop.Iterable, "xs") {
+		return
+	}
+	yield, ok := loop.Body.Statements[0].(*ast.YieldStatement)
+	if !ok {
+		t.Fatalf("loop.Body.Statements[0] is not *ast.YieldStatement. got=%T", loop.Body.Statements[0])
+	}
+	if !testInfixExpression(t, yield.Value, "x", "*", 2) {
+		return
+	}
+	if loop.String() != "for(x in xs) yield (x * 2);" {
+		t.Errorf("wrong loop.String(): %q", loop.String())
+	}
+
+	for _, input := range []string{`yield 1;`, `macro() { yield 1; }`, `for (x of xs) { x }`, `for (1 in xs) { x }`, `for (x in xs) x`} {
+		p := New(lexer.New(input))
+		p.ParseProgram()
+		if len(p.Errors()) == 0 {
+			t.Errorf("expected parser errors for %q", input)
+		}
+	}
+}
+
+func TestSpawnExpression(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"spawn f(x, 1)", "spawn f(x, 1)"},
+		{"spawn f(x) + 1", "(spawn f(x) + 1)"},
+		{"spawn worker", "spawn worker"},
+		{"spawn fn() { x }", "spawn fn() x"},
+	}
+
+	for _, tt := range tests {
+		p := New(lexer.New(tt.input))
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+
+		if program.String() != tt.expected {
+			t.Errorf("wrong program for %q. want=%q, got=%q", tt.input, tt.expected, program.String())
+		}
+	}
+
+	stmt := New(lexer.New("spawn f(x)")).ParseProgram().Statements[0].(*ast.ExpressionStatement)
+	spawn, ok := stmt.Expression.(*ast.SpawnExpression)
+	if !ok {
+		t.Fatalf("stmt.Expression is not *ast.SpawnExpression. got=%T", stmt.Expression)
+	}
+	if _, ok := spawn.Function.(*ast.CallExpression); !ok {
+		t.Errorf("spawn.Function is not *ast.CallExpression. got=%T", spawn.Function)
+	}
+}
+
+func TestMacroLiteralParsing(t *testing.T) {
+	input := `macro(x, y) { x + y; }`
+
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	if len(program.Statements) != 1 {
+		t.Fatalf("program.Statements does not contain %d statements. got=%d", 1, len(program.Statements))
+	}
+
+	stmt, ok := program.Statements[0].(*ast.ExpressionStatement)
+	if !ok {
+		t.Fatalf("program.Statements[0] is not ast.ExpressionStatement. got=%T", program.Statements[0])
+	}
+
+	macro, ok := stmt.Expression.(*ast.MacroLiteral)
+	if !ok {
+		t.Fatalf("stmt.Expression is not ast.MacroLiteral. got=%T", stmt.Expression)
+	}
+
+	if len(macro.Parameters) != 2 {
+		t.Fatalf("macro literal parameters wrong. want=2, got=%d", len(macro.Parameters))
+	}
+	testLiteralExpression(t, macro.Parameters[0], "x")
+	testLiteralExpression(t, macro.Parameters[1], "y")
+
+	if len(macro.Body.Statements) != 1 {
+		t.Fatalf("macro.Body.Statements has not 1 statements. got=%d", len(macro.Body.Statements))
+	}
+
+	bodyStmt, ok := macro.Body.Statements[0].(*ast.ExpressionStatement)
+	if !ok {
+		t.Fatalf("macro body stmt is not ast.ExpressionStatement. got=%T", macro.Body.Statements[0])
+	}
+	testInfixExpression(t, bodyStmt.Expression, "x", "+", "y")
+}
+
 func testInfixExpression(
 	t *testing.T,
 	exp ast.Expression,
@@ -999,3 +1202,154 @@ func checkParserErrors(t *testing.T, p *Parser) {
 	}
 	t.FailNow()
 }
+
+func TestErrorPositions(t *testing.T) {
+	input := `let x = 5;
+let = 10;
+let y 3;`
+	p := New(lexer.New(input))
+	p.ParseProgram()
+
+	expected := []Error{
+		{Msg: "expected next token to be IDENT, got = instead.", Line: 2, Column: 5},
+		{Msg: "no prefix parse function for = found", Line: 2, Column: 5},
+		{Msg: "expected next token to be =, got INT instead.", Line: 3, Column: 7},
+	}
+	details := p.ErrorDetails()
+	if len(details) != len(p.Errors()) {
+		t.Fatalf("ErrorDetails() and Errors() differ in length: %d, %d", len(details), len(p.Errors()))
+	}
+	if len(details) != len(expected) {
+		t.Fatalf("wrong number of errors. want=%d, got=%d (%+v)", len(expected), len(details), details)
+	}
+	for i, e := range expected {
+		if details[i] != e {
+			t.Errorf("wrong error at %d. want=%+v, got=%+v", i, e, details[i])
+		}
+	}
+}
+
+func TestTrace(t *testing.T) {
+	var out bytes.Buffer
+	p := New(lexer.New("-a * b"), WithTrace(&out))
+	p.ParseProgram()
+	checkParserErrors(t, p)
+
+	expected := `BEGIN parseExpressionStatement - "-"
+	BEGIN parseExpression(LOWEST) - "-"
+		BEGIN parsePrefixExpression - "-"
+			BEGIN parseExpression(PREFIX) IDENT "a"
+				BEGIN parseIdentifier IDENT "a"
+				END parseIdentifier
+			END parseExpression(PREFIX)
+		END parsePrefixExpression
+		BEGIN parseInfixExpression * "*"
+			BEGIN parseExpression(PRODUCT) IDENT "b"
+				BEGIN parseIdentifier IDENT "b"
+				END parseIdentifier
+			END parseExpression(PRODUCT)
+		END parseInfixExpression
+	END parseExpression(LOWEST)
+END parseExpressionStatement
+`
+	if out.String() != expected {
+		t.Errorf("wrong trace.\nwant:\n%s\ngot:\n%s", expected, out.String())
+	}
+
+	// Parsers without the option do not trace, and traced parsers do not share their depth.
+	var other bytes.Buffer
+	New(lexer.New("f(1)"), WithTrace(&other)).ParseProgram()
+	New(lexer.New("1 + 2")).ParseProgram()
+	if !strings.HasPrefix(other.String(), "BEGIN parseExpressionStatement") || out.Len() != len(expected) {
+		t.Errorf("the trace of another parser is wrong:\n%s", other.String())
+	}
+}
+
+func TestJSONRoundTrip(t *testing.T) {
+	input := `import "lib";
+export let f = fn(a, b) { return a + b; };
+let g = fn() { yield -1; };
+let m = macro(x) { quote(unquote(x)) };
+for (x in g()) { throw {"k": [x, true][0]}; }
+try { spawn f(1, 2) } catch (e) { e } finally { if (!e) { "s" } else { 3 } }`
+
+	p := New(lexer.New(input))
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	data, err := ast.EncodeJSON(program)
+	if err != nil {
+		t.Fatalf("EncodeJSON failed: %s", err)
+	}
+	decoded, err := ast.DecodeJSON(data)
+	if err != nil {
+		t.Fatalf("DecodeJSON failed: %s", err)
+	}
+	if decoded.String() != program.String() {
+		t.Errorf("the decoded program is different.\nwant=%s\ngot= %s", program.String(), decoded.String())
+	}
+	again, err := ast.EncodeJSON(decoded)
+	if err != nil {
+		t.Fatalf("EncodeJSON failed: %s", err)
+	}
+	if string(again) != string(data) {
+		t.Errorf("the decoded program is encoded differently.\nwant=%s\ngot= %s", data, again)
+	}
+}
+
+func TestEndPosition(t *testing.T) {
+	tests := []struct {
+		input          string
+		expectedLine   int
+		expectedColumn int
+	}{
+		{"x", 1, 2},
+		{"12 + foo", 1, 9},
+		{`"a"`, 1, 4},
+		{"\"a\nbc\"", 2, 4},
+		{"f(1, 2)", 1, 8},
+		{"a[1]", 1, 5},
+		{"[1, 2]", 1, 7},
+		{"{1: 2}", 1, 7},
+		{"(1 + 2)", 1, 7}, // The parentheses are not part of the infix expression.
+		{"fn(x) {\n  x\n}", 3, 2},
+		{"if (x) { 1 } else { 2 }", 1, 24},
+		{"let x = -1;", 1, 11},
+	}
+
+	for _, tt := range tests {
+		p := New(lexer.New(tt.input))
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+
+		end := ast.EndPosition(program.Statements[0])
+		if end.Line != tt.expectedLine || end.Column != tt.expectedColumn {
+			t.Errorf("wrong end of %q. want=%d:%d, got=%d:%d",
+				tt.input, tt.expectedLine, tt.expectedColumn, end.Line, end.Column)
+		}
+	}
+}
+
+// The parser must never panic, whatever the input. Errors must have positions.
+func FuzzParseProgram(f *testing.F) {
+	for _, seed := range []string{
+		"let f = fn(x, y) { if (x < y) { x } else { y } }; f(1, 2)[0]",
+		`{"a": [1, 2], true: fn() { yield 1; }}`,
+		"try { throw 1 } catch (e) { e } finally { spawn f(e) }",
+		"import \"lib\"; export let x = macro(a) { quote(unquote(a)) };",
+		"for (x in [1,2]) { return -x; }",
+		"let = ; fn(,) { [ } )",
+	} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, input string) {
+		p := New(lexer.New(input))
+		p.ParseProgram()
+		for _, e := range p.ErrorDetails() {
+			if e.Line < 1 || e.Column < 1 {
+				t.Fatalf("error %q of %q has no position", e.Msg, input)
+			}
+		}
+	})
+}
@@ -2,36 +2,58 @@ package parser
 
 import (
 	"fmt"
+	"io"
 	"strings"
 )
 
-var traceLevel int = 0
-
 const traceIdentPlaceholder string = "\t"
 
-func identLevel() string {
-	return strings.Repeat(traceIdentPlaceholder, traceLevel-1)
+var precedenceNames = map[int]string{
+	LOWEST:      "LOWEST",
+	EQUALS:      "EQUALS",
+	LESSGREATER: "LESSGREATER",
+	SUM:         "SUM",
+	PRODUCT:     "PRODUCT",
+	PREFIX:      "PREFIX",
+	CALL:        "CALL",
+	INDEX:       "INDEX",
+}
+
+// Writes the parse functions a parser enters and leaves, indented by their depth.
+type tracer struct {
+	w     io.Writer
+	level int
 }
 
-func tracePrint(fs string) {
-	fmt.Printf("%s%s\n", identLevel(), fs)
+// Trace the parse functions to w, along with the token each of them starts at.
+func WithTrace(w io.Writer) Option {
+	return func(p *Parser) {
+		p.tracer = &tracer{w: w}
+	}
 }
 
-func incIdent() {
-	traceLevel = traceLevel + 1
+func (t *tracer) identLevel() string {
+	return strings.Repeat(traceIdentPlaceholder, t.level-1)
 }
 
-func decIdent() {
-	traceLevel = traceLevel - 1
+func (t *tracer) print(fs string) {
+	fmt.Fprintf(t.w, "%s%s\n", t.identLevel(), fs)
 }
 
-func trace(msg string) string {
-	incIdent()
-	tracePrint("BEGIN " + msg)
+// Does nothing unless the parser is traced, so parse functions can always call it.
+func (p *Parser) trace(msg string) string {
+	if p.tracer == nil {
+		return msg
+	}
+	p.tracer.level++
+	p.tracer.print(fmt.Sprintf("BEGIN %s %s %q", msg, p.curToken.Type, p.curToken.Literal))
 	return msg
 }
 
-func untrace(msg string) {
-	tracePrint("END " + msg)
-	decIdent()
+func (p *Parser) untrace(msg string) {
+	if p.tracer == nil {
+		return
+	}
+	p.tracer.print("END " + msg)
+	p.tracer.level--
 }
@@ -0,0 +1,212 @@
+package repl
+
+import (
+	"fmt"
+	"io/ioutil"
+	"monkey/ast"
+	"monkey/compiler"
+	"monkey/lexer"
+	"monkey/object"
+	"monkey/parser"
+	"strconv"
+	"strings"
+)
+
+const HELP = `Meta-commands:
+  :help              show this help
+  :reset             forget the bindings and the macros of the previous inputs
+  :load <file>       run the program in the file, keeping its bindings
+  :dis <expr>        show the bytecode of the input without running it
+  :ast <expr>        show the syntax tree of the input
+  :globals           show the global bindings (those of the VM in the diff engine)
+  :engine [vm|eval|diff]
+                     show or switch the engine running the inputs: the VM, the evaluator,
+                     or both with their differences reported
+  :history [n]       show the last n inputs (20 by default), which the up and down
+                     arrows recall in a terminal
+  :quit              exit the REPL
+Inputs go on over several lines while their braces, brackets or parentheses are open;
+an empty line ends them anyway.
+`
+
+// Run a meta-command, such as `:load file`. Returns whether the REPL should exit.
+func (s *session) command(line string) bool {
+	name, arg := line, ""
+	if i := strings.IndexAny(line, " \t"); i >= 0 {
+		name, arg = line[:i], strings.TrimSpace(line[i+1:])
+	}
+
+	switch name {
+	case ":help", ":h":
+		fmt.Fprint(s.out, HELP)
+	case ":reset":
+		s.reset()
+		fmt.Fprintln(s.out, "The bindings and the macros are cleared.")
+	case ":load":
+		if arg == "" {
+			fmt.Fprintln(s.out, "usage: :load <file>")
+			break
+		}
+		source, err := ioutil.ReadFile(arg)
+		if err != nil {
+			fmt.Fprintln(s.out, err)
+			break
+		}
+		s.run(string(source), arg)
+	case ":dis":
+		s.disassemble(arg)
+	case ":ast":
+		s.printAST(arg)
+	case ":globals":
+		s.printGlobals()
+	case ":engine":
+		switch arg {
+		case "":
+		case EngineVM, EngineEval, EngineDiff:
+			s.engine = arg
+		default:
+			fmt.Fprintln(s.out, "usage: :engine [vm|eval|diff]")
+			return false
+		}
+		fmt.Fprintf(s.out, "engine: %s\n", s.engine)
+	case ":history":
+		n := 20
+		if arg != "" {
+			var err error
+			if n, err = strconv.Atoi(arg); err != nil || n < 0 {
+				fmt.Fprintln(s.out, "usage: :history [n]")
+				break
+			}
+		}
+		entries := s.history.last(n)
+		first := len(s.history.entries) - len(entries) + 1
+		for i, entry := range entries {
+			fmt.Fprintf(s.out, "%5d  %s\n", first+i, strings.ReplaceAll(entry, "\n", "\n       "))
+		}
+	case ":quit", ":q":
+		return true
+	default:
+		fmt.Fprintf(s.out, "unknown command %s. Type :help for the meta-commands.\n", name)
+	}
+	return false
+}
+
+// Parse the source, printing the errors if any. Returns nil on errors.
+func (s *session) parse(source string) *ast.Program {
+	p := parser.New(lexer.New(source))
+	program := p.ParseProgram()
+	if len(p.Errors()) != 0 {
+		printParserErrors(s.out, p.Errors())
+		return nil
+	}
+	return program
+}
+
+/*
+Compile the source as the next input and print its bytecode: the instructions of the input,
+then the constants it adds, with the instructions of the compiled functions among them.
+The bindings and the macros which it defines are discarded.
+*/
+func (s *session) disassemble(source string) {
+	program := s.parse(source)
+	if program == nil {
+		return
+	}
+
+	constants := append([]object.Object(nil), s.constants...)
+	comp := compiler.NewWithState(s.symbolTable.Copy(), constants)
+	macros := object.NewEnclosedEnvironment(s.macros)
+	expanded, err := comp.ExpandMacros(program, macros, s.config.Limits(), s.config.Capabilities)
+	if err != nil {
+		fmt.Fprintf(s.out, "Woops! Macro expansion failed:\n %s\n", err)
+		return
+	}
+	if err := comp.Compile(expanded); err != nil {
+		fmt.Fprintf(s.out, "Woops! Compilation failed:\n %s\n", err)
+		return
+	}
+
+	bytecode := comp.ByteCode()
+	fmt.Fprint(s.out, bytecode.Instructions.String())
+	for i := len(s.constants); i < len(bytecode.Constants); i++ {
+		constant := bytecode.Constants[i]
+		fn, ok := constant.(*object.CompiledFunction)
+		if !ok {
+			fmt.Fprintf(s.out, "constant %d: %s\n", i, constant.Inspect())
+			continue
+		}
+		name := fn.Name
+		if name == "" {
+			name = "<anonymous>"
+		}
+		fmt.Fprintf(s.out, "constant %d: function %s\n", i, name)
+		for _, line := range strings.SplitAfter(fn.Instructions.String(), "\n") {
+			if line != "" {
+				fmt.Fprint(s.out, "  "+line)
+			}
+		}
+	}
+}
+
+// Print the syntax tree of the source, a node per line, indented by its depth. Macros are not expanded.
+func (s *session) printAST(source string) {
+	program := s.parse(source)
+	if program == nil {
+		return
+	}
+	for _, stmt := range program.Statements {
+		ast.Walk(&astPrinter{s: s}, stmt)
+	}
+}
+
+type astPrinter struct {
+	s     *session
+	depth int
+}
+
+func (p *astPrinter) Visit(node ast.Node) ast.Visitor {
+	if node == nil {
+		return nil
+	}
+	label := strings.TrimPrefix(fmt.Sprintf("%T", node), "*ast.")
+	switch n := node.(type) {
+	case *ast.Identifier:
+		label += " " + n.Value
+	case *ast.IntegerLiteral:
+		label += " " + n.Token.Literal
+	case *ast.StringLiteral:
+		label += " " + strconv.Quote(n.Value)
+	case *ast.Boolean:
+		label += " " + n.Token.Literal
+	case *ast.PrefixExpression:
+		label += " " + n.Operator
+	case *ast.InfixExpression:
+		label += " " + n.Operator
+	case *ast.FunctionLiteral:
+		if n.Name != "" {
+			label += " " + n.Name
+		}
+	case *ast.LetStatement:
+		if n.Exported {
+			label += " (exported)"
+		}
+	}
+	fmt.Fprintf(p.s.out, "%s%s\n", strings.Repeat("  ", p.depth), label)
+	return &astPrinter{s: p.s, depth: p.depth + 1}
+}
+
+// Print the global bindings of the current engine, with their values.
+func (s *session) printGlobals() {
+	if s.engine == EngineEval {
+		for _, name := range s.env.Names() {
+			value, _ := s.env.Get(name)
+			fmt.Fprintf(s.out, "%s = %s\n", name, value.Inspect())
+		}
+		return
+	}
+	for i, name := range s.globalNames {
+		if value := s.globals[i]; value != nil {
+			fmt.Fprintf(s.out, "%s = %s\n", name, value.Inspect())
+		}
+	}
+}
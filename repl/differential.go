@@ -0,0 +1,63 @@
+package repl
+
+import (
+	"fmt"
+	"io/ioutil"
+	"monkey/ast"
+	"monkey/compiler"
+	"monkey/evaluator"
+	"monkey/object"
+	"monkey/vm"
+)
+
+/*
+Run the program with both engines, each on its own bindings, and print the result of the VM.
+When the engines disagree, on the value or on the error, both results are reported.
+The evaluator only shadows the VM, so its output is discarded, and the program prints once.
+Its other side effects, such as reading files or advancing the random source, happen in both engines.
+*/
+func (s *session) runDiff(program *ast.Program, comp *compiler.Compiler) {
+	// The evaluator gets a copy, in case the compiler changes the tree.
+	evaluated := s.runEval(ast.Copy(program).(*ast.Program), discardOutput(s.config.Capabilities))
+	compiled := s.runVM(program, comp)
+	s.print(compiled)
+
+	vmResult, evalResult := describeOutcome(compiled), describeOutcome(evaluated)
+	if vmResult != evalResult {
+		fmt.Fprintf(s.out, "divergence between the engines:\n  vm:   %s\n  eval: %s\n", vmResult, evalResult)
+	}
+}
+
+// Returns a copy of the capabilities which grants the same output, but discards it.
+func discardOutput(capabilities *object.Context) *object.Context {
+	if capabilities == nil {
+		capabilities = object.DefaultContext()
+	}
+	shadow := *capabilities
+	if shadow.Stdout != nil {
+		shadow.Stdout = ioutil.Discard
+	}
+	if shadow.Stderr != nil {
+		shadow.Stderr = ioutil.Discard
+	}
+	return &shadow
+}
+
+func describeOutcome(o outcome) string {
+	if o.failure != "" {
+		return "error: " + o.err
+	}
+	if o.value == nil {
+		return "no value"
+	}
+	return object.Describe(o.value)
+}
+
+// The error which stopped an engine, worded the same by both engines when the recursion is too deep.
+func stopError(err error) string {
+	switch err.(type) {
+	case *vm.RecursionError, *evaluator.RecursionError:
+		return "maximum recursion depth exceeded"
+	}
+	return err.Error()
+}
@@ -0,0 +1,65 @@
+package repl
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// Number of inputs kept in the history file.
+const maxHistory = 1000
+
+// The inputs of the sessions, the oldest first. An input of several lines is kept as one entry.
+type history struct {
+	path    string // Empty when the history is not kept across sessions.
+	entries []string
+}
+
+// The file has an entry per line, whose newlines and backslashes are escaped.
+var (
+	escaper   = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	unescaper = strings.NewReplacer(`\\`, `\`, `\n`, "\n")
+)
+
+// Load the history from the file, which is created on the first input if it does not exist.
+func loadHistory(path string) *history {
+	h := &history{path: path}
+	data, err := ioutil.ReadFile(path)
+	if err != nil || len(data) == 0 {
+		return h
+	}
+	for _, line := range strings.Split(strings.TrimSuffix(string(data), "\n"), "\n") {
+		h.entries = append(h.entries, unescaper.Replace(line))
+	}
+	if len(h.entries) > maxHistory {
+		h.entries = h.entries[len(h.entries)-maxHistory:]
+		lines := []string{}
+		for _, entry := range h.entries {
+			lines = append(lines, escaper.Replace(entry))
+		}
+		ioutil.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0600)
+	}
+	return h
+}
+
+// Append the input to the history, and to its file. Failing to write the file does not stop the REPL.
+func (h *history) add(input string) {
+	h.entries = append(h.entries, input)
+	if h.path == "" {
+		return
+	}
+	f, err := os.OpenFile(h.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	f.WriteString(escaper.Replace(input) + "\n")
+}
+
+// Returns the last n entries at most.
+func (h *history) last(n int) []string {
+	if n < len(h.entries) {
+		return h.entries[len(h.entries)-n:]
+	}
+	return h.entries
+}
@@ -0,0 +1,231 @@
+package repl
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode"
+)
+
+// Reads the lines of the inputs.
+type lineReader interface {
+	// Print the prompt and return the next line, without its newline. Returns io.EOF at the end of the input.
+	readLine(prompt string) (string, error)
+}
+
+// Returned by readLine when the line is interrupted with Ctrl-C, which drops the input being typed.
+var errInterrupted = errors.New("interrupted")
+
+/*
+Returns an editor of the lines when in is a terminal, which recalls the inputs of the history with the arrow keys.
+Other inputs, such as files and pipes, are read line by line.
+*/
+func newLineReader(in io.Reader, out io.Writer, h *history) lineReader {
+	if f, ok := in.(*os.File); ok && isTerminal(int(f.Fd())) {
+		fd := int(f.Fd())
+		return &editor{in: bufio.NewReader(in), out: out, history: h, raw: func() (func(), error) { return makeRaw(fd) }}
+	}
+	return &scanner{scanner: bufio.NewScanner(in), out: out}
+}
+
+type scanner struct {
+	scanner *bufio.Scanner
+	out     io.Writer
+}
+
+func (s *scanner) readLine(prompt string) (string, error) {
+	fmt.Fprint(s.out, prompt)
+	if !s.scanner.Scan() {
+		if err := s.scanner.Err(); err != nil {
+			return "", err
+		}
+		return "", io.EOF
+	}
+	return s.scanner.Text(), nil
+}
+
+// Keys as read from a terminal in raw mode.
+const (
+	ctrlA     = 1
+	ctrlC     = 3
+	ctrlD     = 4
+	ctrlE     = 5
+	ctrlH     = 8
+	escape    = 27
+	backspace = 127
+)
+
+/*
+Edits a line typed in a terminal. The arrow keys move the cursor and recall the entries of the history,
+which are edited as a whole when they have several lines. Lines wider than the terminal are not wrapped.
+*/
+type editor struct {
+	in      *bufio.Reader
+	out     io.Writer
+	history *history
+	raw     func() (restore func(), err error) // Puts the terminal in raw mode while a line is edited. Optional.
+
+	prompt string
+	text   []rune
+	cursor int // Index in text.
+	row    int // Of the cursor on the screen, counted from the first row of the text.
+}
+
+func (e *editor) readLine(prompt string) (string, error) {
+	if e.raw != nil {
+		restore, err := e.raw()
+		if err != nil {
+			return "", err
+		}
+		defer restore()
+	}
+
+	e.prompt, e.text, e.cursor, e.row = prompt, nil, 0, 0
+	recalled := len(e.history.entries) // The entry being edited. The one past the last is the new line.
+	var draft string                   // The new line, while an entry is recalled.
+	e.redraw()
+	for {
+		r, _, err := e.in.ReadRune()
+		if err != nil {
+			if err == io.EOF && len(e.text) != 0 {
+				break
+			}
+			return "", err
+		}
+
+		switch r {
+		case '\r', '\n':
+			e.cursor = len(e.text)
+			e.redraw()
+			fmt.Fprint(e.out, "\r\n")
+			return string(e.text), nil
+		case ctrlC:
+			fmt.Fprint(e.out, "^C\r\n")
+			return "", errInterrupted
+		case ctrlD:
+			if len(e.text) == 0 {
+				fmt.Fprint(e.out, "\r\n")
+				return "", io.EOF
+			}
+			e.delete()
+		case ctrlA:
+			e.cursor = 0
+		case ctrlE:
+			e.cursor = len(e.text)
+		case backspace, ctrlH:
+			if e.cursor > 0 {
+				e.cursor--
+				e.delete()
+			}
+		case escape:
+			switch e.escapeSequence() {
+			case "A": // Up.
+				if recalled > 0 {
+					if recalled == len(e.history.entries) {
+						draft = string(e.text)
+					}
+					recalled--
+					e.set(e.history.entries[recalled])
+				}
+			case "B": // Down.
+				if recalled < len(e.history.entries) {
+					recalled++
+					if recalled == len(e.history.entries) {
+						e.set(draft)
+					} else {
+						e.set(e.history.entries[recalled])
+					}
+				}
+			case "C": // Right.
+				if e.cursor < len(e.text) {
+					e.cursor++
+				}
+			case "D": // Left.
+				if e.cursor > 0 {
+					e.cursor--
+				}
+			case "H", "1~", "7~": // Home.
+				e.cursor = 0
+			case "F", "4~", "8~": // End.
+				e.cursor = len(e.text)
+			case "3~": // Delete.
+				e.delete()
+			}
+		default:
+			if unicode.IsPrint(r) || r == '\t' {
+				e.text = append(e.text[:e.cursor], append([]rune{r}, e.text[e.cursor:]...)...)
+				e.cursor++
+			}
+		}
+		e.redraw()
+	}
+	fmt.Fprint(e.out, "\r\n")
+	return string(e.text), nil
+}
+
+// Reads the rest of an escape sequence such as "\x1b[A", and returns its parameters and final byte, e.g. "A" or "3~".
+func (e *editor) escapeSequence() string {
+	if r, _, err := e.in.ReadRune(); err != nil || (r != '[' && r != 'O') {
+		return ""
+	}
+	var sequence strings.Builder
+	for {
+		r, _, err := e.in.ReadRune()
+		if err != nil {
+			return ""
+		}
+		sequence.WriteRune(r)
+		if r >= 0x40 && r <= 0x7e {
+			return sequence.String()
+		}
+	}
+}
+
+// Delete the character under the cursor.
+func (e *editor) delete() {
+	if e.cursor < len(e.text) {
+		e.text = append(e.text[:e.cursor], e.text[e.cursor+1:]...)
+	}
+}
+
+// Replace the text with the entry, with the cursor at its end.
+func (e *editor) set(entry string) {
+	e.text = []rune(entry)
+	e.cursor = len(e.text)
+}
+
+// Print the prompt and the text over the previous ones, and put the cursor in place.
+func (e *editor) redraw() {
+	var out strings.Builder
+	if e.row > 0 {
+		fmt.Fprintf(&out, "\x1b[%dA", e.row)
+	}
+	out.WriteString("\r\x1b[J")
+	lines := strings.Split(string(e.text), "\n")
+	for i, line := range lines {
+		if i == 0 {
+			out.WriteString(e.prompt)
+		} else {
+			out.WriteString("\r\n" + CONTINUATION_PROMPT)
+		}
+		out.WriteString(line)
+	}
+
+	before := string(e.text[:e.cursor])
+	e.row = strings.Count(before, "\n")
+	column := len([]rune(e.prompt)) + e.cursor
+	if i := strings.LastIndex(before, "\n"); i >= 0 {
+		column = len([]rune(CONTINUATION_PROMPT)) + len([]rune(before[i+1:]))
+	}
+	if up := len(lines) - 1 - e.row; up > 0 {
+		fmt.Fprintf(&out, "\x1b[%dA", up)
+	}
+	out.WriteString("\r")
+	if column > 0 {
+		fmt.Fprintf(&out, "\x1b[%dC", column)
+	}
+	fmt.Fprint(e.out, out.String())
+}
@@ -1,17 +1,22 @@
 package repl
 
 import (
-	"bufio"
+	"context"
 	"fmt"
 	"io"
+	"monkey/ast"
 	"monkey/compiler"
+	"monkey/evaluator"
 	"monkey/lexer"
 	"monkey/object"
 	"monkey/parser"
+	"monkey/token"
 	"monkey/vm"
+	"strings"
 )
 
 const PROMPT = ">> "
+const CONTINUATION_PROMPT = ".. " // While the input is incomplete, e.g. a function spanning several lines.
 const MONKEY_FACE = `            __,__
    .--.  .-"     "-.  .--.
   / .. \/  .-. .-.  \/ .. \
@@ -25,54 +30,252 @@ const MONKEY_FACE = `            __,__
            '-----'
 `
 
-func Start(in io.Reader, out io.Writer) {
-	scanner := bufio.NewScanner(in)
+// Configures the REPL in Start.
+type Option func(*session)
 
-	constants := []object.Object{}
-	globals := make([]object.Object, vm.GlobalsSize)
-	symbolTable := compiler.NewSymbolTable()
-	for i, v := range object.Builtins {
-		symbolTable.DefineBuiltin(i, v.Name)
+// Run the inputs with the engine, which is one of the Engine constants. The default is EngineVM.
+func WithEngine(engine string) Option {
+	return func(s *session) {
+		s.engine = engine
+	}
+}
+
+// Keep the inputs in the file, so that `:history` lists those of the previous sessions too.
+func WithHistory(path string) Option {
+	return func(s *session) {
+		s.history = loadHistory(path)
+	}
+}
+
+// Run the inputs and their macros with the capabilities instead of those of the process.
+func WithCapabilities(capabilities *object.Context) Option {
+	return func(s *session) {
+		s.config.Capabilities = capabilities
+	}
+}
+
+/*
+Read inputs from in until it ends, run them and write their results to out.
+An input goes on over the following lines while its braces, brackets or parentheses are not balanced,
+or until an empty line. Lines starting with ":" are meta-commands, listed by `:help`.
+When in is a terminal, the lines can be edited, and the inputs of the history are recalled with the arrow keys.
+*/
+func Start(in io.Reader, out io.Writer, options ...Option) {
+	s := &session{out: out, engine: EngineVM, history: &history{}, config: vm.DefaultConfig()}
+	for _, option := range options {
+		option(s)
 	}
+	s.reset()
+	defer func() { s.generators.Close() }()
+	s.serve(newLineReader(in, out, s.history))
+}
 
+// Run the inputs read by the reader until it ends.
+func (s *session) serve(reader lineReader) {
+	var input []string
 	for {
-		fmt.Fprintf(out, PROMPT)
-		scanned := scanner.Scan()
-		if !scanned {
+		prompt := PROMPT
+		if len(input) != 0 {
+			prompt = CONTINUATION_PROMPT
+		}
+		line, err := reader.readLine(prompt)
+		if err == errInterrupted {
+			input = nil
+			continue
+		}
+		if err != nil {
 			return
 		}
 
-		line := scanner.Text()
-		l := lexer.New(line)
-		p := parser.New(l)
+		if len(input) == 0 {
+			if strings.TrimSpace(line) == "" {
+				continue
+			}
+			if strings.HasPrefix(strings.TrimSpace(line), ":") {
+				s.history.add(line)
+				if quit := s.command(strings.TrimSpace(line)); quit {
+					return
+				}
+				continue
+			}
+		}
 
-		program := p.ParseProgram()
-		if len(p.Errors()) != 0 {
-			printParserErrors(out, p.Errors())
+		input = append(input, line)
+		source := strings.Join(input, "\n")
+		if line != "" && incomplete(source) {
 			continue
 		}
+		input = nil
+		s.history.add(source)
+		s.run(source, "")
+	}
+}
 
-		comp := compiler.NewWithState(symbolTable, constants)
-		err := comp.Compile(program)
-		if err != nil {
-			fmt.Fprintf(out, "Woops! Compilation failed:\n %s\n", err)
-			continue
+/*
+Whether the source ends inside a block, a call, an array, a hash or a string, so that more lines are expected.
+Superfluous closing delimiters are left to the parser to report.
+*/
+func incomplete(source string) bool {
+	l := lexer.New(source)
+	depth := 0
+	var last token.Token
+	for tok := l.NextToken(); tok.Type != token.EOF; tok = l.NextToken() {
+		switch tok.Type {
+		case token.LBRACE, token.LPAREN, token.LBRACKET:
+			depth++
+		case token.RBRACE, token.RPAREN, token.RBRACKET:
+			depth--
 		}
+		last = tok
+	}
+	if depth > 0 {
+		return true
+	}
+	// A string which is not closed runs from its quote to the end of the source.
+	return last.Type == token.STRING && strings.HasSuffix(source, `"`+last.Literal) &&
+		!strings.HasSuffix(source, `"`+last.Literal+`"`)
+}
+
+// The engines which can run the inputs.
+const (
+	EngineVM   = "vm"   // The compiler and the virtual machine.
+	EngineEval = "eval" // The tree-walking evaluator.
+	EngineDiff = "diff" // Both, reporting where their results differ.
+)
 
-		code := comp.ByteCode()
-		constants = code.Constants
+// The state of a REPL, which is kept across its inputs.
+type session struct {
+	out     io.Writer
+	engine  string // One of the Engine constants.
+	history *history
+	config  vm.Config // Of the VM, whose limits and capabilities the macros get too.
 
-		machine := vm.NewWithGlobalsStore(code, globals)
-		err = machine.Run()
-		if err != nil {
-			fmt.Fprintf(out, "Woops! Executing bytecode failed:\n %s\n", err)
-			continue
-		}
+	macros *object.Environment // Shared by both engines, since macros are expanded before either runs.
+
+	// The state of the VM.
+	constants   []object.Object
+	globals     []object.Object
+	symbolTable *compiler.SymbolTable
+	globalNames []string // Indexed by the globals, as in the debug information of the last bytecode.
+	loader      *compiler.Loader
+
+	// The state of the evaluator.
+	env        *object.Environment
+	generators *evaluator.Generators // Started by the inputs, and closed by a reset or at the end of the session.
+}
+
+// Forget the bindings and the macros of the previous inputs.
+func (s *session) reset() {
+	s.macros = object.NewEnvironment()
+
+	s.constants = []object.Object{}
+	s.globals = make([]object.Object, vm.GlobalsSize)
+	s.symbolTable = compiler.NewSymbolTable()
+	for i, v := range object.Builtins {
+		s.symbolTable.DefineBuiltin(i, v.Name)
+	}
+	s.globalNames = nil
+	s.loader = compiler.NewLoader() // Imports are relative to the current directory.
+
+	s.env = object.NewEnvironment()
+	if s.generators != nil {
+		s.generators.Close()
+	}
+	s.generators = &evaluator.Generators{}
+}
+
+// Run the source with the current engine and print its result. Imports are relative to file.
+func (s *session) run(source, file string) {
+	p := parser.New(lexer.New(source))
+	program := p.ParseProgram()
+	if len(p.Errors()) != 0 {
+		printParserErrors(s.out, p.Errors())
+		return
+	}
+
+	comp := s.compiler(file)
+	expanded, err := comp.ExpandMacros(program, s.macros, s.config.Limits(), s.config.Capabilities)
+	if err != nil {
+		fmt.Fprintf(s.out, "Woops! Macro expansion failed:\n %s\n", err)
+		return
+	}
+
+	switch s.engine {
+	case EngineEval:
+		s.print(s.runEval(expanded, s.config.Capabilities))
+	case EngineDiff:
+		s.runDiff(expanded, comp)
+	default:
+		s.print(s.runVM(expanded, comp))
+	}
+}
+
+// Returns a compiler of the next input, with the bindings of the previous ones. Imports are relative to file.
+func (s *session) compiler(file string) *compiler.Compiler {
+	comp := compiler.NewWithState(s.symbolTable, s.constants)
+	comp.SetLoader(s.loader, file)
+	return comp
+}
+
+// The result of an input run by an engine: either a value, which is nil if there is none to print, or an error.
+type outcome struct {
+	value   object.Object
+	err     string // The message of the error.
+	failure string // How the error is reported to the user.
+}
+
+func (s *session) print(o outcome) {
+	if o.failure != "" {
+		io.WriteString(s.out, o.failure+"\n")
+	} else if o.value != nil {
+		io.WriteString(s.out, o.value.Inspect()+"\n")
+	}
+}
+
+// The compiler is the one which expanded the macros of the program, so that its modules get the same limits.
+func (s *session) runVM(program *ast.Program, comp *compiler.Compiler) outcome {
+	err := comp.Compile(program)
+	if err != nil {
+		return outcome{err: err.Error(), failure: fmt.Sprintf("Woops! Compilation failed:\n %s", err)}
+	}
+
+	code := comp.ByteCode()
+	s.constants = code.Constants
+	s.globalNames = code.Debug.Globals
+
+	machine := vm.NewWithGlobalsStore(code, s.globals, s.config)
+	err = machine.Run()
+	if err != nil {
+		return outcome{err: stopError(err), failure: fmt.Sprintf("Woops! Executing bytecode failed:\n %s", err)}
+	}
+
+	if !endsWithExpression(program) {
+		return outcome{}
+	}
+	return outcome{value: machine.LastPoppedStackElem()}
+}
+
+// The evaluator runs with the limits of the VM, so that a deep recursion is an error rather than a crash of the REPL.
+func (s *session) runEval(program *ast.Program, capabilities *object.Context) outcome {
+	limits := evaluator.NewLimits(s.config.Limits(), capabilities)
+	limits.Generators = s.generators // Resumable by the next inputs.
+	evaluated, err := evaluator.EvalContext(context.Background(), program, s.env, limits)
+	if err != nil {
+		return outcome{err: stopError(err), failure: fmt.Sprintf("Woops! Evaluation failed:\n %s", err)}
+	}
+	if errObj, ok := evaluated.(*object.Error); ok {
+		return outcome{err: errObj.Message, failure: errObj.Inspect()}
+	}
+	return outcome{value: evaluated}
+}
 
-		stackElem := machine.LastPoppedStackElem()
-		io.WriteString(out, stackElem.Inspect())
-		io.WriteString(out, "\n")
+// Statements such as `let` leave no value, while the stack may still hold that of a previous expression.
+func endsWithExpression(program *ast.Program) bool {
+	if len(program.Statements) == 0 {
+		return false
 	}
+	_, ok := program.Statements[len(program.Statements)-1].(*ast.ExpressionStatement)
+	return ok
 }
 
 func printParserErrors(out io.Writer, errors []string) {
@@ -0,0 +1,217 @@
+package repl
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"monkey/object"
+	"monkey/vm"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func runREPL(t *testing.T, input string, options ...Option) string {
+	t.Helper()
+	var out bytes.Buffer
+	Start(strings.NewReader(input), &out, options...)
+	return out.String()
+}
+
+func TestIncomplete(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected bool
+	}{
+		{"1 + 2", false},
+		{"let f = fn(x) {", true},
+		{"let f = fn(x) {\n  x\n}", false},
+		{"f(1,", true},
+		{"[1, [2]", true},
+		{"{1: 2", true},
+		{"}", false}, // Left to the parser to report.
+		{`"abc`, true},
+		{`"abc"`, false},
+		{`""`, false},
+		{`"a" + "`, true},
+		{"\"a\nb\"", false},
+	}
+
+	for _, tt := range tests {
+		if got := incomplete(tt.input); got != tt.expected {
+			t.Errorf("incomplete(%q) = %t, want %t", tt.input, got, tt.expected)
+		}
+	}
+}
+
+func TestStart(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected []string
+	}{
+		{"let f = fn(x) {\n  x * 2\n};\nf(21)\n", []string{PROMPT + CONTINUATION_PROMPT + CONTINUATION_PROMPT + PROMPT + "42\n"}},
+		// An empty line ends an incomplete input.
+		{"(1\n\nlen(\"ab\")\n", []string{"expected next token to be ), got EOF instead.", "\n" + PROMPT + "2\n"}},
+		{"let x = 1;\n:globals\n", []string{"x = 1\n"}},
+		{"let x = 1;\n:reset\nx\n", []string{"undefined variable x"}},
+		{":engine eval\nlet x = 2;\nx * 3\n:globals\n", []string{"engine: eval\n", "6\n", "x = 2\n"}},
+		{":engine eval\nlet f = fn(x) { f(x) };\nf(1)\nf\n", []string{"Woops! Evaluation failed:\n maximum recursion depth exceeded", "f(x)\n}"}},
+		{":engine eval\nlet g = fn() { yield 1; yield 2; }(); next(g)\nnext(g)\n:reset\nnext(g)\n", []string{">> 1\n>> 2\n", "identifier not found: g"}},
+		{":engine\n:engine js\n", []string{"engine: vm\n", "usage: :engine [vm|eval|diff]\n"}},
+		{":dis let a = 5\na\n", []string{"0000 OpConstant 0\n0003 OpSetGlobal 0\nconstant 0: 5\n", "undefined variable a"}},
+		{":dis fn(x) { x }\n", []string{"constant 0: function <anonymous>\n  0000 OpGetLocal 0\n  0002 OpReturnValue\n"}},
+		{":ast -a * 2\n", []string{"ExpressionStatement\n  InfixExpression *\n    PrefixExpression -\n      Identifier a\n    IntegerLiteral 2\n"}},
+		{":load testdata/none.mk\n", []string{"no such file or directory"}},
+		{":nope\n", []string{"unknown command :nope."}},
+	}
+
+	for _, tt := range tests {
+		out := runREPL(t, tt.input)
+		for _, expected := range tt.expected {
+			if !strings.Contains(out, expected) {
+				t.Errorf("the output of %q does not contain %q:\n%s", tt.input, expected, out)
+			}
+		}
+	}
+
+	if out := runREPL(t, ":quit\n1\n"); out != PROMPT {
+		t.Errorf("the REPL did not quit: %q", out)
+	}
+}
+
+func TestLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lib.mk")
+	if err := ioutil.WriteFile(path, []byte("let double = fn(x) { x * 2 };"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	out := runREPL(t, ":load "+path+"\ndouble(4)\n")
+	if !strings.HasSuffix(out, "8\n"+PROMPT) {
+		t.Errorf("the loaded bindings are not kept:\n%s", out)
+	}
+}
+
+func TestHistory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history")
+	runREPL(t, "let f = fn() {\n1\n}\n:globals\nlen(\"a\\n\")\n", WithHistory(path))
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("the history was not written: %s", err)
+	}
+	// An input of several lines is one entry, whose newlines are escaped, as are the backslashes.
+	expected := "let f = fn() {\\n1\\n}\n:globals\nlen(\"a\\\\n\")\n"
+	if string(data) != expected {
+		t.Errorf("wrong history file. want=%q, got=%q", expected, data)
+	}
+
+	// The next session lists the inputs of the previous one.
+	out := runREPL(t, ":history 4\n", WithHistory(path))
+	if !strings.Contains(out, "    1  let f = fn() {\n       1\n       }\n    2  :globals\n    3  len(\"a\\n\")\n    4  :history 4\n") {
+		t.Errorf("wrong history:\n%s", out)
+	}
+}
+
+func TestEditor(t *testing.T) {
+	h := &history{entries: []string{"let f = fn(x) {\n  x\n};", "f(1)"}}
+	tests := []struct {
+		keys     string
+		expected []string // The lines read.
+	}{
+		{"1 + 2\r", []string{"1 + 2"}},
+		{"ab\x7fc\r", []string{"ac"}},
+		// Editing in the middle of the line.
+		{"ac\x1b[Db\x1b[C!\r", []string{"abc!"}},
+		{"bc\x01a\x05d\r", []string{"abcd"}},
+		{"abc\x1b[H\x1b[3~\r", []string{"bc"}},
+		// The arrows recall the entries, the newest first, and go back to the new line.
+		{"\x1b[A\r", []string{"f(1)"}},
+		{"\x1b[A\x1b[A\r", []string{"let f = fn(x) {\n  x\n};"}},
+		{"\x1b[A\x1b[A\x1b[A\x1b[B\x1b[D\x7f2\r", []string{"f(2)"}},
+		{"new\x1b[A\x1b[B\r", []string{"new"}},
+		// Ctrl-C drops the line, and Ctrl-D ends the input on an empty one.
+		{"abc\x03\x04", []string{"<interrupted>"}},
+		{"last", []string{"last"}},
+	}
+
+	for _, tt := range tests {
+		var out bytes.Buffer
+		e := &editor{in: bufio.NewReader(strings.NewReader(tt.keys)), out: &out, history: h}
+		var lines []string
+		for {
+			line, err := e.readLine(PROMPT)
+			if err == errInterrupted {
+				line = "<interrupted>"
+			} else if err != nil {
+				break
+			}
+			lines = append(lines, line)
+		}
+		if strings.Join(lines, "|") != strings.Join(tt.expected, "|") {
+			t.Errorf("wrong lines for %q. want=%q, got=%q", tt.keys, tt.expected, lines)
+		}
+	}
+}
+
+// A recalled input of several lines is run as a whole.
+func TestRecall(t *testing.T) {
+	var out bytes.Buffer
+	s := &session{out: &out, engine: EngineVM, history: &history{}, config: vm.DefaultConfig()}
+	s.reset()
+	defer s.generators.Close()
+	keys := "let f = fn(x) {\rx * 2\r};\r\x1b[A\x1b[D\x1b[D\x1b[D\x7f3\rf(5)\r"
+	s.serve(&editor{in: bufio.NewReader(strings.NewReader(keys)), out: &out, history: s.history})
+
+	if !strings.Contains(out.String(), "\r\n15\n") {
+		t.Errorf("the recalled input was not run:\n%q", out.String())
+	}
+	expected := []string{"let f = fn(x) {\nx * 2\n};", "let f = fn(x) {\nx * 3\n};", "f(5)"}
+	if strings.Join(s.history.entries, "|") != strings.Join(expected, "|") {
+		t.Errorf("wrong history. want=%q, got=%q", expected, s.history.entries)
+	}
+}
+
+func TestDifferential(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string // The report of the divergence, if any.
+	}{
+		{"let f = fn(x) { x * 2 }; f(2)", ""},
+		{"[fn() { 1 }, \"a\", {1: true, 2: if (false) { 1 }}]", ""},
+		{"let x = 1;", ""},
+		{"throw 1", ""},
+		{"let f = fn(x) { f(x) }; f(1)", ""},
+		{"let g = fn() { yield 1; yield 2; }(); next(g)\nnext(g)", ""},
+		{`1 + "a"`, "  vm:   error: unsupported types for binary operation: INTEGER STRING\n" +
+			"  eval: error: type mismatch: INTEGER + STRING\n"},
+	}
+
+	for _, tt := range tests {
+		out := runREPL(t, tt.input+"\n", WithEngine(EngineDiff))
+		if tt.expected == "" {
+			if strings.Contains(out, "divergence") {
+				t.Errorf("the engines diverge on %q:\n%s", tt.input, out)
+			}
+			continue
+		}
+		if !strings.Contains(out, "divergence between the engines:\n"+tt.expected) {
+			t.Errorf("the divergence on %q is not reported:\n%s", tt.input, out)
+		}
+	}
+
+	// Each engine keeps its own bindings.
+	out := runREPL(t, "let x = 1;\n:engine diff\nx\n")
+	if !strings.Contains(out, "  vm:   1\n  eval: error: identifier not found: x\n") {
+		t.Errorf("the bindings of the VM leak into the evaluator:\n%s", out)
+	}
+
+	// The program prints once, since the output of the evaluator is discarded.
+	var stdout, stderr bytes.Buffer
+	caps := &object.Context{Stdout: &stdout, Stderr: &stderr}
+	out = runREPL(t, "puts(\"hi\"); eputs(\"oops\");\n", WithEngine(EngineDiff), WithCapabilities(caps))
+	if stdout.String() != "hi\n" || stderr.String() != "oops\n" {
+		t.Errorf("wrong output of the program. stdout=%q, stderr=%q", stdout.String(), stderr.String())
+	}
+	if strings.Contains(out, "divergence") {
+		t.Errorf("the engines diverge on the output:\n%s", out)
+	}
+}
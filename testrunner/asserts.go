@@ -0,0 +1,155 @@
+package testrunner
+
+import (
+	"fmt"
+	"monkey/object"
+	"strings"
+)
+
+// The builtins of the tests, which are bound as globals in the test files only.
+var assertNames = []string{"assert", "assert_eq", "assert_error"}
+
+/*
+A run of a test function. Its asserts keep the error of the failed assertion,
+which tells a failure from the other errors the test may throw.
+*/
+type run struct {
+	failure *object.Error
+}
+
+// Returns the builtins of the run, in the order of assertNames.
+func (r *run) builtins() []*object.Builtin {
+	return []*object.Builtin{
+		{Fn: r.assert},
+		{Fn: r.assertEq},
+		{Fn: r.assertError},
+	}
+}
+
+// Returns the error which fails the test, with the optional message given by the test after the reason.
+func (r *run) fail(message object.Object, format string, a ...interface{}) *object.Error {
+	msg := fmt.Sprintf(format, a...)
+	if message != nil {
+		msg += ": " + inspect(message)
+	}
+	r.failure = &object.Error{Message: msg}
+	return r.failure
+}
+
+// assert(condition[, message]) fails unless the condition is truthy.
+func (r *run) assert(ctx *object.Context, args ...object.Object) object.Object {
+	if len(args) != 1 && len(args) != 2 {
+		return &object.Error{Message: fmt.Sprintf("wrong number of arguments. got=%d, want=1 or 2", len(args))}
+	}
+	if !isTruthy(args[0]) {
+		return r.fail(optional(args, 1), "assertion failed")
+	}
+	return nil
+}
+
+// assert_eq(got, want[, message]) fails unless the values are equal, comparing arrays and hashes by their contents.
+func (r *run) assertEq(ctx *object.Context, args ...object.Object) object.Object {
+	if len(args) != 2 && len(args) != 3 {
+		return &object.Error{Message: fmt.Sprintf("wrong number of arguments. got=%d, want=2 or 3", len(args))}
+	}
+	if !equal(args[0], args[1]) {
+		return r.fail(optional(args, 2), "assert_eq failed: got=%s, want=%s", object.Describe(args[0]), object.Describe(args[1]))
+	}
+	return nil
+}
+
+/*
+assert_error(value[, substring]) fails unless the value is an error, whose message contains the substring if given.
+Builtins cannot call functions, so the value is usually caught by the test, as in
+assert_error(try { f() } catch (e) { e }, "division by zero").
+*/
+func (r *run) assertError(ctx *object.Context, args ...object.Object) object.Object {
+	if len(args) != 1 && len(args) != 2 {
+		return &object.Error{Message: fmt.Sprintf("wrong number of arguments. got=%d, want=1 or 2", len(args))}
+	}
+	errObj, ok := args[0].(*object.Error)
+	if !ok {
+		return r.fail(nil, "assert_error failed: got=%s, want an error", object.Describe(args[0]))
+	}
+	if len(args) == 2 {
+		substring, ok := args[1].(*object.String)
+		if !ok {
+			return &object.Error{Message: fmt.Sprintf("argument to `assert_error` must be STRING, got=%s", args[1].Type())}
+		}
+		if !strings.Contains(errObj.Message, substring.Value) {
+			return r.fail(nil, "assert_error failed: got=%q, want an error containing %q", errObj.Message, substring.Value)
+		}
+	}
+	return nil
+}
+
+func optional(args []object.Object, index int) object.Object {
+	if index < len(args) {
+		return args[index]
+	}
+	return nil
+}
+
+// Strings are shown without quotes, as `puts` does.
+func inspect(o object.Object) string {
+	if s, ok := o.(*object.String); ok {
+		return s.Value
+	}
+	return object.Describe(o)
+}
+
+func isTruthy(o object.Object) bool {
+	switch o := o.(type) {
+	case *object.Boolean:
+		return o.Value
+	case *object.Null:
+		return false
+	default:
+		return true
+	}
+}
+
+// Functions and the other values without contents are equal only to themselves.
+func equal(a, b object.Object) bool {
+	switch a := a.(type) {
+	case *object.Integer:
+		b, ok := b.(*object.Integer)
+		return ok && a.Value == b.Value
+	case *object.Boolean:
+		b, ok := b.(*object.Boolean)
+		return ok && a.Value == b.Value
+	case *object.String:
+		b, ok := b.(*object.String)
+		return ok && a.Value == b.Value
+	case *object.Null:
+		_, ok := b.(*object.Null)
+		return ok
+	case *object.Error:
+		b, ok := b.(*object.Error)
+		return ok && a.Message == b.Message
+	case *object.Array:
+		b, ok := b.(*object.Array)
+		if !ok || len(a.Elements) != len(b.Elements) {
+			return false
+		}
+		for i := range a.Elements {
+			if !equal(a.Elements[i], b.Elements[i]) {
+				return false
+			}
+		}
+		return true
+	case *object.Hash:
+		b, ok := b.(*object.Hash)
+		if !ok || len(a.Pairs) != len(b.Pairs) {
+			return false
+		}
+		for key, pair := range a.Pairs {
+			other, ok := b.Pairs[key]
+			if !ok || !equal(pair.Value, other.Value) {
+				return false
+			}
+		}
+		return true
+	}
+	return a == b
+}
@@ -0,0 +1,160 @@
+package testrunner
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// The results of the test files, in the order they were run.
+type Report struct {
+	Files []*File
+}
+
+// Counts the tests by their statuses. A file which cannot be run counts as one error.
+func (r *Report) Counts() (passed, failed, errored int) {
+	for _, f := range r.Files {
+		if f.Err != nil {
+			errored++
+		}
+		for _, t := range f.Tests {
+			switch t.Status {
+			case Passed:
+				passed++
+			case Failed:
+				failed++
+			default:
+				errored++
+			}
+		}
+	}
+	return passed, failed, errored
+}
+
+func (r *Report) Passed() bool {
+	_, failed, errored := r.Counts()
+	return failed == 0 && errored == 0
+}
+
+/*
+Write the tests which did not pass with their messages, a line per file, and the counts.
+With verbose, the tests which passed are listed too.
+*/
+func (r *Report) WriteText(w io.Writer, verbose bool) error {
+	var out strings.Builder
+	for _, f := range r.Files {
+		for _, t := range f.Tests {
+			if t.Status != Passed || verbose {
+				fmt.Fprintf(&out, "--- %s: %s (%s)\n", t.Status, t.Name, seconds(t.Duration))
+			}
+			if t.Message != "" {
+				fmt.Fprintf(&out, "    %s\n", strings.ReplaceAll(t.Message, "\n", "\n    "))
+			}
+		}
+
+		switch {
+		case f.Err != nil:
+			fmt.Fprintf(&out, "%s\nFAIL\t%s\t[setup failed]\n", f.Err, f.Path)
+		case len(f.Tests) == 0:
+			fmt.Fprintf(&out, "?   \t%s\t[no tests]\n", f.Path)
+		case f.passed():
+			fmt.Fprintf(&out, "ok  \t%s\t%s\n", f.Path, seconds(f.Duration))
+		default:
+			fmt.Fprintf(&out, "FAIL\t%s\t%s\n", f.Path, seconds(f.Duration))
+		}
+	}
+
+	passed, failed, errored := r.Counts()
+	fmt.Fprintf(&out, "\n%d passed, %d failed, %d errors\n", passed, failed, errored)
+	_, err := io.WriteString(w, out.String())
+	return err
+}
+
+func (f *File) passed() bool {
+	for _, t := range f.Tests {
+		if t.Status != Passed {
+			return false
+		}
+	}
+	return f.Err == nil
+}
+
+func seconds(d time.Duration) string {
+	return fmt.Sprintf("%.3fs", d.Seconds())
+}
+
+// The JUnit XML format, as read by CI servers. A file is a test suite.
+type junitSuites struct {
+	XMLName xml.Name     `xml:"testsuites"`
+	Suites  []junitSuite `xml:"testsuite"`
+}
+
+type junitSuite struct {
+	Name     string      `xml:"name,attr"`
+	Tests    int         `xml:"tests,attr"`
+	Failures int         `xml:"failures,attr"`
+	Errors   int         `xml:"errors,attr"`
+	Time     string      `xml:"time,attr"`
+	Cases    []junitCase `xml:"testcase"`
+}
+
+type junitCase struct {
+	Name      string        `xml:"name,attr"`
+	Classname string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitProblem `xml:"failure,omitempty"`
+	Error     *junitProblem `xml:"error,omitempty"`
+}
+
+type junitProblem struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// Write the report in the JUnit XML format. A file which cannot be run is a test case with an error.
+func (r *Report) WriteJUnit(w io.Writer) error {
+	suites := junitSuites{Suites: []junitSuite{}}
+	for _, f := range r.Files {
+		suite := junitSuite{Name: f.Path, Time: fmt.Sprintf("%.3f", f.Duration.Seconds()), Cases: []junitCase{}}
+		if f.Err != nil {
+			suite.Tests++
+			suite.Errors++
+			suite.Cases = append(suite.Cases, junitCase{
+				Name:      f.Path,
+				Classname: f.Path,
+				Time:      suite.Time,
+				Error:     &junitProblem{Message: "setup failed", Text: f.Err.Error()},
+			})
+		}
+		for _, t := range f.Tests {
+			c := junitCase{Name: t.Name, Classname: f.Path, Time: fmt.Sprintf("%.3f", t.Duration.Seconds())}
+			switch t.Status {
+			case Failed:
+				suite.Failures++
+				c.Failure = &junitProblem{Message: firstLine(t.Message), Text: t.Message}
+			case Errored:
+				suite.Errors++
+				c.Error = &junitProblem{Message: firstLine(t.Message), Text: t.Message}
+			}
+			suite.Tests++
+			suite.Cases = append(suite.Cases, c)
+		}
+		suites.Suites = append(suites.Suites, suite)
+	}
+
+	out, err := xml.MarshalIndent(suites, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s%s\n", xml.Header, out)
+	return err
+}
+
+func firstLine(s string) string {
+	if i := strings.IndexByte(s, '\n'); i >= 0 {
+		return s[:i]
+	}
+	return s
+}
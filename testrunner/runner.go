@@ -0,0 +1,272 @@
+/*
+Package testrunner runs the tests written in Monkey.
+
+Tests are the top-level functions named test_* in files named *_test.mk. Each test runs on a VM of its own,
+after the statements of its file, so that the globals set by one test are not seen by the others.
+The files of the tests can use the builtins assert, assert_eq and assert_error,
+whose failures are reported with the file and the line of the failed assertion.
+*/
+package testrunner
+
+import (
+	"fmt"
+	"io/ioutil"
+	"monkey/ast"
+	"monkey/compiler"
+	"monkey/evaluator"
+	"monkey/lexer"
+	"monkey/object"
+	"monkey/parser"
+	"monkey/vm"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	fileSuffix = "_test.mk"
+	testPrefix = "test_"
+)
+
+type Status int
+
+const (
+	Passed  Status = iota
+	Failed         // An assertion failed.
+	Errored        // The test threw a value other than a failed assertion, or the VM stopped it.
+)
+
+func (s Status) String() string {
+	switch s {
+	case Passed:
+		return "PASS"
+	case Failed:
+		return "FAIL"
+	default:
+		return "ERROR"
+	}
+}
+
+type Result struct {
+	Name     string
+	Status   Status
+	Message  string // Why the test did not pass, prefixed with the location if known.
+	Duration time.Duration
+}
+
+type File struct {
+	Path     string
+	Tests    []*Result // In the order of their definitions.
+	Err      error     // Set when the file cannot be read, parsed or compiled, and then no tests are run.
+	Duration time.Duration
+}
+
+/*
+Returns the test files in the paths, sorted. Directories are searched recursively for files named *_test.mk,
+and files are returned whatever their names are.
+*/
+func Discover(paths []string) ([]string, error) {
+	var files []string
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			files = append(files, path)
+			continue
+		}
+		err = filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !info.IsDir() && strings.HasSuffix(p, fileSuffix) {
+				files = append(files, p)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// Run the tests of the file with the VM configuration. Imports are relative to the file.
+func RunFile(path string, config vm.Config) *File {
+	start := time.Now()
+	file := &File{Path: path}
+	defer func() { file.Duration = time.Since(start) }()
+
+	source, err := ioutil.ReadFile(path)
+	if err != nil {
+		file.Err = err
+		return file
+	}
+	program, err := parse(path, string(source))
+	if err != nil {
+		file.Err = err
+		return file
+	}
+
+	// The macros of the file run once, and its statements are compiled once on their own,
+	// so that their errors are reported once.
+	comp := newCompiler(path, nil)
+	program, err = comp.ExpandMacros(program, object.NewEnvironment(), config.Limits(), config.Capabilities)
+	if err != nil {
+		e := err.(*evaluator.MacroError)
+		file.Err = fmt.Errorf("%s:%d:%d: %s", path, e.Line, e.Column, e.Msg)
+		return file
+	}
+	if err := comp.Compile(ast.Copy(program)); err != nil {
+		file.Err = compileError(path, err)
+		return file
+	}
+	for _, test := range tests(program) {
+		file.Tests = append(file.Tests, runTest(path, program, test, config))
+	}
+	return file
+}
+
+// Returns the statements which define tests.
+func tests(program *ast.Program) []*ast.LetStatement {
+	var tests []*ast.LetStatement
+	for _, stmt := range program.Statements {
+		let, ok := stmt.(*ast.LetStatement)
+		if !ok || !strings.HasPrefix(let.Name.Value, testPrefix) {
+			continue
+		}
+		if _, ok := let.Value.(*ast.FunctionLiteral); ok {
+			tests = append(tests, let)
+		}
+	}
+	return tests
+}
+
+// Run the statements of the file followed by a call of the test, on a VM and globals of their own.
+func runTest(path string, program *ast.Program, test *ast.LetStatement, config vm.Config) *Result {
+	start := time.Now()
+	result := &Result{Name: test.Name.Value}
+	defer func() { result.Duration = time.Since(start) }()
+
+	if fn := test.Value.(*ast.FunctionLiteral); len(fn.Parameters) != 0 {
+		result.Status = Errored
+		result.Message = fmt.Sprintf("%s:%d: a test takes no arguments, got=%d", path, test.Token.Line, len(fn.Parameters))
+		return result
+	}
+
+	tok := test.Name.Token
+	call := &ast.ExpressionStatement{
+		Token:      tok,
+		Expression: &ast.CallExpression{Token: tok, Function: &ast.Identifier{Token: tok, Value: test.Name.Value}},
+	}
+	withCall := ast.Copy(program).(*ast.Program)
+	withCall.Statements = append(withCall.Statements, call)
+
+	r := &run{}
+	globals := make([]object.Object, globalsSize(config))
+	bytecode, err := compile(path, withCall, config, func(symbolTable *compiler.SymbolTable) {
+		for i, builtin := range r.builtins() {
+			globals[symbolTable.Define(assertNames[i]).Index] = builtin
+		}
+	})
+	if err != nil {
+		result.Status = Errored
+		result.Message = err.Error()
+		return result
+	}
+
+	err = vm.NewWithGlobalsStore(bytecode, globals, config).Run()
+	switch err := err.(type) {
+	case nil:
+		result.Status = Passed
+	case *vm.UncaughtError:
+		result.Status = Errored
+		if r.failure != nil && err.Value == r.failure {
+			result.Status = Failed
+		}
+		result.Message = locate(path, err) + err.Error()
+	default:
+		result.Status = Errored
+		result.Message = fmt.Sprintf("%s: %s", path, err)
+	}
+	return result
+}
+
+// Returns the location of the throw as a prefix of the message.
+func locate(path string, err *vm.UncaughtError) string {
+	if err.File != "" {
+		path = err.File
+	}
+	if err.Line == 0 {
+		return path + ": "
+	}
+	return fmt.Sprintf("%s:%d: ", path, err.Line)
+}
+
+func globalsSize(config vm.Config) int {
+	if config.GlobalsSize <= 0 {
+		return vm.GlobalsSize
+	}
+	return config.GlobalsSize
+}
+
+// Parse the source. Errors are prefixed with their locations.
+func parse(path, source string) (*ast.Program, error) {
+	p := parser.New(lexer.New(source))
+	program := p.ParseProgram()
+	if len(p.ErrorDetails()) != 0 {
+		msgs := []string{}
+		for _, e := range p.ErrorDetails() {
+			msgs = append(msgs, fmt.Sprintf("%s:%d:%d: %s", path, e.Line, e.Column, e.Msg))
+		}
+		return nil, fmt.Errorf("%s", strings.Join(msgs, "\n"))
+	}
+	return program, nil
+}
+
+/*
+Compile the program, whose macros are expanded already, with the builtins and the asserts.
+The macros of the imported modules run with the limits of the config.
+*/
+func compile(path string, program *ast.Program, config vm.Config, define func(*compiler.SymbolTable)) (*compiler.Bytecode, error) {
+	comp := newCompiler(path, define)
+	// Expanding the program again finds no macro calls, and gives the limits to the macros of the modules.
+	if err := comp.ExpandAndCompile(program, object.NewEnvironment(), config.Limits(), config.Capabilities); err != nil {
+		return nil, compileError(path, err)
+	}
+	return comp.ByteCode(), nil
+}
+
+/*
+Returns a compiler of the file with the builtins and the asserts, which are defined as the first globals by define.
+A nil define only reserves their names.
+*/
+func newCompiler(path string, define func(*compiler.SymbolTable)) *compiler.Compiler {
+	symbolTable := compiler.NewSymbolTable()
+	for i, v := range object.Builtins {
+		symbolTable.DefineBuiltin(i, v.Name)
+	}
+	if define != nil {
+		define(symbolTable)
+	} else {
+		for _, name := range assertNames {
+			symbolTable.Define(name)
+		}
+	}
+
+	comp := compiler.NewWithState(symbolTable, []object.Object{})
+	comp.SetLoader(compiler.NewLoader(), path)
+	return comp
+}
+
+// Prefixes the error with its location in the file.
+func compileError(path string, err error) error {
+	if e, ok := err.(*compiler.Error); ok {
+		return fmt.Errorf("%s:%d:%d: %s", path, e.Line, e.Column, e.Msg)
+	}
+	return fmt.Errorf("%s: %s", path, err)
+}
@@ -0,0 +1,230 @@
+package testrunner
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io/ioutil"
+	"monkey/vm"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDiscover(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"b_test.mk", "a_test.mk", "lib.mk", "sub/c_test.mk", "sub/test.mk"} {
+		writeFile(t, filepath.Join(dir, name), "")
+	}
+
+	files, err := Discover([]string{dir, filepath.Join(dir, "lib.mk")})
+	if err != nil {
+		t.Fatalf("Discover failed: %s", err)
+	}
+	want := []string{
+		filepath.Join(dir, "a_test.mk"),
+		filepath.Join(dir, "b_test.mk"),
+		filepath.Join(dir, "lib.mk"),
+		filepath.Join(dir, "sub", "c_test.mk"),
+	}
+	if !reflect.DeepEqual(files, want) {
+		t.Errorf("wrong files. want=%q, got=%q", want, files)
+	}
+
+	if _, err := Discover([]string{filepath.Join(dir, "missing")}); err == nil {
+		t.Errorf("expected an error for a missing path")
+	}
+}
+
+func TestRunFile(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "lib", "math.mk"), `export let double = fn(x) { x * 2 };`)
+	path := filepath.Join(dir, "math_test.mk")
+	writeFile(t, path, `import "lib/math.mk";
+let count = fn() { yield 1; yield 2; };
+let counter = count();
+let check = fn(x) {
+  assert(x > 10, "too small")
+};
+
+let test_pass = fn() {
+  assert(true);
+  assert_eq(double(2), 4);
+  assert_eq([1, {"a": "b"}], [1, {"a": "b"}]);
+  assert_error(try { 1 / 0 } catch (e) { e }, "division");
+};
+let test_isolated = fn() { assert_eq(next(counter), 1) };
+let test_isolated_again = fn() { assert_eq(next(counter), 1) };
+let test_assert_eq = fn() {
+  assert_eq(double(3), 7, "doubling")
+};
+let test_in_helper = fn() { check(1) };
+let test_assert_error = fn() { assert_error(5) };
+let test_error = fn() { 1 + true };
+let test_throw = fn() { throw "boom" };
+let test_caught = fn() { try { assert(false) } catch (e) { e } };
+let test_arguments = fn(x) { x };
+let not_a_test = fn() { assert(false) };
+let test_not_a_function = 1;
+`)
+
+	file := RunFile(path, vm.DefaultConfig())
+	if file.Err != nil {
+		t.Fatalf("RunFile failed: %s", file.Err)
+	}
+
+	tests := []struct {
+		name    string
+		status  Status
+		message string
+	}{
+		{"test_pass", Passed, ""},
+		{"test_isolated", Passed, ""},
+		{"test_isolated_again", Passed, ""},
+		{"test_assert_eq", Failed, path + ":17: assert_eq failed: got=6, want=7: doubling"},
+		{"test_in_helper", Failed, path + ":5: assertion failed: too small"},
+		{"test_assert_error", Failed, path + ":20: assert_error failed: got=5, want an error"},
+		{"test_error", Errored, path + ":21: unsupported types for binary operation: INTEGER BOOLEAN"},
+		{"test_throw", Errored, path + ":22: uncaught exception: boom"},
+		{"test_caught", Passed, ""},
+		{"test_arguments", Errored, path + ":24: a test takes no arguments, got=1"},
+	}
+	if len(file.Tests) != len(tests) {
+		t.Fatalf("wrong number of tests. want=%d, got=%d", len(tests), len(file.Tests))
+	}
+	for i, tt := range tests {
+		result := file.Tests[i]
+		if result.Name != tt.name || result.Status != tt.status || result.Message != tt.message {
+			t.Errorf("wrong result %d.\nwant=%s %s %q\ngot= %s %s %q",
+				i, tt.name, tt.status, tt.message, result.Name, result.Status, result.Message)
+		}
+	}
+}
+
+func TestRunFileErrors(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		source string
+		err    string
+	}{
+		{"let = 1;", ":1:5: "},
+		{"let test_a = fn() { y };", ":1:21: undefined variable y"},
+		{`import "missing.mk";`, "missing.mk"},
+		{"let m = macro() { let f = fn(x) { f(x) }; f(1) }; m();", ":1:51: macro m: maximum recursion depth exceeded"},
+	}
+
+	for _, tt := range tests {
+		path := filepath.Join(dir, "a_test.mk")
+		writeFile(t, path, tt.source)
+		file := RunFile(path, vm.DefaultConfig())
+		if file.Err == nil || !strings.Contains(file.Err.Error(), tt.err) {
+			t.Errorf("wrong error for %q. want=%q, got=%v", tt.source, tt.err, file.Err)
+		}
+		if len(file.Tests) != 0 {
+			t.Errorf("tests are run for %q", tt.source)
+		}
+	}
+
+	if file := RunFile(filepath.Join(dir, "missing_test.mk"), vm.DefaultConfig()); file.Err == nil {
+		t.Errorf("expected an error for a missing file")
+	}
+}
+
+func testReport() *Report {
+	return &Report{Files: []*File{
+		{Path: "a_test.mk", Tests: []*Result{
+			{Name: "test_ok", Status: Passed},
+			{Name: "test_bad", Status: Failed, Message: "a_test.mk:3: assertion failed"},
+			{Name: "test_crash", Status: Errored, Message: "a_test.mk:5: uncaught exception: 1"},
+		}},
+		{Path: "b_test.mk", Tests: []*Result{{Name: "test_ok", Status: Passed}}},
+		{Path: "c_test.mk"},
+		{Path: "d_test.mk", Err: os.ErrNotExist},
+	}}
+}
+
+func TestWriteText(t *testing.T) {
+	report := testReport()
+	if passed, failed, errored := report.Counts(); passed != 2 || failed != 1 || errored != 2 {
+		t.Errorf("wrong counts. got=%d, %d, %d", passed, failed, errored)
+	}
+	if report.Passed() {
+		t.Errorf("the report passed")
+	}
+
+	var out bytes.Buffer
+	if err := report.WriteText(&out, false); err != nil {
+		t.Fatal(err)
+	}
+	want := `--- FAIL: test_bad (0.000s)
+    a_test.mk:3: assertion failed
+--- ERROR: test_crash (0.000s)
+    a_test.mk:5: uncaught exception: 1
+FAIL	a_test.mk	0.000s
+ok  	b_test.mk	0.000s
+?   	c_test.mk	[no tests]
+file does not exist
+FAIL	d_test.mk	[setup failed]
+
+2 passed, 1 failed, 2 errors
+`
+	if out.String() != want {
+		t.Errorf("wrong text.\nwant=%q\ngot= %q", want, out.String())
+	}
+
+	out.Reset()
+	if err := report.WriteText(&out, true); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(out.String(), "--- PASS: test_ok (0.000s)\n--- FAIL: test_bad") {
+		t.Errorf("passed tests are not listed:\n%s", out.String())
+	}
+
+	passing := &Report{Files: []*File{{Path: "b_test.mk", Tests: []*Result{{Name: "test_ok", Status: Passed}}}}}
+	if !passing.Passed() {
+		t.Errorf("the report did not pass")
+	}
+}
+
+func TestWriteJUnit(t *testing.T) {
+	var out bytes.Buffer
+	if err := testReport().WriteJUnit(&out); err != nil {
+		t.Fatal(err)
+	}
+
+	var suites junitSuites
+	if err := xml.Unmarshal(out.Bytes(), &suites); err != nil {
+		t.Fatalf("invalid XML: %s\n%s", err, out.String())
+	}
+	if len(suites.Suites) != 4 {
+		t.Fatalf("wrong number of suites. got=%d", len(suites.Suites))
+	}
+
+	a := suites.Suites[0]
+	if a.Name != "a_test.mk" || a.Tests != 3 || a.Failures != 1 || a.Errors != 1 {
+		t.Errorf("wrong suite: %+v", a)
+	}
+	if c := a.Cases[1]; c.Name != "test_bad" || c.Failure == nil || c.Failure.Message != "a_test.mk:3: assertion failed" {
+		t.Errorf("wrong failed case: %+v", c)
+	}
+	if c := a.Cases[2]; c.Error == nil || c.Failure != nil {
+		t.Errorf("wrong errored case: %+v", c)
+	}
+	if c := a.Cases[0]; c.Error != nil || c.Failure != nil {
+		t.Errorf("wrong passed case: %+v", c)
+	}
+	if d := suites.Suites[3]; d.Errors != 1 || len(d.Cases) != 1 || d.Cases[0].Error == nil {
+		t.Errorf("wrong suite of a file which cannot be run: %+v", d)
+	}
+}
@@ -0,0 +1,90 @@
+package vm
+
+import (
+	"monkey/budget"
+	"monkey/object"
+)
+
+// Limits of a single VM. The zero value of each field falls back to the package default.
+type Config struct {
+	StackSize   int // Maximum number of slots in the operand stack.
+	MaxFrames   int // Maximum depth of nested function calls.
+	GlobalsSize int // Number of slots in the globals store.
+
+	// When true, the stack and the frames start small and grow on demand up to the limits above.
+	// This saves memory for short scripts at the cost of occasional reallocation.
+	GrowableStack bool
+
+	// Budgets of an execution. Zero means unlimited. Each task spawned by the program has budgets of its own.
+	MaxInstructions int64 // Number of executed instructions.
+	MaxMemory       int64 // Approximate bytes of objects allocated by the VM and builtins.
+
+	// Capabilities given to the builtins. nil means object.DefaultContext(); &object.Context{} grants none.
+	// Each VM, such as those of a Pool, and each task gets a random source of its own seeded from Rand,
+	// so that VMs running in parallel never share one. Tasks write to the same writers under a lock.
+	Capabilities *object.Context
+}
+
+// Initial sizes used when Config.GrowableStack is true.
+const initialGrowableStackSize = 64
+const initialGrowableFrames = 16
+
+func DefaultConfig() Config {
+	return Config{
+		StackSize:   StackSize,
+		MaxFrames:   MaxFrames,
+		GlobalsSize: GlobalsSize,
+	}
+}
+
+// Fill zero-valued fields with the defaults.
+func (c Config) normalize() Config {
+	if c.StackSize <= 0 {
+		c.StackSize = StackSize
+	}
+	if c.MaxFrames <= 0 {
+		c.MaxFrames = MaxFrames
+	}
+	if c.GlobalsSize <= 0 {
+		c.GlobalsSize = GlobalsSize
+	}
+	if c.Capabilities == nil {
+		c.Capabilities = object.DefaultContext()
+	}
+	return c
+}
+
+/*
+Returns a copy of the capabilities for a VM, which RunContext and spawning tasks may modify.
+It has a random source of its own, seeded from that of the config, and the group of the tasks it spawns.
+*/
+func (c Config) vmCapabilities() *object.Context {
+	capabilities := *c.Capabilities
+	if capabilities.Rand != nil {
+		capabilities.Rand = seededRand(capabilities.Rand)
+	}
+	capabilities.Tasks = object.NewTaskGroup()
+	return &capabilities
+}
+
+func (c Config) initialStackSize() int {
+	if c.GrowableStack && initialGrowableStackSize < c.StackSize {
+		return initialGrowableStackSize
+	}
+	return c.StackSize
+}
+
+func (c Config) initialFrames() int {
+	if c.GrowableStack && initialGrowableFrames < c.MaxFrames {
+		return initialGrowableFrames
+	}
+	return c.MaxFrames
+}
+
+/*
+Returns the budgets of the config in the units shared by the engines, for the evaluator which runs the macros
+of the program at compile time, or the program itself, with the same budgets as the VM.
+*/
+func (c Config) Limits() budget.Limits {
+	return budget.Limits{MaxSteps: c.MaxInstructions, MaxMemory: c.MaxMemory, MaxDepth: c.MaxFrames}
+}
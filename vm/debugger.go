@@ -0,0 +1,319 @@
+package vm
+
+import (
+	"context"
+	"errors"
+	"monkey/compiler"
+	"monkey/object"
+)
+
+// Returned from RunContext() internally when the debugger pauses the execution.
+var errPaused = errors.New("paused by the debugger")
+
+type StopReason int
+
+const (
+	StopBreakpoint StopReason = iota
+	StopStep
+	StopExit // The program has finished, with or without an error.
+)
+
+type stepMode int
+
+const (
+	modeContinue stepMode = iota
+	modeStepInto
+	modeStepOver
+	modeStepOut
+)
+
+type offsetBreakpoint struct {
+	fn     *object.CompiledFunction
+	offset int
+}
+
+/*
+Pauses and resumes a VM, and inspects its state while paused.
+Source lines and names of bindings are taken from the DebugTable of the bytecode.
+*/
+type Debugger struct {
+	vm *VM
+
+	lineBreakpoints   map[int]bool
+	offsetBreakpoints map[offsetBreakpoint]bool
+
+	mode       stepMode
+	startDepth int // Number of frames when the current step started.
+
+	started  bool
+	resuming bool // Do not pause at the instruction where the VM is already paused.
+	exited   bool
+	reason   StopReason
+	err      error // Error which ended the program.
+}
+
+// Attach a debugger to the VM. The VM has to be run through the debugger afterwards.
+func NewDebugger(vm *VM) *Debugger {
+	d := &Debugger{
+		vm:                vm,
+		lineBreakpoints:   map[int]bool{},
+		offsetBreakpoints: map[offsetBreakpoint]bool{},
+	}
+	vm.debugger = d
+	return d
+}
+
+func (d *Debugger) SetBreakpoint(line int)   { d.lineBreakpoints[line] = true }
+func (d *Debugger) ClearBreakpoint(line int) { delete(d.lineBreakpoints, line) }
+
+func (d *Debugger) ClearBreakpoints() {
+	d.lineBreakpoints = map[int]bool{}
+	d.offsetBreakpoints = map[offsetBreakpoint]bool{}
+}
+
+// Returns the lines which have breakpoints.
+func (d *Debugger) Breakpoints() []int {
+	lines := []int{}
+	for line := range d.lineBreakpoints {
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// Set a breakpoint at an instruction offset of the function. nil means the main program.
+func (d *Debugger) SetOffsetBreakpoint(fn *object.CompiledFunction, offset int) {
+	if fn == nil {
+		fn = d.vm.frames[0].cl.Fn
+	}
+	d.offsetBreakpoints[offsetBreakpoint{fn: fn, offset: offset}] = true
+}
+
+func (d *Debugger) ClearOffsetBreakpoint(fn *object.CompiledFunction, offset int) {
+	if fn == nil {
+		fn = d.vm.frames[0].cl.Fn
+	}
+	delete(d.offsetBreakpoints, offsetBreakpoint{fn: fn, offset: offset})
+}
+
+// Run until a breakpoint or the end of the program.
+func (d *Debugger) Continue() (StopReason, error) {
+	return d.resume(modeContinue)
+}
+
+// Run until the beginning of the next line, entering called functions.
+func (d *Debugger) StepInto() (StopReason, error) {
+	return d.resume(modeStepInto)
+}
+
+// Run until the beginning of the next line in the current function (or its callers).
+func (d *Debugger) StepOver() (StopReason, error) {
+	return d.resume(modeStepOver)
+}
+
+// Run until the current function returns to its caller.
+func (d *Debugger) StepOut() (StopReason, error) {
+	return d.resume(modeStepOut)
+}
+
+func (d *Debugger) Exited() bool { return d.exited }
+
+// Returns the error which ended the program, if any.
+func (d *Debugger) Err() error { return d.err }
+
+// Returns the value of the last expression statement, after the program has finished.
+func (d *Debugger) Result() object.Object {
+	if !d.exited || d.err != nil {
+		return nil
+	}
+	return d.vm.LastPoppedStackElem()
+}
+
+func (d *Debugger) resume(mode stepMode) (StopReason, error) {
+	if d.exited {
+		return StopExit, d.err
+	}
+
+	d.mode = mode
+	d.startDepth = d.vm.framesIndex
+	d.resuming = d.started
+	d.started = true
+
+	err := d.vm.RunContext(context.Background())
+	if err == errPaused {
+		return d.reason, nil
+	}
+	d.exited = true
+	d.err = err
+	return StopExit, err
+}
+
+// Called by the VM before each instruction.
+func (d *Debugger) shouldPause() bool {
+	if d.resuming {
+		d.resuming = false
+		return false
+	}
+
+	frame := d.vm.currentFrame()
+	offset := frame.ip + 1
+	depth := d.vm.framesIndex
+	info := d.vm.frameDebugInfo(depth - 1)
+	// Lines are those of the program, so the code of imported modules is run through without stopping.
+	lineStart := info.IsLineStart(offset) && info.File == ""
+
+	switch {
+	case d.mode == modeStepInto && lineStart,
+		d.mode == modeStepOver && lineStart && depth <= d.startDepth,
+		d.mode == modeStepOut && depth < d.startDepth:
+		d.reason = StopStep
+		return true
+	}
+
+	if d.offsetBreakpoints[offsetBreakpoint{fn: frame.cl.Fn, offset: offset}] ||
+		(lineStart && d.lineBreakpoints[info.LineAt(offset)]) {
+		d.reason = StopBreakpoint
+		return true
+	}
+	return false
+}
+
+type StackFrame struct {
+	Name   string // "<main>" for the main program.
+	Line   int    // 0 if unknown.
+	Offset int    // Offset of the next instruction to execute.
+	Fn     *object.CompiledFunction
+}
+
+type Variable struct {
+	Name  string
+	Value object.Object // nil if the binding has not been set yet.
+}
+
+// Returns the active frames. The innermost frame comes first.
+func (d *Debugger) Frames() []StackFrame {
+	frames := []StackFrame{}
+	for i := d.vm.framesIndex - 1; i >= 0; i-- {
+		f := d.vm.frames[i]
+		offset := f.ip
+		if i == d.vm.framesIndex-1 {
+			offset = f.ip + 1
+		}
+		frames = append(frames, StackFrame{
+			Name:   d.vm.frameName(i),
+			Line:   d.vm.frameDebugInfo(i).LineAt(offset),
+			Offset: offset,
+			Fn:     f.cl.Fn,
+		})
+	}
+	return frames
+}
+
+// Returns the innermost frame.
+func (d *Debugger) Location() StackFrame {
+	return d.Frames()[0]
+}
+
+// Converts an index of Frames() to an index of vm.frames. Returns -1 if out of range.
+func (d *Debugger) frameIndex(frame int) int {
+	index := d.vm.framesIndex - 1 - frame
+	if frame < 0 || index < 0 {
+		return -1
+	}
+	return index
+}
+
+// Returns the local bindings of the frame, which is an index of Frames().
+func (d *Debugger) Locals(frame int) []Variable {
+	index := d.frameIndex(frame)
+	if index <= 0 { // The main program has no local bindings.
+		return []Variable{}
+	}
+
+	f := d.vm.frames[index]
+	names := d.debugNames(index, func(info *compiler.FunctionDebugInfo) []string { return info.Locals })
+	variables := []Variable{}
+	for i := 0; i < f.cl.Fn.NumLocals; i++ {
+		variables = append(variables, Variable{Name: nameAt(names, i), Value: d.vm.stack[f.basePointer+i]})
+	}
+	return variables
+}
+
+// Returns the free variables of the closure of the frame, which is an index of Frames().
+func (d *Debugger) FreeVariables(frame int) []Variable {
+	index := d.frameIndex(frame)
+	if index <= 0 {
+		return []Variable{}
+	}
+
+	f := d.vm.frames[index]
+	names := d.debugNames(index, func(info *compiler.FunctionDebugInfo) []string { return info.Free })
+	variables := []Variable{}
+	for i, value := range f.cl.Free {
+		variables = append(variables, Variable{Name: nameAt(names, i), Value: value})
+	}
+	return variables
+}
+
+// Returns the global bindings which have been set.
+func (d *Debugger) Globals() []Variable {
+	var names []string
+	if d.vm.debug != nil {
+		names = d.vm.debug.Globals
+	}
+
+	variables := []Variable{}
+	for i, name := range names {
+		if i < len(d.vm.globals) && d.vm.globals[i] != nil {
+			variables = append(variables, Variable{Name: name, Value: d.vm.globals[i]})
+		}
+	}
+	return variables
+}
+
+// Returns the operand stack of the innermost frame. The top of the stack comes last.
+func (d *Debugger) OperandStack() []object.Object {
+	f := d.vm.currentFrame()
+	bottom := 0
+	if d.vm.framesIndex > 1 {
+		bottom = f.basePointer + f.cl.Fn.NumLocals
+	}
+
+	stack := make([]object.Object, d.vm.sp-bottom)
+	copy(stack, d.vm.stack[bottom:d.vm.sp])
+	return stack
+}
+
+// Look up a binding visible from the innermost frame, in the order of locals, free variables and globals.
+func (d *Debugger) Lookup(name string) (object.Object, bool) {
+	for _, v := range d.Locals(0) {
+		if v.Name == name && v.Value != nil {
+			return v.Value, true
+		}
+	}
+	for _, v := range d.FreeVariables(0) {
+		if v.Name == name {
+			return v.Value, true
+		}
+	}
+	for _, v := range d.Globals() {
+		if v.Name == name {
+			return v.Value, true
+		}
+	}
+	return nil, false
+}
+
+func (d *Debugger) debugNames(index int, names func(*compiler.FunctionDebugInfo) []string) []string {
+	info := d.vm.frameDebugInfo(index)
+	if info == nil {
+		return nil
+	}
+	return names(info)
+}
+
+func nameAt(names []string, i int) string {
+	if i < len(names) {
+		return names[i]
+	}
+	return "?"
+}
@@ -0,0 +1,187 @@
+package vm
+
+import (
+	"monkey/compiler"
+	"testing"
+)
+
+const debuggerTestInput = `let add = fn(a, b) {
+	let sum = a + b;
+	sum
+};
+let x = 1;
+let y = add(x, 2);
+let adder = fn(n) { fn(m) { n + m } };
+adder(10)(y)`
+
+func newTestDebugger(t *testing.T, input string) *Debugger {
+	t.Helper()
+
+	comp := compiler.New()
+	err := comp.Compile(parse(input))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	return NewDebugger(New(comp.ByteCode(), DefaultConfig()))
+}
+
+func expectStop(t *testing.T, d *Debugger, reason StopReason, err error, name string, line int) {
+	t.Helper()
+
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if reason == StopExit {
+		t.Fatalf("program exited unexpectedly. expected to stop in %s at line %d", name, line)
+	}
+	location := d.Location()
+	if location.Name != name || location.Line != line {
+		t.Fatalf(
+			"stopped at wrong location. want=%s:%d, got=%s:%d",
+			name, line, location.Name, location.Line,
+		)
+	}
+}
+
+// Matches any value which has been set.
+type anyValue struct{}
+
+func expectVariables(t *testing.T, variables []Variable, expected map[string]interface{}) {
+	t.Helper()
+
+	if len(variables) != len(expected) {
+		t.Fatalf("wrong number of variables. want=%d, got=%d (%+v)", len(expected), len(variables), variables)
+	}
+	for _, v := range variables {
+		want, ok := expected[v.Name]
+		if !ok {
+			t.Fatalf("unexpected variable %s", v.Name)
+		}
+		if _, ok := want.(anyValue); ok {
+			if v.Value == nil {
+				t.Fatalf("variable %s is unset.", v.Name)
+			}
+			continue
+		}
+		if want == nil {
+			if v.Value != nil {
+				t.Fatalf("variable %s should be unset. got=%s", v.Name, v.Value.Inspect())
+			}
+			continue
+		}
+		testExpectedObject(t, want, v.Value)
+	}
+}
+
+func TestDebuggerBreakpointsAndSteps(t *testing.T) {
+	d := newTestDebugger(t, debuggerTestInput)
+	d.SetBreakpoint(2)
+
+	reason, err := d.Continue()
+	expectStop(t, d, reason, err, "add", 2)
+	if reason != StopBreakpoint {
+		t.Fatalf("wrong stop reason. want=%d, got=%d", StopBreakpoint, reason)
+	}
+	expectVariables(t, d.Locals(0), map[string]interface{}{"a": 1, "b": 2, "sum": nil})
+
+	frames := d.Frames()
+	if len(frames) != 2 || frames[1].Name != "<main>" || frames[1].Line != 6 {
+		t.Fatalf("wrong frames. got=%+v", frames)
+	}
+	expectVariables(t, d.Globals(), map[string]interface{}{"x": 1, "add": anyValue{}})
+
+	reason, err = d.StepOver()
+	expectStop(t, d, reason, err, "add", 3)
+	expectVariables(t, d.Locals(0), map[string]interface{}{"a": 1, "b": 2, "sum": 3})
+
+	reason, err = d.StepOut()
+	expectStop(t, d, reason, err, "<main>", 6)
+	if stack := d.OperandStack(); len(stack) != 1 {
+		t.Fatalf("wrong operand stack. got=%v", stack)
+	}
+
+	reason, err = d.StepOver()
+	expectStop(t, d, reason, err, "<main>", 7)
+
+	reason, err = d.StepOver()
+	expectStop(t, d, reason, err, "<main>", 8)
+
+	reason, err = d.StepInto()
+	expectStop(t, d, reason, err, "adder", 7)
+	expectVariables(t, d.Locals(0), map[string]interface{}{"n": 10})
+
+	reason, err = d.StepOut()
+	expectStop(t, d, reason, err, "<main>", 8)
+
+	reason, err = d.StepInto()
+	expectStop(t, d, reason, err, "<anonymous>", 7)
+	expectVariables(t, d.FreeVariables(0), map[string]interface{}{"n": 10})
+	value, ok := d.Lookup("y")
+	if !ok {
+		t.Fatalf("y is not found.")
+	}
+	testExpectedObject(t, 3, value)
+
+	reason, err = d.Continue()
+	if reason != StopExit || err != nil {
+		t.Fatalf("program did not exit. reason=%d, err=%v", reason, err)
+	}
+	testExpectedObject(t, 13, d.Result())
+}
+
+func TestDebuggerOffsetBreakpoint(t *testing.T) {
+	d := newTestDebugger(t, "let a = 1; let b = 2; a + b")
+	// 0000 OpConstant 0, 0003 OpSetGlobal 0, 0006 OpConstant 1, ...
+	d.SetOffsetBreakpoint(nil, 6)
+
+	reason, err := d.Continue()
+	if reason != StopBreakpoint || err != nil {
+		t.Fatalf("did not stop at the breakpoint. reason=%d, err=%v", reason, err)
+	}
+	if d.Location().Offset != 6 {
+		t.Fatalf("wrong offset. want=6, got=%d", d.Location().Offset)
+	}
+	expectVariables(t, d.Globals(), map[string]interface{}{"a": 1})
+
+	reason, err = d.Continue()
+	if reason != StopExit || err != nil {
+		t.Fatalf("program did not exit. reason=%d, err=%v", reason, err)
+	}
+	testExpectedObject(t, 3, d.Result())
+}
+
+func TestDebuggerRuntimeError(t *testing.T) {
+	d := newTestDebugger(t, "let f = fn() { 1 + true };\nf();")
+
+	reason, err := d.Continue()
+	if reason != StopExit || err == nil {
+		t.Fatalf("expected the program to exit with an error. reason=%d, err=%v", reason, err)
+	}
+	if d.Err() != err || d.Result() != nil {
+		t.Fatalf("wrong state after an error. err=%v, result=%v", d.Err(), d.Result())
+	}
+}
+
+// The lines of the debugger are those of the program, so it does not stop in the code of imported modules.
+func TestDebuggerSkipsModules(t *testing.T) {
+	loader := compiler.NewLoader()
+	loader.ReadFile = func(path string) ([]byte, error) {
+		return []byte("let one = 1;\nlet two = 2;\nexport let inc = fn(x) {\n  x + one\n};"), nil
+	}
+	comp := compiler.New()
+	comp.SetLoader(loader, "main.mk")
+	if err := comp.Compile(parse("let a = 1;\nimport \"lib\";\nlet b = inc(a);\nb")); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	d := NewDebugger(New(comp.ByteCode(), DefaultConfig()))
+	d.SetBreakpoint(4) // The body of inc is at line 4 of the module.
+
+	reason, err := d.StepInto()
+	expectStop(t, d, reason, err, "<main>", 1)
+	reason, err = d.StepInto()
+	expectStop(t, d, reason, err, "<main>", 2)
+	reason, err = d.StepInto()
+	expectStop(t, d, reason, err, "<main>", 3)
+	reason, err = d.StepInto()
+	expectStop(t, d, reason, err, "<main>", 4)
+}
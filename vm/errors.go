@@ -0,0 +1,126 @@
+package vm
+
+import (
+	"bytes"
+	"fmt"
+	"monkey/compiler"
+	"monkey/object"
+)
+
+/*
+Returned from Run() when a thrown value is not caught by any try.
+Errors of builtins and of operations, such as adding an integer to a boolean, are thrown as ERROR objects.
+*/
+type UncaughtError struct {
+	Value     object.Object
+	Traceback []string // Function names (and source lines if known) of the frames at the throw. The outermost frame comes first.
+	File      string   // Path of the module where the value was thrown. Empty for the program itself.
+	Line      int      // Source line where the value was thrown, or 0 if unknown.
+}
+
+func (e *UncaughtError) Error() string {
+	if errObj, ok := e.Value.(*object.Error); ok {
+		return errObj.Message
+	}
+	return "uncaught exception: " + e.Value.Inspect()
+}
+
+// Returned by the instructions which throw, to unwind the frames to the innermost handler.
+type thrown struct {
+	value object.Object
+}
+
+func (t *thrown) Error() string { return "thrown: " + t.value.Inspect() }
+
+// An error of the program, which it can catch.
+func runtimeError(format string, a ...interface{}) error {
+	return &thrown{value: &object.Error{Message: fmt.Sprintf(format, a...)}}
+}
+
+/*
+Returned from Run() when a function call would exceed Config.MaxFrames,
+or when nested calls fill the stack of Config.StackSize slots before that.
+*/
+type RecursionError struct {
+	MaxFrames int
+	StackSize int      // Set when the calls ran out of stack rather than frames.
+	Traceback []string // Function names (and source lines if known) of the active frames. The outermost frame comes first.
+}
+
+func (e *RecursionError) Error() string {
+	var out bytes.Buffer
+
+	if e.StackSize != 0 {
+		fmt.Fprintf(&out, "maximum recursion depth exceeded (stack size: %d)\n", e.StackSize)
+	} else {
+		fmt.Fprintf(&out, "maximum recursion depth exceeded (max frames: %d)\n", e.MaxFrames)
+	}
+	out.WriteString("Traceback (most recent call last):")
+
+	// Consecutive frames of the same function are folded into one line.
+	for i := 0; i < len(e.Traceback); {
+		j := i + 1
+		for j < len(e.Traceback) && e.Traceback[j] == e.Traceback[i] {
+			j++
+		}
+		fmt.Fprintf(&out, "\n  in %s", e.Traceback[i])
+		if repeated := j - i - 1; repeated > 0 {
+			fmt.Fprintf(&out, "\n  [previous line repeated %d more times]", repeated)
+		}
+		i = j
+	}
+	return out.String()
+}
+
+/*
+Build the traceback of the active frames.
+*/
+func (vm *VM) traceback() []string {
+	names := make([]string, vm.framesIndex)
+	for i := 0; i < vm.framesIndex; i++ {
+		names[i] = vm.frameName(i)
+		info := vm.frameDebugInfo(i)
+		if line := info.LineAt(vm.frames[i].ip); line != 0 {
+			if info.File != "" {
+				names[i] += fmt.Sprintf(" (%s line %d)", info.File, line)
+			} else {
+				names[i] += fmt.Sprintf(" (line %d)", line)
+			}
+		}
+	}
+	return names
+}
+
+// Returns the file and the source line of the instruction being run in the innermost frame.
+func (vm *VM) location() (string, int) {
+	info := vm.frameDebugInfo(vm.framesIndex - 1)
+	if info == nil {
+		return "", 0
+	}
+	return info.File, info.LineAt(vm.currentFrame().ip)
+}
+
+func (vm *VM) frameName(index int) string {
+	f := vm.frames[index]
+	if index == 0 && vm.task != nil {
+		return "<task>"
+	}
+	if index == 0 {
+		return "<main>"
+	}
+	if f.cl.Fn.Name == "" {
+		return "<anonymous>"
+	}
+	return f.cl.Fn.Name
+}
+
+// Returns the debug information of the function of vm.frames[index], or nil.
+func (vm *VM) frameDebugInfo(index int) *compiler.FunctionDebugInfo {
+	if index == 0 && vm.task != nil {
+		return nil // The first frame of a task only calls its function.
+	}
+	if index == 0 {
+		return vm.debug.Function(nil)
+	}
+	return vm.debug.Function(vm.frames[index].cl.Fn)
+}
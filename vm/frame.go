@@ -9,6 +9,9 @@ type Frame struct {
 	cl          *object.Closure
 	ip          int
 	basePointer int
+
+	generator *object.Generator // The generator whose function the frame runs. nil for a function call.
+	loopEnd   int               // Where the for-in loop which resumed the generator continues after it finishes. -1 for `next`.
 }
 
 func NewFrame(closure *object.Closure, basePointer int) *Frame {
@@ -22,3 +25,12 @@ func NewFrame(closure *object.Closure, basePointer int) *Frame {
 func (f *Frame) Instructions() code.Instructions {
 	return f.cl.Fn.Instructions
 }
+
+func (f *Frame) Closure() *object.Closure {
+	return f.cl
+}
+
+// Index of the first argument or local of the function in the stack of the VM.
+func (f *Frame) BasePointer() int {
+	return f.basePointer
+}
@@ -0,0 +1,153 @@
+package vm
+
+import (
+	"monkey/object"
+)
+
+var nextBuiltin = object.GetBuiltinByName("next")
+
+/*
+The function of a generator created by the VM, while it is suspended.
+Only the task which created the generator may touch it or the Done field of the generator,
+so both are left as they are when it finishes.
+*/
+type suspension struct {
+	cl      *object.Closure
+	ip      int
+	stack   []object.Object // The local bindings and the operands of the function, from its base pointer up.
+	running bool            // Whether a frame is running the function, so it cannot be resumed again.
+	owner   *object.Task    // The task which created the generator. nil for the program itself.
+}
+
+// The state of a for-in loop, which stays on the stack while the body runs.
+type iterator struct {
+	elements  []object.Object // The elements of an array. Unused for a generator.
+	index     int
+	generator *object.Generator
+}
+
+func (it *iterator) Type() object.ObjectType { return "ITERATOR" }
+func (it *iterator) Inspect() string         { return "iterator" }
+
+// Replace the arguments and the callee on the stack with a generator, which has not run the function yet.
+func (vm *VM) createGenerator(cl *object.Closure, numArgs int) error {
+	stack := make([]object.Object, cl.Fn.NumLocals)
+	copy(stack, vm.stack[vm.sp-numArgs:vm.sp])
+	vm.sp = vm.sp - numArgs - 1
+
+	return vm.pushAllocated(&object.Generator{State: &suspension{cl: cl, ip: -1, stack: stack, owner: vm.task}})
+}
+
+// Reports whether the VM can resume the generator, which is not done. It is an error if another task created it.
+func (vm *VM) resumable(gen *object.Generator) (bool, error) {
+	s, ok := gen.State.(*suspension)
+	if !ok {
+		if gen.Done {
+			return false, nil
+		}
+		return false, runtimeError("the generator can only be resumed by the engine which created it")
+	}
+	if s.owner != vm.task {
+		return false, runtimeError("the generator belongs to another task")
+	}
+	return !gen.Done, nil
+}
+
+/*
+Push a frame which continues the function of the generator, with its stack segment copied back on top of the stack.
+The value it yields is pushed for the caller. When it finishes, null is pushed for `next`,
+or the iterator is popped and the loop continues at loopEnd.
+*/
+func (vm *VM) resume(gen *object.Generator, loopEnd int) error {
+	s := gen.State.(*suspension)
+	if s.running {
+		return runtimeError("the generator is already running")
+	}
+
+	frame := &Frame{cl: s.cl, ip: s.ip, basePointer: vm.sp, generator: gen, loopEnd: loopEnd}
+	err := vm.pushFrame(frame)
+	if err != nil {
+		return err
+	}
+	err = vm.growStack(vm.sp + len(s.stack))
+	if err != nil {
+		return err
+	}
+	copy(vm.stack[vm.sp:], s.stack)
+	vm.sp += len(s.stack)
+	s.running = true
+	return nil
+}
+
+// Suspend the generator of the current frame, saving its stack segment, and give the value to the resumer.
+func (vm *VM) yield(value object.Object) error {
+	frame := vm.popFrame()
+	s := frame.generator.State.(*suspension)
+	s.ip = frame.ip
+	s.stack = append(s.stack[:0], vm.stack[frame.basePointer:vm.sp]...)
+	s.running = false
+
+	vm.sp = frame.basePointer
+	return vm.push(value)
+}
+
+// Finish the generator of the frame, which has just been popped by a return, and continue the resumer.
+func (vm *VM) finishGenerator(frame *Frame) error {
+	closeGenerator(frame.generator)
+	vm.sp = frame.basePointer
+	if frame.loopEnd < 0 {
+		return vm.push(Null)
+	}
+	vm.sp-- // The iterator.
+	vm.currentFrame().ip = frame.loopEnd - 1
+	return nil
+}
+
+func closeGenerator(gen *object.Generator) {
+	gen.Done = true
+	s := gen.State.(*suspension)
+	s.cl = nil
+	s.stack = nil
+}
+
+// Close the generators run by vm.frames[from:], which are abandoned by an exception or an error.
+func (vm *VM) closeGenerators(from int) {
+	for i := from; i < vm.framesIndex; i++ {
+		if gen := vm.frames[i].generator; gen != nil {
+			closeGenerator(gen)
+		}
+	}
+}
+
+// Replace the iterable on the top of the stack with an iterator.
+func (vm *VM) executeIter() error {
+	switch iterable := vm.pop().(type) {
+	case *object.Array:
+		return vm.push(&iterator{elements: iterable.Elements})
+	case *object.Generator:
+		return vm.push(&iterator{generator: iterable})
+	default:
+		return runtimeError("cannot iterate over %s", iterable.Type())
+	}
+}
+
+// Push the next value of the iterator on the top of the stack, or pop it and jump to loopEnd.
+func (vm *VM) executeIterNext(loopEnd int) error {
+	it := vm.stack[vm.sp-1].(*iterator)
+	if gen := it.generator; gen != nil {
+		resumable, err := vm.resumable(gen)
+		if err != nil {
+			return err
+		}
+		if resumable {
+			return vm.resume(gen, loopEnd)
+		}
+	} else if it.index < len(it.elements) {
+		it.index++
+		return vm.push(it.elements[it.index-1])
+	}
+
+	vm.sp--
+	vm.currentFrame().ip = loopEnd - 1
+	return nil
+}
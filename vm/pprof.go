@@ -0,0 +1,182 @@
+package vm
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"monkey/object"
+	"strings"
+)
+
+/*
+Write the statistics as a gzipped profile.proto message, which `go tool pprof` reads.
+Each path of calls is a sample with the instructions, the time and the allocations of its innermost function.
+Functions are located at their first source line, and the file name of the main program is "<main>" if unknown.
+*/
+func (p *Profiler) WritePprof(w io.Writer) error {
+	table := newStringTable()
+	var profile protoBuffer
+
+	for _, t := range [][2]string{
+		{"instructions", "count"},
+		{"time", "nanoseconds"},
+		{"alloc_objects", "count"},
+		{"alloc_space", "bytes"},
+	} {
+		var valueType protoBuffer
+		valueType.int64Field(1, table.index(t[0]))
+		valueType.int64Field(2, table.index(t[1]))
+		profile.message(1, &valueType)
+	}
+
+	ids := map[*object.CompiledFunction]uint64{}
+	var functions []FunctionProfile
+	var visit func(n *profileNode, stack []uint64)
+	visit = func(n *profileNode, stack []uint64) {
+		id, ok := ids[n.fn]
+		if !ok {
+			id = uint64(len(ids) + 1)
+			ids[n.fn] = id
+			functions = append(functions, *p.newFunctionProfile(n.fn))
+		}
+		stack = append([]uint64{id}, stack...) // The innermost function comes first.
+
+		if n.instructions != 0 || n.allocations != 0 {
+			var sample protoBuffer
+			sample.packedUint64Field(1, stack)
+			sample.packedInt64Field(2, []int64{n.instructions, int64(n.selfTime), n.allocations, n.allocatedBytes})
+			profile.message(2, &sample)
+		}
+		for _, c := range n.children {
+			visit(c, stack)
+		}
+	}
+	if p.root != nil {
+		visit(p.root, nil)
+	}
+
+	// A location and a function for each function, with the same id.
+	for i, f := range functions {
+		id := uint64(i + 1)
+		var line protoBuffer
+		line.uint64Field(1, id)
+		line.int64Field(2, int64(f.Line))
+		var location protoBuffer
+		location.uint64Field(1, id)
+		location.message(4, &line)
+		profile.message(4, &location)
+
+		file := f.File
+		if file == "" {
+			file = "<main>"
+		}
+		// pprof drops what is in angle brackets, taking it for template arguments of C++.
+		name := strings.Trim(f.Name, "<>")
+		var function protoBuffer
+		function.uint64Field(1, id)
+		function.int64Field(2, table.index(name))
+		function.int64Field(3, table.index(name))
+		function.int64Field(4, table.index(file))
+		function.int64Field(5, int64(f.Line))
+		profile.message(5, &function)
+	}
+
+	for _, s := range table.list {
+		profile.stringField(6, s)
+	}
+	var periodType protoBuffer
+	periodType.int64Field(1, table.index("instructions"))
+	periodType.int64Field(2, table.index("count"))
+	profile.message(11, &periodType)
+	profile.int64Field(12, 1)
+	profile.int64Field(14, table.index("time"))
+
+	gz := gzip.NewWriter(w)
+	if _, err := gz.Write(profile.Bytes()); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// The string table of a profile. The first string is always empty.
+type stringTable struct {
+	list    []string
+	indexes map[string]int64
+}
+
+func newStringTable() *stringTable {
+	return &stringTable{list: []string{""}, indexes: map[string]int64{"": 0}}
+}
+
+func (t *stringTable) index(s string) int64 {
+	i, ok := t.indexes[s]
+	if !ok {
+		i = int64(len(t.list))
+		t.list = append(t.list, s)
+		t.indexes[s] = i
+	}
+	return i
+}
+
+// Encodes the fields of a protocol buffers message. Fields with the zero value are omitted.
+type protoBuffer struct {
+	bytes.Buffer
+}
+
+const (
+	wireVarint = 0
+	wireBytes  = 2
+)
+
+func (b *protoBuffer) varint(x uint64) {
+	for x >= 0x80 {
+		b.WriteByte(byte(x) | 0x80)
+		x >>= 7
+	}
+	b.WriteByte(byte(x))
+}
+
+func (b *protoBuffer) key(field, wireType int) {
+	b.varint(uint64(field)<<3 | uint64(wireType))
+}
+
+func (b *protoBuffer) uint64Field(field int, x uint64) {
+	if x == 0 {
+		return
+	}
+	b.key(field, wireVarint)
+	b.varint(x)
+}
+
+func (b *protoBuffer) int64Field(field int, x int64) {
+	b.uint64Field(field, uint64(x))
+}
+
+// Strings are written even if they are empty, since they may be elements of a repeated field.
+func (b *protoBuffer) stringField(field int, s string) {
+	b.key(field, wireBytes)
+	b.varint(uint64(len(s)))
+	b.WriteString(s)
+}
+
+func (b *protoBuffer) message(field int, m *protoBuffer) {
+	b.key(field, wireBytes)
+	b.varint(uint64(m.Len()))
+	b.Write(m.Bytes())
+}
+
+func (b *protoBuffer) packedUint64Field(field int, xs []uint64) {
+	var packed protoBuffer
+	for _, x := range xs {
+		packed.varint(x)
+	}
+	b.message(field, &packed)
+}
+
+func (b *protoBuffer) packedInt64Field(field int, xs []int64) {
+	var packed protoBuffer
+	for _, x := range xs {
+		packed.varint(uint64(x))
+	}
+	b.message(field, &packed)
+}
@@ -0,0 +1,274 @@
+package vm
+
+import (
+	"fmt"
+	"io"
+	"monkey/code"
+	"monkey/compiler"
+	"monkey/object"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+/*
+Counts the instructions, the calls, the time and the allocations of a VM per function, and the executed opcodes.
+The statistics are kept per path of calls from the main program, so they can be written in the pprof format.
+Time is measured when the running function changes, so the time a builtin takes counts for its caller.
+Tasks spawned by the program run in VMs of their own, which are not profiled.
+*/
+type Profiler struct {
+	vm *VM
+
+	root    *profileNode
+	stack   []profiledFrame // Follows the frames of the VM.
+	opcodes [256]int64
+
+	last    time.Time // When the time was last attributed to a function.
+	running bool
+}
+
+// A function called along a path of calls from the main program.
+type profileNode struct {
+	fn       *object.CompiledFunction
+	parent   *profileNode
+	children map[*object.CompiledFunction]*profileNode
+
+	calls          int64
+	instructions   int64
+	selfTime       time.Duration
+	allocations    int64
+	allocatedBytes int64
+}
+
+type profiledFrame struct {
+	frame *Frame
+	node  *profileNode
+}
+
+// Attach a profiler to the VM, which collects the statistics of the following runs.
+func NewProfiler(vm *VM) *Profiler {
+	p := &Profiler{vm: vm}
+	vm.profiler = p
+	return p
+}
+
+// Count the instruction, which is about to be executed.
+func (p *Profiler) step(op code.Opcode) {
+	if !p.running {
+		p.last = time.Now()
+		p.running = true
+	}
+	n := len(p.stack)
+	if n != p.vm.framesIndex || p.stack[n-1].frame != p.vm.frames[n-1] {
+		p.followFrames()
+	}
+	p.stack[len(p.stack)-1].node.instructions++
+	p.opcodes[op]++
+}
+
+// Attribute the time so far to the function which has been running, and follow the frames pushed or popped since.
+func (p *Profiler) followFrames() {
+	now := time.Now()
+	if len(p.stack) > 0 {
+		p.stack[len(p.stack)-1].node.selfTime += now.Sub(p.last)
+	}
+	p.last = now
+
+	// The frames below the innermost one which is still there are left as they were.
+	for len(p.stack) > 0 {
+		n := len(p.stack)
+		if n <= p.vm.framesIndex && p.stack[n-1].frame == p.vm.frames[n-1] {
+			break
+		}
+		p.stack = p.stack[:n-1]
+	}
+	for i := len(p.stack); i < p.vm.framesIndex; i++ {
+		frame := p.vm.frames[i]
+		var node *profileNode
+		if i == 0 {
+			if p.root == nil {
+				p.root = &profileNode{fn: frame.cl.Fn}
+			}
+			node = p.root
+		} else {
+			node = p.stack[i-1].node.child(frame.cl.Fn)
+		}
+		node.calls++
+		p.stack = append(p.stack, profiledFrame{frame: frame, node: node})
+	}
+}
+
+func (n *profileNode) child(fn *object.CompiledFunction) *profileNode {
+	if n.children == nil {
+		n.children = map[*object.CompiledFunction]*profileNode{}
+	}
+	c, ok := n.children[fn]
+	if !ok {
+		c = &profileNode{fn: fn, parent: n}
+		n.children[fn] = c
+	}
+	return c
+}
+
+// Count an object allocated by the running function.
+func (p *Profiler) allocate(size int64) {
+	if len(p.stack) == 0 {
+		return
+	}
+	node := p.stack[len(p.stack)-1].node
+	node.allocations++
+	node.allocatedBytes += size
+}
+
+// Attribute the time up to the end of a run, so that the time between runs is not counted.
+func (p *Profiler) stop() {
+	if !p.running {
+		return
+	}
+	if len(p.stack) > 0 {
+		p.stack[len(p.stack)-1].node.selfTime += time.Since(p.last)
+	}
+	p.running = false
+}
+
+type FunctionProfile struct {
+	Fn   *object.CompiledFunction
+	Name string // As in tracebacks: "<main>", "<anonymous>" or the name of the function.
+	File string
+	Line int // The first source line of the function. 0 if unknown.
+
+	Calls          int64 // Including the resumptions of generators.
+	Instructions   int64 // Executed by the function itself.
+	SelfTime       time.Duration
+	TotalTime      time.Duration // Including the functions it calls.
+	Allocations    int64
+	AllocatedBytes int64
+}
+
+// Returns the statistics of each function which has run, the longest running first.
+func (p *Profiler) Functions() []FunctionProfile {
+	profiles := map[*object.CompiledFunction]*FunctionProfile{}
+	totals := map[*object.CompiledFunction]time.Duration{}
+	if p.root != nil {
+		p.walk(p.root, map[*object.CompiledFunction]int{}, totals, profiles)
+	}
+
+	result := []FunctionProfile{}
+	for fn, profile := range profiles {
+		profile.TotalTime = totals[fn]
+		result = append(result, *profile)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].SelfTime != result[j].SelfTime {
+			return result[i].SelfTime > result[j].SelfTime
+		}
+		return result[i].Instructions > result[j].Instructions
+	})
+	return result
+}
+
+/*
+Sum the statistics of the node and its descendants per function. Returns the total time of the node.
+The total time of a recursive function is counted at its outermost call only.
+*/
+func (p *Profiler) walk(
+	n *profileNode,
+	onPath map[*object.CompiledFunction]int,
+	totals map[*object.CompiledFunction]time.Duration,
+	profiles map[*object.CompiledFunction]*FunctionProfile,
+) time.Duration {
+	profile, ok := profiles[n.fn]
+	if !ok {
+		profile = p.newFunctionProfile(n.fn)
+		profiles[n.fn] = profile
+	}
+	profile.Calls += n.calls
+	profile.Instructions += n.instructions
+	profile.SelfTime += n.selfTime
+	profile.Allocations += n.allocations
+	profile.AllocatedBytes += n.allocatedBytes
+
+	total := n.selfTime
+	onPath[n.fn]++
+	for _, c := range n.children {
+		total += p.walk(c, onPath, totals, profiles)
+	}
+	onPath[n.fn]--
+	if onPath[n.fn] == 0 {
+		totals[n.fn] += total
+	}
+	return total
+}
+
+func (p *Profiler) newFunctionProfile(fn *object.CompiledFunction) *FunctionProfile {
+	profile := &FunctionProfile{Fn: fn, Name: fn.Name}
+	var info *compiler.FunctionDebugInfo
+	if p.root != nil && fn == p.root.fn {
+		profile.Name = "<main>"
+		info = p.vm.debug.Function(nil)
+	} else {
+		info = p.vm.debug.Function(fn)
+	}
+	if profile.Name == "" {
+		profile.Name = "<anonymous>"
+	}
+	if info != nil {
+		profile.File = info.File
+		if len(info.Lines) > 0 {
+			profile.Line = info.Lines[0].Line
+		}
+	}
+	return profile
+}
+
+type OpcodeProfile struct {
+	Opcode code.Opcode
+	Count  int64
+}
+
+// Returns the number of times each opcode has been executed, the most frequent first.
+func (p *Profiler) Opcodes() []OpcodeProfile {
+	result := []OpcodeProfile{}
+	for op, count := range p.opcodes {
+		if count > 0 {
+			result = append(result, OpcodeProfile{Opcode: code.Opcode(op), Count: count})
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Count != result[j].Count {
+			return result[i].Count > result[j].Count
+		}
+		return result[i].Opcode < result[j].Opcode
+	})
+	return result
+}
+
+// Write the statistics of the functions and the opcodes as tables.
+func (p *Profiler) WriteText(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "self time\ttotal time\tcalls\tinstructions\tallocs\talloc bytes\t\tfunction")
+	for _, f := range p.Functions() {
+		name := f.Name
+		if f.Line != 0 {
+			name += fmt.Sprintf(" (line %d)", f.Line)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%d\t%d\t\t%s\n",
+			f.SelfTime, f.TotalTime, f.Calls, f.Instructions, f.Allocations, f.AllocatedBytes, name)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Fprintln(w)
+	tw = tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "count\t\topcode")
+	for _, op := range p.Opcodes() {
+		name := fmt.Sprintf("%d", op.Opcode)
+		if def, err := code.Lookup(byte(op.Opcode)); err == nil {
+			name = def.Name
+		}
+		fmt.Fprintf(tw, "%d\t\t%s\n", op.Count, name)
+	}
+	return tw.Flush()
+}
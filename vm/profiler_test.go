@@ -0,0 +1,135 @@
+package vm
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"monkey/compiler"
+	"strings"
+	"testing"
+)
+
+const profilerTestInput = `let fib = fn(n) {
+	if (n < 2) { n } else { fib(n - 1) + fib(n - 2) }
+};
+let square = fn(x) { [x * x] };
+let gen = fn() { yield 1; yield 2; };
+fib(10);
+square(3);
+for (x in gen()) { x }`
+
+func newTestProfiler(t *testing.T) *Profiler {
+	t.Helper()
+
+	comp := compiler.New()
+	if err := comp.Compile(parse(profilerTestInput)); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	vm := New(comp.ByteCode(), DefaultConfig())
+	p := NewProfiler(vm)
+	if err := vm.Run(); err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+	return p
+}
+
+func TestProfilerFunctions(t *testing.T) {
+	p := newTestProfiler(t)
+
+	profiles := map[string]FunctionProfile{}
+	var instructions int64
+	for _, f := range p.Functions() {
+		profiles[f.Name] = f
+		instructions += f.Instructions
+		if f.TotalTime < f.SelfTime {
+			t.Errorf("%s: total time %s is less than self time %s", f.Name, f.TotalTime, f.SelfTime)
+		}
+	}
+
+	tests := []struct {
+		name  string
+		line  int
+		calls int64
+	}{
+		{"<main>", 1, 1},
+		{"fib", 2, 177},
+		{"square", 4, 1},
+		{"gen", 5, 3}, // Resumed by each iteration of the loop.
+	}
+	for _, tt := range tests {
+		f, ok := profiles[tt.name]
+		if !ok {
+			t.Errorf("no profile of %s", tt.name)
+			continue
+		}
+		if f.Calls != tt.calls || f.Line != tt.line {
+			t.Errorf("wrong profile of %s. want calls=%d line=%d, got calls=%d line=%d", tt.name, tt.calls, tt.line, f.Calls, f.Line)
+		}
+	}
+
+	if square := profiles["square"]; square.Allocations != 2 {
+		t.Errorf("square should allocate an integer and an array. got=%d", square.Allocations)
+	}
+	if main, fib := profiles["<main>"], profiles["fib"]; main.TotalTime < fib.TotalTime {
+		t.Errorf("the total time of main %s is less than that of fib %s", main.TotalTime, fib.TotalTime)
+	}
+
+	var executed int64
+	for _, op := range p.Opcodes() {
+		executed += op.Count
+	}
+	if executed != instructions {
+		t.Errorf("the opcodes and the functions count different instructions. %d != %d", executed, instructions)
+	}
+	if p.Opcodes()[0].Count < 177 {
+		t.Errorf("the most frequent opcode is executed too few times: %+v", p.Opcodes()[0])
+	}
+}
+
+func TestProfilerOutput(t *testing.T) {
+	p := newTestProfiler(t)
+
+	var text bytes.Buffer
+	if err := p.WriteText(&text); err != nil {
+		t.Fatalf("WriteText failed: %s", err)
+	}
+	for _, expected := range []string{"fib (line 2)", "<main> (line 1)", "OpCall", "OpIterNext"} {
+		if !strings.Contains(text.String(), expected) {
+			t.Errorf("the text output does not contain %q:\n%s", expected, text.String())
+		}
+	}
+
+	var out bytes.Buffer
+	if err := p.WritePprof(&out); err != nil {
+		t.Fatalf("WritePprof failed: %s", err)
+	}
+	gz, err := gzip.NewReader(&out)
+	if err != nil {
+		t.Fatalf("the pprof output is not gzipped: %s", err)
+	}
+	profile, err := ioutil.ReadAll(gz)
+	if err != nil {
+		t.Fatalf("the pprof output is not gzipped: %s", err)
+	}
+	for _, s := range []string{"fib", "square", "alloc_space", "nanoseconds"} {
+		if !bytes.Contains(profile, []byte(s)) {
+			t.Errorf("the string table does not contain %q", s)
+		}
+	}
+}
+
+func TestProtoBuffer(t *testing.T) {
+	var inner protoBuffer
+	inner.uint64Field(1, 300)
+	inner.int64Field(2, 0) // Omitted.
+
+	var b protoBuffer
+	b.message(2, &inner)
+	b.stringField(6, "")
+	b.packedInt64Field(1, []int64{1, 2})
+
+	expected := []byte{0x12, 3, 0x08, 0xac, 0x02, 0x32, 0, 0x0a, 2, 1, 2}
+	if !bytes.Equal(b.Bytes(), expected) {
+		t.Errorf("wrong encoding.\nwant=%x\ngot= %x", expected, b.Bytes())
+	}
+}
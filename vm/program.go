@@ -0,0 +1,100 @@
+package vm
+
+import (
+	"monkey/budget"
+	"monkey/code"
+	"monkey/compiler"
+	"monkey/object"
+	"sync"
+)
+
+/*
+A compiled program, which any number of VMs may run at the same time.
+A Program is never modified after NewProgram, and neither are its constants, such as compiled functions,
+nor the singletons True, False and Null. Each VM running it has globals of its own.
+*/
+type Program struct {
+	main      *object.Closure
+	constants []object.Object
+	debug     *compiler.DebugTable // nil when the bytecode has no debug information.
+}
+
+/*
+Make a program of the bytecode. The parts of the bytecode which a compiler may still append to are copied,
+so the compiler can go on compiling, e.g. the next input of a REPL.
+*/
+func NewProgram(bytecode *compiler.Bytecode) *Program {
+	main := &object.CompiledFunction{
+		Instructions: append(code.Instructions(nil), bytecode.Instructions...),
+		Handlers:     append([]code.Handler(nil), bytecode.Handlers...),
+	}
+
+	var debug *compiler.DebugTable
+	if bytecode.Debug != nil {
+		debug = &compiler.DebugTable{
+			Main:      bytecode.Debug.Main,
+			Functions: make(map[*object.CompiledFunction]*compiler.FunctionDebugInfo, len(bytecode.Debug.Functions)),
+			Globals:   append([]string(nil), bytecode.Debug.Globals...),
+		}
+		for fn, info := range bytecode.Debug.Functions {
+			debug.Functions[fn] = info
+		}
+	}
+
+	return &Program{
+		main:      &object.Closure{Fn: main},
+		constants: append([]object.Object(nil), bytecode.Constants...),
+		debug:     debug,
+	}
+}
+
+/*
+A pool of VMs running the same program, which saves allocating their stacks and globals for each run.
+It is safe for concurrent use.
+*/
+type Pool struct {
+	program *Program
+	config  Config
+	vms     sync.Pool
+}
+
+func NewPool(program *Program, config Config) *Pool {
+	p := &Pool{program: program, config: config}
+	p.vms.New = func() interface{} { return NewFromProgram(p.program, p.config) }
+	return p
+}
+
+// Returns a VM which runs the program from the start, with empty globals.
+func (p *Pool) Get() *VM {
+	return p.vms.Get().(*VM)
+}
+
+// Return the VM after its run. It must not be used afterwards, while the objects it returned stay valid.
+func (p *Pool) Put(vm *VM) {
+	vm.reset()
+	p.vms.Put(vm)
+}
+
+// Clear the state left by a run, keeping the allocated stack, frames and globals.
+func (vm *VM) reset() {
+	for i := 0; i < vm.numGlobals; i++ {
+		vm.globals[i] = nil
+	}
+	vm.numGlobals = 0
+	for i := range vm.stack {
+		vm.stack[i] = nil
+	}
+	vm.sp = 0
+	for i := 1; i < len(vm.frames); i++ {
+		vm.frames[i] = nil
+	}
+	vm.frames[0] = NewFrame(vm.frames[0].cl, 0)
+	vm.framesIndex = 1
+
+	vm.meter = budget.NewMeter(vm.config.MaxInstructions, vm.config.MaxMemory)
+	vm.capabilities = vm.config.vmCapabilities()
+	vm.concurrent = false
+	vm.debugger = nil
+	vm.profiler = nil
+	vm.tracer = nil
+}
@@ -0,0 +1,125 @@
+package vm
+
+import (
+	"io"
+	"math/rand"
+	"monkey/code"
+	"monkey/object"
+	"sync"
+)
+
+/*
+A task runs in a VM of its own, on a goroutine, over the constants and the debug information of the program,
+which are never modified. It gets its own stack, budgets, and a copy of the globals taken when it is spawned,
+so the tasks only share values. These are immutable, except for generators,
+which only the task which created them may resume.
+*/
+
+// Replace the function and the arguments on the top of the stack with a task which calls the function.
+func (vm *VM) executeSpawn(numArgs int) error {
+	callee := vm.stack[vm.sp-1-numArgs]
+	switch callee.(type) {
+	case *object.Closure, *object.Builtin:
+	default:
+		return runtimeError("cannot spawn %s", callee.Type())
+	}
+
+	task := vm.spawn(vm.stack[vm.sp-1-numArgs : vm.sp])
+	vm.sp = vm.sp - numArgs - 1
+	return vm.pushAllocated(task)
+}
+
+// Start a task which calls call[0] with the arguments call[1:].
+func (vm *VM) spawn(call []object.Object) *object.Task {
+	vm.shareCapabilities()
+
+	op := code.OpCall
+	if !code.Fits(op, len(call)-1) {
+		op, _ = code.Wide(op)
+	}
+	main := &object.CompiledFunction{Instructions: code.Make(op, len(call)-1)}
+	program := &Program{main: &object.Closure{Fn: main}, constants: vm.constants, debug: vm.debug}
+
+	taskVM := NewFromProgram(program, vm.config)
+	taskVM.task = object.NewTask()
+	taskVM.globals = append([]object.Object(nil), vm.globals[:vm.numGlobals]...)
+	taskVM.numGlobals = vm.numGlobals
+	taskVM.capabilities = vm.taskCapabilities()
+	taskVM.concurrent = true
+	taskVM.growStack(len(call)) // Cannot fail, since the stack of the spawner holds the call.
+	taskVM.sp = copy(taskVM.stack, call)
+
+	ctx := vm.meter.Context()
+	tasks := taskVM.capabilities.Tasks // Shared with the spawner.
+	tasks.Spawn()
+	go func() {
+		err := taskVM.RunContext(ctx)
+		taskVM.task.Finish(taskVM.result(err))
+		tasks.Exit()
+	}()
+	return taskVM.task
+}
+
+// Returns the result of the task run by the VM, or an *object.Error if it failed with err.
+func (vm *VM) result(err error) object.Object {
+	switch err := err.(type) {
+	case nil:
+		return vm.StackTop()
+	case *UncaughtError:
+		if errObj, ok := err.Value.(*object.Error); ok {
+			return errObj
+		}
+		return &object.Error{Message: err.Error(), Value: err.Value}
+	default:
+		return &object.Error{Message: err.Error()}
+	}
+}
+
+/*
+Make the capabilities safe to share with tasks, before the first one is spawned.
+The writers are locked, since tasks may write to them concurrently.
+*/
+func (vm *VM) shareCapabilities() {
+	if vm.concurrent {
+		return
+	}
+	vm.concurrent = true
+
+	lock := &sync.Mutex{} // Shared by both writers, which are often the same one.
+	if vm.capabilities.Stdout != nil {
+		vm.capabilities.Stdout = &lockedWriter{lock: lock, w: vm.capabilities.Stdout}
+	}
+	if vm.capabilities.Stderr != nil {
+		vm.capabilities.Stderr = &lockedWriter{lock: lock, w: vm.capabilities.Stderr}
+	}
+}
+
+// Returns the capabilities of a new task. It gets a random source of its own, seeded from that of the spawner.
+func (vm *VM) taskCapabilities() *object.Context {
+	capabilities := *vm.capabilities
+	if capabilities.Rand != nil {
+		capabilities.Rand = seededRand(capabilities.Rand)
+	}
+	return &capabilities
+}
+
+// Guards the random sources from which VMs draw their seeds, since VMs of one config may be created concurrently.
+var seedLock sync.Mutex
+
+// Returns a random source of its own, seeded from r.
+func seededRand(r *rand.Rand) *rand.Rand {
+	seedLock.Lock()
+	defer seedLock.Unlock()
+	return rand.New(rand.NewSource(r.Int63()))
+}
+
+type lockedWriter struct {
+	lock *sync.Mutex
+	w    io.Writer
+}
+
+func (w *lockedWriter) Write(p []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.w.Write(p)
+}
@@ -0,0 +1,109 @@
+package vm
+
+import (
+	"fmt"
+	"io"
+	"monkey/code"
+	"monkey/object"
+	"strings"
+)
+
+/*
+Called by a VM before each instruction is executed, at the offset ip in the instructions of the frame.
+The operands and the stack, from the bottom to the top, are only valid during the call and must not be modified.
+Tasks spawned by the program run in VMs of their own, which are not traced.
+*/
+type Tracer interface {
+	Trace(frame *Frame, ip int, op code.Opcode, operands []int, stack []object.Object)
+}
+
+// Trace the following runs of the VM with the tracer. nil stops tracing.
+func (vm *VM) SetTracer(t Tracer) {
+	vm.tracer = t
+}
+
+func (vm *VM) trace(ip int, op code.Opcode) {
+	frame := vm.currentFrame()
+	var operands []int
+	if def, err := code.Lookup(byte(op)); err == nil {
+		operands, _ = code.ReadOperands(def, frame.Instructions()[ip+1:])
+	}
+	vm.tracer.Trace(frame, ip, op, operands, vm.stack[:vm.sp:vm.sp])
+}
+
+/*
+A Tracer writing a line per instruction: the function, the offset, the instruction and the stack.
+The lines are indented by the depth of the calls, like the trace of the parser.
+*/
+type WriterTracer struct {
+	w      io.Writer
+	frames []*Frame // The frames seen so far, which still seem to be on the call stack.
+
+	// Values are abbreviated to this many characters. 0 means no limit.
+	MaxValueLength int
+}
+
+func NewWriterTracer(w io.Writer) *WriterTracer {
+	return &WriterTracer{w: w, MaxValueLength: 40}
+}
+
+func (t *WriterTracer) Trace(frame *Frame, ip int, op code.Opcode, operands []int, stack []object.Object) {
+	t.follow(frame)
+
+	name := frame.cl.Fn.Name
+	if len(t.frames) == 1 {
+		name = "<main>"
+	} else if name == "" {
+		name = "<anonymous>"
+	}
+
+	instruction := fmt.Sprintf("%d", op)
+	if def, err := code.Lookup(byte(op)); err == nil {
+		instruction = def.Name
+	}
+	for _, operand := range operands {
+		instruction += fmt.Sprintf(" %d", operand)
+	}
+
+	values := make([]string, len(stack))
+	for i, value := range stack {
+		values[i] = t.abbreviate(inspect(value))
+	}
+
+	fmt.Fprintf(t.w, "%s%s %04d %-20s [%s]\n",
+		strings.Repeat("\t", len(t.frames)-1), name, ip, instruction, strings.Join(values, ", "))
+}
+
+// Pop the frames which have returned, and push the frame if it has been called since the previous instruction.
+func (t *WriterTracer) follow(frame *Frame) {
+	for i := len(t.frames) - 1; i >= 0; i-- {
+		if t.frames[i] == frame {
+			t.frames = t.frames[:i+1]
+			return
+		}
+	}
+	// The frames of the functions which have returned are above the new one in the stack.
+	for len(t.frames) > 0 && t.frames[len(t.frames)-1].basePointer >= frame.basePointer {
+		t.frames = t.frames[:len(t.frames)-1]
+	}
+	t.frames = append(t.frames, frame)
+}
+
+func (t *WriterTracer) abbreviate(s string) string {
+	if t.MaxValueLength <= 0 {
+		return s
+	}
+	runes := []rune(s)
+	if len(runes) <= t.MaxValueLength {
+		return s
+	}
+	return string(runes[:t.MaxValueLength]) + "..."
+}
+
+// Slots of the stack which are unset, e.g. locals not yet bound, hold nil.
+func inspect(o object.Object) string {
+	if o == nil {
+		return "<nil>"
+	}
+	return o.Inspect()
+}
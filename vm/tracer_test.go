@@ -0,0 +1,124 @@
+package vm
+
+import (
+	"bytes"
+	"monkey/code"
+	"monkey/compiler"
+	"monkey/object"
+	"strings"
+	"testing"
+)
+
+type tracedInstruction struct {
+	fn       string
+	ip       int
+	op       code.Opcode
+	operands []int
+	stack    int
+}
+
+type recordingTracer struct {
+	instructions []tracedInstruction
+}
+
+func (t *recordingTracer) Trace(frame *Frame, ip int, op code.Opcode, operands []int, stack []object.Object) {
+	t.instructions = append(t.instructions, tracedInstruction{
+		fn:       frame.Closure().Fn.Name,
+		ip:       ip,
+		op:       op,
+		operands: append([]int(nil), operands...),
+		stack:    len(stack),
+	})
+}
+
+func newTracedVM(t *testing.T, input string) *VM {
+	t.Helper()
+
+	comp := compiler.New()
+	if err := comp.Compile(parse(input)); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	return New(comp.ByteCode(), DefaultConfig())
+}
+
+func TestTracer(t *testing.T) {
+	vm := newTracedVM(t, "let double = fn(x) { x * 2 }; double(3)")
+	tracer := &recordingTracer{}
+	vm.SetTracer(tracer)
+	if err := vm.Run(); err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+
+	expected := []tracedInstruction{
+		{"", 0, code.OpClosure, []int{1, 0}, 0},
+		{"", 4, code.OpSetGlobal, []int{0}, 1},
+		{"", 7, code.OpGetGlobal, []int{0}, 0},
+		{"", 10, code.OpConstant, []int{2}, 1},
+		{"", 13, code.OpCall, []int{1}, 2},
+		{"double", 0, code.OpGetLocal, []int{0}, 2},
+		{"double", 2, code.OpConstant, []int{0}, 3},
+		{"double", 5, code.OpMul, []int{}, 4},
+		{"double", 6, code.OpReturnValue, []int{}, 3},
+		{"", 15, code.OpPop, []int{}, 1},
+	}
+	if len(tracer.instructions) != len(expected) {
+		t.Fatalf("wrong number of instructions traced. want=%d, got=%d", len(expected), len(tracer.instructions))
+	}
+	for i, want := range expected {
+		got := tracer.instructions[i]
+		if got.fn != want.fn || got.ip != want.ip || got.op != want.op || got.stack != want.stack ||
+			len(got.operands) != len(want.operands) {
+			t.Errorf("instruction %d: want=%+v, got=%+v", i, want, got)
+			continue
+		}
+		for j := range want.operands {
+			if got.operands[j] != want.operands[j] {
+				t.Errorf("instruction %d: want=%+v, got=%+v", i, want, got)
+			}
+		}
+	}
+
+	vm.SetTracer(nil)
+	tracer.instructions = nil
+	if err := vm.Run(); err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+	if len(tracer.instructions) != 0 {
+		t.Errorf("the VM is still traced after SetTracer(nil)")
+	}
+}
+
+func TestWriterTracer(t *testing.T) {
+	vm := newTracedVM(t, `let f = fn(x) { x };
+let g = fn() { f(1) };
+g();
+f("a long string which is abbreviated in the trace")`)
+	var out bytes.Buffer
+	vm.SetTracer(NewWriterTracer(&out))
+	if err := vm.Run(); err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	expected := []string{
+		"<main> 0000 OpClosure 0 0",
+		"\tg 0000 OpGetGlobal 0",
+		"\t\tf 0000 OpGetLocal 0",
+		"\tg 0008 OpReturnValue",
+		"<main> 0019 OpPop",
+		// f is called from the main program this time, so it is not nested in g.
+		"\tf 0000 OpGetLocal 0",
+	}
+	i := 0
+	for _, line := range lines {
+		if i < len(expected) && strings.HasPrefix(line, expected[i]) {
+			i++
+		}
+	}
+	if i != len(expected) {
+		t.Errorf("the trace does not contain %q:\n%s", expected[i], out.String())
+	}
+	if !strings.Contains(out.String(), `a long string which is abbreviated in th...`) {
+		t.Errorf("the long string is not abbreviated:\n%s", out.String())
+	}
+}
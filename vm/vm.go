@@ -1,7 +1,9 @@
 package vm
 
 import (
+	"context"
 	"fmt"
+	"monkey/budget"
 	"monkey/code"
 	"monkey/compiler"
 	"monkey/object"
@@ -11,44 +13,76 @@ const StackSize = 2048
 const GlobalsSize = 65536
 const MaxFrames = 1024
 
-var True = &object.Boolean{Value: true}
-var False = &object.Boolean{Value: false}
-var Null = &object.Null{}
+// Singletons shared by all VMs, which never modify them.
+var True = object.TRUE
+var False = object.FALSE
+var Null = object.NULL
 
-func New(bytecode *compiler.Bytecode) *VM {
-	mainFn := &object.CompiledFunction{Instructions: bytecode.Instructions}
-	mainClosure := &object.Closure{Fn: mainFn}
-	mainFrame := NewFrame(mainClosure, 0)
+// Create a VM which runs the bytecode. Use a Program instead to run the same bytecode many times.
+func New(bytecode *compiler.Bytecode, config Config) *VM {
+	return NewFromProgram(NewProgram(bytecode), config)
+}
+
+// Create a VM which runs the program, with globals of its own.
+func NewFromProgram(program *Program, config Config) *VM {
+	config = config.normalize()
 
-	frames := make([]*Frame, MaxFrames)
-	frames[0] = mainFrame
+	frames := make([]*Frame, config.initialFrames())
+	frames[0] = NewFrame(program.main, 0)
 
 	return &VM{
-		constants:   bytecode.Constants,
-		globals:     make([]object.Object, GlobalsSize),
-		stack:       make([]object.Object, StackSize),
-		sp:          0,
-		frames:      frames,
-		framesIndex: 1,
+		config:       config,
+		capabilities: config.vmCapabilities(),
+		debug:        program.debug,
+		constants:    program.constants,
+		globals:      make([]object.Object, config.GlobalsSize),
+		stack:        make([]object.Object, config.initialStackSize()),
+		sp:           0,
+		frames:       frames,
+		framesIndex:  1,
+		meter:        budget.NewMeter(config.MaxInstructions, config.MaxMemory),
 	}
 }
 
-// Used for REPL
-func NewWithGlobalsStore(bytecode *compiler.Bytecode, s []object.Object) *VM {
-	vm := New(bytecode)
+/*
+Create a VM which runs the bytecode with the given globals store, which keeps the bindings between runs, as in the REPL.
+The store is modified by the run, so VMs sharing it must not run at the same time.
+*/
+func NewWithGlobalsStore(bytecode *compiler.Bytecode, s []object.Object, config Config) *VM {
+	vm := New(bytecode, config)
 	vm.globals = s
+	for i := len(s) - 1; i >= 0; i-- {
+		if s[i] != nil {
+			vm.numGlobals = i + 1
+			break
+		}
+	}
 	return vm
 }
 
 type VM struct {
-	constants []object.Object
-	globals   []object.Object
+	config       Config
+	debug        *compiler.DebugTable // nil when the bytecode has no debug information.
+	capabilities *object.Context      // Given to the builtins.
+
+	constants  []object.Object
+	globals    []object.Object
+	numGlobals int // Number of globals up to the last one set, which are copied for a task.
 
 	stack []object.Object
 	sp    int // Always point to the next value. Top of stack is stack[sp-1]
 
 	frames      []*Frame
 	framesIndex int
+
+	meter *budget.Meter
+
+	debugger *Debugger // Checked before each instruction. nil unless the VM is being debugged.
+	profiler *Profiler // Counts each instruction. nil unless the VM is being profiled.
+	tracer   Tracer    // Called before each instruction. nil unless the VM is being traced.
+
+	task       *object.Task // The task run by the VM. nil for the program itself.
+	concurrent bool         // Whether the capabilities are shared with tasks.
 }
 
 func (vm *VM) StackTop() object.Object {
@@ -64,21 +98,73 @@ func (vm *VM) LastPoppedStackElem() object.Object {
 }
 
 func (vm *VM) Run() error {
+	return vm.RunContext(context.Background())
+}
+
+/*
+Run the bytecode until it finishes, ctx is done, or a budget in the Config is used up.
+Each case is reported with a distinct error type of the budget package.
+*/
+func (vm *VM) RunContext(ctx context.Context) error {
+	vm.meter.SetContext(ctx)
+	vm.capabilities.Done = ctx.Done()
+	if vm.profiler != nil {
+		defer vm.profiler.stop()
+	}
+
+	for {
+		err := vm.run()
+		t, ok := err.(*thrown)
+		if !ok {
+			if err != nil && err != errPaused {
+				vm.closeGenerators(0)
+			}
+			return err
+		}
+		caught, err := vm.unwind(t.value)
+		if err != nil {
+			return err
+		}
+		if !caught {
+			uncaught := &UncaughtError{Value: t.value, Traceback: vm.traceback()}
+			uncaught.File, uncaught.Line = vm.location()
+			vm.closeGenerators(0)
+			return uncaught
+		}
+	}
+}
+
+// Run the instructions until the program finishes or an error, including a thrown exception, stops it.
+func (vm *VM) run() error {
 	var ip int
 	var ins code.Instructions
 	var op code.Opcode
 
 	for vm.currentFrame().ip < len(vm.currentFrame().Instructions())-1 {
+		if vm.debugger != nil && vm.debugger.shouldPause() {
+			return errPaused
+		}
+
 		vm.currentFrame().ip++
 
+		err := vm.meter.Step()
+		if err != nil {
+			return err
+		}
+
 		ip = vm.currentFrame().ip
 		ins = vm.currentFrame().Instructions()
 		op = code.Opcode(ins[ip])
+		if vm.profiler != nil {
+			vm.profiler.step(op)
+		}
+		if vm.tracer != nil {
+			vm.trace(ip, op)
+		}
 
 		switch op {
-		case code.OpConstant:
-			constIndex := code.ReadUint16(ins[ip+1:])
-			vm.currentFrame().ip += 2
+		case code.OpConstant, code.OpConstantWide:
+			constIndex := vm.readOperand(op)
 
 			err := vm.push(vm.constants[constIndex])
 			if err != nil {
@@ -116,12 +202,11 @@ func (vm *VM) Run() error {
 			}
 		case code.OpPop:
 			vm.pop()
-		case code.OpJump:
-			pos := int(code.ReadUint16(ins[ip+1:]))
+		case code.OpJump, code.OpJumpWide:
+			pos := vm.readOperand(op)
 			vm.currentFrame().ip = pos - 1
-		case code.OpJumpNotTruthy:
-			pos := int(code.ReadUint16(ins[ip+1:]))
-			vm.currentFrame().ip += 2
+		case code.OpJumpNotTruthy, code.OpJumpNotTruthyWide:
+			pos := vm.readOperand(op)
 
 			condition := vm.pop()
 			if !isTruthy(condition) {
@@ -132,59 +217,61 @@ func (vm *VM) Run() error {
 			if err != nil {
 				return err
 			}
-		case code.OpSetGlobal:
-			globalIndex := code.ReadUint16(ins[ip+1:])
-			vm.currentFrame().ip += 2
+		case code.OpSetGlobal, code.OpSetGlobalWide:
+			globalIndex := vm.readOperand(op)
+			if globalIndex >= len(vm.globals) {
+				return fmt.Errorf("too many globals: index %d exceeds globals size %d", globalIndex, len(vm.globals))
+			}
 			vm.globals[globalIndex] = vm.pop()
-		case code.OpGetGlobal:
-			globalIndex := code.ReadUint16(ins[ip+1:])
-			vm.currentFrame().ip += 2
+			if globalIndex >= vm.numGlobals {
+				vm.numGlobals = globalIndex + 1
+			}
+		case code.OpGetGlobal, code.OpGetGlobalWide:
+			globalIndex := vm.readOperand(op)
+			if globalIndex >= len(vm.globals) {
+				return fmt.Errorf("too many globals: index %d exceeds globals size %d", globalIndex, len(vm.globals))
+			}
 			err := vm.push(vm.globals[globalIndex])
 			if err != nil {
 				return err
 			}
-		case code.OpSetLocal:
-			localIndex := code.ReadUint8(ins[ip+1:])
-			vm.currentFrame().ip += 1
+		case code.OpSetLocal, code.OpSetLocalWide:
+			localIndex := vm.readOperand(op)
 			frame := vm.currentFrame()
-			vm.stack[frame.basePointer+int(localIndex)] = vm.pop()
-		case code.OpGetLocal:
-			localIndex := code.ReadUint8(ins[ip+1:])
-			vm.currentFrame().ip += 1
+			vm.stack[frame.basePointer+localIndex] = vm.pop()
+		case code.OpGetLocal, code.OpGetLocalWide:
+			localIndex := vm.readOperand(op)
 			frame := vm.currentFrame()
-			err := vm.push(vm.stack[frame.basePointer+int(localIndex)])
+			err := vm.push(vm.stack[frame.basePointer+localIndex])
 			if err != nil {
 				return err
 			}
-		case code.OpGetFree:
-			freeIndex := code.ReadUint8(ins[ip+1:])
-			vm.currentFrame().ip += 1
+		case code.OpGetFree, code.OpGetFreeWide:
+			freeIndex := vm.readOperand(op)
 
 			currentClosure := vm.currentFrame().cl
 			err := vm.push(currentClosure.Free[freeIndex])
 			if err != nil {
 				return err
 			}
-		case code.OpArray:
-			numElements := int(code.ReadUint16(ins[ip+1:]))
-			vm.currentFrame().ip += 2
+		case code.OpArray, code.OpArrayWide:
+			numElements := vm.readOperand(op)
 
 			array := vm.buildArray(vm.sp-numElements, vm.sp)
 			vm.sp = vm.sp - numElements
-			err := vm.push(array)
+			err := vm.pushAllocated(array)
 			if err != nil {
 				return err
 			}
-		case code.OpHash:
-			numElements := int(code.ReadUint16(ins[ip+1:]))
-			vm.currentFrame().ip += 2
+		case code.OpHash, code.OpHashWide:
+			numElements := vm.readOperand(op)
 
 			hash, err := vm.buildHash(vm.sp-numElements, vm.sp)
 			if err != nil {
 				return err
 			}
 			vm.sp = vm.sp - numElements
-			err = vm.push(hash)
+			err = vm.pushAllocated(hash)
 			if err != nil {
 				return err
 			}
@@ -195,17 +282,24 @@ func (vm *VM) Run() error {
 			if err != nil {
 				return err
 			}
-		case code.OpCall:
-			numArgs := code.ReadUint8(ins[ip+1:])
-			vm.currentFrame().ip += 1
+		case code.OpCall, code.OpCallWide:
+			numArgs := vm.readOperand(op)
 
-			err := vm.executeCall(int(numArgs))
+			err := vm.executeCall(numArgs)
 			if err != nil {
 				return err
 			}
 		case code.OpReturnValue:
 			returnValue := vm.pop()
 			frame := vm.popFrame() // go back to the caller of the current function
+			if frame.generator != nil {
+				// The return value of a generator is discarded.
+				err := vm.finishGenerator(frame)
+				if err != nil {
+					return err
+				}
+				continue
+			}
 			vm.sp = frame.basePointer - 1
 			err := vm.push(returnValue)
 			if err != nil {
@@ -213,14 +307,20 @@ func (vm *VM) Run() error {
 			}
 		case code.OpReturn:
 			frame := vm.popFrame()
+			if frame.generator != nil {
+				err := vm.finishGenerator(frame)
+				if err != nil {
+					return err
+				}
+				continue
+			}
 			vm.sp = frame.basePointer - 1
 			err := vm.push(Null)
 			if err != nil {
 				return err
 			}
-		case code.OpGetBuiltin:
-			builtinIndex := code.ReadUint8(ins[ip+1:])
-			vm.currentFrame().ip += 1
+		case code.OpGetBuiltin, code.OpGetBuiltinWide:
+			builtinIndex := vm.readOperand(op)
 
 			definition := object.Builtins[builtinIndex]
 
@@ -233,6 +333,15 @@ func (vm *VM) Run() error {
 			numFree := code.ReadUint8(ins[ip+3:])
 			vm.currentFrame().ip += 3
 
+			err := vm.pushClosure(int(constIndex), int(numFree))
+			if err != nil {
+				return err
+			}
+		case code.OpClosureWide:
+			constIndex := code.ReadUint32(ins[ip+1:])
+			numFree := code.ReadUint16(ins[ip+5:])
+			vm.currentFrame().ip += 6
+
 			err := vm.pushClosure(int(constIndex), int(numFree))
 			if err != nil {
 				return err
@@ -243,11 +352,74 @@ func (vm *VM) Run() error {
 			if err != nil {
 				return err
 			}
+		case code.OpThrow:
+			return &thrown{value: vm.pop()}
+		case code.OpYield:
+			if vm.currentFrame().generator == nil {
+				return fmt.Errorf("yield outside of a generator")
+			}
+			err := vm.yield(vm.pop())
+			if err != nil {
+				return err
+			}
+		case code.OpIter:
+			err := vm.executeIter()
+			if err != nil {
+				return err
+			}
+		case code.OpIterNext, code.OpIterNextWide:
+			loopEnd := vm.readOperand(op)
+
+			err := vm.executeIterNext(loopEnd)
+			if err != nil {
+				return err
+			}
+		case code.OpSpawn, code.OpSpawnWide:
+			numArgs := vm.readOperand(op)
+
+			err := vm.executeSpawn(numArgs)
+			if err != nil {
+				return err
+			}
 		}
 	}
 	return nil
 }
 
+/*
+Unwind the frames to the innermost handler covering the instruction being executed, and push the exception for it.
+Returns false, leaving the frames as they are, when no handler covers the instruction.
+*/
+func (vm *VM) unwind(exception object.Object) (bool, error) {
+	for i := vm.framesIndex - 1; i >= 0; i-- {
+		frame := vm.frames[i]
+		for _, h := range frame.cl.Fn.Handlers {
+			// The ip of a frame is within the instruction being executed, which is a call for the callers.
+			if frame.ip < h.Start || frame.ip >= h.End {
+				continue
+			}
+			vm.closeGenerators(i + 1)
+			vm.framesIndex = i + 1
+			vm.sp = frame.basePointer + frame.cl.Fn.NumLocals + h.Depth
+			frame.ip = h.Target - 1
+			return true, vm.push(exception)
+		}
+	}
+	return false, nil
+}
+
+/*
+Read the first operand of the current instruction, and advance ip over it.
+The width is taken from the definition, so narrow and wide variants of an opcode can share the code.
+*/
+func (vm *VM) readOperand(op code.Opcode) int {
+	frame := vm.currentFrame()
+	width := code.FirstOperandWidth(op)
+	operand := code.ReadOperand(frame.Instructions()[frame.ip+1:], width)
+	frame.ip += width
+	return operand
+}
+
 func (vm *VM) pop() object.Object {
 	o := vm.stack[vm.sp-1]
 	vm.sp--
@@ -255,8 +427,11 @@ func (vm *VM) pop() object.Object {
 }
 
 func (vm *VM) push(o object.Object) error {
-	if vm.sp >= StackSize {
-		return fmt.Errorf("stack overflow")
+	if vm.sp >= len(vm.stack) {
+		err := vm.growStack(vm.sp + 1)
+		if err != nil {
+			return err
+		}
 	}
 
 	vm.stack[vm.sp] = o
@@ -264,6 +439,49 @@ func (vm *VM) push(o object.Object) error {
 	return nil
 }
 
+// Push an object which has just been created, counting it against the memory budget.
+func (vm *VM) pushAllocated(o object.Object) error {
+	size := budget.SizeOf(o)
+	err := vm.meter.Allocate(size)
+	if err != nil {
+		return err
+	}
+	if vm.profiler != nil {
+		vm.profiler.allocate(size)
+	}
+	return vm.push(o)
+}
+
+/*
+Make sure that the stack has at least `size` slots.
+The stack is reallocated only when Config.GrowableStack is true.
+Running out of stack inside function calls is reported as a recursion too deep, with its traceback.
+*/
+func (vm *VM) growStack(size int) error {
+	if size <= len(vm.stack) {
+		return nil
+	}
+	if size > vm.config.StackSize {
+		if vm.framesIndex > 1 {
+			return &RecursionError{MaxFrames: vm.config.MaxFrames, StackSize: vm.config.StackSize, Traceback: vm.traceback()}
+		}
+		return fmt.Errorf("stack overflow")
+	}
+
+	newSize := len(vm.stack) * 2
+	for newSize < size {
+		newSize *= 2
+	}
+	if newSize > vm.config.StackSize {
+		newSize = vm.config.StackSize
+	}
+
+	stack := make([]object.Object, newSize)
+	copy(stack, vm.stack)
+	vm.stack = stack
+	return nil
+}
+
 func (vm *VM) executeBinaryOperation(op code.Opcode) error {
 	right := vm.pop()
 	left := vm.pop()
@@ -278,7 +496,7 @@ func (vm *VM) executeBinaryOperation(op code.Opcode) error {
 		return vm.executeBinaryStringOperation(op, left, right)
 	}
 
-	return fmt.Errorf(
+	return runtimeError(
 		"unsupported types for binary operation: %s %s",
 		leftType, rightType,
 	)
@@ -301,12 +519,15 @@ func (vm *VM) executeBinaryIntegerOperation(
 	case code.OpMul:
 		result = leftVal * rightVal
 	case code.OpDiv:
+		if rightVal == 0 {
+			return runtimeError("division by zero")
+		}
 		result = leftVal / rightVal
 	default:
 		return fmt.Errorf("unknown integer operator: %d", op)
 	}
 
-	return vm.push(&object.Integer{Value: result})
+	return vm.pushAllocated(&object.Integer{Value: result})
 }
 
 func (vm *VM) executeBinaryStringOperation(
@@ -325,7 +546,7 @@ func (vm *VM) executeBinaryStringOperation(
 		return fmt.Errorf("unknown string operator: %d", op)
 	}
 
-	return vm.push(&object.String{Value: result})
+	return vm.pushAllocated(&object.String{Value: result})
 }
 
 func (vm *VM) executeComparison(op code.Opcode) error {
@@ -342,7 +563,7 @@ func (vm *VM) executeComparison(op code.Opcode) error {
 	case code.OpNotEqual:
 		return vm.push(nativeBoolToBooleanObject(left != right))
 	default:
-		return fmt.Errorf(
+		return runtimeError(
 			"unknown operator: %d, (%s %s)",
 			op, left, right,
 		)
@@ -392,14 +613,13 @@ func (vm *VM) executeBangOperator() error {
 func (vm *VM) executeMinusOperator() error {
 	operand := vm.pop()
 	if operand.Type() != object.INTEGER_OBJ {
-		return fmt.Errorf(
+		return runtimeError(
 			"unsupported type for negation: %s",
 			operand.Type(),
 		)
 	}
 	value := operand.(*object.Integer).Value
-	vm.push(&object.Integer{Value: -value})
-	return nil
+	return vm.pushAllocated(&object.Integer{Value: -value})
 }
 
 func isTruthy(obj object.Object) bool {
@@ -431,7 +651,7 @@ func (vm *VM) buildHash(startIndex, endIndex int) (object.Object, error) {
 
 		hashableKey, ok := key.(object.Hashable)
 		if !ok {
-			return nil, fmt.Errorf("unusable as a hash key: %s", key.Type())
+			return nil, runtimeError("unusable as a hash key: %s", key.Type())
 		}
 
 		hashedPairs[hashableKey.HashKey()] = pair
@@ -446,7 +666,7 @@ func (vm *VM) executeIndexExpression(left, index object.Object) error {
 	case left.Type() == object.HASH_OBJ:
 		return vm.executeHashIndex(left, index)
 	default:
-		return fmt.Errorf("index operator not supported: %s", left.Type())
+		return runtimeError("index operator not supported: %s", left.Type())
 	}
 }
 
@@ -458,7 +678,6 @@ func (vm *VM) executeArrayIndex(array, index object.Object) error {
 	if i < 0 || max < i {
 		return vm.push(Null)
 	}
-	fmt.Print(arrayObject.Elements[i])
 	return vm.push(arrayObject.Elements[i])
 }
 
@@ -466,7 +685,7 @@ func (vm *VM) executeHashIndex(hash, key object.Object) error {
 	hashObject := hash.(*object.Hash)
 	hashableKey, ok := key.(object.Hashable)
 	if !ok {
-		return fmt.Errorf("unusable as a hash key: %T", key)
+		return runtimeError("unusable as a hash key: %T", key)
 	}
 	pair, ok := hashObject.Pairs[hashableKey.HashKey()]
 	if !ok {
@@ -481,34 +700,70 @@ func (vm *VM) executeCall(numArgs int) error {
 	case *object.Closure:
 		return vm.callClosure(callee, numArgs)
 	case *object.Builtin:
+		if callee == nextBuiltin && numArgs == 1 {
+			if gen, ok := vm.stack[vm.sp-1].(*object.Generator); ok {
+				resumable, err := vm.resumable(gen)
+				if err != nil {
+					return err
+				}
+				if resumable {
+					vm.sp = vm.sp - numArgs - 1
+					return vm.resume(gen, -1)
+				}
+			}
+		}
 		return vm.callBuiltin(callee, numArgs)
 	default:
-		return fmt.Errorf("calling non-function")
+		return runtimeError("calling non-function")
 	}
 }
 
 func (vm *VM) callClosure(cl *object.Closure, numArgs int) error {
 	if cl.Fn.NumParameters != numArgs {
-		return fmt.Errorf("wrong number of arguments: want=%d, got=%d", cl.Fn.NumParameters, numArgs)
+		return runtimeError("wrong number of arguments: want=%d, got=%d", cl.Fn.NumParameters, numArgs)
+	}
+	if cl.Fn.Generator {
+		return vm.createGenerator(cl, numArgs)
 	}
 
 	frame := NewFrame(cl, vm.sp-numArgs)
-	vm.pushFrame(frame)
+	err := vm.pushFrame(frame)
+	if err != nil {
+		return err
+	}
+
+	// Reserve slots for the local bindings.
+	err = vm.growStack(frame.basePointer + cl.Fn.NumLocals)
+	if err != nil {
+		return err
+	}
+	// Clear values left by previous calls, so that unset bindings are distinguishable (e.g. in a debugger).
+	for i := frame.basePointer + numArgs; i < frame.basePointer+cl.Fn.NumLocals; i++ {
+		vm.stack[i] = nil
+	}
 	vm.sp = frame.basePointer + cl.Fn.NumLocals
 	return nil
 }
 
 func (vm *VM) callBuiltin(builtin *object.Builtin, numArgs int) error {
 	args := vm.stack[vm.sp-numArgs : vm.sp]
-	result := builtin.Fn(args...)
+	result := builtin.Fn(vm.capabilities, args...)
 	vm.sp = vm.sp - numArgs - 1
 
+	if errObj, ok := result.(*object.Error); ok {
+		// A builtin which blocks, such as `recv`, returns an error when the execution is canceled.
+		if err := vm.meter.Canceled(); err != nil {
+			return err
+		}
+		if errObj.Value != nil { // `wait` for a task which threw a value other than an error.
+			return &thrown{value: errObj.Value}
+		}
+		return &thrown{value: errObj}
+	}
 	if result != nil {
-		vm.push(result)
-	} else {
-		vm.push(Null)
+		return vm.pushAllocated(result)
 	}
-	return nil
+	return vm.push(Null)
 }
 
 func (vm *VM) pushClosure(constIndex int, numFree int) error {
@@ -528,16 +783,31 @@ func (vm *VM) pushClosure(constIndex int, numFree int) error {
 		Fn:   function,
 		Free: free,
 	}
-	return vm.push(closure)
+	return vm.pushAllocated(closure)
 }
 
 func (vm *VM) currentFrame() *Frame {
 	return vm.frames[vm.framesIndex-1]
 }
 
-func (vm *VM) pushFrame(f *Frame) {
+func (vm *VM) pushFrame(f *Frame) error {
+	if vm.framesIndex >= len(vm.frames) {
+		if vm.framesIndex >= vm.config.MaxFrames {
+			return &RecursionError{MaxFrames: vm.config.MaxFrames, Traceback: vm.traceback()}
+		}
+
+		newSize := len(vm.frames) * 2
+		if newSize > vm.config.MaxFrames {
+			newSize = vm.config.MaxFrames
+		}
+		frames := make([]*Frame, newSize)
+		copy(frames, vm.frames)
+		vm.frames = frames
+	}
+
 	vm.frames[vm.framesIndex] = f
 	vm.framesIndex++
+	return nil
 }
 
 /*
@@ -1,13 +1,24 @@
 package vm
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"math/rand"
 	"monkey/ast"
+	"monkey/budget"
 	"monkey/compiler"
 	"monkey/lexer"
 	"monkey/object"
 	"monkey/parser"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 type vmTestCase struct {
@@ -326,7 +337,7 @@ func TestCallingFunctionsWithWrongNumberOfArguments(t *testing.T) {
 			t.Fatalf("compiler error: %s", err)
 		}
 
-		vm := New(comp.ByteCode())
+		vm := New(comp.ByteCode(), DefaultConfig())
 		err = vm.Run()
 
 		if err == nil {
@@ -353,6 +364,27 @@ func TestFirstClassFunctions(t *testing.T) {
 	runVmTests(t, tests)
 }
 
+func TestCapabilities(t *testing.T) {
+	var out bytes.Buffer
+	comp := compiler.New()
+	if err := comp.Compile(parse(`puts("sandboxed"); try { readFile("secret.txt") } catch (e) { e }`)); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	vm := New(comp.ByteCode(), Config{Capabilities: &object.Context{Stdout: &out}})
+	if err := vm.Run(); err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+
+	errObj, ok := vm.LastPoppedStackElem().(*object.Error)
+	if !ok || errObj.Message != "`readFile` is not permitted: no filesystem" {
+		t.Errorf("readFile is not denied. got=%+v", vm.LastPoppedStackElem())
+	}
+	if out.String() != "sandboxed\n" {
+		t.Errorf("puts does not write to the given stdout. got=%q", out.String())
+	}
+}
+
+// Errors of builtins are thrown, so the failing cases catch them.
 func TestBuiltinFunctions(t *testing.T) {
 	tests := []vmTestCase{
 		// len
@@ -360,7 +392,7 @@ func TestBuiltinFunctions(t *testing.T) {
 		{`len("four")`, 4},
 		{`len("hello world")`, 11},
 		{
-			`len(1)`,
+			`try { len(1) } catch (e) { e }`,
 			&object.Error{Message: "argument to `len` not supported, got=INTEGER"},
 		},
 		{`len([1,2,3])`, 3},
@@ -370,21 +402,275 @@ func TestBuiltinFunctions(t *testing.T) {
 		// first
 		{`first([1,2,3])`, 1},
 		{`first([])`, Null},
-		{`first(1)`, &object.Error{Message: "argument to `first` must be ARRAY, got: INTEGER"}},
+		{`try { first(1) } catch (e) { e }`, &object.Error{Message: "argument to `first` must be ARRAY, got: INTEGER"}},
 		// last
 		{`last([1,2,3])`, 3},
 		{`last([])`, Null},
-		{`last(1)`, &object.Error{Message: "argument to `last` must be ARRAY, got: INTEGER"}},
+		{`try { last(1) } catch (e) { e }`, &object.Error{Message: "argument to `last` must be ARRAY, got: INTEGER"}},
 		// rest
 		{`rest([1,2,3])`, []int{2, 3}}, // これ
 		{`rest([])`, Null},
 		// push
 		{`push([], 1)`, []int{1}},
-		{`push(1,1)`, &object.Error{Message: "argument to `push` must be ARRAY, got=INTEGER"}},
+		{`try { push(1,1) } catch (e) { e }`, &object.Error{Message: "argument to `push` must be ARRAY, got=INTEGER"}},
+	}
+	runVmTests(t, tests)
+}
+
+func TestTryExpressions(t *testing.T) {
+	tests := []vmTestCase{
+		{`try { throw 1; 2 } catch (e) { e + 10 }`, 11},
+		{`try { 5 } catch (e) { 10 }`, 5},
+		{`try { } catch (e) { 1 }`, Null},
+		{`let f = fn() { throw "boom" }; try { f() } catch (e) { e }`, "boom"},
+		{`try { 1 + true } catch (e) { e }`, &object.Error{Message: "unsupported types for binary operation: INTEGER BOOLEAN"}},
+		{`try { fn(a) { a }() } catch (e) { e }`, &object.Error{Message: "wrong number of arguments: want=1, got=0"}},
+		{`try { 1 / 0 } catch (e) { e }`, &object.Error{Message: "division by zero"}},
+		{`let x = try { len(1) } catch (err) { err }; 5`, 5},
+		{`let f = fn(e) { 7 }; f(try { 1 / 0 } catch (e) { e })`, 7},
+		// The stack is restored to the depth at the start of the try.
+		{`let f = fn() { throw 2 }; 1 + try { 2 + f() } catch (e) { 10 }`, 11},
+		{`let f = fn() { throw 2 }; [1, try { [2, f()] } catch (e) { 3 }, 4]`, []int{1, 3, 4}},
+		{`try { try { throw 1 } catch (e) { throw e + 1 } } catch (e) { e * 10 }`, 20},
+		{`try { try { throw 1 } finally { 2 } } catch (e) { e }`, 1},
+		{`try { try { throw 1 } finally { throw 2 } } catch (e) { e }`, 2},
+		{`try { try { 1 } finally { throw 3 } } catch (e) { e }`, 3},
+		{`try { try { throw 1 } catch (e) { 5 } finally { throw 4 } } catch (e) { e }`, 4},
+		{`try { try { throw 1 } catch (e) { 5 } finally { 6 } } catch (e) { e }`, 5},
+		{`let f = fn() { try { return 1 } finally { 2 } }; f()`, 1},
+		{`let f = fn() { try { return 1 } finally { throw 2 } }; try { f() } catch (e) { e }`, 2},
+		// The finally block run by a return is not covered by the catch of its own try.
+		{`let f = fn() { try { return 1 } catch (e) { 100 } finally { throw 2 } }; try { f() } catch (e) { e }`, 2},
+		{`fn() { try { return 1; } finally { return 2; } }()`, 2},
+		{`fn() { try { throw 1 } catch (e) { return e + 1 } finally { 0 } }()`, 2},
+		{`let f = fn() { try { throw 5 } catch (e) { fn() { e } } }; f()()`, 5},
+		{`let g = fn(x) { let y = x * 2; throw y }; let f = fn() { let a = 1; a + try { g(5) } catch (e) { e } }; f()`, 11},
+		{`let f = fn(n) { if (n == 0) { throw "done" } f(n - 1) }; try { f(50) } catch (e) { e }`, "done"},
+	}
+	runVmTests(t, tests)
+}
+
+func TestUncaughtExceptions(t *testing.T) {
+	tests := []struct {
+		input     string
+		expected  string
+		traceback []string
+		line      int
+	}{
+		{`throw 5; 6`, "uncaught exception: 5", []string{"<main> (line 1)"}, 1},
+		{
+			"let f = fn() {\n throw [1, \"a\"]\n};\nf()",
+			"uncaught exception: [1, a]",
+			[]string{"<main> (line 4)", "f (line 2)"},
+			2,
+		},
+		{`try { throw 1 } catch (e) { len(e) }`, "argument to `len` not supported, got=INTEGER", []string{"<main> (line 1)"}, 1},
+		{`try { throw 1 } finally { 2 }`, "uncaught exception: 1", []string{"<main> (line 1)"}, 1},
+		{
+			"let g = fn() {\n yield 1;\n throw 2\n};\nlet it = g();\nnext(it);\nnext(it)",
+			"uncaught exception: 2",
+			[]string{"<main> (line 7)", "g (line 3)"},
+			3,
+		},
+	}
+
+	for _, tt := range tests {
+		comp := compiler.New()
+		if err := comp.Compile(parse(tt.input)); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+		err := New(comp.ByteCode(), DefaultConfig()).Run()
+		uncaught, ok := err.(*UncaughtError)
+		if !ok {
+			t.Errorf("error is not *UncaughtError for %q. got=%T (%v)", tt.input, err, err)
+			continue
+		}
+		if uncaught.Error() != tt.expected {
+			t.Errorf("wrong error. want=%q, got=%q", tt.expected, uncaught.Error())
+		}
+		if !reflect.DeepEqual(uncaught.Traceback, tt.traceback) {
+			t.Errorf("wrong traceback. want=%q, got=%q", tt.traceback, uncaught.Traceback)
+		}
+		if uncaught.File != "" || uncaught.Line != tt.line {
+			t.Errorf("wrong location. want=line %d, got=%q line %d", tt.line, uncaught.File, uncaught.Line)
+		}
+	}
+}
+
+func TestGenerators(t *testing.T) {
+	prelude := `
+	let collect = fn(gen, acc) { let x = next(gen); if (x) { collect(gen, push(acc, x)) } else { acc } };
+	let range = fn(from, to) { if (from < to) { yield from; for (x in range(from + 1, to)) { yield x; } } };
+	`
+	tests := []vmTestCase{
+		{`let g = fn() { yield 1; yield 2; }; let it = g(); let a = next(it); [a, next(it)]`, []int{1, 2}},
+		{`let g = fn() { yield 1; }; let it = g(); next(it); next(it); next(it)`, Null},
+		// The function runs lazily, up to the next yield.
+		{`let g = fn() { yield 1; throw "unreachable"; }; next(g())`, 1},
+		{`let g = fn(a, b) { let c = a * b; yield c; yield c + a; }; let it = g(2, 3); let x = next(it); [x, next(it)]`, []int{6, 8}},
+		{`let g = fn(a) { let f = fn(x) { x + a }; yield f(1); yield f(2); }; collect(g(10), [])`, []int{11, 12}},
+		{`collect(range(0, 5), [])`, []int{0, 1, 2, 3, 4}},
+		{`let double = fn(gen) { for (x in gen) { yield x * 2; } }; collect(double(range(0, 4)), [])`, []int{0, 2, 4, 6}},
+		{`let g = fn(xs) { for (x in xs) { yield x * 10; } }; collect(g([1, 2, 3]), [])`, []int{10, 20, 30}},
+		{`let g = fn() { yield 1; return 5; yield 2; }; collect(g(), [])`, []int{1}},
+		// The operands below a yield are kept while the generator is suspended.
+		{`let g = fn() { let a = 10 + if (true) { yield 1; 2 }; yield a; }; collect(g(), [])`, []int{1, 12}},
+		{`let g = fn() { let a = [5, try { yield 1; 2 } finally { 3 }]; yield a[0] + a[1]; }; collect(g(), [])`, []int{1, 7}},
+		{`let g = fn() { yield [1, 2][0]; yield 10 + try { throw 2 } catch (e) { e }; }; collect(g(), [])`, []int{1, 12}},
+		{`let g = fn() { try { yield 1; throw 2; } catch (e) { yield e * 10; } }; collect(g(), [])`, []int{1, 20}},
+		{`let g = fn() { yield 1; throw "boom"; }; let it = g(); next(it); try { next(it) } catch (e) { e }`, "boom"},
+		{`let g = fn() { yield 1; throw "boom"; }; let it = g(); next(it); try { next(it) } catch (e) { 0 }; next(it)`, Null},
+		{`try { next(1) } catch (e) { e }`, &object.Error{Message: "argument to `next` must be GENERATOR, got=INTEGER"}},
+		// for-in loops over arrays.
+		{`let find = fn(xs, y) { for (x in xs) { if (x == y) { return true; } }; false }; find([1, 2, 3], 2)`, true},
+		{`let find = fn(xs, y) { for (x in xs) { if (x == y) { return true; } }; false }; find([1, 2, 3], 5)`, false},
+		{`let first = fn(gen) { for (x in gen) { return x; } }; first(range(3, 10))`, 3},
+		{`for (x in []) { throw "unreachable"; }; 5`, 5},
+		{`1 + fn() { for (x in [1, 2]) { x; }; 2 }()`, 3},
+		{`try { for (x in 5) { } } catch (e) { e }`, &object.Error{Message: "cannot iterate over INTEGER"}},
+	}
+	for i := range tests {
+		tests[i].input = prelude + tests[i].input
+	}
+	runVmTests(t, tests)
+}
+
+func TestTasks(t *testing.T) {
+	deadlock := &object.Error{Message: "deadlock: all tasks are blocked"}
+	prelude := `
+	let drain = fn(ch, acc) { let x = recv(ch); if (x) { drain(ch, push(acc, x)) } else { acc } };
+	let produce = fn(ch, xs) { for (x in xs) { send(ch, x); }; close(ch); };
+	`
+	tests := []vmTestCase{
+		{`wait(spawn fn() { 1 + 2 })`, 3},
+		{`let add = fn(a, b) { a + b }; wait(spawn add(1, 2))`, 3},
+		{`wait(spawn len([1, 2]))`, 2},
+		{`wait(spawn fn() { wait(spawn fn() { 4 }) })`, 4},
+		{`let ch = channel(); spawn fn() { send(ch, 5) }; recv(ch)`, 5},
+		{`let ch = channel(); spawn produce(ch, [1, 2, 3]); drain(ch, [])`, []int{1, 2, 3}},
+		// A task sees the globals as they were when it was spawned.
+		{`let out = channel(3); for (i in [1, 2, 3]) { spawn fn() { send(out, i * i) } }; recv(out) + recv(out) + recv(out)`, 14},
+		{`let x = 1; let t = spawn fn() { x }; let y = 2; wait(t)`, 1},
+		// Errors of a task are thrown by wait.
+		{`try { wait(spawn fn() { throw "boom" }) } catch (e) { e }`, "boom"},
+		{`try { wait(spawn fn() { 1 + true }) } catch (e) { e }`, &object.Error{Message: "unsupported types for binary operation: INTEGER BOOLEAN"}},
+		{`try { wait(spawn fn(a) { a }) } catch (e) { e }`, &object.Error{Message: "wrong number of arguments: want=1, got=0"}},
+		{`try { spawn 5 } catch (e) { e }`, &object.Error{Message: "cannot spawn INTEGER"}},
+		{`try { wait(5) } catch (e) { e }`, &object.Error{Message: "argument to `wait` must be TASK, got=INTEGER"}},
+		// Generators stay in the task which created them.
+		{`let g = fn() { yield 1; }; let it = g(); try { wait(spawn fn() { next(it) }) } catch (e) { e }`, &object.Error{Message: "the generator belongs to another task"}},
+		{`let g = fn() { yield 1; }; try { next(wait(spawn g())) } catch (e) { e }`, &object.Error{Message: "the generator belongs to another task"}},
+		{`let g = fn() { yield 1; }; try { for (x in wait(spawn g())) { } } catch (e) { e }`, &object.Error{Message: "the generator belongs to another task"}},
+		// Channels and select.
+		{`let c = channel(); close(c); recv(c)`, Null},
+		{`let c = channel(1); send(c, 1); close(c); [recv(c)]`, []int{1}},
+		{`try { let c = channel(); close(c); send(c, 1) } catch (e) { e }`, &object.Error{Message: "send on closed channel"}},
+		{`try { let c = channel(); close(c); close(c) } catch (e) { e }`, &object.Error{Message: "close of closed channel"}},
+		{`let a = channel(1); let b = channel(1); send(b, 7); select([a, b])`, []int{1, 7}},
+		{`let a = channel(1); let r = select([[a, 3]]); [r[0], recv(a)]`, []int{0, 3}},
+		{`select([channel()], "none")`, "none"},
+		{`let ch = channel(); spawn fn() { send(ch, 9) }; select([channel(), ch])[1]`, 9},
+		{`try { select([1]) } catch (e) { e }`, &object.Error{Message: "case 0 of `select` must be CHANNEL or [CHANNEL, value], got=1"}},
+		// When every task is blocked and none can proceed, they all fail, as a deadlocked Go program does.
+		{`try { recv(channel()) } catch (e) { e }`, deadlock},
+		{`try { send(channel(), 1) } catch (e) { e }`, deadlock},
+		{`try { select([]) } catch (e) { e }`, deadlock},
+		{`let c = channel(); spawn fn() { recv(c) }; try { recv(c) } catch (e) { e }`, deadlock},
+		{`let c = channel(); let t = spawn fn() { recv(c) }; try { wait(t) } catch (e) { e }`, deadlock},
+		// A task blocked on a channel is not deadlocked while another one can still unblock it.
+		{`let c = channel(); spawn fn() { send(c, 1) }; let d = channel(); spawn fn() { send(d, recv(c) + 1) }; recv(d)`, 2},
+		{`let c = channel(); let t = spawn fn() { close(c) }; [recv(c), wait(t)]`, []interface{}{Null, Null}},
+	}
+	for i := range tests {
+		tests[i].input = prelude + tests[i].input
 	}
 	runVmTests(t, tests)
 }
 
+// Tasks share the writers of the capabilities, which must not be written concurrently.
+func TestTaskCapabilities(t *testing.T) {
+	var out bytes.Buffer
+	comp := compiler.New()
+	input := `
+	let done = channel();
+	for (i in [1, 2, 3, 4]) { spawn fn() { puts(i); send(done, random(10)); } }
+	recv(done); recv(done); recv(done); recv(done);
+	puts("done");`
+	if err := comp.Compile(parse(input)); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	capabilities := &object.Context{Stdout: &out, Rand: rand.New(rand.NewSource(1))}
+	vm := New(comp.ByteCode(), Config{Capabilities: capabilities})
+	if err := vm.Run(); err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 5 || lines[4] != "done" {
+		t.Fatalf("wrong output. got=%q", out.String())
+	}
+	sort.Strings(lines[:4])
+	if strings.Join(lines[:4], " ") != "1 2 3 4" {
+		t.Errorf("wrong output of the tasks. got=%q", out.String())
+	}
+	if capabilities.Stdout != &out {
+		t.Errorf("the capabilities of the config are modified")
+	}
+}
+
+// VMs run the same program in parallel, each with its own globals.
+func TestPool(t *testing.T) {
+	comp := compiler.New()
+	input := `
+	let sum = fn(n, acc) { if (n == 0) { acc } else { sum(n - 1, acc + n) } };
+	let total = sum(100, 0);
+	let g = fn() { yield total; };
+	for (x in g()) { x * 2 }
+	for (x in [1, 2, 3]) { random(10) }
+	total`
+	if err := comp.Compile(parse(input)); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	bytecode := comp.ByteCode()
+	program := NewProgram(bytecode)
+	bytecode.Constants[0] = &object.Integer{Value: 0} // The program keeps its own constants.
+
+	// The VMs must not share the random source of the config, which is not safe for concurrent use.
+	capabilities := &object.Context{Rand: rand.New(rand.NewSource(1))}
+	pool := NewPool(program, Config{GrowableStack: true, Capabilities: capabilities})
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				vm := pool.Get()
+				for _, global := range vm.globals {
+					if global != nil {
+						errs <- fmt.Errorf("the globals of a previous run are left: %s", global.Inspect())
+						return
+					}
+				}
+				if err := vm.Run(); err != nil {
+					errs <- err
+					return
+				}
+				if err := testIntegerObject(5050, vm.LastPoppedStackElem()); err != nil {
+					errs <- err
+					return
+				}
+				pool.Put(vm)
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
 func TestClosures(t *testing.T) {
 	tests := []vmTestCase{
 		{
@@ -478,6 +764,354 @@ func TestRecursiveFunctions(t *testing.T) {
 	runVmTests(t, tests)
 }
 
+func TestRecursionDepthExceeded(t *testing.T) {
+	input := `
+	let loop = fn() { loop() };
+	loop();`
+
+	program := parse(input)
+	comp := compiler.New()
+	err := comp.Compile(program)
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	vm := New(comp.ByteCode(), DefaultConfig())
+	err = vm.Run()
+	if err == nil {
+		t.Fatalf("expected VM error but resulted in none.")
+	}
+
+	recursionErr, ok := err.(*RecursionError)
+	if !ok {
+		t.Fatalf("error is not RecursionError. got=%T (%s)", err, err)
+	}
+	if len(recursionErr.Traceback) != MaxFrames {
+		t.Fatalf("wrong traceback length. want=%d, got=%d", MaxFrames, len(recursionErr.Traceback))
+	}
+	if recursionErr.Traceback[0] != "<main> (line 3)" || recursionErr.Traceback[MaxFrames-1] != "loop (line 2)" {
+		t.Fatalf("wrong traceback. got=%v", recursionErr.Traceback[:2])
+	}
+
+	expected := `maximum recursion depth exceeded (max frames: 1024)
+Traceback (most recent call last):
+  in <main> (line 3)
+  in loop (line 2)
+  [previous line repeated 1022 more times]`
+	if err.Error() != expected {
+		t.Fatalf("wrong VM error: want=%q, got=%q", expected, err)
+	}
+}
+
+// A recursion with arguments fills the stack before the frames run out, which is reported the same way.
+func TestRecursionWithArgumentsExceeded(t *testing.T) {
+	input := `
+	let f = fn(n) { f(n + 1) };
+	f(0);`
+
+	comp := compiler.New()
+	if err := comp.Compile(parse(input)); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	err := New(comp.ByteCode(), DefaultConfig()).Run()
+
+	recursionErr, ok := err.(*RecursionError)
+	if !ok {
+		t.Fatalf("error is not RecursionError. got=%T (%v)", err, err)
+	}
+	if recursionErr.StackSize != StackSize || len(recursionErr.Traceback) < 2 {
+		t.Fatalf("wrong error: %+v", recursionErr)
+	}
+	if recursionErr.Traceback[0] != "<main> (line 3)" || recursionErr.Traceback[len(recursionErr.Traceback)-1] != "f (line 2)" {
+		t.Fatalf("wrong traceback. got=%v", recursionErr.Traceback[:2])
+	}
+	if !strings.HasPrefix(err.Error(), "maximum recursion depth exceeded (stack size: 2048)\nTraceback (most recent call last):\n  in <main> (line 3)\n  in f (line 2)\n") {
+		t.Fatalf("wrong VM error: %q", err)
+	}
+}
+
+func TestConfig(t *testing.T) {
+	countDown := `
+	let countDown = fn(x) {
+		if (x == 0) {
+			return 0;
+		} else {
+			countDown(x - 1)
+		}
+	};
+	countDown(300);`
+
+	tests := []struct {
+		input         string
+		config        Config
+		expected      interface{}
+		expectedError string
+	}{
+		{
+			input:    countDown,
+			config:   Config{GrowableStack: true},
+			expected: 0,
+		},
+		{
+			input:         countDown,
+			config:        Config{MaxFrames: 100},
+			expectedError: "maximum recursion depth exceeded (max frames: 100)",
+		},
+		{
+			input:         countDown,
+			config:        Config{MaxFrames: 100, GrowableStack: true},
+			expectedError: "maximum recursion depth exceeded (max frames: 100)",
+		},
+		{
+			input:         countDown,
+			config:        Config{StackSize: 100, GrowableStack: true},
+			expectedError: "maximum recursion depth exceeded (stack size: 100)",
+		},
+		{
+			input:    "let a = 1; let b = 2; a + b",
+			config:   Config{GlobalsSize: 2},
+			expected: 3,
+		},
+		{
+			input:         "let a = 1; let b = 2; a + b",
+			config:        Config{GlobalsSize: 1},
+			expectedError: "too many globals: index 1 exceeds globals size 1",
+		},
+	}
+
+	for _, tt := range tests {
+		program := parse(tt.input)
+		comp := compiler.New()
+		err := comp.Compile(program)
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		vm := New(comp.ByteCode(), tt.config)
+		err = vm.Run()
+
+		if tt.expectedError == "" {
+			if err != nil {
+				t.Fatalf("vm error: %s", err)
+			}
+			testExpectedObject(t, tt.expected, vm.LastPoppedStackElem())
+			continue
+		}
+
+		if err == nil {
+			t.Fatalf("expected VM error but resulted in none.")
+		}
+		if !strings.HasPrefix(err.Error(), tt.expectedError) {
+			t.Fatalf("wrong VM error: want=%q, got=%q", tt.expectedError, err)
+		}
+	}
+}
+
+func TestWideOperands(t *testing.T) {
+	manyParams := []string{}
+	manyArgs := []string{}
+	manyLets := []string{}
+	for i := 0; i < 300; i++ {
+		manyParams = append(manyParams, "p"+identifierSuffix(i))
+		manyArgs = append(manyArgs, fmt.Sprintf("%d", i))
+		manyLets = append(manyLets, fmt.Sprintf("let v%s = %d;", identifierSuffix(i), i))
+	}
+
+	tests := []vmTestCase{
+		{
+			input: fmt.Sprintf(
+				"let f = fn(%s) { paa + pln }; f(%s);",
+				strings.Join(manyParams, ", "), strings.Join(manyArgs, ", "),
+			),
+			expected: 299,
+		},
+		{
+			input: fmt.Sprintf(
+				"let f = fn() { %s fn() { vab + vln } }; f()();",
+				strings.Join(manyLets, " "),
+			),
+			expected: 300,
+		},
+		{
+			input:    strings.Repeat("1; ", 70000) + "2",
+			expected: 2,
+		},
+		{
+			input:    "if (false) { " + strings.Repeat("1; ", 20000) + "} else { 3 }",
+			expected: 3,
+		},
+		{
+			input:    "let f = fn(x) { if (x) { " + strings.Repeat("1; ", 20000) + "4 } else { 5 } }; f(true) + f(false)",
+			expected: 9,
+		},
+	}
+	runVmTests(t, tests)
+}
+
+func TestBudgets(t *testing.T) {
+	fibonacci := `
+	let fibonacci = fn(x) {
+		if (x < 2) {
+			return x;
+		}
+		fibonacci(x - 1) + fibonacci(x - 2)
+	};
+	fibonacci(35);`
+	concat := `
+	let concat = fn(s, n) {
+		if (n == 0) {
+			return s;
+		}
+		concat(s + "monkey", n - 1)
+	};
+	concat("", 100);`
+
+	tests := []struct {
+		input   string
+		config  Config
+		timeout time.Duration
+		check   func(err error) bool
+	}{
+		{
+			input:   fibonacci,
+			timeout: 10 * time.Millisecond,
+			check: func(err error) bool {
+				_, ok := err.(*budget.CanceledError)
+				return ok && errors.Is(err, context.DeadlineExceeded)
+			},
+		},
+		{
+			// Tasks and the builtins which block are canceled with the program.
+			input: `let busy = fn(x) { if (x < 2) { return x } busy(x - 1) + busy(x - 2) };
+			spawn fn() { busy(35) }; try { recv(channel()) } catch (e) { 1 }`,
+			timeout: 10 * time.Millisecond,
+			check: func(err error) bool {
+				_, ok := err.(*budget.CanceledError)
+				return ok && errors.Is(err, context.DeadlineExceeded)
+			},
+		},
+		{
+			input:  fibonacci,
+			config: Config{MaxInstructions: 1000},
+			check: func(err error) bool {
+				stepErr, ok := err.(*budget.StepLimitError)
+				return ok && stepErr.Limit == 1000
+			},
+		},
+		{
+			input:  concat,
+			config: Config{MaxMemory: 10000},
+			check: func(err error) bool {
+				memErr, ok := err.(*budget.MemoryLimitError)
+				return ok && memErr.Limit == 10000
+			},
+		},
+		{
+			input:  concat,
+			config: Config{MaxInstructions: 10000, MaxMemory: 100000},
+			check:  func(err error) bool { return err == nil },
+		},
+	}
+
+	for _, tt := range tests {
+		program := parse(tt.input)
+		comp := compiler.New()
+		err := comp.Compile(program)
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		ctx := context.Background()
+		if tt.timeout != 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, tt.timeout)
+			defer cancel()
+		}
+
+		vm := New(comp.ByteCode(), tt.config)
+		err = vm.RunContext(ctx)
+		if !tt.check(err) {
+			t.Errorf("unexpected VM error. got=%T (%v)", err, err)
+		}
+	}
+}
+
+// Identifiers cannot contain digits, so index them with letters. e.g. 0 -> "aa", 27 -> "bb"
+func identifierSuffix(i int) string {
+	return string(rune('a'+i/26)) + string(rune('a'+i%26))
+}
+
+// Macros are expanded by the evaluator before compilation.
+func TestExpandedMacros(t *testing.T) {
+	tests := []vmTestCase{
+		{
+			`let unless = macro(cond, cons, alt) { quote(if (!(unquote(cond))) { unquote(cons) } else { unquote(alt) }) };
+			unless(10 > 5, "no", "yes")`,
+			"yes",
+		},
+		{
+			`let twice = macro(x) { quote([unquote(x), unquote(x)]) };
+			let count = fn(n) { n + 1 };
+			twice(count(1))`,
+			[]int{2, 2},
+		},
+	}
+
+	for _, tt := range tests {
+		comp := compiler.New()
+		expanded, err := comp.ExpandMacros(parse(tt.input), object.NewEnvironment(), budget.Limits{}, nil)
+		if err != nil {
+			t.Fatalf("macro expansion error: %s", err)
+		}
+		if err := comp.Compile(expanded); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+		vm := New(comp.ByteCode(), DefaultConfig())
+		if err := vm.Run(); err != nil {
+			t.Fatalf("vm error: %s", err)
+		}
+		testExpectedObject(t, tt.expected, vm.LastPoppedStackElem())
+	}
+}
+
+func TestModules(t *testing.T) {
+	files := map[string]string{
+		"lib/math.mk": `import "counter"; let x = 10;
+		let plus = macro(a, b) { puts("expanding"); quote(unquote(a) + unquote(b)) };
+		export let add = fn(a) { plus(a, x) + one };`,
+		"lib/counter.mk": `puts("counter is loaded"); export let one = 1;`,
+	}
+	loader := compiler.NewLoader()
+	loader.ReadFile = func(path string) ([]byte, error) {
+		src, ok := files[filepath.ToSlash(path)]
+		if !ok {
+			return nil, fmt.Errorf("no such file: %s", path)
+		}
+		return []byte(src), nil
+	}
+
+	var out bytes.Buffer
+	caps := &object.Context{Stdout: &out}
+
+	comp := compiler.New()
+	comp.SetLoader(loader, "main.mk")
+	program := parse(`let x = 1; import "lib/math"; import "lib/counter"; [add(x), one, x]`)
+	err := comp.ExpandAndCompile(program, object.NewEnvironment(), budget.Limits{}, caps)
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	vm := New(comp.ByteCode(), Config{Capabilities: &object.Context{Stdout: &out}})
+	if err := vm.Run(); err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+	testExpectedObject(t, []int{12, 1, 1}, vm.LastPoppedStackElem())
+
+	// The macros of the module are expanded with the limits of the loader.
+	if out.String() != "expanding\ncounter is loaded\n" {
+		t.Errorf("the module is not expanded and run exactly once. output=%q", out.String())
+	}
+}
+
 /*
 Tests the top element in the stack.
 */
@@ -505,7 +1139,7 @@ func runVmTests(t *testing.T, tests []vmTestCase) {
 			fmt.Printf("\n")
 		}
 
-		vm := New(comp.ByteCode())
+		vm := New(comp.ByteCode(), DefaultConfig())
 		err = vm.Run()
 		if err != nil {
 			t.Fatalf("vm error: %s", err)
@@ -0,0 +1,51 @@
+package wire
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	messages := []interface{}{
+		map[string]int{"seq": 1},
+		[]string{"a", "ü"},
+	}
+	for _, m := range messages {
+		if err := WriteMessage(&buf, m); err != nil {
+			t.Fatalf("WriteMessage: %s", err)
+		}
+	}
+
+	r := bufio.NewReader(&buf)
+	expected := []string{`{"seq":1}`, `["a","ü"]`}
+	for _, e := range expected {
+		content, err := ReadMessage(r)
+		if err != nil {
+			t.Fatalf("ReadMessage: %s", err)
+		}
+		if string(content) != e {
+			t.Errorf("wrong content. want=%s, got=%s", e, content)
+		}
+	}
+	if _, err := ReadMessage(r); err != io.EOF {
+		t.Errorf("expected io.EOF at the end, got=%v", err)
+	}
+}
+
+func TestMalformedHeaders(t *testing.T) {
+	tests := []string{
+		"Content-Type: json\r\n\r\n{}",
+		"Content-Length: x\r\n\r\n{}",
+		"Content-Length 2\r\n\r\n{}",
+		"Content-Length: 10\r\n\r\n{}",
+	}
+	for _, input := range tests {
+		if _, err := ReadMessage(bufio.NewReader(strings.NewReader(input))); err == nil || err == io.EOF {
+			t.Errorf("expected an error for %q, got=%v", input, err)
+		}
+	}
+}